@@ -0,0 +1,421 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ethereum"
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	stg "github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+	"github.com/vocdoni/vocdoni-z-sandbox/util"
+)
+
+const (
+	// AdminChallengeTTL is how long the login challenges can be signed.
+	AdminChallengeTTL = 5 * time.Minute
+	// AdminSessionTTL is how long the token of an admin session is valid.
+	AdminSessionTTL = time.Hour
+	// AdminChallengePrefix is the prefix of the login challenges, so the
+	// signatures of the admins can not be reused for anything else.
+	AdminChallengePrefix = "vocdoni sequencer admin login "
+
+	// DefaultAuditLogLimit is the number of audit entries listed per page if
+	// the limit is not provided.
+	DefaultAuditLogLimit = 50
+	// MaxAuditLogLimit is the maximum number of audit entries listed per page.
+	MaxAuditLogLimit = 500
+)
+
+// AdminRole is the role of an admin, which defines the admin endpoints it
+// can use: the auditors can only read the state of the sequencer, and the
+// operators can also change it.
+type AdminRole string
+
+const (
+	// AdminRoleOperator is the role of the admins that manage the sequencer.
+	AdminRoleOperator AdminRole = "operator"
+	// AdminRoleAuditor is the role of the admins with read-only access.
+	AdminRoleAuditor AdminRole = "auditor"
+)
+
+// Valid returns whether the role is one of the known roles.
+func (r AdminRole) Valid() bool {
+	return r == AdminRoleOperator || r == AdminRoleAuditor
+}
+
+// allows returns whether the role can use the endpoints that require the
+// role provided.
+func (r AdminRole) allows(required AdminRole) bool {
+	return r == AdminRoleOperator || r == required
+}
+
+// Admin is an admin of the sequencer, identified by its name in the audit
+// log.
+type Admin struct {
+	Name string
+	Role AdminRole
+}
+
+// adminSession is the session of an admin logged in with a signed challenge.
+type adminSession struct {
+	admin   Admin
+	expires time.Time
+}
+
+// adminAuth authenticates the admins by their bearer token: one of the
+// tokens of the configuration, or the token of a session started by signing
+// a challenge with one of the admin addresses.
+//
+// The challenges are not stored: they carry their expiration and are
+// authenticated with challengeKey, so anyone can request them without
+// using memory. Only the challenges used to log in are kept, until they
+// expire, so they cannot be used again.
+type adminAuth struct {
+	tokens       map[string]Admin
+	addresses    map[common.Address]AdminRole
+	challengeKey []byte
+
+	mu       sync.Mutex
+	used     map[string]time.Time
+	sessions map[string]*adminSession
+}
+
+// newAdminAuth returns the admin authenticator of the tokens and addresses
+// provided, checking their roles.
+func newAdminAuth(tokens map[string]Admin, addresses map[common.Address]AdminRole) (*adminAuth, error) {
+	for _, admin := range tokens {
+		if !admin.Role.Valid() {
+			return nil, fmt.Errorf("invalid role %q of admin %q", admin.Role, admin.Name)
+		}
+	}
+	for address, role := range addresses {
+		if !role.Valid() {
+			return nil, fmt.Errorf("invalid role %q of admin %s", role, address.Hex())
+		}
+	}
+	return &adminAuth{
+		tokens:       tokens,
+		addresses:    addresses,
+		challengeKey: util.RandomBytes(32),
+		used:         make(map[string]time.Time),
+		sessions:     make(map[string]*adminSession),
+	}, nil
+}
+
+// newChallenge returns a new login challenge and when it expires. The
+// challenge is a random nonce and its expiration, followed by their HMAC.
+func (aa *adminAuth) newChallenge() (string, time.Time) {
+	expires := time.Now().Add(AdminChallengeTTL).Truncate(time.Second)
+	payload := binary.BigEndian.AppendUint64(util.RandomBytes(16), uint64(expires.Unix()))
+	return AdminChallengePrefix + hex.EncodeToString(append(payload, aa.challengeMAC(payload)...)), expires
+}
+
+// challengeMAC returns the HMAC of the payload of a challenge.
+func (aa *adminAuth) challengeMAC(payload []byte) []byte {
+	mac := hmac.New(sha256.New, aa.challengeKey)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// checkChallenge returns when the challenge expires, if it was returned by
+// newChallenge and has not expired.
+func (aa *adminAuth) checkChallenge(challenge string) (time.Time, error) {
+	encoded, ok := strings.CutPrefix(challenge, AdminChallengePrefix)
+	if !ok {
+		return time.Time{}, fmt.Errorf("unknown challenge")
+	}
+	data, err := hex.DecodeString(encoded)
+	if err != nil || len(data) != 16+8+sha256.Size {
+		return time.Time{}, fmt.Errorf("unknown challenge")
+	}
+	payload, sum := data[:16+8], data[16+8:]
+	if !hmac.Equal(sum, aa.challengeMAC(payload)) {
+		return time.Time{}, fmt.Errorf("unknown challenge")
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload[16:])), 0)
+	if time.Now().After(expires) {
+		return time.Time{}, fmt.Errorf("expired challenge")
+	}
+	return expires, nil
+}
+
+// login checks the signature of the challenge, which can only be used once,
+// and starts a session of the admin address that signed it.
+func (aa *adminAuth) login(challenge string, signature []byte) (string, *adminSession, error) {
+	expires, err := aa.checkChallenge(challenge)
+	if err != nil {
+		return "", nil, err
+	}
+	address, err := ethereum.AddrFromSignature([]byte(challenge), signature)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not recover the signer: %w", err)
+	}
+	role, ok := aa.addresses[address]
+	if !ok {
+		return "", nil, fmt.Errorf("%s is not an admin address", address.Hex())
+	}
+	aa.mu.Lock()
+	defer aa.mu.Unlock()
+	aa.sweep()
+	if _, ok := aa.used[challenge]; ok {
+		return "", nil, fmt.Errorf("challenge already used")
+	}
+	aa.used[challenge] = expires
+	token := hex.EncodeToString(util.RandomBytes(32))
+	session := &adminSession{
+		admin:   Admin{Name: address.Hex(), Role: role},
+		expires: time.Now().Add(AdminSessionTTL),
+	}
+	aa.sessions[token] = session
+	return token, session, nil
+}
+
+// admin returns the admin of the bearer token, if it is valid.
+func (aa *adminAuth) admin(token string) (Admin, bool) {
+	var admin Admin
+	found := false
+	for t, a := range aa.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			admin, found = a, true
+		}
+	}
+	if found {
+		return admin, true
+	}
+	aa.mu.Lock()
+	defer aa.mu.Unlock()
+	session, ok := aa.sessions[token]
+	if !ok || time.Now().After(session.expires) {
+		return Admin{}, false
+	}
+	return session.admin, true
+}
+
+// sweep removes the used challenges that expired and the expired sessions.
+// It must be called with the lock held.
+func (aa *adminAuth) sweep() {
+	now := time.Now()
+	for c, expires := range aa.used {
+		if now.After(expires) {
+			delete(aa.used, c)
+		}
+	}
+	for t, s := range aa.sessions {
+		if now.After(s.expires) {
+			delete(aa.sessions, t)
+		}
+	}
+}
+
+// adminKey is the context key of the admin authenticated by adminAuth.
+type adminKey struct{}
+
+// requestAdmin returns the admin authenticated by the adminAuth middleware.
+func requestAdmin(r *http.Request) Admin {
+	admin, _ := r.Context().Value(adminKey{}).(Admin)
+	return admin
+}
+
+// adminAuth is the middleware that authenticates the admins by the bearer
+// token of the request, and records the request in the audit log once it
+// is served.
+func (a *API) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			ErrUnauthorized.With("missing bearer token").Write(w)
+			return
+		}
+		admin, ok := a.admins.admin(token)
+		if !ok {
+			ErrUnauthorized.Write(w)
+			return
+		}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), adminKey{}, admin)))
+		a.audit(admin, r.Method+" "+chi.RouteContext(r.Context()).RoutePattern(), r.URL.Path, ww.Status())
+	})
+}
+
+// requireRole is the middleware that rejects the admins whose role does
+// not allow the role provided.
+func requireRole(role AdminRole) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if admin := requestAdmin(r); !admin.Role.allows(role) {
+				ErrForbidden.Withf("the %s role is required", role).Write(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// audit records an admin action in the audit log. The action is served
+// anyway if it can not be recorded.
+func (a *API) audit(admin Admin, action, path string, status int) {
+	if err := a.storage.AddAuditEntry(&stg.AuditEntry{
+		Actor:  admin.Name,
+		Role:   string(admin.Role),
+		Action: action,
+		Path:   path,
+		Status: status,
+	}); err != nil {
+		log.Warnw("could not record admin action", "error", err.Error(), "actor", admin.Name, "action", action)
+	}
+}
+
+// adminChallenge returns a challenge to be signed by an admin address to
+// log in
+// GET /admin/challenge
+func (a *API) adminChallenge(w http.ResponseWriter, r *http.Request) {
+	challenge, expires := a.admins.newChallenge()
+	httpWriteJSON(w, &AdminChallengeResponse{Challenge: challenge, ExpiresAt: expires})
+}
+
+// adminLogin starts the session of the admin address that signed the
+// challenge, and returns its bearer token
+// POST /admin/login
+func (a *API) adminLogin(w http.ResponseWriter, r *http.Request) {
+	req := &AdminLoginRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		ErrMalformedBody.Withf("could not decode request body: %v", err).Write(w)
+		return
+	}
+	token, session, err := a.admins.login(req.Challenge, req.Signature)
+	if err != nil {
+		ErrUnauthorized.WithErr(err).Write(w)
+		return
+	}
+	a.audit(session.admin, "login", r.URL.Path, http.StatusOK)
+	log.Infow("admin logged in", "admin", session.admin.Name, "role", session.admin.Role)
+	httpWriteJSON(w, &AdminLoginResponse{Token: token, Role: session.admin.Role, ExpiresAt: session.expires})
+}
+
+// cancelProcess cancels a process that has not ended, so it does not accept
+// more ballots and its queued items are not leased to the workers
+// POST /admin/process/{id}/cancel
+func (a *API) cancelProcess(w http.ResponseWriter, r *http.Request) {
+	pid, ok := processIDParam(w, r)
+	if !ok {
+		return
+	}
+	process, err := a.storage.Process(pid)
+	if err != nil {
+		writeProcessError(w, err)
+		return
+	}
+	if process.Status == stg.ProcessStatusEnded {
+		ErrProcessNotCancelable.With("the process has ended").Write(w)
+		return
+	}
+	if err := a.storage.SetProcessStatus(pid, stg.ProcessStatusCanceled); err != nil {
+		writeProcessError(w, err)
+		return
+	}
+	log.Infow("process canceled", "processId", pid.String(), "admin", requestAdmin(r).Name)
+	httpWriteOK(w)
+}
+
+// exportKey returns a backup of the encryption keys of a process, with the
+// private key sealed with the backup key of the request. Only the keys
+// stored by the sequencer can be exported, not the ones of a remote keystore
+// POST /admin/process/{id}/key
+func (a *API) exportKey(w http.ResponseWriter, r *http.Request) {
+	pid, ok := processIDParam(w, r)
+	if !ok {
+		return
+	}
+	req := &KeyExportRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		ErrMalformedBody.Withf("could not decode request body: %v", err).Write(w)
+		return
+	}
+	if len(req.BackupKey) != stg.MasterKeySize {
+		ErrMalformedBody.Withf("the backup key must be %d bytes", stg.MasterKeySize).Write(w)
+		return
+	}
+	backup, err := a.storage.ExportKey(pid, req.BackupKey)
+	if err != nil {
+		if errors.Is(err, stg.ErrNotFound) {
+			ErrKeyNotFound.Write(w)
+			return
+		}
+		ErrGenericInternalServerError.Withf("could not export key: %v", err).Write(w)
+		return
+	}
+	log.Infow("encryption key exported", "processId", pid.String(), "admin", requestAdmin(r).Name)
+	httpWriteJSON(w, &KeyExportResponse{Backup: backup})
+}
+
+// auditLog lists the audit log of the admin actions in the order they were
+// done, filtered by the query parameters:
+//   - cursor: the nextCursor of the previous page
+//   - limit: the maximum number of entries of the page
+//
+// GET /admin/audit
+func (a *API) auditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var cursor []byte
+	if v := query.Get("cursor"); v != "" {
+		var err error
+		if cursor, err = hex.DecodeString(v); err != nil || len(cursor) != stg.AuditCursorSize {
+			ErrMalformedQuery.Withf("invalid cursor %q", v).Write(w)
+			return
+		}
+	}
+	limit := DefaultAuditLogLimit
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > MaxAuditLogLimit {
+			ErrMalformedQuery.Withf("invalid limit %q, it must be between 1 and %d", v, MaxAuditLogLimit).Write(w)
+			return
+		}
+	}
+	entries, next, err := a.storage.AuditLog(cursor, limit)
+	if err != nil {
+		ErrGenericInternalServerError.Withf("could not list audit log: %v", err).Write(w)
+		return
+	}
+	httpWriteJSON(w, &AuditLogResponse{Entries: entries, NextCursor: next})
+}
+
+// processIDParam decodes the process ID of the URL. If it is malformed, the
+// error is written to the response and false is returned.
+func processIDParam(w http.ResponseWriter, r *http.Request) (types.ProcessID, bool) {
+	pid := types.ProcessID{}
+	data, err := hex.DecodeString(chi.URLParam(r, "id"))
+	if err == nil {
+		err = pid.Unmarshal(data)
+	}
+	if err != nil {
+		ErrMalformedProcessID.Withf("could not decode process ID: %v", err).Write(w)
+		return pid, false
+	}
+	return pid, true
+}
+
+// writeProcessError writes the API error matching a process storage error.
+func writeProcessError(w http.ResponseWriter, err error) {
+	if errors.Is(err, stg.ErrNotFound) {
+		ErrProcessNotFound.Write(w)
+		return
+	}
+	ErrGenericInternalServerError.WithErr(err).Write(w)
+}
@@ -1,62 +1,331 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/vocdoni/vocdoni-z-sandbox/keystore"
 	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	"github.com/vocdoni/vocdoni-z-sandbox/metrics"
 	stg "github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/tracing"
 	"go.vocdoni.io/dvote/db"
 	"go.vocdoni.io/dvote/db/metadb"
 )
 
 // APIConfig type represents the configuration for the API HTTP server.
-// It includes the host, port and the data directory.
+// It includes the host, port (0 to listen on a random free port), the data
+// directory and the master key used to
+// encrypt the process private keys at rest. The process keys are managed by
+// the KeyStore provided, or by a local keystore using the storage if it is
+// nil. The failed queue items are retried according to the RetryPolicy, and
+// the stale reservations are released according to the Reaper config, or
+// the storage defaults if they are nil. The ballots that reuse a nullifier
+// are handled according to the OverwritePolicy, unless the process has its
+// own (see storage.OverwritePolicy). The ballot submissions are limited by
+// BallotLimits, or by DefaultBallotLimits if it is nil. If Tracing is not
+// nil, the spans are exported as configured until the server is shut down.
 type APIConfig struct {
-	Host    string
-	Port    int
-	DataDir string
+	Host            string
+	Port            int
+	DataDir         string
+	MasterKey       []byte
+	KeyStore        keystore.KeyStore
+	RetryPolicy     *stg.RetryPolicy
+	Reaper          *stg.ReaperConfig
+	OverwritePolicy *stg.OverwritePolicy
+	BallotLimits    *BallotLimits
+	Tracing         *tracing.Config
+	// WorkerTokens maps the bearer tokens of the remote workers to their
+	// IDs. The worker endpoints reject every request if it is empty.
+	WorkerTokens map[string]string
+	// AdminTokens maps the bearer tokens of the admins to their name and
+	// role, and AdminAddresses maps the addresses of the admins that log in
+	// by signing a challenge to their role. The admin endpoints reject
+	// every request if both are empty.
+	AdminTokens    map[string]Admin
+	AdminAddresses map[common.Address]AdminRole
 }
 
 // API type represents the API HTTP server with JWT authentication capabilities.
 type API struct {
-	router  *chi.Mux
-	storage *stg.Storage
-	db      db.Database
+	router       *chi.Mux
+	storage      *stg.Storage
+	keystore     keystore.KeyStore
+	db           db.Database
+	workerTokens map[string]string
+	admins       *adminAuth
+
+	ballotLimits   BallotLimits
+	ipLimiter      *rateLimiter
+	addressLimiter *rateLimiter
+
+	// address is the host and port the server listens on, see Start
+	address      string
+	queueMetrics *queueCollector
+	// stopTracing flushes the pending spans and stops the tracer provider,
+	// if the tracing was initialized by New
+	stopTracing func(context.Context) error
+
+	lifecycleLock sync.Mutex
+	server        *http.Server
+	listener      net.Listener
+	startErr      error
+	ready         chan struct{}
+	readyOnce     sync.Once
+	stopped       chan struct{}
+	// shutDown is closed once Shutdown has finished, with its result in
+	// shutdownErr
+	shutDown    chan struct{}
+	shutdownErr error
+
+	// inflight is held for reading by the requests being served, so the
+	// storage is closed once they return, see trackRequests
+	inflight sync.RWMutex
+	closed   bool
 }
 
-// New creates a new API instance with the given configuration.
-// It also initializes the storage and starts the HTTP server.
+// DefaultShutdownTimeout is the time the server waits for the requests in
+// flight when the context of Start is done.
+const DefaultShutdownTimeout = 10 * time.Second
+
+// New creates a new API instance with the given configuration. It opens the
+// database and initializes the storage, which are closed by Shutdown, but it
+// does not start the HTTP server, see Start.
 func New(conf *APIConfig) (*API, error) {
 	if conf == nil {
 		return nil, fmt.Errorf("missing API configuration")
 	}
+	if len(conf.MasterKey) == 0 {
+		return nil, fmt.Errorf("missing master key, refusing to start")
+	}
+	if conf.BallotLimits != nil {
+		if err := conf.BallotLimits.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	admins, err := newAdminAuth(conf.AdminTokens, conf.AdminAddresses)
+	if err != nil {
+		return nil, err
+	}
 
 	database, err := metadb.New(db.TypePebble, conf.DataDir)
 	if err != nil {
 		return nil, err
 	}
 
-	storage := stg.New(database)
+	storage, err := stg.New(database, conf.MasterKey)
+	if err != nil {
+		database.Close()
+		return nil, fmt.Errorf("could not initialize storage: %w", err)
+	}
+
+	if conf.RetryPolicy != nil {
+		storage.SetRetryPolicy(*conf.RetryPolicy)
+	}
+	if conf.OverwritePolicy != nil {
+		storage.SetDefaultOverwritePolicy(*conf.OverwritePolicy)
+	}
+	reaper := stg.DefaultReaperConfig
+	if conf.Reaper != nil {
+		reaper = *conf.Reaper
+	}
+	if err := storage.StartReaper(reaper); err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("could not start reservation reaper: %w", err)
+	}
+	var stopTracing func(context.Context) error
+	if conf.Tracing != nil {
+		if stopTracing, err = tracing.Init(context.Background(), *conf.Tracing); err != nil {
+			storage.Close()
+			return nil, fmt.Errorf("could not initialize tracing: %w", err)
+		}
+	}
+	queueMetrics, err := registerQueueMetrics(storage)
+	if err != nil {
+		storage.Close()
+		if stopTracing != nil {
+			_ = stopTracing(context.Background())
+		}
+		return nil, fmt.Errorf("could not register queue metrics: %w", err)
+	}
 
 	a := &API{
-		storage: storage,
-		db:      database,
+		storage:      storage,
+		keystore:     conf.KeyStore,
+		db:           database,
+		workerTokens: conf.WorkerTokens,
+		admins:       admins,
+		ballotLimits: DefaultBallotLimits,
+		address:      net.JoinHostPort(conf.Host, strconv.Itoa(conf.Port)),
+		queueMetrics: queueMetrics,
+		stopTracing:  stopTracing,
+		ready:        make(chan struct{}),
+		stopped:      make(chan struct{}),
+		shutDown:     make(chan struct{}),
+	}
+	if conf.BallotLimits != nil {
+		a.ballotLimits = *conf.BallotLimits
+	}
+	a.ipLimiter = newRateLimiter(a.ballotLimits.PerIP)
+	a.addressLimiter = newRateLimiter(a.ballotLimits.PerAddress)
+	storage.SetPendingBallotsQuota(a.ballotLimits.MaxPendingPerProcess)
+	if a.keystore == nil {
+		a.keystore = keystore.NewLocal(storage)
 	}
 
 	// Initialize router
 	a.initRouter()
+	return a, nil
+}
+
+// Start listens on the host and port of the configuration and serves the
+// API in the background, until Shutdown is called or the context is done.
+// It returns once the server is listening, so the API is ready to serve
+// requests if it returns no error. The address it listens on is returned by
+// Addr, which is the only way to know the port if it was 0. If it cannot
+// listen, the server can not be started again.
+func (a *API) Start(ctx context.Context) error {
+	a.lifecycleLock.Lock()
+	defer a.lifecycleLock.Unlock()
+	select {
+	case <-a.stopped:
+		return fmt.Errorf("the API server is shut down")
+	default:
+	}
+	if a.startErr != nil {
+		return a.startErr
+	}
+	if a.server != nil {
+		return fmt.Errorf("the API server is already started")
+	}
+	listener, err := net.Listen("tcp", a.address)
+	if err != nil {
+		a.startErr = fmt.Errorf("could not listen on %s: %w", a.address, err)
+		a.closeReady()
+		return a.startErr
+	}
+	a.listener = listener
+	a.server = &http.Server{
+		Handler:           a.router,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Infow("Starting API server", "address", listener.Addr().String())
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorw(err, "API server stopped")
+		}
+	}(a.server)
 	go func() {
-		log.Infow("Starting API server", "host", conf.Host, "port", conf.Port)
-		if err := http.ListenAndServe(fmt.Sprintf("%s:%d", conf.Host, conf.Port), a.router); err != nil {
-			log.Fatalf("failed to start the API server: %v", err)
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+			defer cancel()
+			if err := a.Shutdown(shutdownCtx); err != nil {
+				log.Warnw("could not shut down the API server gracefully", "error", err.Error())
+			}
+		case <-a.stopped:
 		}
 	}()
-	return a, nil
+	a.closeReady()
+	return nil
+}
+
+// Ready returns a channel that is closed once the server is listening, or
+// once it can not listen: when Start fails or Shutdown is called before
+// it. Addr returns nil in that case.
+func (a *API) Ready() <-chan struct{} {
+	return a.ready
+}
+
+func (a *API) closeReady() {
+	a.readyOnce.Do(func() { close(a.ready) })
+}
+
+// Addr returns the address the server listens on, or nil if it is not
+// started.
+func (a *API) Addr() net.Addr {
+	a.lifecycleLock.Lock()
+	defer a.lifecycleLock.Unlock()
+	if a.listener == nil {
+		return nil
+	}
+	return a.listener.Addr()
+}
+
+// Shutdown stops the server gracefully: it stops listening and waits for the
+// requests in flight to finish, or closes their connections when the context
+// is done. Then, once all the handlers have returned, it closes the storage
+// and its database, and flushes the pending spans if the tracing was
+// configured. It can be called before Start and more than once, the calls
+// after the first one wait for it and return its result.
+func (a *API) Shutdown(ctx context.Context) error {
+	a.lifecycleLock.Lock()
+	select {
+	case <-a.stopped:
+		a.lifecycleLock.Unlock()
+		<-a.shutDown
+		return a.shutdownErr
+	default:
+	}
+	close(a.stopped)
+	server := a.server
+	a.closeReady()
+	// the lock is not held while the requests are drained, so Addr does
+	// not block, and Start fails since the server is stopped
+	a.lifecycleLock.Unlock()
+
+	var err error
+	if server != nil {
+		if err = server.Shutdown(ctx); err != nil {
+			err = fmt.Errorf("could not drain the API server: %w", err)
+			if err := server.Close(); err != nil {
+				log.Warnw("could not close the API server", "error", err.Error())
+			}
+		}
+	}
+	// the handlers of the connections closed can still be running
+	a.inflight.Lock()
+	a.closed = true
+	a.inflight.Unlock()
+
+	unregisterQueueMetrics(a.queueMetrics)
+	a.storage.Close()
+	if a.stopTracing != nil {
+		if err := a.stopTracing(ctx); err != nil {
+			log.Warnw("could not flush the pending spans", "error", err.Error())
+		}
+	}
+	log.Infow("API server stopped", "address", a.address)
+	a.shutdownErr = err
+	close(a.shutDown)
+	return err
+}
+
+// trackRequests is the middleware that holds the inflight lock while the
+// requests are served, so Shutdown does not close the storage under them.
+// The requests that arrive once it is closed are rejected.
+func (a *API) trackRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.inflight.RLock()
+		defer a.inflight.RUnlock()
+		if a.closed {
+			ErrShuttingDown.Write(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 // Router returns the chi router for testing purposes
@@ -64,34 +333,109 @@ func (a *API) Router() *chi.Mux {
 	return a.router
 }
 
+// Storage returns the storage of the API for testing purposes
+func (a *API) Storage() *stg.Storage {
+	return a.storage
+}
+
 // registerHandlers registers all the API handlers.
 func (a *API) registerHandlers() {
 	log.Infow("register handler", "endpoint", PingEndpoint, "method", "GET")
 	a.router.Get(PingEndpoint, func(w http.ResponseWriter, r *http.Request) {
 		httpWriteOK(w)
 	})
+	log.Infow("register handler", "endpoint", MetricsEndpoint, "method", "GET")
+	a.router.Method(http.MethodGet, MetricsEndpoint, metrics.Handler())
 	log.Infow("register handler", "endpoint", ProcessEndpoint, "method", "POST")
 	a.router.Post(ProcessEndpoint, a.newProcess)
 	log.Infow("register handler", "endpoint", ProcessEndpoint, "method", "GET")
 	a.router.Get(ProcessEndpoint, a.process)
+	log.Infow("register handler", "endpoint", ProcessesEndpoint, "method", "GET")
+	a.router.Get(ProcessesEndpoint, a.processes)
+	log.Infow("register handler", "endpoint", OrganizerNonceEndpoint, "method", "GET")
+	a.router.Get(OrganizerNonceEndpoint, a.organizerNonce)
+	log.Infow("register handler", "endpoint", BallotsEndpoint, "method", "POST")
+	a.router.With(rateLimitByIP(a.ipLimiter)).Post(BallotsEndpoint, a.newBallot)
+	log.Infow("register handler", "endpoint", BallotStatusEndpoint, "method", "GET")
+	a.router.Get(BallotStatusEndpoint, a.ballotStatus)
+	log.Infow("register handler", "endpoint", ProcessResultsEndpoint, "method", "GET")
+	a.router.Get(ProcessResultsEndpoint, a.processResults)
+	log.Infow("register handler", "endpoint", ProcessCensusEndpoint, "method", "GET")
+	a.router.Get(ProcessCensusEndpoint, a.processCensus)
+	log.Infow("register handler", "endpoint", ProcessQueueEndpoint, "method", "GET")
+	a.router.Get(ProcessQueueEndpoint, a.processQueue)
+	log.Infow("register handler", "endpoint", MetadataEndpoint, "method", "POST")
+	a.router.Post(MetadataEndpoint, a.newMetadata)
+	log.Infow("register handler", "endpoint", MetadataHashEndpoint, "method", "GET")
+	a.router.Get(MetadataHashEndpoint, a.metadata)
+	log.Infow("register handler", "endpoint", AdminChallengeEndpoint, "method", "GET")
+	a.router.Get(AdminChallengeEndpoint, a.adminChallenge)
+	log.Infow("register handler", "endpoint", AdminLoginEndpoint, "method", "POST")
+	a.router.Post(AdminLoginEndpoint, a.adminLogin)
+
+	// Admin endpoints, authenticated by the admin tokens and recorded in the
+	// audit log
+	a.router.Group(func(r chi.Router) {
+		r.Use(a.adminAuth)
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(AdminRoleAuditor))
+			log.Infow("register handler", "endpoint", AdminQueuesEndpoint, "method", "GET")
+			r.Get(AdminQueuesEndpoint, a.adminQueues)
+			log.Infow("register handler", "endpoint", DeadLettersEndpoint, "method", "GET")
+			r.Get(DeadLettersEndpoint, a.deadLetters)
+			log.Infow("register handler", "endpoint", DeadLetterEndpoint, "method", "GET")
+			r.Get(DeadLetterEndpoint, a.deadLetter)
+			log.Infow("register handler", "endpoint", AdminAuditLogEndpoint, "method", "GET")
+			r.Get(AdminAuditLogEndpoint, a.auditLog)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(AdminRoleOperator))
+			log.Infow("register handler", "endpoint", DeadLetterEndpoint, "method", "DELETE")
+			r.Delete(DeadLetterEndpoint, a.purgeDeadLetter)
+			log.Infow("register handler", "endpoint", DeadLetterRequeueEndpoint, "method", "POST")
+			r.Post(DeadLetterRequeueEndpoint, a.requeueDeadLetter)
+			log.Infow("register handler", "endpoint", AdminProcessCancelEndpoint, "method", "POST")
+			r.Post(AdminProcessCancelEndpoint, a.cancelProcess)
+			log.Infow("register handler", "endpoint", AdminProcessKeyEndpoint, "method", "POST")
+			r.Post(AdminProcessKeyEndpoint, a.exportKey)
+		})
+	})
+
+	// Worker endpoints, authenticated by the worker tokens
+	a.router.Group(func(r chi.Router) {
+		r.Use(a.workerAuth)
+		log.Infow("register handler", "endpoint", WorkerLeaseEndpoint, "method", "POST")
+		r.Post(WorkerLeaseEndpoint, a.leaseJob)
+		log.Infow("register handler", "endpoint", WorkerHeartbeatEndpoint, "method", "POST")
+		r.Post(WorkerHeartbeatEndpoint, a.heartbeat)
+		log.Infow("register handler", "endpoint", WorkerCompleteEndpoint, "method", "POST")
+		r.Post(WorkerCompleteEndpoint, a.completeJob)
+		log.Infow("register handler", "endpoint", WorkerFailEndpoint, "method", "POST")
+		r.Post(WorkerFailEndpoint, a.failJob)
+	})
 }
 
 // initRouter creates the router with all the routes and middleware.
 func (a *API) initRouter() {
 	// Create the router with a basic middleware stack
 	a.router = chi.NewRouter()
+	// The clients authenticate with the Authorization header, never with
+	// cookies, so the credentials of the browsers are not allowed
 	a.router.Use(cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		AllowCredentials: true,
+		AllowCredentials: false,
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
 	}).Handler)
 	a.router.Use(middleware.Logger)
+	a.router.Use(a.trackRequests)
 	a.router.Use(middleware.Recoverer)
 	a.router.Use(middleware.Throttle(100))
 	a.router.Use(middleware.ThrottleBacklog(5000, 40000, 60*time.Second))
 	a.router.Use(middleware.Timeout(45 * time.Second))
+	a.router.Use(metricsMiddleware)
+	a.router.Use(tracingMiddleware)
 
 	// Register the API handlers
 	a.registerHandlers()
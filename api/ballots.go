@@ -0,0 +1,172 @@
+package api
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/vocdoni/arbo"
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	stg "github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/tracing"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+// newBallot queues a ballot of a process to be verified. The ballots are
+// rate limited by client IP, the census proof is checked before rate
+// limiting them by voter address, and the ballots of each process waiting to
+// be verified are limited by the storage, so the verifiers only spend time
+// on the ballots that can be valid (see BallotLimits). Only the processes
+// that are ready accept ballots.
+// POST /process/{id}/ballots
+func (a *API) newBallot(w http.ResponseWriter, r *http.Request) {
+	pid := types.ProcessID{}
+	data, err := hex.DecodeString(chi.URLParam(r, "id"))
+	if err == nil {
+		err = pid.Unmarshal(data)
+	}
+	if err != nil {
+		ErrMalformedProcessID.Withf("could not decode process ID: %v", err).Write(w)
+		return
+	}
+	req := &BallotRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		ErrMalformedBody.Withf("could not decode request body: %v", err).Write(w)
+		return
+	}
+	b, err := stg.DecodeArtifact[stg.Ballot](req.Ballot)
+	if err != nil {
+		ErrMalformedBody.Withf("could not decode ballot: %v", err).Write(w)
+		return
+	}
+	if !bytes.Equal(b.ProcessID, pid.Marshal()) {
+		ErrMalformedBody.With("the ballot is for another process").Write(w)
+		return
+	}
+	if len(b.Nullifier) == 0 {
+		ErrMalformedBody.With("the ballot has no nullifier").Write(w)
+		return
+	}
+	process, err := a.storage.Process(pid)
+	if err != nil {
+		if errors.Is(err, stg.ErrNotFound) {
+			ErrProcessNotFound.Write(w)
+			return
+		}
+		ErrGenericInternalServerError.Withf("could not retrieve process: %v", err).Write(w)
+		return
+	}
+	if process.Status != stg.ProcessStatusReady {
+		ErrProcessClosed.Withf("the process is %s", process.Status).Write(w)
+		return
+	}
+	if err := checkCensusProof(process, b); err != nil {
+		ErrNotInCensus.WithErr(err).Write(w)
+		return
+	}
+	// the address is only charged once the census proof is checked, so the
+	// junk ballots with the address of a voter do not block its ballots
+	if ok, wait := a.addressLimiter.allow(string(b.Address)); !ok {
+		writeRateLimited(w, wait, "too many ballots from the voter address")
+		return
+	}
+
+	// The trace of the ballot continues the trace of the request
+	b.TraceContext = tracing.Inject(r.Context())
+	if err := a.storage.PushBallot(b); err != nil {
+		if errors.Is(err, stg.ErrNullifierQueued) || errors.Is(err, stg.ErrTooManyOverwrites) {
+			ErrBallotRejected.WithErr(err).Write(w)
+			return
+		}
+		if errors.Is(err, stg.ErrPendingQuotaExceeded) {
+			ErrProcessQuotaExceeded.WithErr(err).Write(w)
+			return
+		}
+		if errors.Is(err, stg.ErrProcessClosed) {
+			ErrProcessClosed.WithErr(err).Write(w)
+			return
+		}
+		ErrGenericInternalServerError.Withf("could not queue ballot: %v", err).Write(w)
+		return
+	}
+	log.Debugw("new ballot", "processId", pid.String(), "nullifier", b.Nullifier.String())
+	httpWriteOK(w)
+}
+
+// ballotStatus returns the status of the current ballot of a nullifier
+// GET /process/{id}/ballots/{nullifier}
+func (a *API) ballotStatus(w http.ResponseWriter, r *http.Request) {
+	pid, ok := processIDParam(w, r)
+	if !ok {
+		return
+	}
+	nullifier, err := hex.DecodeString(chi.URLParam(r, "nullifier"))
+	if err != nil || len(nullifier) == 0 {
+		ErrMalformedNullifier.Withf("could not decode nullifier: %v", err).Write(w)
+		return
+	}
+	status, err := a.storage.BallotStatus(pid.Marshal(), nullifier)
+	if err != nil {
+		if errors.Is(err, stg.ErrNotFound) {
+			ErrBallotNotFound.Write(w)
+			return
+		}
+		ErrGenericInternalServerError.Withf("could not retrieve ballot status: %v", err).Write(w)
+		return
+	}
+	httpWriteJSON(w, &BallotStatusResponse{Nullifier: nullifier, Status: status})
+}
+
+// processCensus returns the census of a process, to build the census proofs
+// of its ballots
+// GET /process/{id}/census
+func (a *API) processCensus(w http.ResponseWriter, r *http.Request) {
+	pid, ok := processIDParam(w, r)
+	if !ok {
+		return
+	}
+	process, err := a.storage.Process(pid)
+	if err != nil {
+		writeProcessError(w, err)
+		return
+	}
+	httpWriteJSON(w, &CensusResponse{Root: process.CensusRoot, Levels: types.CensusLevels})
+}
+
+// checkCensusProof checks that the census proof of the ballot is a proof of
+// the address and weight of the voter in the census of the process. The
+// census is a MiMC BLS12-377 arbo tree, as verified by the vote verifier
+// circuit, and the siblings are the unpacked siblings of the arbo proof.
+func checkCensusProof(process *stg.Process, b *stg.Ballot) error {
+	if !bytes.Equal(b.CensusProof.Root, process.CensusRoot) {
+		return fmt.Errorf("the census root is not the root of the process")
+	}
+	if b.VoterWeight == nil || b.VoterWeight.Sign() <= 0 {
+		return fmt.Errorf("invalid voter weight %v", b.VoterWeight)
+	}
+	if err := types.CheckCensusSiblings(len(b.CensusProof.Siblings)); err != nil {
+		return err
+	}
+	siblings := make([][]byte, len(b.CensusProof.Siblings))
+	for i, s := range b.CensusProof.Siblings {
+		siblings[i] = s
+	}
+	packed, err := arbo.PackSiblings(arbo.HashFunctionMiMC_BLS12_377, siblings)
+	if err != nil {
+		return fmt.Errorf("invalid census siblings: %w", err)
+	}
+	key := arbo.BigToFF(arbo.BLS12377BaseField, new(big.Int).SetBytes(b.Address)).Bytes()
+	ok, err := arbo.CheckProof(arbo.HashFunctionMiMC_BLS12_377, key, b.VoterWeight.Bytes(), b.CensusProof.Root, packed)
+	if err != nil {
+		return fmt.Errorf("invalid census proof: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("the census proof does not prove the address and weight of the voter")
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/api"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ethereum"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+// AdminLogin signs a login challenge with the admin key and sets the bearer
+// token of the session as the auth token of the client (see SetAuthToken).
+// It returns the session, whose token expires at ExpiresAt.
+func (c *HTTPclient) AdminLogin(ctx context.Context, admin *ethereum.SignKeys) (*api.AdminLoginResponse, error) {
+	challenge := &api.AdminChallengeResponse{}
+	if err := c.call(ctx, HTTPGET, true, nil, challenge, nil, api.AdminChallengeEndpoint); err != nil {
+		return nil, fmt.Errorf("could not get login challenge: %w", err)
+	}
+	signature, err := admin.SignEthereum([]byte(challenge.Challenge))
+	if err != nil {
+		return nil, fmt.Errorf("could not sign login challenge: %w", err)
+	}
+	resp := &api.AdminLoginResponse{}
+	req := &api.AdminLoginRequest{Challenge: challenge.Challenge, Signature: signature}
+	if err := c.call(ctx, HTTPPOST, false, req, resp, nil, api.AdminLoginEndpoint); err != nil {
+		return nil, err
+	}
+	c.SetAuthToken(resp.Token)
+	return resp, nil
+}
+
+// CancelProcess cancels the process, which requires the operator role.
+// Canceling a canceled process has no effect, so the call is retried.
+func (c *HTTPclient) CancelProcess(ctx context.Context, pid types.HexBytes) error {
+	return c.call(ctx, HTTPPOST, true, nil, nil, nil, "admin", "process", pid.String(), "cancel")
+}
+
+// ExportKey returns a backup of the encryption keys of the process, with
+// the private key sealed with the backup key, which requires the operator
+// role.
+func (c *HTTPclient) ExportKey(ctx context.Context, pid, backupKey types.HexBytes) (types.HexBytes, error) {
+	resp := &api.KeyExportResponse{}
+	if err := c.call(ctx, HTTPPOST, true, &api.KeyExportRequest{BackupKey: backupKey}, resp, nil,
+		"admin", "process", pid.String(), "key"); err != nil {
+		return nil, err
+	}
+	return resp.Backup, nil
+}
+
+// AuditLog returns a page of up to limit entries of the audit log, starting
+// after the cursor (nil for the first page). The next page is requested with
+// the NextCursor of the response.
+func (c *HTTPclient) AuditLog(ctx context.Context, cursor types.HexBytes, limit int) (*api.AuditLogResponse, error) {
+	var params []string
+	if cursor != nil {
+		params = append(params, "cursor", cursor.String())
+	}
+	if limit > 0 {
+		params = append(params, "limit", strconv.Itoa(limit))
+	}
+	resp := &api.AuditLogResponse{}
+	if err := c.call(ctx, HTTPGET, true, nil, resp, params, api.AdminAuditLogEndpoint); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
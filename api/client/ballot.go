@@ -0,0 +1,30 @@
+package client
+
+import (
+	"context"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/api"
+	stg "github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+// SubmitBallot submits a ballot to be verified and queued. A ballot with the
+// same nullifier may be rejected by the overwrite policy of the process, so
+// the call is not retried.
+func (c *HTTPclient) SubmitBallot(ctx context.Context, b *stg.Ballot) error {
+	data, err := stg.EncodeArtifact(b)
+	if err != nil {
+		return err
+	}
+	return c.call(ctx, HTTPPOST, false, &api.BallotRequest{Ballot: data}, nil, nil, "process", b.ProcessID.String(), "ballots")
+}
+
+// BallotStatus returns the status of the current ballot of the nullifier in
+// the process.
+func (c *HTTPclient) BallotStatus(ctx context.Context, pid, nullifier types.HexBytes) (stg.BallotStatus, error) {
+	resp := &api.BallotStatusResponse{}
+	if err := c.call(ctx, HTTPGET, true, nil, resp, nil, "process", pid.String(), "ballots", nullifier.String()); err != nil {
+		return "", err
+	}
+	return resp.Status, nil
+}
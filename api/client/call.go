@@ -0,0 +1,124 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/api"
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
+)
+
+// DefaultRetryDelay is the time waited before retrying a failed idempotent
+// call, doubled on each attempt.
+const DefaultRetryDelay = 500 * time.Millisecond
+
+// call performs a request to the endpoint specified in urlPath and decodes the
+// JSON response into out, if it is not nil. The errors returned by the API
+// are decoded into api.Error, so they can be checked with errors.Is against
+// the errors defined by the api package.
+//
+// Only the idempotent calls are retried, when the request fails or the API
+// is unavailable, since retrying the others could apply them twice. The
+// retries stop when the context is done.
+func (c *HTTPclient) call(ctx context.Context, method string, idempotent bool, jsonBody any, out any,
+	params []string, urlPath ...string,
+) error {
+	var body []byte
+	if jsonBody != nil {
+		var err error
+		if body, err = json.Marshal(jsonBody); err != nil {
+			return fmt.Errorf("failed to marshal JSON: %w", err)
+		}
+	}
+	u, err := c.requestURL(params, urlPath...)
+	if err != nil {
+		return err
+	}
+	headers := c.headers(jsonBody != nil)
+
+	attempts := 1
+	if idempotent && c.retries > 1 {
+		attempts = c.retries
+	}
+	delay := DefaultRetryDelay
+	for i := 1; ; i++ {
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), reqBody)
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header = headers.Clone()
+		log.Debugw("http client call", "type", method, "url", u.String(), "attempt", i)
+
+		data, status, err := c.do(req)
+		switch {
+		case err == nil && status == http.StatusOK:
+			if out == nil {
+				return nil
+			}
+			if err := json.Unmarshal(data, out); err != nil {
+				return fmt.Errorf("could not decode response: %w", err)
+			}
+			return nil
+		case err == nil && !retryableStatus(status):
+			return decodeError(status, data)
+		case err == nil:
+			err = decodeError(status, data)
+		}
+		if i >= attempts || ctx.Err() != nil {
+			return err
+		}
+		log.Warnw("http call failed, retrying", "error", err.Error(), "attempt", i, "retries", attempts)
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// do sends the request and reads the response.
+func (c *HTTPclient) do(req *http.Request) ([]byte, int, error) {
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("failed to read response body: %w", err)
+	}
+	return data, resp.StatusCode, nil
+}
+
+// retryableStatus returns whether a response with the status provided may
+// succeed if the request is retried.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// decodeError returns the api.Error of a failed response, with the HTTP
+// status of the response. If the body is not an API error, the error contains
+// the status and the body.
+func decodeError(status int, data []byte) error {
+	apiErr := api.Error{}
+	if err := json.Unmarshal(data, &apiErr); err != nil || apiErr.Code == 0 {
+		return fmt.Errorf("%s: %d (%s)", errCodeNot200, status, bytes.TrimSpace(data))
+	}
+	apiErr.HTTPstatus = status
+	return apiErr
+}
@@ -35,6 +35,7 @@ type HTTPclient struct {
 	c       *http.Client
 	host    *url.URL
 	retries int
+	token   string
 }
 
 // New connects to the API host with a random bearer token and returns the handle
@@ -84,6 +85,12 @@ func (c *HTTPclient) SetRetries(n int) {
 	c.retries = n
 }
 
+// SetAuthToken configures the bearer token sent in the Authorization header
+// of the requests, such as the worker tokens.
+func (c *HTTPclient) SetAuthToken(token string) {
+	c.token = token
+}
+
 // SetTimeout configures the timeout for the HTTP client.
 func (c *HTTPclient) SetTimeout(d time.Duration) {
 	c.c.Timeout = d
@@ -114,34 +121,11 @@ func (c *HTTPclient) Request(method string, jsonBody any, params []string, urlPa
 		}
 	}
 
-	// Parse the base host URL
-	u, err := url.Parse(c.host.String())
+	u, err := c.requestURL(params, urlPath...)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to parse host URL: %w", err)
-	}
-
-	// Join path segments
-	u.Path = path.Join(u.Path, path.Join(urlPath...))
-
-	// Process query parameters from the params slice.
-	// Expecting even-length slice: [key1, val1, key2, val2, ...]
-	// If length is odd, the last parameter without a pair will be ignored.
-	if len(params) > 0 {
-		values := url.Values{}
-		for i := 0; i < len(params)-1; i += 2 {
-			key := params[i]
-			val := params[i+1]
-			values.Set(key, val)
-		}
-		u.RawQuery = values.Encode()
-	}
-
-	// Prepare headers
-	headers := http.Header{}
-	if jsonBody != nil {
-		headers.Set("Content-Type", "application/json")
-		headers.Set("Accept", "application/json")
+		return nil, 0, err
 	}
+	headers := c.headers(jsonBody != nil)
 
 	// Log the request details, truncating body if large
 	log.Debugw("http client request",
@@ -191,3 +175,44 @@ func (c *HTTPclient) Request(method string, jsonBody any, params []string, urlPa
 
 	return data, resp.StatusCode, nil
 }
+
+// requestURL returns the URL of the endpoint specified in urlPath, with the
+// query parameters provided (see Request).
+func (c *HTTPclient) requestURL(params []string, urlPath ...string) (*url.URL, error) {
+	// Parse the base host URL
+	u, err := url.Parse(c.host.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host URL: %w", err)
+	}
+
+	// Join path segments
+	u.Path = path.Join(u.Path, path.Join(urlPath...))
+
+	// Process query parameters from the params slice.
+	// Expecting even-length slice: [key1, val1, key2, val2, ...]
+	// If length is odd, the last parameter without a pair will be ignored.
+	if len(params) > 0 {
+		values := url.Values{}
+		for i := 0; i < len(params)-1; i += 2 {
+			key := params[i]
+			val := params[i+1]
+			values.Set(key, val)
+		}
+		u.RawQuery = values.Encode()
+	}
+	return u, nil
+}
+
+// headers returns the headers of the requests, including the bearer token if
+// it is configured.
+func (c *HTTPclient) headers(jsonBody bool) http.Header {
+	headers := http.Header{}
+	if jsonBody {
+		headers.Set("Content-Type", "application/json")
+		headers.Set("Accept", "application/json")
+	}
+	if c.token != "" {
+		headers.Set("Authorization", "Bearer "+c.token)
+	}
+	return headers
+}
@@ -0,0 +1,28 @@
+package client
+
+import (
+	"context"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/api"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+// UploadMetadata uploads the metadata of a process and returns its hash, to
+// be set as the metadata hash of the process. The metadata is stored under
+// its hash, so the call is idempotent and it is retried.
+func (c *HTTPclient) UploadMetadata(ctx context.Context, metadata *types.Metadata) (types.HexBytes, error) {
+	resp := &api.MetadataResponse{}
+	if err := c.call(ctx, HTTPPOST, true, metadata, resp, nil, api.MetadataEndpoint); err != nil {
+		return nil, err
+	}
+	return resp.Hash, nil
+}
+
+// Metadata returns the metadata with the hash provided.
+func (c *HTTPclient) Metadata(ctx context.Context, hash types.HexBytes) (*types.Metadata, error) {
+	metadata := &types.Metadata{}
+	if err := c.call(ctx, HTTPGET, true, nil, metadata, nil, "metadata", hash.String()); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/vocdoni-z-sandbox/api"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ethereum"
+	stg "github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+// ProcessesQuery filters the processes listed by HTTPclient.Processes. The
+// zero value of each field matches all the processes.
+type ProcessesQuery struct {
+	Organizer *common.Address
+	ChainID   *uint32
+	Status    stg.ProcessStatus
+	// From and To limit the creation time of the processes, with second
+	// precision, both included.
+	From time.Time
+	To   time.Time
+	// Cursor is the NextCursor of the previous page, nil for the first one.
+	Cursor types.HexBytes
+	// Limit is the maximum number of processes of the page, the API default
+	// if zero.
+	Limit int
+}
+
+// params returns the query parameters of the listing, see HTTPclient.Request.
+func (q *ProcessesQuery) params() []string {
+	params := []string{}
+	if q.Organizer != nil {
+		params = append(params, "organizer", q.Organizer.Hex())
+	}
+	if q.ChainID != nil {
+		params = append(params, "chainId", strconv.FormatUint(uint64(*q.ChainID), 10))
+	}
+	if q.Status != "" {
+		params = append(params, "status", string(q.Status))
+	}
+	if !q.From.IsZero() {
+		params = append(params, "from", strconv.FormatInt(q.From.Unix(), 10))
+	}
+	if !q.To.IsZero() {
+		params = append(params, "to", strconv.FormatInt(q.To.Unix(), 10))
+	}
+	if len(q.Cursor) > 0 {
+		params = append(params, "cursor", q.Cursor.String())
+	}
+	if q.Limit != 0 {
+		params = append(params, "limit", strconv.Itoa(q.Limit))
+	}
+	return params
+}
+
+// CreateProcess creates a process signed by the organizer. The nonce of the
+// process is set to the next nonce of the organizer, and the process is
+// signed with its EIP-712 typed data (see api.Process.TypedData), so only
+// the chain ID and the parameters of the process need to be set.
+//
+// The call is not retried, a failed creation can be retried with a new call,
+// which uses the next nonce if the previous one was applied.
+func (c *HTTPclient) CreateProcess(ctx context.Context, organizer *ethereum.SignKeys, process *api.Process,
+) (*api.ProcessResponse, error) {
+	nonce, err := c.OrganizerNonce(ctx, organizer.Address())
+	if err != nil {
+		return nil, fmt.Errorf("could not get organizer nonce: %w", err)
+	}
+	process.Nonce = nonce
+	if err := process.Sign(organizer); err != nil {
+		return nil, err
+	}
+	resp := &api.ProcessResponse{}
+	if err := c.call(ctx, HTTPPOST, false, process, resp, nil, api.ProcessEndpoint); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// GetProcess returns the process with the ID provided.
+func (c *HTTPclient) GetProcess(ctx context.Context, pid types.HexBytes) (*api.ProcessResponse, error) {
+	resp := &api.ProcessResponse{}
+	if err := c.call(ctx, HTTPGET, true, nil, resp, []string{"id", pid.String()}, api.ProcessEndpoint); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Processes returns a page of the processes matching the query, in creation
+// order. The next page is requested with the NextCursor of the response.
+func (c *HTTPclient) Processes(ctx context.Context, query *ProcessesQuery) (*api.ProcessesResponse, error) {
+	resp := &api.ProcessesResponse{}
+	if err := c.call(ctx, HTTPGET, true, nil, resp, query.params(), api.ProcessesEndpoint); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ProcessQueue returns the queue statistics of the process.
+func (c *HTTPclient) ProcessQueue(ctx context.Context, pid types.HexBytes) (*stg.QueueStats, error) {
+	resp := &stg.QueueStats{}
+	if err := c.call(ctx, HTTPGET, true, nil, resp, nil, "process", pid.String(), "queue"); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Results returns the decrypted results of the process, once it has ended.
+func (c *HTTPclient) Results(ctx context.Context, pid types.HexBytes) (*api.ResultsResponse, error) {
+	resp := &api.ResultsResponse{}
+	if err := c.call(ctx, HTTPGET, true, nil, resp, nil, "process", pid.String(), "results"); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Census returns the census of the process, to build the census proofs of
+// its voters.
+func (c *HTTPclient) Census(ctx context.Context, pid types.HexBytes) (*api.CensusResponse, error) {
+	resp := &api.CensusResponse{}
+	if err := c.call(ctx, HTTPGET, true, nil, resp, nil, "process", pid.String(), "census"); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// OrganizerNonce returns the next nonce of the organizer, to be used to create
+// its next process.
+func (c *HTTPclient) OrganizerNonce(ctx context.Context, organizer common.Address) (uint64, error) {
+	resp := &api.OrganizerNonceResponse{}
+	if err := c.call(ctx, HTTPGET, true, nil, resp, nil, "organizers", organizer.Hex(), "nonce"); err != nil {
+		return 0, err
+	}
+	return resp.Nonce, nil
+}
@@ -0,0 +1,210 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/api"
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	"github.com/vocdoni/vocdoni-z-sandbox/tracing"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// DefaultWorkerPollInterval is the time a worker waits to lease a job
+	// again when there are none available.
+	DefaultWorkerPollInterval = time.Second
+	// DefaultWorkerHeartbeatInterval is the time between the heartbeats sent
+	// by a worker to extend the lease of the job it is processing.
+	DefaultWorkerHeartbeatInterval = 30 * time.Second
+)
+
+// errLeaseLost is returned when the lease of a job expired or was taken by
+// another worker while it was being processed.
+var errLeaseLost = errors.New("job lease lost")
+
+// ProveFunc processes a leased job and returns its encoded result, as
+// expected by the complete endpoint of its stage (see api.WorkerJobUpdate).
+// The context is cancelled if the lease of the job is lost.
+type ProveFunc func(ctx context.Context, job *api.WorkerJob) ([]byte, error)
+
+// WorkerConfig defines the jobs leased by a worker: their stage, and the
+// process and maximum number of items for the stages that need them. The
+// zero intervals take their default value.
+type WorkerConfig struct {
+	Stage             string
+	ProcessID         types.HexBytes
+	MaxCount          int
+	PollInterval      time.Duration
+	HeartbeatInterval time.Duration
+}
+
+// Worker runs the proving loop of a remote worker: it leases the jobs of a
+// stage from the node, processes them and submits their results, sending
+// heartbeats while they are being processed. The client must be configured
+// with the worker token (see HTTPclient.SetAuthToken).
+type Worker struct {
+	cli   *HTTPclient
+	conf  WorkerConfig
+	prove ProveFunc
+}
+
+// NewWorker creates a new worker using the client, config and prove function
+// provided.
+func NewWorker(cli *HTTPclient, conf WorkerConfig, prove ProveFunc) *Worker {
+	if conf.PollInterval == 0 {
+		conf.PollInterval = DefaultWorkerPollInterval
+	}
+	if conf.HeartbeatInterval == 0 {
+		conf.HeartbeatInterval = DefaultWorkerHeartbeatInterval
+	}
+	return &Worker{cli: cli, conf: conf, prove: prove}
+}
+
+// Run processes jobs until the context is cancelled. The failures of the
+// jobs are reported to the node, and the errors talking to it are logged, so
+// they do not stop the loop.
+func (w *Worker) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		processed, err := w.RunOnce(ctx)
+		if err != nil {
+			log.Warnw("worker job failed", "stage", w.conf.Stage, "error", err.Error())
+		}
+		if processed && err == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(w.conf.PollInterval):
+		}
+	}
+}
+
+// RunOnce leases a job and processes it. It returns false if there were no
+// jobs available.
+func (w *Worker) RunOnce(ctx context.Context) (bool, error) {
+	job, err := w.lease()
+	if err != nil || job == nil {
+		return false, err
+	}
+	proveCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go w.heartbeats(proveCtx, cancel, job)
+
+	proveCtx, span := startProveSpan(proveCtx, job)
+	start := time.Now()
+	result, err := w.prove(proveCtx, job)
+	duration := time.Since(start)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	if cause := context.Cause(proveCtx); errors.Is(cause, errLeaseLost) {
+		return true, cause
+	}
+	update := &api.WorkerJobUpdate{Stage: job.Stage, Keys: job.Keys, Duration: duration}
+	if err != nil {
+		update.Error = err.Error()
+		if err := w.send(api.WorkerFailEndpoint, update); err != nil {
+			return true, fmt.Errorf("could not report failed job: %w", err)
+		}
+		return true, err
+	}
+	update.Result = result
+	if err := w.send(api.WorkerCompleteEndpoint, update); err != nil {
+		return true, fmt.Errorf("could not complete job: %w", err)
+	}
+	return true, nil
+}
+
+// startProveSpan starts the span of the processing of a job. It continues
+// the trace of its item if it has a single one, or it is linked to the
+// traces of its items otherwise.
+func startProveSpan(ctx context.Context, job *api.WorkerJob) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{trace.WithAttributes(
+		attribute.String("vocdoni.stage", job.Stage),
+		attribute.Int("vocdoni.job.items", len(job.Keys)),
+	)}
+	if len(job.TraceContexts) == 1 {
+		ctx = tracing.Extract(ctx, job.TraceContexts[0])
+	} else {
+		for _, tc := range job.TraceContexts {
+			if link, ok := tracing.Link(tc); ok {
+				opts = append(opts, trace.WithLinks(link))
+			}
+		}
+	}
+	return tracing.Start(ctx, job.Stage+" prove", opts...)
+}
+
+// lease requests a job to the node. It returns nil if there are none.
+func (w *Worker) lease() (*api.WorkerJob, error) {
+	req := &api.WorkerLeaseRequest{
+		Stage:     w.conf.Stage,
+		ProcessID: w.conf.ProcessID,
+		MaxCount:  w.conf.MaxCount,
+	}
+	data, status, err := w.cli.Request(HTTPPOST, req, nil, api.WorkerLeaseEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("%s: %d (%s)", errCodeNot200, status, data)
+	}
+	job := &api.WorkerJob{}
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(job); err != nil {
+		return nil, fmt.Errorf("could not decode job: %w", err)
+	}
+	return job, nil
+}
+
+// heartbeats extends the lease of the job periodically until the context is
+// done. If the lease is lost, the context is cancelled with errLeaseLost.
+func (w *Worker) heartbeats(ctx context.Context, cancel context.CancelCauseFunc, job *api.WorkerJob) {
+	ticker := time.NewTicker(w.conf.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := w.send(api.WorkerHeartbeatEndpoint, &api.WorkerJobUpdate{Stage: job.Stage, Keys: job.Keys})
+			if errors.Is(err, errLeaseLost) {
+				cancel(err)
+				return
+			}
+			if err != nil {
+				log.Warnw("could not send worker heartbeat", "stage", job.Stage, "error", err.Error())
+			}
+		}
+	}
+}
+
+// send posts a job update to the endpoint provided.
+func (w *Worker) send(endpoint string, update *api.WorkerJobUpdate) error {
+	data, status, err := w.cli.Request(HTTPPOST, update, nil, endpoint)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound, http.StatusForbidden:
+		return fmt.Errorf("%w: %s", errLeaseLost, data)
+	default:
+		return fmt.Errorf("%s: %d (%s)", errCodeNot200, status, data)
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	stg "github.com/vocdoni/vocdoni-z-sandbox/storage"
+)
+
+// deadLetters lists the queue items that could not be processed
+// GET /admin/deadletters
+func (a *API) deadLetters(w http.ResponseWriter, r *http.Request) {
+	dls, err := a.storage.DeadLetters()
+	if err != nil {
+		ErrGenericInternalServerError.Withf("could not list dead letters: %v", err).Write(w)
+		return
+	}
+	httpWriteJSON(w, &DeadLettersResponse{DeadLetters: dls})
+}
+
+// deadLetter retrieves a dead letter, including its encoded artifact
+// GET /admin/deadletters/{id}
+func (a *API) deadLetter(w http.ResponseWriter, r *http.Request) {
+	id, ok := deadLetterID(w, r)
+	if !ok {
+		return
+	}
+	dl, err := a.storage.DeadLetter(id)
+	if err != nil {
+		writeDeadLetterError(w, err)
+		return
+	}
+	httpWriteJSON(w, dl)
+}
+
+// requeueDeadLetter pushes a dead letter back to its queue
+// POST /admin/deadletters/{id}/requeue
+func (a *API) requeueDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, ok := deadLetterID(w, r)
+	if !ok {
+		return
+	}
+	if err := a.storage.RequeueDeadLetter(id); err != nil {
+		writeDeadLetterError(w, err)
+		return
+	}
+	log.Infow("dead letter requeued", "id", hex.EncodeToString(id))
+	httpWriteOK(w)
+}
+
+// purgeDeadLetter removes a dead letter
+// DELETE /admin/deadletters/{id}
+func (a *API) purgeDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, ok := deadLetterID(w, r)
+	if !ok {
+		return
+	}
+	if err := a.storage.PurgeDeadLetter(id); err != nil {
+		writeDeadLetterError(w, err)
+		return
+	}
+	log.Infow("dead letter purged", "id", hex.EncodeToString(id))
+	httpWriteOK(w)
+}
+
+// deadLetterID decodes the dead letter ID of the URL. If it is malformed,
+// the error is written to the response and false is returned.
+func deadLetterID(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	id, err := hex.DecodeString(chi.URLParam(r, "id"))
+	if err != nil || len(id) == 0 {
+		ErrMalformedDeadLetterID.Withf("could not decode dead letter ID: %v", err).Write(w)
+		return nil, false
+	}
+	return id, true
+}
+
+// writeDeadLetterError writes the API error matching a dead letter storage
+// error.
+func writeDeadLetterError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, stg.ErrNotFound):
+		ErrDeadLetterNotFound.WithErr(err).Write(w)
+	case errors.Is(err, stg.ErrKeyAlreadyExists):
+		ErrDeadLetterQueued.WithErr(err).Write(w)
+	default:
+		ErrGenericInternalServerError.WithErr(err).Write(w)
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -32,6 +33,29 @@ func (e Error) MarshalJSON() ([]byte, error) {
 		})
 }
 
+// UnmarshalJSON decodes an error written by the API (see MarshalJSON). The
+// HTTPstatus is not part of the JSON, so it is left unset.
+func (e *Error) UnmarshalJSON(data []byte) error {
+	var msg struct {
+		Err  string `json:"error"`
+		Code int    `json:"code"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	e.Err = errors.New(msg.Err)
+	e.Code = msg.Code
+	return nil
+}
+
+// Is reports whether the target is an Error with the same Code, so the errors
+// decoded by the clients can be compared with the errors defined by the API,
+// like errors.Is(err, api.ErrProcessNotFound).
+func (e Error) Is(target error) bool {
+	t, ok := target.(Error)
+	return ok && t.Code == e.Code
+}
+
 // Error returns the Message contained inside the APIerror
 func (e Error) Error() string {
 	return e.Err.Error()
@@ -49,6 +73,10 @@ func (e Error) Write(w http.ResponseWriter) {
 	if log.Level() == log.LogLevelDebug {
 		log.Debugw("API error response", "error", e.Error(), "code", e.Code, "httpStatus", e.HTTPstatus)
 	}
+	// record the error code for the request metrics
+	if mw, ok := w.(*metricsWriter); ok {
+		mw.errorCode = e.Code
+	}
 	// set the content type to JSON
 	w.Header().Set("Content-Type", "application/json")
 	http.Error(w, string(msg), e.HTTPstatus)
@@ -25,12 +25,39 @@ import (
 // Do note that HTTPstatus 204 No Content implies the response body will be empty,
 // so the Code and Message will actually be discarded, never sent to the client
 var (
-	ErrResourceNotFound   = Error{Code: 40001, HTTPstatus: http.StatusNotFound, Err: fmt.Errorf("resource not found")}
-	ErrMalformedBody      = Error{Code: 40004, HTTPstatus: http.StatusBadRequest, Err: fmt.Errorf("malformed JSON body")}
-	ErrInvalidSignature   = Error{Code: 40005, HTTPstatus: http.StatusBadRequest, Err: fmt.Errorf("invalid signature")}
-	ErrMalformedProcessID = Error{Code: 40006, HTTPstatus: http.StatusBadRequest, Err: fmt.Errorf("malformed process ID")}
-	ErrProcessNotFound    = Error{Code: 40007, HTTPstatus: http.StatusNotFound, Err: fmt.Errorf("process not found")}
+	ErrResourceNotFound      = Error{Code: 40001, HTTPstatus: http.StatusNotFound, Err: fmt.Errorf("resource not found")}
+	ErrMalformedBody         = Error{Code: 40004, HTTPstatus: http.StatusBadRequest, Err: fmt.Errorf("malformed JSON body")}
+	ErrInvalidSignature      = Error{Code: 40005, HTTPstatus: http.StatusBadRequest, Err: fmt.Errorf("invalid signature")}
+	ErrMalformedProcessID    = Error{Code: 40006, HTTPstatus: http.StatusBadRequest, Err: fmt.Errorf("malformed process ID")}
+	ErrProcessNotFound       = Error{Code: 40007, HTTPstatus: http.StatusNotFound, Err: fmt.Errorf("process not found")}
+	ErrMalformedDeadLetterID = Error{Code: 40008, HTTPstatus: http.StatusBadRequest, Err: fmt.Errorf("malformed dead letter ID")}
+	ErrDeadLetterNotFound    = Error{Code: 40009, HTTPstatus: http.StatusNotFound, Err: fmt.Errorf("dead letter not found")}
+	ErrDeadLetterQueued      = Error{Code: 40010, HTTPstatus: http.StatusConflict, Err: fmt.Errorf("dead letter already queued")}
+	ErrInvalidWorkerToken    = Error{Code: 40011, HTTPstatus: http.StatusUnauthorized, Err: fmt.Errorf("invalid worker token")}
+	ErrMalformedJob          = Error{Code: 40012, HTTPstatus: http.StatusBadRequest, Err: fmt.Errorf("malformed job")}
+	ErrLeaseNotFound         = Error{Code: 40013, HTTPstatus: http.StatusNotFound, Err: fmt.Errorf("job lease not found")}
+	ErrLeaseNotOwned         = Error{Code: 40014, HTTPstatus: http.StatusForbidden, Err: fmt.Errorf("job leased by another worker")}
+	ErrInvalidMetadata       = Error{Code: 40015, HTTPstatus: http.StatusBadRequest, Err: fmt.Errorf("invalid metadata")}
+	ErrMalformedMetadataHash = Error{Code: 40016, HTTPstatus: http.StatusBadRequest, Err: fmt.Errorf("malformed metadata hash")}
+	ErrMetadataNotFound      = Error{Code: 40017, HTTPstatus: http.StatusNotFound, Err: fmt.Errorf("metadata not found")}
+	ErrMalformedQuery        = Error{Code: 40018, HTTPstatus: http.StatusBadRequest, Err: fmt.Errorf("malformed query parameters")}
+	ErrNonceUsed             = Error{Code: 40019, HTTPstatus: http.StatusConflict, Err: fmt.Errorf("nonce already used")}
+	ErrMalformedAddress      = Error{Code: 40020, HTTPstatus: http.StatusBadRequest, Err: fmt.Errorf("malformed address")}
+	ErrInvalidBallotMode     = Error{Code: 40021, HTTPstatus: http.StatusBadRequest, Err: fmt.Errorf("invalid ballot mode")}
+	ErrTooManyRequests       = Error{Code: 40022, HTTPstatus: http.StatusTooManyRequests, Err: fmt.Errorf("too many requests")}
+	ErrProcessQuotaExceeded  = Error{Code: 40023, HTTPstatus: http.StatusTooManyRequests, Err: fmt.Errorf("ballot quota of the process exceeded")}
+	ErrNotInCensus           = Error{Code: 40024, HTTPstatus: http.StatusForbidden, Err: fmt.Errorf("voter not in the census")}
+	ErrBallotRejected        = Error{Code: 40025, HTTPstatus: http.StatusConflict, Err: fmt.Errorf("ballot rejected")}
+	ErrUnauthorized          = Error{Code: 40026, HTTPstatus: http.StatusUnauthorized, Err: fmt.Errorf("invalid admin credentials")}
+	ErrForbidden             = Error{Code: 40027, HTTPstatus: http.StatusForbidden, Err: fmt.Errorf("admin role not allowed")}
+	ErrKeyNotFound           = Error{Code: 40028, HTTPstatus: http.StatusNotFound, Err: fmt.Errorf("encryption key not found")}
+	ErrProcessNotCancelable  = Error{Code: 40029, HTTPstatus: http.StatusConflict, Err: fmt.Errorf("process can not be canceled")}
+	ErrMalformedNullifier    = Error{Code: 40030, HTTPstatus: http.StatusBadRequest, Err: fmt.Errorf("malformed nullifier")}
+	ErrBallotNotFound        = Error{Code: 40031, HTTPstatus: http.StatusNotFound, Err: fmt.Errorf("ballot not found")}
+	ErrProcessNotEnded       = Error{Code: 40032, HTTPstatus: http.StatusConflict, Err: fmt.Errorf("process has not ended")}
+	ErrProcessClosed         = Error{Code: 40033, HTTPstatus: http.StatusConflict, Err: fmt.Errorf("process not accepting ballots")}
 
 	ErrMarshalingServerJSONFailed = Error{Code: 50001, HTTPstatus: http.StatusInternalServerError, Err: fmt.Errorf("marshaling (server-side) JSON failed")}
 	ErrGenericInternalServerError = Error{Code: 50002, HTTPstatus: http.StatusInternalServerError, Err: fmt.Errorf("internal server error")}
+	ErrShuttingDown               = Error{Code: 50003, HTTPstatus: http.StatusServiceUnavailable, Err: fmt.Errorf("the API server is shutting down")}
 )
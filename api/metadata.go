@@ -0,0 +1,63 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	stg "github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+// metadataHashLen is the size of the metadata hashes (see
+// storage.MetadataHash).
+const metadataHashLen = 32
+
+// newMetadata stores the metadata of a process, keyed by its hash
+// POST /metadata
+func (a *API) newMetadata(w http.ResponseWriter, r *http.Request) {
+	metadata := &types.Metadata{}
+	if err := json.NewDecoder(r.Body).Decode(metadata); err != nil {
+		ErrMalformedBody.Withf("could not decode request body: %v", err).Write(w)
+		return
+	}
+	if err := metadata.Validate(); err != nil {
+		ErrInvalidMetadata.WithErr(err).Write(w)
+		return
+	}
+	hash, err := a.storage.StoreMetadata(metadata)
+	if err != nil {
+		ErrGenericInternalServerError.Withf("could not store metadata: %v", err).Write(w)
+		return
+	}
+	log.Infow("new metadata", "hash", hash.String())
+	httpWriteJSON(w, &MetadataResponse{Hash: hash})
+}
+
+// metadata retrieves the metadata of a process by its hash
+// GET /metadata/{hash}
+func (a *API) metadata(w http.ResponseWriter, r *http.Request) {
+	hash, err := hex.DecodeString(chi.URLParam(r, "hash"))
+	if err != nil || len(hash) != metadataHashLen {
+		ErrMalformedMetadataHash.Withf("could not decode metadata hash: %v", err).Write(w)
+		return
+	}
+	metadata, err := a.storage.MetadataByHash(hash)
+	if err != nil {
+		writeMetadataError(w, err)
+		return
+	}
+	httpWriteJSON(w, metadata)
+}
+
+// writeMetadataError writes the API error matching a metadata storage error.
+func writeMetadataError(w http.ResponseWriter, err error) {
+	if errors.Is(err, stg.ErrNotFound) {
+		ErrMetadataNotFound.WithErr(err).Write(w)
+		return
+	}
+	ErrGenericInternalServerError.WithErr(err).Write(w)
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	"github.com/vocdoni/vocdoni-z-sandbox/metrics"
+	stg "github.com/vocdoni/vocdoni-z-sandbox/storage"
+)
+
+// metricsWriter records the HTTP status and the API error code of a
+// response, see Error.Write.
+type metricsWriter struct {
+	http.ResponseWriter
+	status    int
+	errorCode int
+}
+
+func (w *metricsWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// metricsMiddleware counts the requests and measures their duration by
+// route pattern, so the metrics do not grow with the URL parameters.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		mw := &metricsWriter{ResponseWriter: w}
+		next.ServeHTTP(mw, r)
+
+		route := "unknown"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := mw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		metrics.HTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(status), strconv.Itoa(mw.errorCode)).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+var (
+	queueItemsDesc = prometheus.NewDesc("vocdoni_queue_items",
+		"Items of each processing stage queue, by state.", []string{"stage", "state"}, nil)
+	queueProcessItemsDesc = prometheus.NewDesc("vocdoni_queue_process_items",
+		"Items of each processing stage queue of the open processes with queued items, by state.",
+		[]string{"process", "stage", "state"}, nil)
+	queueOldestAgeDesc = prometheus.NewDesc("vocdoni_queue_oldest_item_age_seconds",
+		"Time the oldest available item of each processing stage queue has been waiting.", []string{"stage"}, nil)
+	queueReclaimedDesc = prometheus.NewDesc("vocdoni_queue_reclaimed_reservations_total",
+		"Stale reservations released by the reaper, by processing stage.", []string{"stage"}, nil)
+	queueDeadLettersDesc = prometheus.NewDesc("vocdoni_queue_dead_letters",
+		"Queue items that could not be processed.", nil, nil)
+)
+
+// queueCollector exports the queue statistics of the storage (see
+// storage.QueueStats) when the metrics are scraped.
+type queueCollector struct {
+	storage *stg.Storage
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueItemsDesc
+	ch <- queueProcessItemsDesc
+	ch <- queueOldestAgeDesc
+	ch <- queueReclaimedDesc
+	ch <- queueDeadLettersDesc
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	total := c.storage.QueueStats(nil)
+	for stage, ss := range total.Stages {
+		ch <- prometheus.MustNewConstMetric(queueItemsDesc, prometheus.GaugeValue, float64(ss.Available), stage, "available")
+		ch <- prometheus.MustNewConstMetric(queueItemsDesc, prometheus.GaugeValue, float64(ss.Reserved), stage, "reserved")
+		ch <- prometheus.MustNewConstMetric(queueOldestAgeDesc, prometheus.GaugeValue, ss.OldestAge.Seconds(), stage)
+		ch <- prometheus.MustNewConstMetric(queueReclaimedDesc, prometheus.CounterValue, float64(ss.Reclaimed), stage)
+	}
+	ch <- prometheus.MustNewConstMetric(queueDeadLettersDesc, prometheus.GaugeValue, float64(total.Dead))
+	// the items of the closed processes are only counted in the totals, so
+	// their series are not exported forever
+	for _, pid := range c.storage.QueueProcesses() {
+		if !c.storage.ProcessOpen(pid) {
+			continue
+		}
+		process := hex.EncodeToString(pid)
+		for stage, ss := range c.storage.QueueStats(pid).Stages {
+			ch <- prometheus.MustNewConstMetric(queueProcessItemsDesc, prometheus.GaugeValue, float64(ss.Available), process, stage, "available")
+			ch <- prometheus.MustNewConstMetric(queueProcessItemsDesc, prometheus.GaugeValue, float64(ss.Reserved), process, stage, "reserved")
+		}
+	}
+}
+
+// registeredQueueCollector is the queue collector registered, protected by
+// queueCollectorLock.
+var (
+	registeredQueueCollector *queueCollector
+	queueCollectorLock       sync.Mutex
+)
+
+// registerQueueMetrics exports the queue statistics of the storage, and
+// returns the collector to unregister it once the storage is closed. Only
+// the storage of one API instance can be exported by the process, so the
+// collector of a previous instance is replaced.
+func registerQueueMetrics(storage *stg.Storage) (*queueCollector, error) {
+	queueCollectorLock.Lock()
+	defer queueCollectorLock.Unlock()
+	c := &queueCollector{storage: storage}
+	err := metrics.Register(c)
+	var already prometheus.AlreadyRegisteredError
+	if errors.As(err, &already) {
+		log.Warnw("replacing the queue metrics of a previous API instance")
+		metrics.Unregister(already.ExistingCollector)
+		err = metrics.Register(c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	registeredQueueCollector = c
+	return c, nil
+}
+
+// unregisterQueueMetrics stops exporting the queue statistics of the
+// collector, unless it was replaced by the collector of another instance.
+func unregisterQueueMetrics(c *queueCollector) {
+	queueCollectorLock.Lock()
+	defer queueCollectorLock.Unlock()
+	if registeredQueueCollector != c {
+		return
+	}
+	metrics.Unregister(c)
+	registeredQueueCollector = nil
+}
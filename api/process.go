@@ -3,15 +3,17 @@ package api
 import (
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/go-chi/chi/v5"
 
 	"github.com/vocdoni/arbo/memdb"
-	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/curves"
-	"github.com/vocdoni/vocdoni-z-sandbox/crypto/elgamal"
-	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ethereum"
 	"github.com/vocdoni/vocdoni-z-sandbox/log"
 	"github.com/vocdoni/vocdoni-z-sandbox/state"
+	stg "github.com/vocdoni/vocdoni-z-sandbox/storage"
 	"github.com/vocdoni/vocdoni-z-sandbox/types"
 )
 
@@ -24,8 +26,21 @@ func (a *API) newProcess(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := p.CheckTimes(); err != nil {
+		ErrMalformedBody.WithErr(err).Write(w)
+		return
+	}
+	if err := p.ResolveBallotMode(); err != nil {
+		ErrInvalidBallotMode.WithErr(err).Write(w)
+		return
+	}
+	if err := p.BallotMode.Validate(); err != nil {
+		ErrInvalidBallotMode.WithErr(err).Write(w)
+		return
+	}
+
 	// Extract the address from the signature
-	address, err := ethereum.AddrFromSignature([]byte(fmt.Sprintf("%d%d", p.ChainID, p.Nonce)), p.Signature)
+	address, err := p.SignerAddress()
 	if err != nil {
 		ErrInvalidSignature.Withf("could not extract address from signature: %v", err).Write(w)
 		return
@@ -38,19 +53,37 @@ func (a *API) newProcess(w http.ResponseWriter, r *http.Request) {
 		ChainID: p.ChainID,
 	}
 
-	// Generate the elgamal key
-	publicKey, privateKey, err := elgamal.GenerateKey(curves.New(curves.CurveTypeBN254))
-	if err != nil {
-		ErrGenericInternalServerError.Withf("could not generate elgamal key: %v", err).Write(w)
+	// Check the metadata of the process, if it has one
+	if p.MetadataHash != nil {
+		metadata, err := a.storage.MetadataByHash(p.MetadataHash)
+		if err != nil {
+			writeMetadataError(w, err)
+			return
+		}
+		if err := metadata.CheckBallotMode(&p.BallotMode); err != nil {
+			ErrInvalidMetadata.WithErr(err).Write(w)
+			return
+		}
+	}
+
+	// Use the nonce before generating the key, so only one of the
+	// concurrent requests with the same signature generates it
+	if err := a.storage.ReserveProcess(pid); err != nil {
+		if errors.Is(err, stg.ErrNonceUsed) || errors.Is(err, stg.ErrKeyAlreadyExists) {
+			ErrNonceUsed.WithErr(err).Write(w)
+			return
+		}
+		ErrGenericInternalServerError.Withf("could not reserve process: %v", err).Write(w)
 		return
 	}
-	x, y := publicKey.Point()
 
-	// Store the encryption keys
-	if err := a.storage.SetEncryptionKeys(pid, publicKey, privateKey); err != nil {
-		ErrGenericInternalServerError.Withf("could not store encryption keys: %v", err).Write(w)
+	// Generate the elgamal key, the private key is kept by the keystore
+	publicKey, err := a.keystore.GenerateKey(pid)
+	if err != nil {
+		ErrGenericInternalServerError.Withf("could not generate elgamal key: %v", err).Write(w)
 		return
 	}
+	x, y := publicKey.Point()
 
 	// Initialize the state
 	st, err := state.New(memdb.New(), pid.Marshal())
@@ -66,7 +99,7 @@ func (a *API) newProcess(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := st.Initialize(p.CensusRoot, ballotmode, publicKey.Marshal()); err != nil {
+	if err := st.Initialize(p.CensusRoot, ballotmode, state.SerializeEncryptionKey(publicKey)); err != nil {
 		ErrGenericInternalServerError.Withf("could not initialize state: %v", err).Write(w)
 		return
 	}
@@ -76,11 +109,42 @@ func (a *API) newProcess(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Store the process
+	process := &stg.Process{
+		CensusRoot:      p.CensusRoot,
+		BallotMode:      p.BallotMode,
+		MetadataHash:    p.MetadataHash,
+		EncryptionKey:   stg.EncryptionKeys{X: x, Y: y},
+		OverwritePolicy: p.OverwritePolicy,
+	}
+	if p.StartTime != 0 {
+		process.StartTime = time.Unix(int64(p.StartTime), 0)
+	}
+	if p.EndTime != 0 {
+		process.EndTime = time.Unix(int64(p.EndTime), 0)
+	}
+	if err := a.storage.SetProcess(pid, process); err != nil {
+		if errors.Is(err, stg.ErrNonceUsed) || errors.Is(err, stg.ErrKeyAlreadyExists) {
+			ErrNonceUsed.WithErr(err).Write(w)
+			return
+		}
+		ErrGenericInternalServerError.Withf("could not store process: %v", err).Write(w)
+		return
+	}
+
 	// Create the process response
 	pr := &ProcessResponse{
 		ProcessID:        pid.Marshal(),
 		EncryptionPubKey: [2]types.BigInt{types.BigInt(*x), types.BigInt(*y)},
 		StateRoot:        root.Bytes(),
+		MetadataHash:     p.MetadataHash,
+		BallotMode:       &p.BallotMode,
+		BallotPreset:     types.DetectBallotModePreset(&p.BallotMode),
+	}
+	pr.StartTime, pr.EndTime = processTimes(process)
+	if pr.OverwritePolicy = p.OverwritePolicy; pr.OverwritePolicy == nil {
+		policy := a.storage.DefaultOverwritePolicy()
+		pr.OverwritePolicy = &policy
 	}
 
 	// Write the response
@@ -104,7 +168,7 @@ func (a *API) process(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Retrieve the process
-	pubk, _, err := a.storage.EncryptionKeys(pid)
+	pubk, err := a.keystore.PublicKey(pid)
 	if err != nil {
 		ErrProcessNotFound.Withf("could not retrieve process: %v", err).Write(w)
 		return
@@ -121,6 +185,56 @@ func (a *API) process(w http.ResponseWriter, r *http.Request) {
 		StateRoot:        types.HexBytes{}, // TO-DO
 	}
 
+	// The processes created before they were stored have no metadata,
+	// status or creation time
+	if process, err := a.storage.Process(pid); err == nil {
+		pr.MetadataHash = process.MetadataHash
+		pr.BallotMode = &process.BallotMode
+		pr.BallotPreset = types.DetectBallotModePreset(&process.BallotMode)
+		pr.Status = process.Status
+		pr.CreatedAt = &process.CreatedAt
+		pr.StartTime, pr.EndTime = processTimes(process)
+	} else if !errors.Is(err, stg.ErrNotFound) {
+		ErrGenericInternalServerError.Withf("could not retrieve process: %v", err).Write(w)
+		return
+	}
+	policy, err := a.storage.OverwritePolicy(pid)
+	if err != nil {
+		ErrGenericInternalServerError.Withf("could not retrieve overwrite policy: %v", err).Write(w)
+		return
+	}
+	pr.OverwritePolicy = &policy
+
 	// Write the response
 	httpWriteJSON(w, pr)
 }
+
+// processTimes returns the voting period of the process for the responses,
+// nil if it was not defined.
+func processTimes(p *stg.Process) (*time.Time, *time.Time) {
+	var start, end *time.Time
+	if !p.StartTime.IsZero() {
+		start = &p.StartTime
+	}
+	if !p.EndTime.IsZero() {
+		end = &p.EndTime
+	}
+	return start, end
+}
+
+// organizerNonce returns the next nonce of an organizer
+// GET /organizers/{address}/nonce
+func (a *API) organizerNonce(w http.ResponseWriter, r *http.Request) {
+	address := chi.URLParam(r, "address")
+	if !common.IsHexAddress(address) {
+		ErrMalformedAddress.Withf("invalid address %q", address).Write(w)
+		return
+	}
+	organizer := common.HexToAddress(address)
+	nonce, err := a.storage.OrganizerNonce(organizer)
+	if err != nil {
+		ErrGenericInternalServerError.Withf("could not read organizer nonce: %v", err).Write(w)
+		return
+	}
+	httpWriteJSON(w, &OrganizerNonceResponse{Address: organizer.Hex(), Nonce: nonce})
+}
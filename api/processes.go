@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	stg "github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+const (
+	// DefaultProcessesLimit is the number of processes listed per page if
+	// the limit is not provided.
+	DefaultProcessesLimit = 20
+	// MaxProcessesLimit is the maximum number of processes listed per page.
+	MaxProcessesLimit = 100
+)
+
+// processes lists the voting processes in creation order, filtered by the
+// query parameters:
+//   - organizer: the address of the organizer
+//   - chainId: the chain ID of the process ID
+//   - status: the status of the process (ready, ended or canceled)
+//   - from, to: the creation time range, as unix timestamps (both included)
+//   - cursor: the nextCursor of the previous page
+//   - limit: the maximum number of processes of the page
+//
+// GET /processes
+func (a *API) processes(w http.ResponseWriter, r *http.Request) {
+	filter, cursor, limit, err := processesQuery(r)
+	if err != nil {
+		ErrMalformedQuery.WithErr(err).Write(w)
+		return
+	}
+	entries, next, err := a.storage.ListProcesses(filter, cursor, limit)
+	if err != nil {
+		ErrGenericInternalServerError.Withf("could not list processes: %v", err).Write(w)
+		return
+	}
+	resp := &ProcessesResponse{
+		Processes:  make([]*ProcessResponse, 0, len(entries)),
+		NextCursor: next,
+	}
+	for _, e := range entries {
+		pr := &ProcessResponse{
+			ProcessID: e.ID.Marshal(),
+			Address:   e.ID.Address.Hex(),
+			ChainID:   e.ID.ChainID,
+			Nonce:     e.ID.Nonce,
+			EncryptionPubKey: [2]types.BigInt{
+				types.BigInt(*e.Process.EncryptionKey.X),
+				types.BigInt(*e.Process.EncryptionKey.Y),
+			},
+			MetadataHash: e.Process.MetadataHash,
+			BallotMode:   &e.Process.BallotMode,
+			BallotPreset: types.DetectBallotModePreset(&e.Process.BallotMode),
+			Status:       e.Process.Status,
+			CreatedAt:    &e.Process.CreatedAt,
+		}
+		pr.StartTime, pr.EndTime = processTimes(e.Process)
+		resp.Processes = append(resp.Processes, pr)
+	}
+	httpWriteJSON(w, resp)
+}
+
+// processesQuery decodes the filter, cursor and limit of the query
+// parameters of the process listing.
+func processesQuery(r *http.Request) (*stg.ProcessFilter, []byte, int, error) {
+	query := r.URL.Query()
+	filter := &stg.ProcessFilter{}
+	if organizer := query.Get("organizer"); organizer != "" {
+		if !common.IsHexAddress(organizer) {
+			return nil, nil, 0, fmt.Errorf("invalid organizer address %q", organizer)
+		}
+		address := common.HexToAddress(organizer)
+		filter.Organizer = &address
+	}
+	if chainID := query.Get("chainId"); chainID != "" {
+		id, err := strconv.ParseUint(chainID, 10, 32)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("invalid chain ID: %w", err)
+		}
+		id32 := uint32(id)
+		filter.ChainID = &id32
+	}
+	if status := stg.ProcessStatus(query.Get("status")); status != "" {
+		if !status.Valid() {
+			return nil, nil, 0, fmt.Errorf("invalid status %q", status)
+		}
+		filter.Status = status
+	}
+	for _, param := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &filter.CreatedFrom}, {"to", &filter.CreatedTo}} {
+		if v := query.Get(param.name); v != "" {
+			ts, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || ts < 0 {
+				return nil, nil, 0, fmt.Errorf("invalid %s timestamp %q", param.name, v)
+			}
+			*param.t = time.Unix(ts, 0)
+		}
+	}
+	if !filter.CreatedTo.IsZero() {
+		// the timestamps have second precision, include the whole second
+		filter.CreatedTo = filter.CreatedTo.Add(time.Second - 1)
+	}
+
+	var cursor []byte
+	if v := query.Get("cursor"); v != "" {
+		var err error
+		if cursor, err = hex.DecodeString(v); err != nil || len(cursor) != stg.ProcessCursorSize {
+			return nil, nil, 0, fmt.Errorf("invalid cursor %q", v)
+		}
+	}
+	limit := DefaultProcessesLimit
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > MaxProcessesLimit {
+			return nil, nil, 0, fmt.Errorf("invalid limit %q, it must be between 1 and %d", v, MaxProcessesLimit)
+		}
+	}
+	return filter, cursor, limit, nil
+}
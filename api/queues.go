@@ -0,0 +1,39 @@
+package api
+
+import (
+	"encoding/hex"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	stg "github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+// processQueue returns the queue statistics of a process
+// GET /process/{id}/queue
+func (a *API) processQueue(w http.ResponseWriter, r *http.Request) {
+	pid := types.ProcessID{}
+	data, err := hex.DecodeString(chi.URLParam(r, "id"))
+	if err == nil {
+		err = pid.Unmarshal(data)
+	}
+	if err != nil {
+		ErrMalformedProcessID.Withf("could not decode process ID: %v", err).Write(w)
+		return
+	}
+	httpWriteJSON(w, a.storage.QueueStats(pid.Marshal()))
+}
+
+// adminQueues returns the queue statistics of all the processes with queued
+// items, and their totals
+// GET /admin/queues
+func (a *API) adminQueues(w http.ResponseWriter, r *http.Request) {
+	resp := &QueuesResponse{
+		Total:     a.storage.QueueStats(nil),
+		Processes: make(map[string]*stg.QueueStats),
+	}
+	for _, pid := range a.storage.QueueProcesses() {
+		resp.Processes[hex.EncodeToString(pid)] = a.storage.QueueStats(pid)
+	}
+	httpWriteJSON(w, resp)
+}
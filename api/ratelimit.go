@@ -0,0 +1,164 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit is the configuration of a token bucket, which allows Burst
+// requests at once and is refilled with Rate requests per second. Both must
+// be positive.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// validate returns an error if the rate or the burst are not positive.
+func (l *RateLimit) validate() error {
+	if l.Rate <= 0 || math.IsNaN(l.Rate) || math.IsInf(l.Rate, 0) {
+		return fmt.Errorf("invalid rate %v, it must be a positive number", l.Rate)
+	}
+	if l.Burst <= 0 {
+		return fmt.Errorf("invalid burst %d, it must be positive", l.Burst)
+	}
+	return nil
+}
+
+// BallotLimits protect the verifiers from the clients that flood the API
+// with ballots. The ballots are limited by client IP and by voter address,
+// and the ballots of each process waiting to be verified are limited by
+// MaxPendingPerProcess, unlimited if it is zero. The nil rate limits are
+// not applied.
+type BallotLimits struct {
+	PerIP                *RateLimit
+	PerAddress           *RateLimit
+	MaxPendingPerProcess int
+}
+
+// validate returns an error if a rate limit or the pending ballots quota
+// are not valid.
+func (bl *BallotLimits) validate() error {
+	if bl.PerIP != nil {
+		if err := bl.PerIP.validate(); err != nil {
+			return fmt.Errorf("per IP ballot limit: %w", err)
+		}
+	}
+	if bl.PerAddress != nil {
+		if err := bl.PerAddress.validate(); err != nil {
+			return fmt.Errorf("per address ballot limit: %w", err)
+		}
+	}
+	if bl.MaxPendingPerProcess < 0 {
+		return fmt.Errorf("invalid max pending ballots per process %d", bl.MaxPendingPerProcess)
+	}
+	return nil
+}
+
+// DefaultBallotLimits are the ballot limits of the API if none are
+// configured.
+var DefaultBallotLimits = BallotLimits{
+	PerIP:                &RateLimit{Rate: 10, Burst: 50},
+	PerAddress:           &RateLimit{Rate: 0.2, Burst: 5},
+	MaxPendingPerProcess: 100000,
+}
+
+// tokenBucket is the state of the bucket of a key: the tokens left at the
+// time of the last request.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket for each key. The buckets that are full
+// again are removed, so only the keys seen recently take memory. A nil
+// rateLimiter allows every request.
+type rateLimiter struct {
+	limit RateLimit
+	// refill is how long an empty bucket takes to be full again
+	refill time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	sweepAt time.Time
+}
+
+// newRateLimiter returns a rate limiter with the limit provided, or nil if
+// it is nil.
+func newRateLimiter(limit *RateLimit) *rateLimiter {
+	if limit == nil {
+		return nil
+	}
+	return &rateLimiter{
+		limit:   *limit,
+		refill:  time.Duration(float64(limit.Burst) / limit.Rate * float64(time.Second)),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of the key. If it is empty, it returns
+// false and how long until the next token.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.After(l.sweepAt) {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) >= l.refill {
+				delete(l.buckets, k)
+			}
+		}
+		l.sweepAt = now.Add(l.refill)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.limit.Burst)}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// rateLimitByIP is the middleware that limits the requests of each client
+// IP with the rate limiter provided.
+func rateLimitByIP(l *rateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, wait := l.allow(clientIP(r)); !ok {
+				writeRateLimited(w, wait, "too many requests from the client IP")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientIP returns the IP of the client of the request, the remote address
+// without its port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeRateLimited writes the ErrTooManyRequests error, with the seconds to
+// wait before retrying in the Retry-After header.
+func writeRateLimited(w http.ResponseWriter, wait time.Duration, reason string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	ErrTooManyRequests.With(reason).Write(w)
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/keystore"
+	stg "github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+// processResults decrypts the results of an ended process with its key. The
+// results of the processes that have not ended are not decrypted, so the
+// partial results are not disclosed.
+// GET /process/{id}/results
+func (a *API) processResults(w http.ResponseWriter, r *http.Request) {
+	pid, ok := processIDParam(w, r)
+	if !ok {
+		return
+	}
+	process, err := a.storage.Process(pid)
+	if err != nil {
+		writeProcessError(w, err)
+		return
+	}
+	if process.Status != stg.ProcessStatusEnded {
+		ErrProcessNotEnded.Withf("the process is %s", process.Status).Write(w)
+		return
+	}
+	results, err := a.storage.Results(pid)
+	if err != nil {
+		ErrGenericInternalServerError.Withf("could not retrieve results: %v", err).Write(w)
+		return
+	}
+	maxValue, err := maxResults(&process.BallotMode, results.Ballots-results.Overwrites)
+	if err != nil {
+		ErrGenericInternalServerError.WithErr(err).Write(w)
+		return
+	}
+	tally, err := keystore.Tally(a.keystore, pid, results.ResultsAdd, results.ResultsSub, maxValue)
+	if err != nil {
+		ErrGenericInternalServerError.WithErr(err).Write(w)
+		return
+	}
+	httpWriteJSON(w, &ResultsResponse{
+		Results:    (*types.BigInt)(tally),
+		Ballots:    results.Ballots,
+		Overwrites: results.Overwrites,
+	})
+}
+
+// maxResults returns the maximum value of the results of the ballots
+// provided: the maximum total cost of a ballot, or its maximum value times
+// the number of fields if the cost is not limited, for each ballot.
+func maxResults(mode *types.BallotMode, ballots uint64) (uint64, error) {
+	perBallot := mode.MaxTotalCost.MathBigInt()
+	if perBallot.Sign() == 0 {
+		perBallot = new(big.Int).Mul(mode.MaxValue.MathBigInt(), big.NewInt(int64(mode.MaxCount)))
+	}
+	maxValue := new(big.Int).Mul(perBallot, new(big.Int).SetUint64(ballots))
+	if !maxValue.IsUint64() {
+		return 0, fmt.Errorf("the results may exceed the decryption range: %s", maxValue)
+	}
+	return maxValue.Uint64(), nil
+}
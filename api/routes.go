@@ -3,6 +3,52 @@ package api
 const (
 	// ProcessEndpoint is the endpoint for creating a new voting process
 	ProcessEndpoint = "/process"
+	// ProcessesEndpoint is the endpoint for listing the voting processes
+	ProcessesEndpoint = "/processes"
+	// BallotsEndpoint is the endpoint for submitting the ballots of a process
+	BallotsEndpoint = "/process/{id}/ballots"
+	// BallotStatusEndpoint is the endpoint for the status of the ballot of a nullifier
+	BallotStatusEndpoint = "/process/{id}/ballots/{nullifier}"
+	// ProcessResultsEndpoint is the endpoint for the results of an ended process
+	ProcessResultsEndpoint = "/process/{id}/results"
+	// ProcessCensusEndpoint is the endpoint for the census of a process
+	ProcessCensusEndpoint = "/process/{id}/census"
+	// ProcessQueueEndpoint is the endpoint for the queue statistics of a process
+	ProcessQueueEndpoint = "/process/{id}/queue"
+	// AdminChallengeEndpoint is the endpoint for the challenge signed by the admins to log in
+	AdminChallengeEndpoint = "/admin/challenge"
+	// AdminLoginEndpoint is the endpoint for the admins to log in with a signed challenge
+	AdminLoginEndpoint = "/admin/login"
+	// AdminQueuesEndpoint is the endpoint for the queue statistics of all the processes
+	AdminQueuesEndpoint = "/admin/queues"
+	// AdminProcessCancelEndpoint is the endpoint for canceling a process
+	AdminProcessCancelEndpoint = "/admin/process/{id}/cancel"
+	// AdminProcessKeyEndpoint is the endpoint for exporting the encryption keys of a process
+	AdminProcessKeyEndpoint = "/admin/process/{id}/key"
+	// AdminAuditLogEndpoint is the endpoint for listing the audit log of the admin actions
+	AdminAuditLogEndpoint = "/admin/audit"
+	// OrganizerNonceEndpoint is the endpoint for the next nonce of an organizer
+	OrganizerNonceEndpoint = "/organizers/{address}/nonce"
+	// MetadataEndpoint is the endpoint for uploading the metadata of a process
+	MetadataEndpoint = "/metadata"
+	// MetadataHashEndpoint is the endpoint for retrieving metadata by its hash
+	MetadataHashEndpoint = "/metadata/{hash}"
+	// MetricsEndpoint is the endpoint for the Prometheus metrics
+	MetricsEndpoint = "/metrics"
 	// PingEndpoint is the endpoint for checking the API status
 	PingEndpoint = "/ping"
+	// DeadLettersEndpoint is the endpoint for listing the dead letters
+	DeadLettersEndpoint = "/admin/deadletters"
+	// DeadLetterEndpoint is the endpoint for inspecting or purging a dead letter
+	DeadLetterEndpoint = "/admin/deadletters/{id}"
+	// DeadLetterRequeueEndpoint is the endpoint for requeuing a dead letter
+	DeadLetterRequeueEndpoint = "/admin/deadletters/{id}/requeue"
+	// WorkerLeaseEndpoint is the endpoint for the workers to lease a job
+	WorkerLeaseEndpoint = "/workers/lease"
+	// WorkerHeartbeatEndpoint is the endpoint for the workers to extend the lease of a job
+	WorkerHeartbeatEndpoint = "/workers/heartbeat"
+	// WorkerCompleteEndpoint is the endpoint for the workers to submit the result of a job
+	WorkerCompleteEndpoint = "/workers/complete"
+	// WorkerFailEndpoint is the endpoint for the workers to report a failed job
+	WorkerFailEndpoint = "/workers/fail"
 )
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ethereum"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+const (
+	// SignatureDomainName is the name of the EIP-712 domain of the
+	// signatures of the API.
+	SignatureDomainName = "vocdoni-z-sandbox"
+	// SignatureDomainVersion is the version of the EIP-712 domain of the
+	// signatures of the API.
+	SignatureDomainVersion = "1"
+)
+
+// SignatureDomain returns the EIP-712 domain of the signatures of the API on
+// the chain provided.
+func SignatureDomain(chainID uint32) apitypes.TypedDataDomain {
+	return ethereum.TypedDataDomain(SignatureDomainName, SignatureDomainVersion, uint64(chainID))
+}
+
+// TypedData returns the EIP-712 typed data signed by the organizer to create
+// the process, which covers all its parameters. The chain ID is part of the
+// domain (see SignatureDomain). The overwrite policy is only part of the
+// message if the process has one.
+func (p *Process) TypedData() *apitypes.TypedData {
+	data := &apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": ethereum.TypedDataDomainTypes,
+			"NewProcess": {
+				{Name: "nonce", Type: "uint64"},
+				{Name: "censusRoot", Type: "bytes"},
+				{Name: "ballotMode", Type: "BallotMode"},
+				{Name: "metadataHash", Type: "bytes"},
+				{Name: "startTime", Type: "uint64"},
+				{Name: "endTime", Type: "uint64"},
+			},
+			"BallotMode": {
+				{Name: "maxCount", Type: "uint8"},
+				{Name: "forceUniqueness", Type: "bool"},
+				{Name: "maxValue", Type: "uint256"},
+				{Name: "minValue", Type: "uint256"},
+				{Name: "maxTotalCost", Type: "uint256"},
+				{Name: "minTotalCost", Type: "uint256"},
+				{Name: "costExponent", Type: "uint8"},
+				{Name: "costFromWeight", Type: "bool"},
+			},
+		},
+		PrimaryType: "NewProcess",
+		Domain:      SignatureDomain(p.ChainID),
+		Message: apitypes.TypedDataMessage{
+			"nonce":        new(big.Int).SetUint64(p.Nonce),
+			"censusRoot":   []byte(p.CensusRoot),
+			"ballotMode":   ballotModeTypedData(&p.BallotMode),
+			"metadataHash": []byte(p.MetadataHash),
+			"startTime":    new(big.Int).SetUint64(p.StartTime),
+			"endTime":      new(big.Int).SetUint64(p.EndTime),
+		},
+	}
+	if p.OverwritePolicy != nil {
+		data.Types["NewProcess"] = append(data.Types["NewProcess"], apitypes.Type{Name: "overwritePolicy", Type: "OverwritePolicy"})
+		data.Types["OverwritePolicy"] = []apitypes.Type{
+			{Name: "rejectQueued", Type: "bool"},
+			{Name: "maxOverwrites", Type: "uint32"},
+		}
+		data.Message["overwritePolicy"] = map[string]any{
+			"rejectQueued":  p.OverwritePolicy.RejectQueued,
+			"maxOverwrites": new(big.Int).SetUint64(uint64(p.OverwritePolicy.MaxOverwrites)),
+		}
+	}
+	return data
+}
+
+func ballotModeTypedData(bm *types.BallotMode) map[string]any {
+	return map[string]any{
+		"maxCount":        new(big.Int).SetUint64(uint64(bm.MaxCount)),
+		"forceUniqueness": bm.ForceUniqueness,
+		"maxValue":        bm.MaxValue.MathBigInt(),
+		"minValue":        bm.MinValue.MathBigInt(),
+		"maxTotalCost":    bm.MaxTotalCost.MathBigInt(),
+		"minTotalCost":    bm.MinTotalCost.MathBigInt(),
+		"costExponent":    new(big.Int).SetUint64(uint64(bm.CostExponent)),
+		"costFromWeight":  bm.CostFromWeight,
+	}
+}
+
+// Sign sets the signature of the process by the organizer. The ballot mode
+// of the preset, if there is one, is set before signing it (see
+// ResolveBallotMode).
+func (p *Process) Sign(signer *ethereum.SignKeys) error {
+	if err := p.ResolveBallotMode(); err != nil {
+		return err
+	}
+	signature, err := signer.SignTypedData(p.TypedData())
+	if err != nil {
+		return fmt.Errorf("could not sign process: %w", err)
+	}
+	p.Signature = signature
+	return nil
+}
+
+// SignerAddress returns the address of the organizer that signed the process.
+func (p *Process) SignerAddress() (common.Address, error) {
+	return ethereum.AddrFromTypedDataSignature(p.TypedData(), p.Signature)
+}
+
+// ResolveBallotMode sets the ballot mode of the preset of the process, if it
+// has one. A ballot mode provided with the preset must be the same.
+func (p *Process) ResolveBallotMode() error {
+	if p.BallotPreset == nil {
+		return nil
+	}
+	bm, err := p.BallotPreset.BallotMode()
+	if err != nil {
+		return err
+	}
+	if p.BallotMode.MaxCount != 0 {
+		got, err := p.BallotMode.Marshal()
+		if err != nil {
+			return err
+		}
+		want, err := bm.Marshal()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("the ballot mode does not match the %s preset", p.BallotPreset.Name)
+		}
+	}
+	p.BallotMode = *bm
+	return nil
+}
+
+// CheckTimes checks that the voting period of the process, if it is defined,
+// ends after it starts.
+func (p *Process) CheckTimes() error {
+	if p.EndTime != 0 && p.EndTime <= p.StartTime {
+		return fmt.Errorf("end time %s is not after start time %s",
+			time.Unix(int64(p.EndTime), 0).UTC(), time.Unix(int64(p.StartTime), 0).UTC())
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/vocdoni/vocdoni-z-sandbox/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingMiddleware traces the requests, continuing the trace context of
+// their headers, so the logs of the handlers written with the request
+// context (like log.InfowCtx) can be matched with the traces. It runs after
+// metricsMiddleware, whose writer records the status of the response.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+		next.ServeHTTP(w, r.WithContext(ctx))
+
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			span.SetName(r.Method + " " + rctx.RoutePattern())
+			span.SetAttributes(attribute.String("http.route", rctx.RoutePattern()))
+		}
+		mw, ok := w.(*metricsWriter)
+		if !ok || mw.status == 0 {
+			return
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", mw.status))
+		if mw.errorCode != 0 {
+			span.SetAttributes(attribute.Int("vocdoni.error.code", mw.errorCode))
+		}
+		if mw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, strconv.Itoa(mw.status))
+		}
+	})
+}
@@ -1,14 +1,37 @@
 package api
 
-import "github.com/vocdoni/vocdoni-z-sandbox/types"
+import (
+	"time"
+
+	stg "github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
 
 // Process is the struct to create a new voting process
 type Process struct {
 	CensusRoot types.HexBytes   `json:"censusRoot"`
 	BallotMode types.BallotMode `json:"ballotRules"`
-	Nonce      uint64           `json:"nonce"`
-	ChainID    uint32           `json:"chainId"`
-	Signature  []byte           `json:"signature"`
+	// BallotPreset is the name and parameters of a ballot mode preset, which
+	// produces the ballot mode of the process (see ResolveBallotMode). It is
+	// optional.
+	BallotPreset *types.BallotModePreset `json:"ballotPreset,omitempty"`
+	Nonce        uint64                  `json:"nonce"`
+	ChainID      uint32                  `json:"chainId"`
+	// Signature is the EIP-712 signature of the process by the organizer
+	// (see Process.TypedData). The nonce must not be lower than the next
+	// nonce of the organizer (see OrganizerNonceEndpoint).
+	Signature []byte `json:"signature"`
+	// MetadataHash is the hash of the metadata of the process, uploaded
+	// before creating it (see MetadataEndpoint). It is optional.
+	MetadataHash types.HexBytes `json:"metadataHash,omitempty"`
+	// StartTime and EndTime are the voting period of the process, as unix
+	// timestamps. They are optional.
+	StartTime uint64 `json:"startTime,omitempty"`
+	EndTime   uint64 `json:"endTime,omitempty"`
+	// OverwritePolicy defines how the ballots that reuse a nullifier are
+	// handled, see storage.OverwritePolicy. It is optional, the processes
+	// without one use the policy of the node.
+	OverwritePolicy *stg.OverwritePolicy `json:"overwritePolicy,omitempty"`
 }
 
 // ProcessResponse represents the response of a voting process
@@ -19,4 +42,148 @@ type ProcessResponse struct {
 	ChainID          uint32          `json:"chainId,omitempty"`
 	Nonce            uint64          `json:"nonce,omitempty"`
 	Address          string          `json:"address,omitempty"`
+	MetadataHash     types.HexBytes  `json:"metadataHash,omitempty"`
+	// BallotMode is the ballot mode of the process, and BallotPreset the
+	// preset it matches, or the custom preset if there is none.
+	BallotMode   *types.BallotMode       `json:"ballotRules,omitempty"`
+	BallotPreset *types.BallotModePreset `json:"ballotPreset,omitempty"`
+	Status       stg.ProcessStatus       `json:"status,omitempty"`
+	CreatedAt    *time.Time              `json:"createdAt,omitempty"`
+	StartTime    *time.Time              `json:"startTime,omitempty"`
+	EndTime      *time.Time              `json:"endTime,omitempty"`
+	// OverwritePolicy is the overwrite policy applied to the ballots of the
+	// process, its own or the policy of the node.
+	OverwritePolicy *stg.OverwritePolicy `json:"overwritePolicy,omitempty"`
+}
+
+// OrganizerNonceResponse is the next nonce of an organizer, which is the
+// lowest nonce of the next process it can create
+type OrganizerNonceResponse struct {
+	Address string `json:"address"`
+	Nonce   uint64 `json:"nonce"`
+}
+
+// ProcessesResponse is a page of the processes listed, and the cursor of the
+// next page, which is empty if it is the last one
+type ProcessesResponse struct {
+	Processes  []*ProcessResponse `json:"processes"`
+	NextCursor types.HexBytes     `json:"nextCursor,omitempty"`
+}
+
+// BallotRequest is a ballot submitted to a process, encoded as a storage
+// artifact (see storage.EncodeArtifact).
+type BallotRequest struct {
+	Ballot types.HexBytes `json:"ballot"`
+}
+
+// BallotStatusResponse is the status of the current ballot of a nullifier
+type BallotStatusResponse struct {
+	Nullifier types.HexBytes   `json:"nullifier"`
+	Status    stg.BallotStatus `json:"status"`
+}
+
+// ResultsResponse is the decrypted results of an ended process, and the
+// number of ballots counted and overwritten
+type ResultsResponse struct {
+	Results    *types.BigInt `json:"results"`
+	Ballots    uint64        `json:"ballots"`
+	Overwrites uint64        `json:"overwrites"`
+}
+
+// CensusResponse is the census of a process: the root of its census tree and
+// the maximum number of levels of the census proofs
+type CensusResponse struct {
+	Root   types.HexBytes `json:"root"`
+	Levels int            `json:"levels"`
+}
+
+// MetadataResponse is the hash of the metadata uploaded, used to retrieve
+// it and to reference it from the process
+type MetadataResponse struct {
+	Hash types.HexBytes `json:"hash"`
+}
+
+// DeadLettersResponse is the list of the queue items that could not be processed
+type DeadLettersResponse struct {
+	DeadLetters []*stg.DeadLetter `json:"deadLetters"`
+}
+
+// QueuesResponse is the queue statistics of all the processes, and of each
+// process with queued items or dead letters, by hex encoded process ID
+type QueuesResponse struct {
+	Total     *stg.QueueStats            `json:"total"`
+	Processes map[string]*stg.QueueStats `json:"processes"`
+}
+
+// AdminChallengeResponse is the challenge to be signed by an admin address
+// to log in, and when it expires
+type AdminChallengeResponse struct {
+	Challenge string    `json:"challenge"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// AdminLoginRequest is the challenge signed by an admin address (see
+// ethereum.SignKeys.SignEthereum)
+type AdminLoginRequest struct {
+	Challenge string         `json:"challenge"`
+	Signature types.HexBytes `json:"signature"`
+}
+
+// AdminLoginResponse is the bearer token of the admin session, its role and
+// when it expires
+type AdminLoginResponse struct {
+	Token     string    `json:"token"`
+	Role      AdminRole `json:"role"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// KeyExportRequest is the key used to seal the private key of the exported
+// encryption keys of a process
+type KeyExportRequest struct {
+	BackupKey types.HexBytes `json:"backupKey"`
+}
+
+// KeyExportResponse is the backup of the encryption keys of a process, which
+// can be restored with storage.ImportKey and the same backup key
+type KeyExportResponse struct {
+	Backup types.HexBytes `json:"backup"`
+}
+
+// AuditLogResponse is a page of the audit log of the admin actions, and the
+// cursor of the next page, which is empty if it is the last one
+type AuditLogResponse struct {
+	Entries    []*stg.AuditEntry `json:"entries"`
+	NextCursor types.HexBytes    `json:"nextCursor,omitempty"`
+}
+
+// WorkerLeaseRequest is the request of a worker to lease a job of a
+// processing stage. The process ID is required by the verified ballot and
+// aggregated batch stages, and MaxCount limits the number of verified
+// ballots of the job.
+type WorkerLeaseRequest struct {
+	Stage     string         `json:"stage"`
+	ProcessID types.HexBytes `json:"processId,omitempty"`
+	MaxCount  int            `json:"maxCount,omitempty"`
+}
+
+// WorkerJob is a job leased by a worker. It contains the keys of the queue
+// items leased, their encoded artifacts (see storage.EncodeArtifact) and
+// their trace contexts (see tracing.Inject), in the same order.
+type WorkerJob struct {
+	Stage         string              `json:"stage"`
+	Keys          []types.HexBytes    `json:"keys"`
+	Artifacts     []types.HexBytes    `json:"artifacts"`
+	TraceContexts []map[string]string `json:"traceContexts,omitempty"`
+}
+
+// WorkerJobUpdate is sent by a worker to extend the lease of a job, to
+// complete it with its encoded result, or to report that it failed. The
+// duration is the time the worker spent processing the job, which the
+// sequencer exports as a metric of the stage.
+type WorkerJobUpdate struct {
+	Stage    string           `json:"stage"`
+	Keys     []types.HexBytes `json:"keys"`
+	Result   types.HexBytes   `json:"result,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	Duration time.Duration    `json:"duration,omitempty"`
 }
@@ -0,0 +1,261 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	"github.com/vocdoni/vocdoni-z-sandbox/metrics"
+	stg "github.com/vocdoni/vocdoni-z-sandbox/storage"
+)
+
+// workerIDKey is the request context key of the authenticated worker ID.
+type workerIDKey struct{}
+
+// workerAuth is the middleware that authenticates the workers by the bearer
+// token of the request, and stores their ID in the request context.
+func (a *API) workerAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			ErrInvalidWorkerToken.With("missing bearer token").Write(w)
+			return
+		}
+		var workerID string
+		for t, id := range a.workerTokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				workerID = id
+			}
+		}
+		if workerID == "" {
+			ErrInvalidWorkerToken.Write(w)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), workerIDKey{}, workerID)))
+	})
+}
+
+// workerID returns the ID of the worker authenticated by workerAuth.
+func workerID(r *http.Request) string {
+	id, _ := r.Context().Value(workerIDKey{}).(string)
+	return id
+}
+
+// leaseJob reserves the next job of a processing stage for the worker. If
+// there are no jobs available, it responds with no content. The items of the
+// processes that have ended or were canceled are not leased.
+// POST /workers/lease
+func (a *API) leaseJob(w http.ResponseWriter, r *http.Request) {
+	req := &WorkerLeaseRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		ErrMalformedBody.Withf("could not decode request body: %v", err).Write(w)
+		return
+	}
+	worker := workerID(r)
+	job := &WorkerJob{Stage: req.Stage}
+	var err error
+	switch req.Stage {
+	case stg.StageBallot:
+		var b *stg.Ballot
+		var k []byte
+		if b, k, err = a.storage.NextBallotForWorker(worker); err == nil {
+			err = addToJob(job, k, b)
+		}
+	case stg.StageVerifiedBallot:
+		if len(req.ProcessID) == 0 || req.MaxCount <= 0 {
+			ErrMalformedJob.With("missing process ID or max count").Write(w)
+			return
+		}
+		var vbs []*stg.VerifiedBallot
+		var keys [][]byte
+		if vbs, keys, err = a.storage.PullVerifiedBallotsForWorker(req.ProcessID, req.MaxCount, worker); err == nil {
+			for i := range vbs {
+				if err = addToJob(job, keys[i], vbs[i]); err != nil {
+					break
+				}
+			}
+		}
+	case stg.StageBallotBatch:
+		if len(req.ProcessID) == 0 {
+			ErrMalformedJob.With("missing process ID").Write(w)
+			return
+		}
+		var abb *stg.AggregatedBallotBatch
+		var k []byte
+		if abb, k, err = a.storage.NextBallotBatchForWorker(req.ProcessID, worker); err == nil {
+			err = addToJob(job, k, abb)
+		}
+	default:
+		ErrMalformedJob.Withf("unknown stage %q", req.Stage).Write(w)
+		return
+	}
+	if errors.Is(err, stg.ErrNoMoreElements) || errors.Is(err, stg.ErrNotFound) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if errors.Is(err, stg.ErrProcessClosed) {
+		ErrProcessClosed.WithErr(err).Write(w)
+		return
+	}
+	if err != nil {
+		ErrGenericInternalServerError.Withf("could not lease job: %v", err).Write(w)
+		return
+	}
+	log.DebugwCtx(r.Context(), "job leased", "worker", worker, "stage", job.Stage, "items", len(job.Keys))
+	httpWriteJSON(w, job)
+}
+
+// addToJob appends a leased item and its encoded artifact to the job.
+func addToJob[T stg.Artifact](job *WorkerJob, key []byte, artifact *T) error {
+	data, err := stg.EncodeArtifact(artifact)
+	if err != nil {
+		return err
+	}
+	job.Keys = append(job.Keys, key)
+	job.Artifacts = append(job.Artifacts, data)
+	job.TraceContexts = append(job.TraceContexts, stg.ArtifactTraceContext(artifact))
+	return nil
+}
+
+// jobUpdate decodes the job update of the request. If it is not valid, the
+// error is written to the response and nil is returned. The storage checks
+// that the items are leased by the worker when they are updated, so the
+// lease cannot change between the check and the update.
+func (a *API) jobUpdate(w http.ResponseWriter, r *http.Request) *WorkerJobUpdate {
+	update := &WorkerJobUpdate{}
+	if err := json.NewDecoder(r.Body).Decode(update); err != nil {
+		ErrMalformedBody.Withf("could not decode request body: %v", err).Write(w)
+		return nil
+	}
+	if len(update.Keys) == 0 {
+		ErrMalformedJob.With("missing job keys").Write(w)
+		return nil
+	}
+	switch update.Stage {
+	case stg.StageBallot, stg.StageVerifiedBallot, stg.StageBallotBatch:
+		return update
+	default:
+		ErrMalformedJob.Withf("unknown stage %q", update.Stage).Write(w)
+		return nil
+	}
+}
+
+// heartbeat extends the lease of a job, so it is not released as stale while
+// the worker is processing it.
+// POST /workers/heartbeat
+func (a *API) heartbeat(w http.ResponseWriter, r *http.Request) {
+	update := a.jobUpdate(w, r)
+	if update == nil {
+		return
+	}
+	extend := map[string]func([]byte, string) error{
+		stg.StageBallot:         a.storage.ExtendBallotReservation,
+		stg.StageVerifiedBallot: a.storage.ExtendVerifiedBallotReservation,
+		stg.StageBallotBatch:    a.storage.ExtendBallotBatchReservation,
+	}[update.Stage]
+	for _, k := range update.Keys {
+		if err := extend(k, workerID(r)); err != nil {
+			writeLeaseError(w, err)
+			return
+		}
+	}
+	httpWriteOK(w)
+}
+
+// completeJob moves the items of a job to the next stage with the result
+// computed by the worker: a verified ballot for a ballot, and an aggregated
+// batch for verified ballots. The aggregated batches need no result. The
+// result must match the items leased, see storage.ErrResultMismatch.
+// POST /workers/complete
+func (a *API) completeJob(w http.ResponseWriter, r *http.Request) {
+	update := a.jobUpdate(w, r)
+	if update == nil {
+		return
+	}
+	switch update.Stage {
+	case stg.StageBallot:
+		if len(update.Keys) != 1 {
+			ErrMalformedJob.With("a ballot job has a single key").Write(w)
+			return
+		}
+		vb, err := stg.DecodeArtifact[stg.VerifiedBallot](update.Result)
+		if err != nil {
+			ErrMalformedJob.Withf("could not decode verified ballot: %v", err).Write(w)
+			return
+		}
+		if err := a.storage.MarkBallotDoneForWorker(update.Keys[0], workerID(r), vb); err != nil {
+			writeLeaseError(w, err)
+			return
+		}
+	case stg.StageVerifiedBallot:
+		abb, err := stg.DecodeArtifact[stg.AggregatedBallotBatch](update.Result)
+		if err != nil {
+			ErrMalformedJob.Withf("could not decode aggregated batch: %v", err).Write(w)
+			return
+		}
+		keys := make([][]byte, len(update.Keys))
+		for i, k := range update.Keys {
+			keys[i] = k
+		}
+		if err := a.storage.MarkVerifiedBallotsDoneForWorker(keys, workerID(r), abb); err != nil {
+			writeLeaseError(w, err)
+			return
+		}
+	case stg.StageBallotBatch:
+		for _, k := range update.Keys {
+			if err := a.storage.MarkBallotBatchDoneForWorker(k, workerID(r)); err != nil {
+				writeLeaseError(w, err)
+				return
+			}
+		}
+	}
+	observeProving(update, false)
+	log.DebugwCtx(r.Context(), "job completed", "worker", workerID(r), "stage", update.Stage, "items", len(update.Keys))
+	httpWriteOK(w)
+}
+
+// failJob reports that a job failed, so its items are retried later or moved
+// to the dead letters.
+// POST /workers/fail
+func (a *API) failJob(w http.ResponseWriter, r *http.Request) {
+	update := a.jobUpdate(w, r)
+	if update == nil {
+		return
+	}
+	cause := errors.New(update.Error)
+	for _, k := range update.Keys {
+		if err := a.storage.MarkFailedForWorker(update.Stage, k, workerID(r), cause); err != nil {
+			writeLeaseError(w, err)
+			return
+		}
+	}
+	observeProving(update, true)
+	log.WarnwCtx(r.Context(), "job failed", "worker", workerID(r), "stage", update.Stage, "keys", update.Keys, "error", update.Error)
+	httpWriteOK(w)
+}
+
+// observeProving exports the time the worker spent processing the job, if
+// it was reported.
+func observeProving(update *WorkerJobUpdate, failed bool) {
+	if update.Duration > 0 {
+		metrics.ObserveProving(update.Stage, update.Duration, failed)
+	}
+}
+
+// writeLeaseError writes the API error matching a reservation storage error.
+func writeLeaseError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, stg.ErrNotFound):
+		ErrLeaseNotFound.WithErr(err).Write(w)
+	case errors.Is(err, stg.ErrNotReservationOwner):
+		ErrLeaseNotOwned.WithErr(err).Write(w)
+	case errors.Is(err, stg.ErrUnknownStage), errors.Is(err, stg.ErrResultMismatch):
+		ErrMalformedJob.WithErr(err).Write(w)
+	default:
+		ErrGenericInternalServerError.WithErr(err).Write(w)
+	}
+}
@@ -0,0 +1,190 @@
+// Package ballot builds the ballots of the voters: it encrypts the choices
+// with the encryption key of the process, computes the commitment and
+// nullifier of the voter, generates the ballot proof with the circom circuit
+// and signs its inputs with the key of the voter. It is meant for the native
+// clients and load generators, which need valid ballots without depending on
+// the test helpers of the circuits.
+package ballot
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/elgamal"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ethereum"
+	"github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+const (
+	// NumFields is the number of fields of the ballots of the circuit, the
+	// maximum number of choices of a ballot.
+	NumFields = types.MaxBallotFields
+	// SecretSize is the size of the secrets generated by NewSecret.
+	SecretSize = 16
+)
+
+// Process describes the process the ballot is cast in.
+type Process struct {
+	ID            types.ProcessID
+	BallotMode    types.BallotMode
+	EncryptionKey ecc.Point
+}
+
+// CensusProof is the proof that the voter is part of the census of the
+// process, with the weight of its vote.
+type CensusProof struct {
+	Root     types.HexBytes
+	Weight   *big.Int
+	Siblings []types.HexBytes
+}
+
+// Params are the inputs of a ballot.
+type Params struct {
+	Process *Process
+	// Voter is the key of the voter, whose address is its census key.
+	Voter  *ethereum.SignKeys
+	Census *CensusProof
+	// Secret is the secret of the voter in the process, which derives its
+	// commitment and nullifier. The same secret must be used to overwrite
+	// a vote (see NewSecret).
+	Secret []byte
+	// Choices are the values of the fields of the ballot. The circuit
+	// encrypts and checks the first MaxCount fields of the ballot mode, the
+	// missing ones are zero.
+	Choices []*big.Int
+	// K is the randomness of the encryption, a random one is used if nil.
+	K *big.Int
+}
+
+// Ballot is a ballot ready to be submitted: the encrypted fields, the
+// commitment and nullifier of the voter, the ballot proof, the signature of
+// its inputs and the census proof.
+type Ballot struct {
+	ProcessID types.HexBytes `json:"processId"`
+	Address   types.HexBytes `json:"address"`
+	Weight    *big.Int       `json:"weight"`
+	// EncryptedFields are the first MaxCount encrypted fields, the padding
+	// fields of the circuit are not included.
+	EncryptedFields []*elgamal.Ciphertext `json:"encryptedFields"`
+	Nullifier       types.HexBytes        `json:"nullifier"`
+	Commitment      types.HexBytes        `json:"commitment"`
+	// InputsHash is the hash of the public inputs of the ballot proof, and
+	// Signature is the signature of the voter of its value in the scalar
+	// field of BLS12-377 (see SignatureHash).
+	InputsHash  types.HexBytes      `json:"inputsHash"`
+	Proof       storage.CircomProof `json:"proof"`
+	Signature   types.HexBytes      `json:"signature"`
+	CensusProof storage.CensusProof `json:"censusProof"`
+}
+
+// NewSecret returns a random secret for a voter.
+func NewSecret() ([]byte, error) {
+	secret := make([]byte, SecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("could not generate secret: %w", err)
+	}
+	return secret, nil
+}
+
+// Build returns the ballot of the params provided, proven by the prover. The
+// choices are checked against the ballot mode of the process before proving
+// them.
+func Build(params *Params, prover Prover) (*Ballot, error) {
+	inputs, err := NewInputs(params)
+	if err != nil {
+		return nil, err
+	}
+	data, err := inputs.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	rawProof, _, err := prover.Prove(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate ballot proof: %w", err)
+	}
+	var proof storage.CircomProof
+	if err := json.Unmarshal([]byte(rawProof), &proof); err != nil {
+		return nil, fmt.Errorf("could not decode ballot proof: %w", err)
+	}
+	signature, err := ethcrypto.Sign(SignatureHash(inputs.Hash), &params.Voter.Private)
+	if err != nil {
+		return nil, fmt.Errorf("could not sign ballot: %w", err)
+	}
+	return &Ballot{
+		ProcessID:       params.Process.ID.Marshal(),
+		Address:         params.Voter.Address().Bytes(),
+		Weight:          new(big.Int).Set(params.Census.Weight),
+		EncryptedFields: inputs.EncryptedFields,
+		Nullifier:       inputs.Nullifier.Bytes(),
+		Commitment:      inputs.Commitment.Bytes(),
+		InputsHash:      inputs.Hash.Bytes(),
+		Proof:           proof,
+		Signature:       signature,
+		CensusProof: storage.CensusProof{
+			Root:     params.Census.Root,
+			Siblings: params.Census.Siblings,
+		},
+	}, nil
+}
+
+// StorageBallot returns the ballot in the format submitted to the
+// sequencer (see api.BallotRequest). The sequencer ballots hold a single
+// encrypted field, so only the ballots of the ballot modes with MaxCount 1
+// can be converted.
+func (b *Ballot) StorageBallot() (*storage.Ballot, error) {
+	if len(b.EncryptedFields) != 1 {
+		return nil, fmt.Errorf("the sequencer ballots have a single encrypted field, the ballot has %d",
+			len(b.EncryptedFields))
+	}
+	return &storage.Ballot{
+		ProcessID:        b.ProcessID,
+		VoterWeight:      new(big.Int).Set(b.Weight),
+		EncryptedBallot:  *b.EncryptedFields[0],
+		Nullifier:        b.Nullifier,
+		Commitment:       b.Commitment,
+		Address:          b.Address,
+		BallotInputsHash: b.InputsHash,
+		BallotProof:      b.Proof,
+		Signature:        b.Signature,
+		CensusProof:      b.CensusProof,
+	}, nil
+}
+
+// check returns an error if the params are incomplete, or if the choices are
+// not valid for the ballot mode of the process.
+func (p *Params) check() error {
+	switch {
+	case p.Process == nil || p.Process.EncryptionKey == nil:
+		return fmt.Errorf("missing process encryption key")
+	case p.Voter == nil || p.Voter.Private.D == nil:
+		return fmt.Errorf("missing voter private key")
+	case len(p.Secret) == 0:
+		return fmt.Errorf("missing voter secret")
+	case p.Census == nil || len(p.Census.Root) == 0:
+		return fmt.Errorf("missing census proof")
+	case p.Census.Weight == nil || p.Census.Weight.Sign() <= 0:
+		return fmt.Errorf("invalid census weight %v", p.Census.Weight)
+	}
+	if err := types.CheckCensusSiblings(len(p.Census.Siblings)); err != nil {
+		return err
+	}
+	if err := p.Process.BallotMode.Validate(); err != nil {
+		return fmt.Errorf("invalid ballot mode: %w", err)
+	}
+	return p.Process.BallotMode.CheckVote(p.Choices, p.Census.Weight)
+}
+
+// fields returns the choices padded with zeros up to MaxCount.
+func (p *Params) fields() []*big.Int {
+	fields := make([]*big.Int, 0, max(len(p.Choices), int(p.Process.BallotMode.MaxCount)))
+	fields = append(fields, p.Choices...)
+	for len(fields) < int(p.Process.BallotMode.MaxCount) {
+		fields = append(fields, big.NewInt(0))
+	}
+	return fields
+}
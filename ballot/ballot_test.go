@@ -0,0 +1,261 @@
+package ballot
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/curves"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/elgamal"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ethereum"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+const (
+	ballotProofWasm = "../circuits/assets/circom/circuit/ballot_proof.wasm"
+	// ballotModeVectors are the test vectors of the ballot mode rules of the
+	// types package.
+	ballotModeVectors = "../types/testdata/ballotmode_vectors.json"
+)
+
+// testProof is a proof with the format of the rapidsnark proofs.
+const testProof = `{"pi_a":["1","2","1"],"pi_b":[["1","2"],["3","4"],["1","0"]],"pi_c":["5","6","1"],"protocol":"groth16"}`
+
+// proverFunc adapts a function to the Prover interface.
+type proverFunc func(inputs []byte) (string, string, error)
+
+func (f proverFunc) Prove(inputs []byte) (string, string, error) {
+	return f(inputs)
+}
+
+// testParams returns the params of a ballot with 5 choices between 0 and 16
+// whose cost is their sum of squares, and the private encryption key.
+func testParams(c *qt.C) (*Params, *big.Int) {
+	publicKey, privateKey, err := elgamal.GenerateKey(curves.New(curves.CurveTypeBabyJubJubGnark))
+	c.Assert(err, qt.IsNil)
+	voter := ethereum.NewSignKeys()
+	c.Assert(voter.Generate(), qt.IsNil)
+	secret, err := NewSecret()
+	c.Assert(err, qt.IsNil)
+	bm := types.BallotMode{
+		MaxCount:     5,
+		MaxValue:     *new(types.BigInt).SetBytes(big.NewInt(16).Bytes()),
+		MaxTotalCost: *new(types.BigInt).SetBytes(big.NewInt(16 * 16 * 5).Bytes()),
+		MinTotalCost: *new(types.BigInt).SetBytes(big.NewInt(5).Bytes()),
+		CostExponent: 2,
+	}
+	return &Params{
+		Process: &Process{
+			ID:            types.ProcessID{Address: common.Address{1}, Nonce: 1, ChainID: 1},
+			BallotMode:    bm,
+			EncryptionKey: publicKey,
+		},
+		Voter: voter,
+		Census: &CensusProof{
+			Root:     []byte{1},
+			Weight:   big.NewInt(10),
+			Siblings: []types.HexBytes{{2}, {3}},
+		},
+		Secret:  secret,
+		Choices: []*big.Int{big.NewInt(1), big.NewInt(0), big.NewInt(15), big.NewInt(3), big.NewInt(3)},
+	}, privateKey
+}
+
+func TestBuild(t *testing.T) {
+	c := qt.New(t)
+	params, privateKey := testParams(c)
+
+	var proven []byte
+	prover := proverFunc(func(inputs []byte) (string, string, error) {
+		proven = inputs
+		return testProof, `["1"]`, nil
+	})
+	b, err := Build(params, prover)
+	c.Assert(err, qt.IsNil)
+	c.Assert(proven, qt.Not(qt.HasLen), 0)
+	c.Assert(b.ProcessID, qt.DeepEquals, types.HexBytes(params.Process.ID.Marshal()))
+	c.Assert(b.Address, qt.DeepEquals, types.HexBytes(params.Voter.Address().Bytes()))
+	c.Assert(b.Proof.Protocol, qt.Equals, "groth16")
+	c.Assert(b.Proof.B, qt.HasLen, 3)
+	c.Assert(b.CensusProof.Siblings, qt.HasLen, 2)
+
+	// The fields decrypt to the choices
+	c.Assert(b.EncryptedFields, qt.HasLen, len(params.Choices))
+	for i, ct := range b.EncryptedFields {
+		_, choice, err := elgamal.Decrypt(params.Process.EncryptionKey, ecc.MustSecretScalar(privateKey), ct.C1, ct.C2, 16)
+		c.Assert(err, qt.IsNil)
+		c.Assert(choice.Cmp(params.Choices[i]), qt.Equals, 0)
+	}
+
+	// The signature of the inputs hash recovers the voter
+	pubKey, err := ethcrypto.SigToPub(SignatureHash(new(big.Int).SetBytes(b.InputsHash)), b.Signature)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ethcrypto.PubkeyToAddress(*pubKey), qt.Equals, params.Voter.Address())
+
+	// The same secret derives the same nullifier, with a new encryption
+	again, err := Build(params, prover)
+	c.Assert(err, qt.IsNil)
+	c.Assert(again.Nullifier, qt.DeepEquals, b.Nullifier)
+	c.Assert(again.Commitment, qt.DeepEquals, b.Commitment)
+	c.Assert(again.EncryptedFields[0].C1.Equal(b.EncryptedFields[0].C1), qt.IsFalse)
+	c.Assert(again.InputsHash, qt.Not(qt.DeepEquals), b.InputsHash)
+
+	// The errors of the prover are returned
+	_, err = Build(params, proverFunc(func([]byte) (string, string, error) {
+		return "", "", errors.New("no proving key")
+	}))
+	c.Assert(err, qt.ErrorMatches, ".*no proving key")
+}
+
+func TestStorageBallot(t *testing.T) {
+	c := qt.New(t)
+	params, _ := testParams(c)
+	prover := proverFunc(func([]byte) (string, string, error) { return testProof, `["1"]`, nil })
+
+	// The ballots of several fields can not be submitted
+	b, err := Build(params, prover)
+	c.Assert(err, qt.IsNil)
+	_, err = b.StorageBallot()
+	c.Assert(err, qt.Not(qt.IsNil))
+
+	// The ballots of a single field are converted with all their inputs
+	params.Process.BallotMode.MaxCount = 1
+	params.Process.BallotMode.MinTotalCost = *new(types.BigInt).SetBytes(big.NewInt(1).Bytes())
+	params.Choices = []*big.Int{big.NewInt(7)}
+	b, err = Build(params, prover)
+	c.Assert(err, qt.IsNil)
+	sb, err := b.StorageBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(sb.ProcessID, qt.DeepEquals, b.ProcessID)
+	c.Assert(sb.Address, qt.DeepEquals, b.Address)
+	c.Assert(sb.VoterWeight.Cmp(params.Census.Weight), qt.Equals, 0)
+	c.Assert(sb.EncryptedBallot.C1.Equal(b.EncryptedFields[0].C1), qt.IsTrue)
+	c.Assert(sb.EncryptedBallot.C2.Equal(b.EncryptedFields[0].C2), qt.IsTrue)
+	c.Assert(sb.Nullifier, qt.DeepEquals, b.Nullifier)
+	c.Assert(sb.Commitment, qt.DeepEquals, b.Commitment)
+	c.Assert(sb.BallotInputsHash, qt.DeepEquals, b.InputsHash)
+	c.Assert(sb.BallotProof, qt.DeepEquals, b.Proof)
+	c.Assert(sb.Signature, qt.DeepEquals, b.Signature)
+	c.Assert(sb.CensusProof, qt.DeepEquals, b.CensusProof)
+}
+
+func TestInvalidParams(t *testing.T) {
+	c := qt.New(t)
+	prover := proverFunc(func([]byte) (string, string, error) {
+		c.Fatal("invalid params proven")
+		return "", "", nil
+	})
+	for _, tc := range []struct {
+		name   string
+		modify func(p *Params)
+	}{
+		{"no encryption key", func(p *Params) { p.Process.EncryptionKey = nil }},
+		{"no voter key", func(p *Params) { p.Voter = ethereum.NewSignKeys() }},
+		{"no secret", func(p *Params) { p.Secret = nil }},
+		{"no census root", func(p *Params) { p.Census.Root = nil }},
+		{"zero weight", func(p *Params) { p.Census.Weight = big.NewInt(0) }},
+		{"too many siblings", func(p *Params) { p.Census.Siblings = make([]types.HexBytes, types.CensusLevels+1) }},
+		{"too many choices", func(p *Params) { p.Choices = append(p.Choices, big.NewInt(1)) }},
+		{"value too high", func(p *Params) { p.Choices[0] = big.NewInt(17) }},
+		{"negative value", func(p *Params) { p.Choices[0] = big.NewInt(-1) }},
+		{"cost too low", func(p *Params) { p.Choices = []*big.Int{big.NewInt(1), big.NewInt(1)} }},
+		{"cost too high", func(p *Params) {
+			p.Process.BallotMode.MaxTotalCost = *new(types.BigInt).SetBytes(big.NewInt(100).Bytes())
+		}},
+		{"cost above weight", func(p *Params) { p.Process.BallotMode.CostFromWeight = true }},
+		{"repeated value", func(p *Params) { p.Process.BallotMode.ForceUniqueness = true }},
+		{"repeated padding", func(p *Params) {
+			p.Process.BallotMode.ForceUniqueness = true
+			p.Choices = []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3)}
+		}},
+		{"cost equal to maximum", func(p *Params) {
+			p.Process.BallotMode.MaxTotalCost = *new(types.BigInt).SetBytes(big.NewInt(244).Bytes())
+		}},
+	} {
+		params, _ := testParams(c)
+		tc.modify(params)
+		_, err := Build(params, prover)
+		c.Assert(err, qt.Not(qt.IsNil), qt.Commentf("params %s", tc.name))
+	}
+}
+
+func TestCircuitWitness(t *testing.T) {
+	c := qt.New(t)
+	wasm, err := os.ReadFile(ballotProofWasm)
+	c.Assert(err, qt.IsNil)
+
+	// The inputs satisfy the constraints of the ballot circuit
+	params, _ := testParams(c)
+	inputs, err := NewInputs(params)
+	c.Assert(err, qt.IsNil)
+	data, err := inputs.MarshalJSON()
+	c.Assert(err, qt.IsNil)
+	prover := &CircomProver{Wasm: wasm}
+	w, err := prover.Witness(data)
+	c.Assert(err, qt.IsNil)
+	c.Assert(w, qt.Not(qt.HasLen), 0)
+
+	// as do the inputs of fewer choices, padded with encrypted zeros
+	params.Choices = params.Choices[:3]
+	inputs, err = NewInputs(params)
+	c.Assert(err, qt.IsNil)
+	c.Assert(inputs.EncryptedFields, qt.HasLen, int(params.Process.BallotMode.MaxCount))
+	data, err = inputs.MarshalJSON()
+	c.Assert(err, qt.IsNil)
+	_, err = prover.Witness(data)
+	c.Assert(err, qt.IsNil)
+
+	// and a tampered inputs hash does not
+	inputs.Circom["inputs_hash"] = "1"
+	data, err = inputs.MarshalJSON()
+	c.Assert(err, qt.IsNil)
+	_, err = prover.Witness(data)
+	c.Assert(err, qt.Not(qt.IsNil))
+}
+
+func TestBallotModeVectors(t *testing.T) {
+	c := qt.New(t)
+	wasm, err := os.ReadFile(ballotProofWasm)
+	c.Assert(err, qt.IsNil)
+	data, err := os.ReadFile(ballotModeVectors)
+	c.Assert(err, qt.IsNil)
+	var vectors struct {
+		Votes []struct {
+			Name       string           `json:"name"`
+			BallotMode types.BallotMode `json:"ballotMode"`
+			Fields     []*types.BigInt  `json:"fields"`
+			Weight     *types.BigInt    `json:"weight"`
+			Valid      bool             `json:"valid"`
+		} `json:"votes"`
+	}
+	c.Assert(json.Unmarshal(data, &vectors), qt.IsNil)
+
+	// The valid votes satisfy the constraints of the circuit, and the
+	// invalid ones are rejected before proving them
+	prover := &CircomProver{Wasm: wasm}
+	for _, tc := range vectors.Votes {
+		params, _ := testParams(c)
+		params.Process.BallotMode = tc.BallotMode
+		params.Census.Weight = tc.Weight.MathBigInt()
+		params.Choices = make([]*big.Int, len(tc.Fields))
+		for i, f := range tc.Fields {
+			params.Choices[i] = f.MathBigInt()
+		}
+		inputs, err := NewInputs(params)
+		if !tc.Valid {
+			c.Assert(err, qt.Not(qt.IsNil), qt.Commentf("vote %s", tc.Name))
+			continue
+		}
+		c.Assert(err, qt.IsNil, qt.Commentf("vote %s", tc.Name))
+		data, err := inputs.MarshalJSON()
+		c.Assert(err, qt.IsNil)
+		_, err = prover.Witness(data)
+		c.Assert(err, qt.IsNil, qt.Commentf("vote %s", tc.Name))
+	}
+}
@@ -0,0 +1,163 @@
+package ballot
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	gecc "github.com/consensys/gnark-crypto/ecc"
+	"github.com/iden3/go-iden3-crypto/mimc7"
+	"github.com/vocdoni/arbo"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/elgamal"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/hash/poseidon"
+	"github.com/vocdoni/vocdoni-z-sandbox/util"
+)
+
+// Inputs are the inputs of the ballot proof circuit, and the values derived
+// from them that are part of the ballot.
+type Inputs struct {
+	// Circom are the inputs of the circom circuit, encoded by MarshalJSON.
+	Circom          map[string]any
+	EncryptedFields []*elgamal.Ciphertext
+	Commitment      *big.Int
+	Nullifier       *big.Int
+	// Hash is the hash of the public inputs, the only public signal of the
+	// circuit.
+	Hash *big.Int
+}
+
+// NewInputs checks the params and computes the inputs of the ballot proof
+// circuit.
+func NewInputs(params *Params) (*Inputs, error) {
+	if err := params.check(); err != nil {
+		return nil, err
+	}
+	k := params.K
+	if k == nil {
+		var err error
+		if k, err = elgamal.RandK(); err != nil {
+			return nil, fmt.Errorf("could not generate encryption randomness: %w", err)
+		}
+	}
+
+	// Encrypt the first MaxCount fields, the rest are zero points
+	choices := params.fields()
+	fields := make([]string, NumFields)
+	cipherfields := make([][][]string, NumFields)
+	plainCipherfields := make([]*big.Int, 0, 4*NumFields)
+	encrypted := make([]*elgamal.Ciphertext, 0, len(choices))
+	for i := range NumFields {
+		if i >= len(choices) {
+			fields[i] = "0"
+			cipherfields[i] = [][]string{{"0", "0"}, {"0", "0"}}
+			plainCipherfields = append(plainCipherfields, big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0))
+			continue
+		}
+		ct, err := elgamal.NewCiphertext(params.Process.EncryptionKey).Encrypt(choices[i], params.Process.EncryptionKey, k)
+		if err != nil {
+			return nil, fmt.Errorf("could not encrypt field %d: %w", i, err)
+		}
+		c1X, c1Y := ct.C1.Point()
+		c2X, c2Y := ct.C2.Point()
+		fields[i] = choices[i].String()
+		cipherfields[i] = [][]string{{c1X.String(), c1Y.String()}, {c2X.String(), c2Y.String()}}
+		plainCipherfields = append(plainCipherfields, c1X, c1Y, c2X, c2Y)
+		encrypted = append(encrypted, ct)
+	}
+
+	address := util.BigToFF(new(big.Int).SetBytes(params.Voter.Address().Bytes()))
+	processID := util.BigToFF(new(big.Int).SetBytes(params.Process.ID.Marshal()))
+	secret := util.BigToFF(new(big.Int).SetBytes(params.Secret))
+	commitment, nullifier, err := CommitmentAndNullifier(address, processID, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hash the public inputs
+	bm := &params.Process.BallotMode
+	forceUniqueness, costFromWeight := big.NewInt(0), big.NewInt(0)
+	if bm.ForceUniqueness {
+		forceUniqueness.SetInt64(1)
+	}
+	if bm.CostFromWeight {
+		costFromWeight.SetInt64(1)
+	}
+	pkX, pkY := params.Process.EncryptionKey.Point()
+	public := []*big.Int{
+		big.NewInt(int64(bm.MaxCount)),
+		forceUniqueness,
+		bm.MaxValue.MathBigInt(),
+		bm.MinValue.MathBigInt(),
+		bm.MaxTotalCost.MathBigInt(),
+		bm.MinTotalCost.MathBigInt(),
+		big.NewInt(int64(bm.CostExponent)),
+		costFromWeight,
+		address,
+		params.Census.Weight,
+		processID,
+		pkX,
+		pkY,
+		nullifier,
+		commitment,
+	}
+	hash, err := mimc7.Hash(append(public, plainCipherfields...), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not hash ballot inputs: %w", err)
+	}
+
+	return &Inputs{
+		Circom: map[string]any{
+			"fields":           fields,
+			"max_count":        fmt.Sprint(bm.MaxCount),
+			"force_uniqueness": forceUniqueness.String(),
+			"max_value":        bm.MaxValue.String(),
+			"min_value":        bm.MinValue.String(),
+			"max_total_cost":   bm.MaxTotalCost.String(),
+			"min_total_cost":   bm.MinTotalCost.String(),
+			"cost_exp":         fmt.Sprint(bm.CostExponent),
+			"cost_from_weight": costFromWeight.String(),
+			"address":          address.String(),
+			"weight":           params.Census.Weight.String(),
+			"process_id":       processID.String(),
+			"pk":               []string{pkX.String(), pkY.String()},
+			"k":                k.String(),
+			"cipherfields":     cipherfields,
+			"nullifier":        nullifier.String(),
+			"commitment":       commitment.String(),
+			"secret":           secret.String(),
+			"inputs_hash":      hash.String(),
+		},
+		EncryptedFields: encrypted,
+		Commitment:      commitment,
+		Nullifier:       nullifier,
+		Hash:            hash,
+	}, nil
+}
+
+// MarshalJSON encodes the inputs of the circom circuit.
+func (in *Inputs) MarshalJSON() ([]byte, error) {
+	return json.Marshal(in.Circom)
+}
+
+// CommitmentAndNullifier returns the commitment of a voter, the Poseidon hash
+// of its address, the process ID and its secret, and its nullifier, the
+// Poseidon hash of the commitment and the secret. The values must be in the
+// scalar field of BN254.
+func CommitmentAndNullifier(address, processID, secret *big.Int) (*big.Int, *big.Int, error) {
+	commitment, err := poseidon.MultiPoseidon(address, processID, secret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not compute commitment: %w", err)
+	}
+	nullifier, err := poseidon.MultiPoseidon(commitment, secret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not compute nullifier: %w", err)
+	}
+	return commitment, nullifier, nil
+}
+
+// SignatureHash returns the hash signed by the voter for the inputs hash of a
+// ballot: its value in the scalar field of BLS12-377, where the signature is
+// verified, as 32 bytes.
+func SignatureHash(inputsHash *big.Int) []byte {
+	return arbo.BigToFF(gecc.BLS12_377.ScalarField(), inputsHash).FillBytes(make([]byte, 32))
+}
@@ -0,0 +1,64 @@
+package ballot
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/iden3/go-rapidsnark/prover"
+	"github.com/iden3/go-rapidsnark/witness"
+)
+
+// Prover generates the ballot proof for the JSON encoded inputs of the circom
+// circuit, and returns the JSON encoded proof and public signals.
+type Prover interface {
+	Prove(inputs []byte) (proof string, publicSignals string, err error)
+}
+
+// CircomProver proves the ballots with the circom circuit: it calculates the
+// witness with the circuit WASM and generates the Groth16 proof with
+// rapidsnark.
+type CircomProver struct {
+	Wasm       []byte
+	ProvingKey []byte
+}
+
+// LoadCircomProver returns a CircomProver with the circuit WASM and proving
+// key (zkey) files provided.
+func LoadCircomProver(wasmFile, provingKeyFile string) (*CircomProver, error) {
+	wasm, err := os.ReadFile(wasmFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read circuit wasm: %w", err)
+	}
+	pk, err := os.ReadFile(provingKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read proving key: %w", err)
+	}
+	return &CircomProver{Wasm: wasm, ProvingKey: pk}, nil
+}
+
+// Witness calculates the witness of the inputs, which fails if they do not
+// satisfy the constraints of the circuit.
+func (p *CircomProver) Witness(inputs []byte) ([]byte, error) {
+	parsed, err := witness.ParseInputs(inputs)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse inputs: %w", err)
+	}
+	calc, err := witness.NewCircom2WitnessCalculator(p.Wasm, true)
+	if err != nil {
+		return nil, fmt.Errorf("could not load circuit: %w", err)
+	}
+	w, err := calc.CalculateWTNSBin(parsed, true)
+	if err != nil {
+		return nil, fmt.Errorf("could not calculate witness: %w", err)
+	}
+	return w, nil
+}
+
+// Prove generates the proof of the inputs.
+func (p *CircomProver) Prove(inputs []byte) (string, string, error) {
+	w, err := p.Witness(inputs)
+	if err != nil {
+		return "", "", err
+	}
+	return prover.Groth16ProverRaw(p.ProvingKey, w)
+}
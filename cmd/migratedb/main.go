@@ -0,0 +1,59 @@
+// Command migratedb upgrades the artifacts stored in the database of a node
+// to the current version of their encoding. The node must be stopped while
+// it runs.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	"github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/db/metadb"
+)
+
+func main() {
+	dataDir := flag.String("datadir", "", "data directory of the node database")
+	masterKey := flag.String("masterkey", os.Getenv("MASTER_KEY"), "hex encoded master key of the node (env MASTER_KEY)")
+	logLevel := flag.String("loglevel", "info", "log level (debug, info, warn, error)")
+	flag.Parse()
+	log.Init(*logLevel, "stdout", nil)
+
+	if *dataDir == "" {
+		log.Fatal("missing data directory")
+	}
+	key, err := hex.DecodeString(*masterKey)
+	if err != nil {
+		log.Fatalf("could not decode master key: %v", err)
+	}
+	if err := migrate(*dataDir, key); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// migrate opens the storage of the database in the directory provided, which
+// migrates the keys, metadata and the other records, and then migrates the
+// queue artifacts.
+func migrate(dataDir string, masterKey []byte) error {
+	database, err := metadb.New(db.TypePebble, dataDir)
+	if err != nil {
+		return fmt.Errorf("could not open database: %w", err)
+	}
+	st, err := storage.New(database, masterKey)
+	if err != nil {
+		database.Close()
+		return fmt.Errorf("could not open storage: %w", err)
+	}
+	defer st.Close()
+	migrated, err := st.MigrateQueues()
+	if err != nil {
+		return fmt.Errorf("could not migrate queues: %w", err)
+	}
+	for stage, n := range migrated {
+		log.Infow("migrated queue artifacts", "stage", stage, "count", n)
+	}
+	return nil
+}
@@ -1,13 +1,17 @@
 package bjj
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"math/big"
+	"math/bits"
 	"sync"
 
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
 	babyjubjub "github.com/consensys/gnark-crypto/ecc/bn254/twistededwards"
 	curve "github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/ctfield"
 	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/format"
 	"github.com/vocdoni/vocdoni-z-sandbox/types"
 )
@@ -23,10 +27,24 @@ type BJJ struct {
 // Scaling factor f (as big.Int)
 var scalingFactor *big.Int
 
+// groupOrder is the order of the full BabyJubJub group (the subgroup order
+// times the cofactor), which is the period of the scalar multiplication of
+// any point of the curve, in or out of the prime order subgroup.
+var groupOrder *big.Int
+
+// frModulusMinusTwo is the exponent used to invert field elements in
+// constant time (Fermat's little theorem).
+var frModulusMinusTwo = new(big.Int).Sub(fr.Modulus(), big.NewInt(2))
+
+// frModulus are the limbs of the modulus used by the constant-time additions
+// and subtractions of the ladder formulas.
+var frModulus = ctfield.Modulus[fr.Element](fr.Modulus())
+
 func init() {
 	Params = babyjubjub.GetEdwardsCurve()
 	scalingFactor = new(big.Int)
 	scalingFactor.SetString("6360561867910373094066688120553762416144456282423235903351243436111059670888", 10)
+	groupOrder = new(big.Int).Mul(&Params.Order, Params.Cofactor.BigInt(new(big.Int)))
 }
 
 // New creates a new BJJ point (identity element by default).
@@ -63,6 +81,189 @@ func (g *BJJ) ScalarMult(a curve.Point, scalar *big.Int) {
 	g.inner.ScalarMultiplication(a.(*BJJ).inner, scalar)
 }
 
+// SecretScalarMult performs a constant-time scalar multiplication of a point
+// by a secret scalar. It uses a Montgomery ladder over projective coordinates
+// with the complete twisted Edwards formulas, so every bit of the scalar
+// costs one addition and one doubling, and the points are swapped with
+// branch-free conditional moves. The formulas are implemented with the
+// branch-free field additions and subtractions of ctfield, since the
+// gnark-crypto ones are not. The result is converted back to affine
+// coordinates using Fermat inversion, which also takes a fixed time.
+func (g *BJJ) SecretScalarMult(a curve.Point, scalar *curve.SecretScalar) {
+	var r0, r1 babyjubjub.PointProj
+	r0.X.SetZero()
+	r0.Y.SetOne()
+	r0.Z.SetOne()
+	r1.FromAffine(a.(*BJJ).inner)
+	for i := curve.SecretScalarBits - 1; i >= 0; i-- {
+		bit := int(scalar.Bit(i))
+		condSwap(&r0, &r1, bit)
+		projAdd(&r1, &r0, &r1)
+		projDouble(&r0, &r0)
+		condSwap(&r0, &r1, bit)
+	}
+	// affine = (X/Z, Y/Z), with 1/Z computed as Z^(r-2)
+	var zInv fr.Element
+	zInv.Exp(r0.Z, frModulusMinusTwo)
+	g.inner.X.Mul(&r0.X, &zInv)
+	g.inner.Y.Mul(&r0.Y, &zInv)
+}
+
+// projAdd sets p = p1 + p2 in projective coordinates
+// (https://hyperelliptic.org/EFD/g1p/auto-twisted-projective.html#addition-add-2008-bbjlp),
+// which is complete for BabyJubJub, so it is valid for any input.
+func projAdd(p, p1, p2 *babyjubjub.PointProj) {
+	var a, b, c, d, e, f, g, h, i fr.Element
+	a.Mul(&p1.Z, &p2.Z)
+	b.Square(&a)
+	c.Mul(&p1.X, &p2.X)
+	d.Mul(&p1.Y, &p2.Y)
+	e.Mul(&Params.D, &c).Mul(&e, &d)
+	ctfield.Sub(&f, &b, &e, &frModulus)
+	ctfield.Add(&g, &b, &e, &frModulus)
+	ctfield.Add(&h, &p1.X, &p1.Y, &frModulus)
+	ctfield.Add(&i, &p2.X, &p2.Y, &frModulus)
+	// X3 = A*F*((X1+Y1)*(X2+Y2)-C-D)
+	h.Mul(&h, &i)
+	ctfield.Sub(&h, &h, &c, &frModulus)
+	ctfield.Sub(&h, &h, &d, &frModulus)
+	p.X.Mul(&h, &a).Mul(&p.X, &f)
+	// Y3 = A*G*(D-a*C)
+	c.Mul(&c, &Params.A)
+	ctfield.Sub(&d, &d, &c, &frModulus)
+	p.Y.Mul(&d, &a).Mul(&p.Y, &g)
+	p.Z.Mul(&f, &g)
+}
+
+// projDouble sets p = 2*p1 in projective coordinates
+// (https://hyperelliptic.org/EFD/g1p/auto-twisted-projective.html#doubling-dbl-2008-bbjlp).
+func projDouble(p, p1 *babyjubjub.PointProj) {
+	var b, c, d, e, f, h, j fr.Element
+	ctfield.Add(&b, &p1.X, &p1.Y, &frModulus)
+	b.Square(&b)
+	c.Square(&p1.X)
+	d.Square(&p1.Y)
+	e.Mul(&c, &Params.A)
+	ctfield.Add(&f, &e, &d, &frModulus)
+	h.Square(&p1.Z)
+	ctfield.Sub(&j, &f, &h, &frModulus)
+	ctfield.Sub(&j, &j, &h, &frModulus)
+	// X3 = (B-C-D)*J
+	ctfield.Sub(&b, &b, &c, &frModulus)
+	ctfield.Sub(&b, &b, &d, &frModulus)
+	p.X.Mul(&b, &j)
+	// Y3 = F*(E-D)
+	ctfield.Sub(&e, &e, &d, &frModulus)
+	p.Y.Mul(&f, &e)
+	p.Z.Mul(&f, &j)
+}
+
+// condSwap swaps p and q in constant time if c is 1, and leaves them
+// untouched if c is 0.
+func condSwap(p, q *babyjubjub.PointProj, c int) {
+	var t fr.Element
+	t.Select(c, &p.X, &q.X)
+	q.X.Select(c, &q.X, &p.X)
+	p.X = t
+	t.Select(c, &p.Y, &q.Y)
+	q.Y.Select(c, &q.Y, &p.Y)
+	p.Y = t
+	t.Select(c, &p.Z, &q.Z)
+	q.Z.Select(c, &q.Z, &p.Z)
+	p.Z = t
+}
+
+// MultiScalarMult computes sum(scalars[i] * points[i]) using the bucket
+// method of Pippenger over extended twisted Edwards coordinates. The scalars
+// are reduced modulo the order of the full group, so the result is also
+// correct for points outside the prime order subgroup, and split in windows of c bits; for
+// each window the points are accumulated in 2^c-1 buckets by their digit and
+// the buckets are combined with a running sum, so the cost is roughly
+// (bits/c) * (n + 2^c) additions instead of n full scalar multiplications.
+// Only the windows up to the largest scalar are processed, so small scalars,
+// such as the unit weights of a sum of ciphertexts, take a single window.
+func (g *BJJ) MultiScalarMult(points []curve.Point, scalars []*big.Int) error {
+	if len(points) != len(scalars) {
+		return fmt.Errorf("points and scalars length mismatch: %d != %d", len(points), len(scalars))
+	}
+	bases := make([]babyjubjub.PointExtended, len(points))
+	limbs := make([][4]uint64, len(scalars))
+	k := new(big.Int)
+	maxBits := 1
+	for i := range points {
+		bases[i].FromAffine(points[i].(*BJJ).inner)
+		k.Mod(scalars[i], groupOrder)
+		limbs[i] = scalarLimbs(k)
+		maxBits = max(maxBits, k.BitLen())
+	}
+	c := msmWindowSize(len(points))
+	numWindows := (maxBits + c - 1) / c
+	buckets := make([]babyjubjub.PointExtended, 1<<c-1)
+
+	var result, running, windowSum babyjubjub.PointExtended
+	setIdentity(&result)
+	for w := numWindows - 1; w >= 0; w-- {
+		for i := 0; i < c; i++ {
+			result.Double(&result)
+		}
+		for b := range buckets {
+			setIdentity(&buckets[b])
+		}
+		for i := range bases {
+			if digit := scalarWindow(&limbs[i], w*c, c); digit > 0 {
+				buckets[digit-1].Add(&buckets[digit-1], &bases[i])
+			}
+		}
+		// sum(d * bucket[d]) computed as the sum of the running sums
+		setIdentity(&running)
+		setIdentity(&windowSum)
+		for b := len(buckets) - 1; b >= 0; b-- {
+			running.Add(&running, &buckets[b])
+			windowSum.Add(&windowSum, &running)
+		}
+		result.Add(&result, &windowSum)
+	}
+	g.inner.FromExtended(&result)
+	return nil
+}
+
+// msmWindowSize returns the window size in bits used by MultiScalarMult for
+// the given number of points, which is close to log2(n).
+func msmWindowSize(n int) int {
+	return min(max(bits.Len(uint(n))-1, 2), 16)
+}
+
+// scalarLimbs returns the value of k (which must fit in 256 bits) as four
+// little-endian 64 bits limbs.
+func scalarLimbs(k *big.Int) [4]uint64 {
+	var buf [32]byte
+	k.FillBytes(buf[:])
+	var limbs [4]uint64
+	for i := range limbs {
+		limbs[i] = binary.BigEndian.Uint64(buf[32-8*(i+1) : 32-8*i])
+	}
+	return limbs
+}
+
+// scalarWindow returns the c bits of the scalar starting at the given bit.
+func scalarWindow(limbs *[4]uint64, start, c int) uint64 {
+	word, shift := start/64, uint(start%64)
+	v := limbs[word] >> shift
+	if shift+uint(c) > 64 && word+1 < len(limbs) {
+		v |= limbs[word+1] << (64 - shift)
+	}
+	return v & (1<<uint(c) - 1)
+}
+
+// setIdentity sets p to the identity element in extended coordinates
+// (0:1:1:0).
+func setIdentity(p *babyjubjub.PointExtended) {
+	p.X.SetZero()
+	p.Y.SetOne()
+	p.Z.SetOne()
+	p.T.SetZero()
+}
+
 // ScalarBaseMult performs scalar multiplication using the base point.
 func (g *BJJ) ScalarBaseMult(scalar *big.Int) {
 	g.SetGenerator()
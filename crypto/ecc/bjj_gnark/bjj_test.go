@@ -8,6 +8,7 @@ import (
 
 	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc"
 	bjjIden3 "github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/bjj_iden3"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/ecctest"
 )
 
 // Helper function to generate a non-base point
@@ -147,3 +148,104 @@ func TestEqual(t *testing.T) {
 	c.Assert(bjjPoint1.Equal(bjjPoint2), qt.IsFalse)
 	c.Assert(iden3Point1.Equal(iden3Point2), qt.IsFalse)
 }
+
+func TestSecretScalarMult(t *testing.T) {
+	c := qt.New(t)
+	bjjPoint, iden3Point := generateNonBasePoint()
+	order := bjjPoint.Order()
+
+	scalars := []*big.Int{
+		big.NewInt(0),
+		big.NewInt(1),
+		big.NewInt(2),
+		big.NewInt(123456789),
+		new(big.Int).Sub(order, big.NewInt(1)),
+		new(big.Int).Rsh(order, 3),
+	}
+	for _, scalar := range scalars {
+		secret := ecc.MustSecretScalar(scalar)
+
+		expected := New()
+		expected.ScalarMult(bjjPoint, scalar)
+		result := New()
+		result.SecretScalarMult(bjjPoint, secret)
+		c.Assert(result.Equal(expected), qt.IsTrue, qt.Commentf("scalar %s", scalar))
+
+		iden3Result := bjjIden3.New()
+		iden3Result.SecretScalarMult(iden3Point, secret)
+		c.Assert(result.String(), qt.Equals, iden3Result.String(), qt.Commentf("scalar %s", scalar))
+	}
+
+	// the receiver can also be the input point
+	p, _ := generateNonBasePoint()
+	expected := New()
+	expected.ScalarMult(p, big.NewInt(88))
+	p.SecretScalarMult(p, ecc.MustSecretScalar(big.NewInt(88)))
+	c.Assert(p.Equal(expected), qt.IsTrue)
+}
+
+func TestMultiScalarMult(t *testing.T) {
+	c := qt.New(t)
+
+	for _, n := range []int{0, 1, 3, 10, 64, 300} {
+		points, scalars := ecctest.RandomPointsAndScalars(c, new(BJJ).New(), n)
+
+		expected := new(BJJ).New()
+		iden3Points := make([]ecc.Point, n)
+		for i := range points {
+			term := New()
+			term.ScalarMult(points[i], scalars[i])
+			expected.Add(expected, term)
+			x, y := points[i].Point()
+			iden3Points[i] = bjjIden3.New().SetPoint(x, y)
+		}
+
+		result := New()
+		c.Assert(result.MultiScalarMult(points, scalars), qt.IsNil)
+		c.Assert(result.Equal(expected), qt.IsTrue, qt.Commentf("n = %d", n))
+
+		iden3Result := bjjIden3.New()
+		c.Assert(iden3Result.MultiScalarMult(iden3Points, scalars), qt.IsNil)
+		c.Assert(iden3Result.String(), qt.Equals, result.String(), qt.Commentf("n = %d", n))
+	}
+
+	// negative and larger than the order scalars are reduced
+	point, _ := generateNonBasePoint()
+	order := point.Order()
+	result := New()
+	c.Assert(result.MultiScalarMult(
+		[]ecc.Point{point, point},
+		[]*big.Int{big.NewInt(-5), new(big.Int).Add(order, big.NewInt(7))},
+	), qt.IsNil)
+	expected := New()
+	expected.ScalarMult(point, big.NewInt(2))
+	c.Assert(result.Equal(expected), qt.IsTrue)
+
+	// points outside the prime order subgroup: (order + 1) * (P + T), with T
+	// of order two, is P
+	torsion := New().(*BJJ)
+	torsion.inner.X.SetZero()
+	torsion.inner.Y.SetOne()
+	torsion.inner.Y.Neg(&torsion.inner.Y)
+	mixed := New()
+	mixed.Add(point, torsion)
+	c.Assert(result.MultiScalarMult(
+		[]ecc.Point{mixed},
+		[]*big.Int{new(big.Int).Add(order, big.NewInt(1))},
+	), qt.IsNil)
+	c.Assert(result.Equal(point), qt.IsTrue)
+
+	c.Assert(result.MultiScalarMult([]ecc.Point{point}, nil), qt.IsNotNil)
+}
+
+func TestSecretScalarMultTiming(t *testing.T) {
+	ecctest.TestSecretScalarMultTiming(t, new(BJJ).New())
+}
+
+func BenchmarkSecretScalarMult(b *testing.B) {
+	ecctest.BenchmarkSecretScalarMult(b, new(BJJ).New())
+}
+
+func BenchmarkMultiScalarMult(b *testing.B) {
+	ecctest.BenchmarkMultiScalarMult(b, new(BJJ).New())
+}
@@ -7,6 +7,7 @@ import (
 	"sync"
 
 	babyjubjub "github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-iden3-crypto/ff"
 
 	curve "github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc"
 	"github.com/vocdoni/vocdoni-z-sandbox/types"
@@ -45,6 +46,54 @@ func (g *BJJ) ScalarMult(a curve.Point, scalar *big.Int) {
 	g.inner = g.inner.Mul(scalar, a.(*BJJ).inner)
 }
 
+// SecretScalarMult performs scalar multiplication of a point by a secret
+// scalar using a Montgomery ladder with branch-free conditional swaps, so the
+// sequence of operations does not depend on the scalar. Note that the final
+// conversion to affine coordinates relies on the iden3 inversion and math/big,
+// so use the bjj_gnark implementation when a constant-time guarantee is
+// required.
+func (g *BJJ) SecretScalarMult(a curve.Point, scalar *curve.SecretScalar) {
+	r0 := babyjubjub.NewPointProjective()
+	r1 := a.(*BJJ).inner.Projective()
+	for i := curve.SecretScalarBits - 1; i >= 0; i-- {
+		bit := uint64(scalar.Bit(i))
+		condSwap(r0, r1, bit)
+		r1 = r1.Add(r0, r1)
+		r0 = r0.Add(r0, r0)
+		condSwap(r0, r1, bit)
+	}
+	g.inner = r0.Affine()
+}
+
+// condSwap swaps p and q if c is 1, and leaves them untouched if c is 0,
+// using a mask over the limbs of the coordinates instead of a branch.
+func condSwap(p, q *babyjubjub.PointProjective, c uint64) {
+	mask := -c
+	for _, pair := range [][2]*ff.Element{{p.X, q.X}, {p.Y, q.Y}, {p.Z, q.Z}} {
+		for i := range pair[0] {
+			t := mask & (pair[0][i] ^ pair[1][i])
+			pair[0][i] ^= t
+			pair[1][i] ^= t
+		}
+	}
+}
+
+// MultiScalarMult computes sum(scalars[i] * points[i]) multiplying and
+// adding each point independently. This implementation is kept as a
+// reference, use bjj_gnark for the bucket method.
+func (g *BJJ) MultiScalarMult(points []curve.Point, scalars []*big.Int) error {
+	if len(points) != len(scalars) {
+		return fmt.Errorf("points and scalars length mismatch: %d != %d", len(points), len(scalars))
+	}
+	res := babyjubjub.NewPointProjective()
+	for i := range points {
+		term := babyjubjub.NewPoint().Mul(scalars[i], points[i].(*BJJ).inner)
+		res = res.Add(res, term.Projective())
+	}
+	g.inner = res.Affine()
+	return nil
+}
+
 func (g *BJJ) ScalarBaseMult(scalar *big.Int) {
 	g.inner = g.inner.Mul(scalar, babyjubjub.B8)
 }
@@ -7,18 +7,34 @@ import (
 	"sync"
 
 	curve "github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/ctfield"
 	"github.com/vocdoni/vocdoni-z-sandbox/types"
 
+	"github.com/consensys/gnark-crypto/ecc"
 	"github.com/consensys/gnark-crypto/ecc/bn254"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fp"
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
 )
 
 var Generator bn254.G1Jac
 
+var (
+	// b3 is 3*b, where b = 3 is the constant of the curve y^2 = x^3 + b. It
+	// is used by the complete addition formulas.
+	b3 fp.Element
+	// fpModulusMinusTwo is the exponent used to invert field elements in
+	// constant time (Fermat's little theorem).
+	fpModulusMinusTwo = new(big.Int).Sub(fp.Modulus(), big.NewInt(2))
+	// fpModulus are the limbs of the modulus used by the constant-time
+	// additions and subtractions of the complete addition formulas.
+	fpModulus = ctfield.Modulus[fp.Element](fp.Modulus())
+)
+
 func init() {
 	Generator.X.SetOne()
 	Generator.Y.SetUint64(2)
 	Generator.Z.SetOne()
+	b3.SetUint64(9)
 }
 
 // G1 is the affine representation of a G1 group element.
@@ -53,6 +69,51 @@ func (g *G1) ScalarMult(a curve.Point, scalar *big.Int) {
 	*g.inner = *temp
 }
 
+// SecretScalarMult performs a constant-time scalar multiplication of a point
+// by a secret scalar. It uses a Montgomery ladder over homogeneous projective
+// coordinates with the complete addition formulas for short Weierstrass
+// curves with a = 0 (Renes-Costello-Batina 2016, algorithm 7), which have no
+// exceptional cases, so every bit of the scalar costs exactly two additions
+// and the points are swapped with branch-free conditional moves. The field
+// additions and subtractions are the branch-free ones of ctfield. The result
+// is converted back to affine coordinates using Fermat inversion.
+func (g *G1) SecretScalarMult(a curve.Point, scalar *curve.SecretScalar) {
+	var r0, r1 projPoint
+	r0.setInfinity()
+	r1.fromAffine(a.(*G1).inner)
+	for i := curve.SecretScalarBits - 1; i >= 0; i-- {
+		bit := int(scalar.Bit(i))
+		r0.condSwap(&r1, bit)
+		r1.add(&r0, &r1)
+		r0.add(&r0, &r0)
+		r0.condSwap(&r1, bit)
+	}
+	r0.toAffine(g.inner)
+}
+
+// MultiScalarMult computes sum(scalars[i] * points[i]) using the gnark-crypto
+// multi-exponentiation, which implements the bucket method of Pippenger and
+// splits the work across all the available CPUs.
+func (g *G1) MultiScalarMult(points []curve.Point, scalars []*big.Int) error {
+	if len(points) != len(scalars) {
+		return fmt.Errorf("points and scalars length mismatch: %d != %d", len(points), len(scalars))
+	}
+	if len(points) == 0 {
+		g.SetZero()
+		return nil
+	}
+	affinePoints := make([]bn254.G1Affine, len(points))
+	frScalars := make([]fr.Element, len(scalars))
+	for i := range points {
+		affinePoints[i].Set(points[i].(*G1).inner)
+		frScalars[i].SetBigInt(scalars[i])
+	}
+	if _, err := g.inner.MultiExp(affinePoints, frScalars, ecc.MultiExpConfig{}); err != nil {
+		return fmt.Errorf("multi-exponentiation failed: %w", err)
+	}
+	return nil
+}
+
 func (g *G1) ScalarBaseMult(scalar *big.Int) {
 	g.inner.ScalarMultiplicationBase(scalar)
 }
@@ -124,3 +185,92 @@ func (g *G1) SetPoint(x, y *big.Int) curve.Point {
 	g.inner.Y.SetBigInt(y)
 	return g
 }
+
+// projPoint is a G1 point in homogeneous projective coordinates (X:Y:Z),
+// representing the affine point (X/Z, Y/Z). The point at infinity is (0:1:0).
+type projPoint struct {
+	X, Y, Z fp.Element
+}
+
+func (p *projPoint) setInfinity() {
+	p.X.SetZero()
+	p.Y.SetOne()
+	p.Z.SetZero()
+}
+
+// fromAffine sets p to the affine point a. The gnark-crypto encoding of the
+// point at infinity in affine coordinates is (0, 0).
+func (p *projPoint) fromAffine(a *bn254.G1Affine) {
+	p.X.Set(&a.X)
+	p.Y.Set(&a.Y)
+	p.Z.SetOne()
+	if a.IsInfinity() {
+		p.setInfinity()
+	}
+}
+
+// toAffine stores p in a, using Fermat inversion so it takes the same time
+// for any point. The point at infinity (Z = 0) results in (0, 0), since the
+// inverse computed this way is zero.
+func (p *projPoint) toAffine(a *bn254.G1Affine) {
+	var zInv fp.Element
+	zInv.Exp(p.Z, fpModulusMinusTwo)
+	a.X.Mul(&p.X, &zInv)
+	a.Y.Mul(&p.Y, &zInv)
+}
+
+// condSwap swaps p and q in constant time if c is 1, and leaves them
+// untouched if c is 0.
+func (p *projPoint) condSwap(q *projPoint, c int) {
+	var t fp.Element
+	t.Select(c, &p.X, &q.X)
+	q.X.Select(c, &q.X, &p.X)
+	p.X = t
+	t.Select(c, &p.Y, &q.Y)
+	q.Y.Select(c, &q.Y, &p.Y)
+	p.Y = t
+	t.Select(c, &p.Z, &q.Z)
+	q.Z.Select(c, &q.Z, &p.Z)
+	p.Z = t
+}
+
+// add sets p = p1 + p2 using the complete addition formula for a = 0
+// (https://eprint.iacr.org/2015/1060, algorithm 7). It is valid for any
+// input, including doublings and the point at infinity.
+func (p *projPoint) add(p1, p2 *projPoint) {
+	var t0, t1, t2, t3, t4, x3, y3, z3 fp.Element
+	t0.Mul(&p1.X, &p2.X)
+	t1.Mul(&p1.Y, &p2.Y)
+	t2.Mul(&p1.Z, &p2.Z)
+	ctfield.Add(&t3, &p1.X, &p1.Y, &fpModulus)
+	ctfield.Add(&t4, &p2.X, &p2.Y, &fpModulus)
+	t3.Mul(&t3, &t4)
+	ctfield.Add(&t4, &t0, &t1, &fpModulus)
+	ctfield.Sub(&t3, &t3, &t4, &fpModulus)
+	ctfield.Add(&t4, &p1.Y, &p1.Z, &fpModulus)
+	ctfield.Add(&x3, &p2.Y, &p2.Z, &fpModulus)
+	t4.Mul(&t4, &x3)
+	ctfield.Add(&x3, &t1, &t2, &fpModulus)
+	ctfield.Sub(&t4, &t4, &x3, &fpModulus)
+	ctfield.Add(&x3, &p1.X, &p1.Z, &fpModulus)
+	ctfield.Add(&y3, &p2.X, &p2.Z, &fpModulus)
+	x3.Mul(&x3, &y3)
+	ctfield.Add(&y3, &t0, &t2, &fpModulus)
+	ctfield.Sub(&y3, &x3, &y3, &fpModulus)
+	ctfield.Add(&x3, &t0, &t0, &fpModulus)
+	ctfield.Add(&t0, &x3, &t0, &fpModulus)
+	t2.Mul(&b3, &t2)
+	ctfield.Add(&z3, &t1, &t2, &fpModulus)
+	ctfield.Sub(&t1, &t1, &t2, &fpModulus)
+	y3.Mul(&b3, &y3)
+	x3.Mul(&t4, &y3)
+	t2.Mul(&t3, &t1)
+	ctfield.Sub(&x3, &t2, &x3, &fpModulus)
+	y3.Mul(&y3, &t0)
+	t1.Mul(&t1, &z3)
+	ctfield.Add(&y3, &t1, &y3, &fpModulus)
+	t0.Mul(&t0, &t3)
+	z3.Mul(&z3, &t4)
+	ctfield.Add(&z3, &z3, &t0, &fpModulus)
+	p.X, p.Y, p.Z = x3, y3, z3
+}
@@ -0,0 +1,127 @@
+package bn254
+
+import (
+	"math/big"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/ecctest"
+)
+
+func newPoint() ecc.Point {
+	return new(G1).New()
+}
+
+func TestSecretScalarMult(t *testing.T) {
+	c := qt.New(t)
+	point := newPoint()
+	point.ScalarBaseMult(big.NewInt(123456789))
+	order := point.Order()
+
+	scalars := []*big.Int{
+		big.NewInt(0),
+		big.NewInt(1),
+		big.NewInt(2),
+		big.NewInt(88),
+		new(big.Int).Sub(order, big.NewInt(1)),
+		new(big.Int).Rsh(order, 3),
+	}
+	for _, scalar := range scalars {
+		expected := newPoint()
+		expected.ScalarMult(point, scalar)
+		result := newPoint()
+		result.SecretScalarMult(point, ecc.MustSecretScalar(scalar))
+		c.Assert(result.Equal(expected), qt.IsTrue, qt.Commentf("scalar %s", scalar))
+	}
+
+	// multiplying the point at infinity results in the point at infinity
+	zero := newPoint()
+	zero.SetZero()
+	result := newPoint()
+	result.SecretScalarMult(zero, ecc.MustSecretScalar(big.NewInt(42)))
+	c.Assert(result.Equal(zero), qt.IsTrue)
+
+	// multiplying by the order results in the point at infinity
+	result.SecretScalarMult(point, ecc.MustSecretScalar(order))
+	c.Assert(result.Equal(zero), qt.IsTrue)
+}
+
+// TestSecretScalarMultVectors checks SecretScalarMult against known multiples
+// of the generator of G1.
+func TestSecretScalarMultVectors(t *testing.T) {
+	c := qt.New(t)
+	vectors := []struct {
+		scalar, x, y string
+	}{
+		{
+			"2",
+			"1368015179489954701390400359078579693043519447331113978918064868415326638035",
+			"9918110051302171585080402603319702774565515993150576347155970296011118125764",
+		},
+		{
+			"123456789",
+			"9121282642809701931333593728297233225556711250127745709186816755779879923737",
+			"8783642022119951289582979607207867126556038468480503109520224385365741455513",
+		},
+		{
+			"6350874878119819312338956282401532409788428879151445726012394534686998597021",
+			"11848165253230112317027953470615703125578046113569611973992738851080064210225",
+			"2554298421603765061761200028188877971384218644464587625277013152152508494116",
+		},
+		{
+			// order - 1, the negation of the generator
+			"21888242871839275222246405745257275088548364400416034343698204186575808495616",
+			"1",
+			"21888242871839275222246405745257275088696311157297823662689037894645226208581",
+		},
+	}
+	generator := newPoint()
+	generator.SetGenerator()
+	for _, v := range vectors {
+		scalar, ok := new(big.Int).SetString(v.scalar, 10)
+		c.Assert(ok, qt.IsTrue)
+		x, _ := new(big.Int).SetString(v.x, 10)
+		y, _ := new(big.Int).SetString(v.y, 10)
+		expected := newPoint().SetPoint(x, y)
+
+		result := newPoint()
+		result.SecretScalarMult(generator, ecc.MustSecretScalar(scalar))
+		c.Assert(result.Equal(expected), qt.IsTrue, qt.Commentf("scalar %s", v.scalar))
+	}
+}
+
+func TestSecretScalarMultTiming(t *testing.T) {
+	ecctest.TestSecretScalarMultTiming(t, newPoint())
+}
+
+func BenchmarkSecretScalarMult(b *testing.B) {
+	ecctest.BenchmarkSecretScalarMult(b, newPoint())
+}
+
+func TestMultiScalarMult(t *testing.T) {
+	c := qt.New(t)
+
+	for _, n := range []int{0, 1, 3, 10, 64, 300} {
+		points, scalars := ecctest.RandomPointsAndScalars(c, newPoint(), n)
+
+		expected := newPoint()
+		for i := range points {
+			term := newPoint()
+			term.ScalarMult(points[i], scalars[i])
+			expected.Add(expected, term)
+		}
+
+		result := newPoint()
+		c.Assert(result.MultiScalarMult(points, scalars), qt.IsNil)
+		c.Assert(result.Equal(expected), qt.IsTrue, qt.Commentf("n = %d", n))
+	}
+
+	point := newPoint()
+	c.Assert(point.MultiScalarMult([]ecc.Point{point}, nil), qt.IsNotNil)
+}
+
+func BenchmarkMultiScalarMult(b *testing.B) {
+	ecctest.BenchmarkMultiScalarMult(b, newPoint())
+}
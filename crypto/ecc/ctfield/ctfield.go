@@ -0,0 +1,77 @@
+// ctfield package provides the modular additions and subtractions of the
+// gnark-crypto field elements in constant time. The gnark-crypto ones reduce
+// the result with a branch that depends on the value of the operands, which
+// leaks the scalar through the timing of the constant-time scalar
+// multiplications built on them. The multiplications and squarings of
+// gnark-crypto reduce without branches, so they can be used as they are.
+package ctfield
+
+import (
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+)
+
+// Element is a 4-limb field element in Montgomery form, such as the
+// gnark-crypto fp.Element and fr.Element of the BN254 fields. The additions
+// and subtractions do not depend on the Montgomery form, so they operate on
+// the limbs directly.
+type Element interface {
+	~[4]uint64
+}
+
+// Modulus returns the limbs of the modulus q of the field, to be used with
+// Add, Sub and Neg. The modulus must be lower than 2^255, so the sum of two
+// reduced elements does not overflow the limbs.
+func Modulus[E Element](q *big.Int) E {
+	var buf [32]byte
+	q.FillBytes(buf[:])
+	var m E
+	for i := range m {
+		m[i] = binary.BigEndian.Uint64(buf[24-8*i:])
+	}
+	return m
+}
+
+// Add sets z = x + y mod q.
+func Add[E Element](z, x, y, q *E) {
+	var sum, reduced E
+	var carry, borrow uint64
+	for i := range sum {
+		sum[i], carry = bits.Add64((*x)[i], (*y)[i], carry)
+	}
+	for i := range reduced {
+		reduced[i], borrow = bits.Sub64(sum[i], (*q)[i], borrow)
+	}
+	// the sum is kept if it is lower than q, that is, if subtracting q
+	// borrows
+	selectElement(z, borrow, &sum, &reduced)
+}
+
+// Sub sets z = x - y mod q.
+func Sub[E Element](z, x, y, q *E) {
+	var diff, reduced E
+	var carry, borrow uint64
+	for i := range diff {
+		diff[i], borrow = bits.Sub64((*x)[i], (*y)[i], borrow)
+	}
+	for i := range reduced {
+		reduced[i], carry = bits.Add64(diff[i], (*q)[i], carry)
+	}
+	// q is added back if the subtraction borrows
+	selectElement(z, borrow, &reduced, &diff)
+}
+
+// Neg sets z = -x mod q.
+func Neg[E Element](z, x, q *E) {
+	var zero E
+	Sub(z, &zero, x, q)
+}
+
+// selectElement sets z to a if c is 1 and to b if c is 0, without branching.
+func selectElement[E Element](z *E, c uint64, a, b *E) {
+	mask := -c
+	for i := range *z {
+		(*z)[i] = (*b)[i] ^ (mask & ((*a)[i] ^ (*b)[i]))
+	}
+}
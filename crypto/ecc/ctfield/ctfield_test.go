@@ -0,0 +1,50 @@
+package ctfield
+
+import (
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fp"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestAddSubNeg(t *testing.T) {
+	c := qt.New(t)
+	q := Modulus[fr.Element](fr.Modulus())
+
+	var minusOne, one, zero, x, y fr.Element
+	one.SetOne()
+	minusOne.Neg(&one)
+	_, err := x.SetRandom()
+	c.Assert(err, qt.IsNil)
+	_, err = y.SetRandom()
+	c.Assert(err, qt.IsNil)
+	values := []fr.Element{zero, one, minusOne, x, y}
+
+	for _, a := range values {
+		for _, b := range values {
+			var got, expected fr.Element
+			Add(&got, &a, &b, &q)
+			expected.Add(&a, &b)
+			c.Assert(got.Equal(&expected), qt.IsTrue, qt.Commentf("%s + %s", a.String(), b.String()))
+			Sub(&got, &a, &b, &q)
+			expected.Sub(&a, &b)
+			c.Assert(got.Equal(&expected), qt.IsTrue, qt.Commentf("%s - %s", a.String(), b.String()))
+		}
+		var got, expected fr.Element
+		Neg(&got, &a, &q)
+		expected.Neg(&a)
+		c.Assert(got.Equal(&expected), qt.IsTrue, qt.Commentf("-%s", a.String()))
+	}
+}
+
+func TestModulus(t *testing.T) {
+	c := qt.New(t)
+	// the largest element plus one is zero
+	q := Modulus[fp.Element](fp.Modulus())
+	var minusOne, one, got fp.Element
+	one.SetOne()
+	minusOne.Neg(&one)
+	Add(&got, &minusOne, &one, &q)
+	c.Assert(got.IsZero(), qt.IsTrue)
+}
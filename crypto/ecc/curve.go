@@ -29,6 +29,22 @@ type Point interface {
 	// Multiplies the group element a by the scalar value.
 	ScalarMult(a Point, scalar *big.Int)
 
+	// SecretScalarMult performs scalar multiplication of an elliptic curve
+	// element by a secret scalar. It must be used instead of ScalarMult when
+	// the scalar is a private key, a private share or any other secret, since
+	// it runs the same sequence of operations regardless of the scalar value.
+	// The bjj_iden3 implementation does not hold this guarantee, since its
+	// conversion to affine coordinates relies on math/big, so it must not be
+	// used with secret scalars when the timing can be observed.
+	SecretScalarMult(a Point, scalar *SecretScalar)
+
+	// MultiScalarMult computes the sum of the points multiplied by their
+	// respective scalars (sum(scalars[i] * points[i])) and stores the result
+	// in the receiver. It is much faster than multiplying and adding each
+	// point independently. Returns an error if the number of points and
+	// scalars differ.
+	MultiScalarMult(points []Point, scalars []*big.Int) error
+
 	// ScalarBaseMult performs scalar multiplication of the generator point by a scalar value.
 	// The receiver is set to the result of multiplying the generator point by the scalar.
 	ScalarBaseMult(scalar *big.Int)
@@ -31,3 +31,28 @@ func New(curveType string) ecc.Point {
 		panic(fmt.Sprintf("unsupported curve type: %s", curveType))
 	}
 }
+
+// IsValid returns true if the curve type provided is supported by New.
+func IsValid(curveType string) bool {
+	switch curveType {
+	case CurveTypeBabyJubJubGnark, CurveTypeBN254, CurveTypeBabyJubJubIden3:
+		return true
+	default:
+		return false
+	}
+}
+
+// Type returns the curve type of the point provided, or an empty string if
+// the point implementation is not known.
+func Type(p ecc.Point) string {
+	switch p.(type) {
+	case *bjj_gnark.BJJ:
+		return CurveTypeBabyJubJubGnark
+	case *bn254.G1:
+		return CurveTypeBN254
+	case *bjj_iden3.BJJ:
+		return CurveTypeBabyJubJubIden3
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,143 @@
+// Package ecctest provides helpers shared by the tests and benchmarks of the
+// ecc.Point implementations.
+package ecctest
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc"
+)
+
+// RandomPointsAndScalars returns n random multiples of the generator of the
+// curve and n random scalars lower than its order.
+func RandomPointsAndScalars(tb testing.TB, curve ecc.Point, n int) ([]ecc.Point, []*big.Int) {
+	order := curve.Order()
+	points := make([]ecc.Point, n)
+	scalars := make([]*big.Int, n)
+	for i := range points {
+		k, err := rand.Int(rand.Reader, order)
+		qt.Assert(tb, err, qt.IsNil)
+		points[i] = curve.New()
+		points[i].ScalarBaseMult(k)
+		scalars[i], err = rand.Int(rand.Reader, order)
+		qt.Assert(tb, err, qt.IsNil)
+	}
+	return points, scalars
+}
+
+// BenchmarkSecretScalarMult runs SecretScalarMult with a scalar with a single
+// bit set and with a scalar with almost all of them set. Both sub-benchmarks
+// must report the same time, since the multiplication is constant time.
+func BenchmarkSecretScalarMult(b *testing.B, curve ecc.Point) {
+	point := curve.New()
+	point.ScalarBaseMult(big.NewInt(123456789))
+	scalars := []struct {
+		name   string
+		scalar *ecc.SecretScalar
+	}{
+		{"low", ecc.MustSecretScalar(big.NewInt(1))},
+		{"high", ecc.MustSecretScalar(new(big.Int).Sub(curve.Order(), big.NewInt(1)))},
+	}
+	for _, s := range scalars {
+		b.Run(s.name, func(b *testing.B) {
+			result := curve.New()
+			for i := 0; i < b.N; i++ {
+				result.SecretScalarMult(point, s.scalar)
+			}
+		})
+	}
+}
+
+// timingSamples is the number of measurements of each class taken by
+// TestSecretScalarMultTiming, and timingThreshold the maximum absolute value
+// of the Welch's t statistic accepted. The threshold is the one dudect uses to
+// report a definite leak, a variable time multiplication exceeds it by two
+// orders of magnitude with these scalars.
+const (
+	timingSamples   = 2000
+	timingThreshold = 10
+)
+
+// TestSecretScalarMultTiming checks that the time of SecretScalarMult does not
+// depend on the scalar, following the approach of dudect: the multiplication
+// is measured with a scalar with a single bit set and with a scalar with
+// almost all of them set, interleaving both classes in random order, the
+// slowest measurements are discarded to remove the noise of the scheduler,
+// and the means of both classes are compared with the Welch's t-test. It is
+// skipped in short mode, since it takes a few seconds.
+func TestSecretScalarMultTiming(t *testing.T, curve ecc.Point) {
+	if testing.Short() {
+		t.Skip("skipping timing test in short mode")
+	}
+	point := curve.New()
+	point.ScalarBaseMult(big.NewInt(123456789))
+	scalars := [2]*ecc.SecretScalar{
+		ecc.MustSecretScalar(big.NewInt(1)),
+		ecc.MustSecretScalar(new(big.Int).Sub(curve.Order(), big.NewInt(1))),
+	}
+	classes := make([]byte, 2*timingSamples)
+	_, err := rand.Read(classes)
+	qt.Assert(t, err, qt.IsNil)
+
+	result := curve.New()
+	// warm up the caches and the CPU frequency before measuring
+	for i := 0; i < timingSamples/10; i++ {
+		result.SecretScalarMult(point, scalars[i%2])
+	}
+	durations := make([]float64, len(classes))
+	for i, class := range classes {
+		scalar := scalars[class&1]
+		start := time.Now()
+		result.SecretScalarMult(point, scalar)
+		durations[i] = float64(time.Since(start))
+	}
+
+	sorted := slices.Clone(durations)
+	slices.Sort(sorted)
+	cutoff := sorted[len(sorted)*9/10]
+	var n, mean, m2 [2]float64
+	for i, d := range durations {
+		if d > cutoff {
+			continue
+		}
+		// Welford's online mean and variance
+		class := classes[i] & 1
+		n[class]++
+		delta := d - mean[class]
+		mean[class] += delta / n[class]
+		m2[class] += delta * (d - mean[class])
+	}
+	qt.Assert(t, n[0] > 1 && n[1] > 1, qt.IsTrue)
+	tValue := (mean[0] - mean[1]) / math.Sqrt(m2[0]/(n[0]-1)/n[0]+m2[1]/(n[1]-1)/n[1])
+	qt.Assert(t, math.Abs(tValue) < timingThreshold, qt.IsTrue,
+		qt.Commentf("low %s, high %s, t = %.2f", time.Duration(mean[0]), time.Duration(mean[1]), tValue))
+}
+
+// BenchmarkMultiScalarMult compares MultiScalarMult with multiplying and
+// adding each point independently.
+func BenchmarkMultiScalarMult(b *testing.B, curve ecc.Point) {
+	for _, n := range []int{10, 100, 1000} {
+		points, scalars := RandomPointsAndScalars(b, curve, n)
+		b.Run(fmt.Sprintf("pippenger/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = curve.New().MultiScalarMult(points, scalars)
+			}
+		})
+		b.Run(fmt.Sprintf("naive/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				res, term := curve.New(), curve.New()
+				for j := range points {
+					term.ScalarMult(points[j], scalars[j])
+					res.Add(res, term)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package ecc
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math/big"
+)
+
+// SecretScalarSize is the size in bytes of the fixed-width buffer used to
+// hold a SecretScalar. It is large enough for any scalar of the supported
+// curves (BN254 and BabyJubJub).
+const SecretScalarSize = 32
+
+// SecretScalarBits is the number of bits iterated by the constant-time
+// scalar multiplication, regardless of the actual value of the scalar.
+const SecretScalarBits = SecretScalarSize * 8
+
+// SecretScalar holds a secret scalar (e.g. a private key or a private share)
+// in a fixed-width big-endian buffer. Unlike *big.Int, its representation
+// does not depend on the value it holds, which allows the curve
+// implementations to multiply by it in constant time, and it can be zeroed
+// once it is no longer needed so the secret does not linger in memory.
+type SecretScalar struct {
+	b [SecretScalarSize]byte
+}
+
+// NewSecretScalar creates a new SecretScalar with the value of k. The value
+// must be non-negative and fit in SecretScalarSize bytes, otherwise an error
+// is returned. The caller is responsible of zeroing k if it is no longer
+// needed (see ZeroBigInt).
+func NewSecretScalar(k *big.Int) (*SecretScalar, error) {
+	if k == nil {
+		return nil, fmt.Errorf("secret scalar cannot be nil")
+	}
+	if k.Sign() < 0 {
+		return nil, fmt.Errorf("secret scalar cannot be negative")
+	}
+	if k.BitLen() > SecretScalarBits {
+		return nil, fmt.Errorf("secret scalar too large: %d bits", k.BitLen())
+	}
+	s := &SecretScalar{}
+	k.FillBytes(s.b[:])
+	return s, nil
+}
+
+// MustSecretScalar is like NewSecretScalar but panics on error. It is
+// intended to be used with scalars that are already known to be valid, such
+// as keys reduced modulo the curve order.
+func MustSecretScalar(k *big.Int) *SecretScalar {
+	s, err := NewSecretScalar(k)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Bit returns the i-th bit of the scalar (0 being the least significant
+// bit) as 0 or 1. It does not branch on the value of the scalar.
+func (s *SecretScalar) Bit(i int) uint {
+	return uint(s.b[SecretScalarSize-1-i/8]>>(uint(i)%8)) & 1
+}
+
+// BigInt returns a copy of the scalar as *big.Int. The returned value is not
+// protected anymore, so it should only be used to serialize or export the
+// secret, and zeroed by the caller afterwards.
+func (s *SecretScalar) BigInt() *big.Int {
+	return new(big.Int).SetBytes(s.b[:])
+}
+
+// IsZero returns true if the scalar is zero, in constant time.
+func (s *SecretScalar) IsZero() bool {
+	var zero [SecretScalarSize]byte
+	return subtle.ConstantTimeCompare(s.b[:], zero[:]) == 1
+}
+
+// Equal returns true if both scalars are equal, in constant time.
+func (s *SecretScalar) Equal(o *SecretScalar) bool {
+	return subtle.ConstantTimeCompare(s.b[:], o.b[:]) == 1
+}
+
+// Zero overwrites the scalar with zeros. The SecretScalar can not be used
+// anymore to perform operations after calling it.
+func (s *SecretScalar) Zero() {
+	if s == nil {
+		return
+	}
+	clear(s.b[:])
+}
+
+// ZeroBigInt overwrites the memory used by the given big.Int with zeros and
+// sets it to zero. It helps to remove secrets that have been temporarily
+// stored as *big.Int from memory.
+func ZeroBigInt(k *big.Int) {
+	if k == nil {
+		return
+	}
+	words := k.Bits()
+	clear(words[:cap(words)])
+	k.SetInt64(0)
+}
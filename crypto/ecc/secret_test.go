@@ -0,0 +1,48 @@
+package ecc
+
+import (
+	"math/big"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestSecretScalar(t *testing.T) {
+	c := qt.New(t)
+
+	k := big.NewInt(0b1011)
+	s, err := NewSecretScalar(k)
+	c.Assert(err, qt.IsNil)
+	c.Assert(s.BigInt().Cmp(k), qt.Equals, 0)
+	c.Assert(s.Bit(0), qt.Equals, uint(1))
+	c.Assert(s.Bit(1), qt.Equals, uint(1))
+	c.Assert(s.Bit(2), qt.Equals, uint(0))
+	c.Assert(s.Bit(3), qt.Equals, uint(1))
+	c.Assert(s.Bit(SecretScalarBits-1), qt.Equals, uint(0))
+	c.Assert(s.IsZero(), qt.IsFalse)
+	c.Assert(s.Equal(MustSecretScalar(big.NewInt(11))), qt.IsTrue)
+
+	s.Zero()
+	c.Assert(s.IsZero(), qt.IsTrue)
+	c.Assert(s.BigInt().Sign(), qt.Equals, 0)
+
+	_, err = NewSecretScalar(big.NewInt(-1))
+	c.Assert(err, qt.IsNotNil)
+	_, err = NewSecretScalar(new(big.Int).Lsh(big.NewInt(1), SecretScalarBits))
+	c.Assert(err, qt.IsNotNil)
+	_, err = NewSecretScalar(nil)
+	c.Assert(err, qt.IsNotNil)
+}
+
+func TestZeroBigInt(t *testing.T) {
+	c := qt.New(t)
+
+	k, ok := new(big.Int).SetString("123456789012345678901234567890", 10)
+	c.Assert(ok, qt.IsTrue)
+	words := k.Bits()
+	ZeroBigInt(k)
+	c.Assert(k.Sign(), qt.Equals, 0)
+	for _, w := range words {
+		c.Assert(w, qt.Equals, big.Word(0))
+	}
+}
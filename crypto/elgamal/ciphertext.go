@@ -56,6 +56,43 @@ func (z *Ciphertext) Add(x, y *Ciphertext) *Ciphertext {
 	return z
 }
 
+// Sum sets z to the sum of the given ciphertexts and returns it. Each
+// component is computed with a single multi-scalar multiplication, which is
+// faster than adding the ciphertexts one by one.
+func (z *Ciphertext) Sum(cts []*Ciphertext) (*Ciphertext, error) {
+	one := big.NewInt(1)
+	weights := make([]*big.Int, len(cts))
+	for i := range weights {
+		weights[i] = one
+	}
+	return z.WeightedSum(cts, weights)
+}
+
+// WeightedSum sets z to sum(weights[i] * cts[i]) and returns it. Since the
+// ElGamal encryption is additively homomorphic, the result is the encryption
+// of the weighted sum of the messages.
+func (z *Ciphertext) WeightedSum(cts []*Ciphertext, weights []*big.Int) (*Ciphertext, error) {
+	if len(cts) != len(weights) {
+		return nil, fmt.Errorf("ciphertexts and weights length mismatch: %d != %d", len(cts), len(weights))
+	}
+	c1s := make([]ecc.Point, len(cts))
+	c2s := make([]ecc.Point, len(cts))
+	for i, ct := range cts {
+		c1s[i] = ct.C1
+		c2s[i] = ct.C2
+	}
+	c1, c2 := z.C1.New(), z.C2.New()
+	if err := c1.MultiScalarMult(c1s, weights); err != nil {
+		return nil, fmt.Errorf("failed to sum C1: %w", err)
+	}
+	if err := c2.MultiScalarMult(c2s, weights); err != nil {
+		return nil, fmt.Errorf("failed to sum C2: %w", err)
+	}
+	z.C1 = c1
+	z.C2 = c2
+	return z, nil
+}
+
 // Serialize returns a slice of len 4*32 bytes,
 // representing the C1.X, C1.Y, C2.X, C2.Y as little-endian,
 // in reduced twisted edwards form.
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc"
 	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/curves"
 )
 
@@ -77,6 +78,47 @@ func TestCiphertext_Add(t *testing.T) {
 	c.Assert(sum.C2, qt.Not(qt.IsNil))
 }
 
+func TestCiphertext_Sum(t *testing.T) {
+	c := qt.New(t)
+
+	for _, curveType := range []string{curves.CurveTypeBN254, curves.CurveTypeBabyJubJubGnark} {
+		publicKey, privateKey, err := GenerateKey(curves.New(curveType))
+		c.Assert(err, qt.IsNil)
+		secret := ecc.MustSecretScalar(privateKey)
+
+		msgs := []int64{3, 0, 7, 1, 5}
+		weights := []*big.Int{big.NewInt(2), big.NewInt(1), big.NewInt(3), big.NewInt(10), big.NewInt(1)}
+		cts := make([]*Ciphertext, len(msgs))
+		for i, m := range msgs {
+			cts[i], err = NewCiphertext(publicKey).Encrypt(big.NewInt(m), publicKey, nil)
+			c.Assert(err, qt.IsNil)
+		}
+
+		// the sum must match adding the ciphertexts one by one
+		sum, err := NewCiphertext(publicKey).Sum(cts)
+		c.Assert(err, qt.IsNil)
+		expected := NewCiphertext(publicKey)
+		for _, ct := range cts {
+			expected.Add(expected, ct)
+		}
+		c.Assert(sum.C1.Equal(expected.C1), qt.IsTrue, qt.Commentf("curve %s", curveType))
+		c.Assert(sum.C2.Equal(expected.C2), qt.IsTrue, qt.Commentf("curve %s", curveType))
+		_, decrypted, err := Decrypt(publicKey, secret, sum.C1, sum.C2, 100)
+		c.Assert(err, qt.IsNil)
+		c.Assert(decrypted.Int64(), qt.Equals, int64(16))
+
+		// the weighted sum decrypts to the weighted sum of the messages
+		wsum, err := NewCiphertext(publicKey).WeightedSum(cts, weights)
+		c.Assert(err, qt.IsNil)
+		_, decrypted, err = Decrypt(publicKey, secret, wsum.C1, wsum.C2, 100)
+		c.Assert(err, qt.IsNil)
+		c.Assert(decrypted.Int64(), qt.Equals, int64(2*3+0+3*7+10*1+5))
+
+		_, err = NewCiphertext(publicKey).WeightedSum(cts, weights[:2])
+		c.Assert(err, qt.IsNotNil)
+	}
+}
+
 func TestCiphertext_SerializeDeserialize(t *testing.T) {
 	c := qt.New(t)
 
@@ -9,10 +9,13 @@ import (
 )
 
 // ComputePartialDecryption computes the partial decryption using the participant's private share.
+// The private share is multiplied in constant time and the temporary copy is zeroed afterwards.
 func (p *Participant) ComputePartialDecryption(c1 ecc.Point) ecc.Point {
+	share := ecc.MustSecretScalar(p.PrivateShare)
+	defer share.Zero()
 	// Compute s_i = privateShare * C1.
 	si := c1.New()
-	si.ScalarMult(c1, p.PrivateShare)
+	si.SecretScalarMult(c1, share)
 	return si
 }
 
@@ -25,13 +28,19 @@ func CombinePartialDecryptions(c2 ecc.Point, partialDecryptions map[int]ecc.Poin
 	}
 
 	// Sum up the partial decryptions weighted by Lagrange coefficients.
+	pds := make([]ecc.Point, len(participants))
+	lambdas := make([]*big.Int, len(participants))
+	for i, id := range participants {
+		pd, ok := partialDecryptions[id]
+		if !ok {
+			return nil, fmt.Errorf("missing partial decryption from participant %d", id)
+		}
+		pds[i] = pd
+		lambdas[i] = lagrangeCoeffs[id]
+	}
 	s := c2.New()
-	for _, id := range participants {
-		pd := partialDecryptions[id]
-		lambda := lagrangeCoeffs[id]
-		term := s.New()
-		term.ScalarMult(pd, lambda)
-		s.Add(s, term)
+	if err := s.MultiScalarMult(pds, lambdas); err != nil {
+		return nil, fmt.Errorf("failed to combine partial decryptions: %w", err)
 	}
 	// Compute M = C2 - s.
 	s.Neg(s)
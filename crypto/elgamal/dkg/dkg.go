@@ -103,17 +103,16 @@ func (p *Participant) verifyShare(share *big.Int, publicCoeffs []ecc.Point) bool
 	lhs.ScalarBaseMult(share)
 
 	// Compute rhs = sum_{i} publicCoeffs[i] * x^{i}
-	rhs := p.CurvePoint.New()
 	x := big.NewInt(int64(p.ID))
+	xPowers := make([]*big.Int, len(publicCoeffs))
 	xPower := big.NewInt(1)
-
-	for _, coeffCommitment := range publicCoeffs {
-		term := p.CurvePoint.New()
-		term.ScalarMult(coeffCommitment, xPower)
-		rhs.Add(rhs, term)
-
+	for i := range publicCoeffs {
+		xPowers[i] = new(big.Int).Set(xPower)
 		xPower.Mul(xPower, x)
-		// xPower.Mod(xPower, order) // Ensure this is removed
+	}
+	rhs := p.CurvePoint.New()
+	if err := rhs.MultiScalarMult(publicCoeffs, xPowers); err != nil {
+		return false
 	}
 
 	return lhs.Equal(rhs)
@@ -137,3 +136,19 @@ func (p *Participant) AggregatePublicKey(allPublicCoeffs map[int][]ecc.Point) {
 	}
 	p.PublicKey = pk
 }
+
+// ZeroSecrets overwrites the secret coefficients, the shares and the private
+// share of the participant with zeros, so they do not linger in memory once
+// the participant is no longer needed.
+func (p *Participant) ZeroSecrets() {
+	for _, coeff := range p.SecretCoeffs {
+		ecc.ZeroBigInt(coeff)
+	}
+	for _, share := range p.SecretShares {
+		ecc.ZeroBigInt(share)
+	}
+	for _, share := range p.ReceivedShares {
+		ecc.ZeroBigInt(share)
+	}
+	ecc.ZeroBigInt(p.PrivateShare)
+}
@@ -11,7 +11,7 @@ import (
 
 // ScalarECIES encapsulates methods for encryption and decryption of a scalar, using elliptic curve cryptography.
 type ScalarECIES struct {
-	privateKey *big.Int
+	privateKey *ecc.SecretScalar
 	publicKey  ecc.Point
 	curvePoint ecc.Point
 	hashFunc   func([]byte) [32]byte
@@ -37,9 +37,14 @@ func New(privateKey *big.Int, curve ecc.Point, hashFunc func([]byte) [32]byte) (
 			return nil, err
 		}
 	} else {
-		se.privateKey = privateKey
+		secret, err := ecc.NewSecretScalar(new(big.Int).Mod(privateKey, curve.Order()))
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key: %w", err)
+		}
+		se.privateKey = secret
 		publicKey := curve.New()
-		publicKey.ScalarBaseMult(privateKey)
+		publicKey.SetGenerator()
+		publicKey.SecretScalarMult(publicKey, secret)
 		se.publicKey = publicKey
 	}
 	return se, nil
@@ -56,12 +61,17 @@ func (se *ScalarECIES) generateKeys() error {
 	if privateKey.Sign() == 0 {
 		privateKey.Add(privateKey, big.NewInt(1)) // Ensure privateKey != 0
 	}
-	se.privateKey = privateKey
+	secret, err := ecc.NewSecretScalar(privateKey)
+	ecc.ZeroBigInt(privateKey)
+	if err != nil {
+		return err
+	}
+	se.privateKey = secret
 
 	// Compute publicKey = privateKey * G
 	publicKey := se.curvePoint.New()
 	publicKey.SetGenerator()
-	publicKey.ScalarMult(publicKey, privateKey)
+	publicKey.SecretScalarMult(publicKey, secret)
 	se.publicKey = publicKey
 	return nil
 }
@@ -71,9 +81,16 @@ func (se *ScalarECIES) GetPublicKey() []byte {
 	return se.publicKey.Marshal()
 }
 
-// GetPrivateKey returns the private key.
+// GetPrivateKey returns a copy of the private key. The caller should zero
+// it (see ecc.ZeroBigInt) once it is no longer needed.
 func (se *ScalarECIES) GetPrivateKey() *big.Int {
-	return se.privateKey
+	return se.privateKey.BigInt()
+}
+
+// Zero overwrites the private key with zeros. The instance can not be used
+// to decrypt anymore after calling it.
+func (se *ScalarECIES) Zero() {
+	se.privateKey.Zero()
 }
 
 // Encrypt encrypts a message (scalar) using the recipient's public key.
@@ -121,7 +138,7 @@ func (se *ScalarECIES) Decrypt(c *big.Int, RBytes []byte) (*big.Int, error) {
 
 	// Compute shared secret point S = sk * R
 	S := se.curvePoint.New()
-	S.ScalarMult(R, se.privateKey)
+	S.SecretScalarMult(R, se.privateKey)
 
 	// Hash S to get shared secret scalar s
 	s := se.hashPointToScalar(S)
@@ -80,11 +80,12 @@ func GenerateKey(curve ecc.Point) (publicKey ecc.Point, privateKey *big.Int, err
 
 // Decrypt decrypts the given ciphertext (c1, c2) using the private key.
 // It returns the point M = c2 - d*c1 and the discrete log message scalar.
-// If no solution is found, returns an error.
-func Decrypt(publicKey ecc.Point, privateKey *big.Int, c1, c2 ecc.Point, maxMessage uint64) (M ecc.Point, message *big.Int, err error) {
+// If no solution is found, returns an error. The private key is only used
+// through constant-time scalar multiplication.
+func Decrypt(publicKey ecc.Point, privateKey *ecc.SecretScalar, c1, c2 ecc.Point, maxMessage uint64) (M ecc.Point, message *big.Int, err error) {
 	// Compute M = c2 - d*c1
 	dC1 := c2.New()
-	dC1.ScalarMult(c1, privateKey)
+	dC1.SecretScalarMult(c1, privateKey)
 	dC1.Neg(dC1) // dC1 = -d*c1
 
 	M = c2.New()
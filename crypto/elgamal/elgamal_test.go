@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc"
 	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/curves"
 )
 
@@ -39,7 +40,7 @@ func TestEncryptDecrypt(t *testing.T) {
 		c.Assert(err, qt.IsNil)
 		c.Assert(k, qt.Not(qt.IsNil))
 
-		M, recoveredMsg, err := Decrypt(publicKey, privateKey, c1, c2, maxMessage)
+		M, recoveredMsg, err := Decrypt(publicKey, ecc.MustSecretScalar(privateKey), c1, c2, maxMessage)
 		c.Assert(err, qt.IsNil)
 		c.Assert(recoveredMsg.String(), qt.DeepEquals, msg.String())
 
@@ -77,7 +78,7 @@ func TestCheckK(t *testing.T) {
 	c.Assert(CheckK(c1, wrongK), qt.IsFalse, qt.Commentf("CheckK failed: it should not have matched this wrong k"))
 
 	// Bonus: try decrypting to ensure correctness (not necessary for CheckK logic)
-	M, mInt, err := Decrypt(pubKey, privKey, c1, c2, maxMsg)
+	M, mInt, err := Decrypt(pubKey, ecc.MustSecretScalar(privKey), c1, c2, maxMsg)
 	c.Assert(err, qt.IsNil)
 	c.Assert(mInt.Cmp(msg), qt.Equals, 0, qt.Commentf("Decryption mismatch: got %s, want %s", mInt.String(), msg.String()))
 	c.Assert(M, qt.Not(qt.IsNil), qt.Commentf("M point is nil after decrypt"))
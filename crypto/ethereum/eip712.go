@@ -0,0 +1,79 @@
+package ethereum
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// TypedDataDomainTypes are the fields of the domains returned by
+// TypedDataDomain, which must be the EIP712Domain type of the typed data.
+var TypedDataDomainTypes = []apitypes.Type{
+	{Name: "name", Type: "string"},
+	{Name: "version", Type: "string"},
+	{Name: "chainId", Type: "uint256"},
+}
+
+// TypedDataDomain returns the EIP-712 domain with the name, version and chain
+// ID provided, which separates the signatures of an application and chain
+// from any other. Its fields are TypedDataDomainTypes.
+func TypedDataDomain(name, version string, chainID uint64) apitypes.TypedDataDomain {
+	return apitypes.TypedDataDomain{
+		Name:    name,
+		Version: version,
+		ChainId: (*math.HexOrDecimal256)(new(big.Int).SetUint64(chainID)),
+	}
+}
+
+// TypedDataHash returns the EIP-712 digest of the typed data, which is the
+// hash signed by the wallets. The values of the message are checked against
+// their types.
+func TypedDataHash(data *apitypes.TypedData) ([]byte, error) {
+	hash, _, err := apitypes.TypedDataAndHash(*data)
+	if err != nil {
+		return nil, fmt.Errorf("could not hash typed data: %w", err)
+	}
+	return hash, nil
+}
+
+// SignTypedData signs the EIP-712 typed data.
+func (k *SignKeys) SignTypedData(data *apitypes.TypedData) ([]byte, error) {
+	if k.Private.D == nil {
+		return nil, errors.New("no private key available")
+	}
+	hash, err := TypedDataHash(data)
+	if err != nil {
+		return nil, err
+	}
+	return ethcrypto.Sign(hash, &k.Private)
+}
+
+// AddrFromTypedDataSignature recovers the Ethereum address that signed the
+// EIP-712 typed data.
+func AddrFromTypedDataSignature(data *apitypes.TypedData, signature []byte) (ethcommon.Address, error) {
+	if len(signature) != SignatureLength {
+		return ethcommon.Address{}, fmt.Errorf("signature length not correct (%d)", len(signature))
+	}
+	hash, err := TypedDataHash(data)
+	if err != nil {
+		return ethcommon.Address{}, err
+	}
+	// the wallets add 27 to the recovery ID
+	sig := ethcommon.CopyBytes(signature)
+	if sig[64] > 1 {
+		sig[64] -= 27
+	}
+	if sig[64] > 1 {
+		return ethcommon.Address{}, errors.New("bad recover ID byte")
+	}
+	pubKey, err := ethcrypto.SigToPub(hash, sig)
+	if err != nil {
+		return ethcommon.Address{}, fmt.Errorf("sigToPub %w", err)
+	}
+	return ethcrypto.PubkeyToAddress(*pubKey), nil
+}
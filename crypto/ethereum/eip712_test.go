@@ -0,0 +1,121 @@
+package ethereum
+
+import (
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	qt "github.com/frankban/quicktest"
+)
+
+// mailExample returns the typed data of the example of EIP-712.
+func mailExample() *apitypes.TypedData {
+	return &apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {
+				{Name: "name", Type: "string"},
+				{Name: "version", Type: "string"},
+				{Name: "chainId", Type: "uint256"},
+				{Name: "verifyingContract", Type: "address"},
+			},
+			"Person": {
+				{Name: "name", Type: "string"},
+				{Name: "wallet", Type: "address"},
+			},
+			"Mail": {
+				{Name: "from", Type: "Person"},
+				{Name: "to", Type: "Person"},
+				{Name: "contents", Type: "string"},
+			},
+		},
+		PrimaryType: "Mail",
+		Domain: apitypes.TypedDataDomain{
+			Name:              "Ether Mail",
+			Version:           "1",
+			ChainId:           math.NewHexOrDecimal256(1),
+			VerifyingContract: "0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC",
+		},
+		Message: apitypes.TypedDataMessage{
+			"from": map[string]any{
+				"name":   "Cow",
+				"wallet": "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826",
+			},
+			"to": map[string]any{
+				"name":   "Bob",
+				"wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB",
+			},
+			"contents": "Hello, Bob!",
+		},
+	}
+}
+
+func TestTypedData(t *testing.T) {
+	c := qt.New(t)
+	t.Parallel()
+
+	data := mailExample()
+	c.Assert(string(data.EncodeType("Mail")), qt.Equals, "Mail(Person from,Person to,string contents)Person(string name,address wallet)")
+	domainSeparator, err := data.HashStruct("EIP712Domain", data.Domain.Map())
+	c.Assert(err, qt.IsNil)
+	c.Assert(hex.EncodeToString(domainSeparator), qt.Equals, "f2cee375fa42b42143804025fc449deafd50cc031ca257e0b194a650a912090f")
+	structHash, err := data.HashStruct("Mail", data.Message)
+	c.Assert(err, qt.IsNil)
+	c.Assert(hex.EncodeToString(structHash), qt.Equals, "c52c0ee5d84264471806290a3f2c4cecfc5490626bf912d01f240d7a274b371e")
+	hash, err := TypedDataHash(data)
+	c.Assert(err, qt.IsNil)
+	c.Assert(hex.EncodeToString(hash), qt.Equals, "be609aee343fb3c4b28e1df9e632fca64fcfaede20f02e86244efddf30957bd2")
+
+	// The signature of the example, with the key of "cow"
+	s := NewSignKeys()
+	c.Assert(s.AddHexKey(hex.EncodeToString(ethcrypto.Keccak256([]byte("cow")))), qt.IsNil)
+	c.Assert(s.Address(), qt.Equals, ethcommon.HexToAddress("0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"))
+	signature, err := s.SignTypedData(data)
+	c.Assert(err, qt.IsNil)
+	c.Assert(hex.EncodeToString(signature), qt.Equals, "4355c47d63924e8a72e509b65029052eb6c299d53a04e167c5775fd466751c9d"+
+		"07299936d304c153f6443dfa05f40ff007d72911b6f72307f996231605b91562"+"01")
+
+	// The address is recovered with both recovery ID formats
+	addr, err := AddrFromTypedDataSignature(data, signature)
+	c.Assert(err, qt.IsNil)
+	c.Assert(addr, qt.Equals, s.Address())
+	walletSignature := ethcommon.CopyBytes(signature)
+	walletSignature[64] += 27
+	addr, err = AddrFromTypedDataSignature(data, walletSignature)
+	c.Assert(err, qt.IsNil)
+	c.Assert(addr, qt.Equals, s.Address())
+	c.Assert(walletSignature[64], qt.Equals, byte(28))
+
+	// Another domain recovers another address
+	data.Types["EIP712Domain"] = TypedDataDomainTypes
+	data.Domain = TypedDataDomain("Ether Mail", "1", 1)
+	addr, err = AddrFromTypedDataSignature(data, signature)
+	c.Assert(err, qt.IsNil)
+	c.Assert(addr, qt.Not(qt.Equals), s.Address())
+
+	// The values are checked against their types
+	for _, f := range []struct {
+		typ   string
+		value any
+	}{
+		{"uint8", big.NewInt(256)},
+		{"uint256", big.NewInt(-1)},
+		{"bool", "true"},
+		{"address", "0x01"},
+	} {
+		data := &apitypes.TypedData{
+			Types: apitypes.Types{
+				"EIP712Domain": TypedDataDomainTypes,
+				"T":            {{Name: "f", Type: f.typ}},
+			},
+			PrimaryType: "T",
+			Domain:      TypedDataDomain("test", "1", 1),
+			Message:     apitypes.TypedDataMessage{"f": f.value},
+		}
+		_, err := TypedDataHash(data)
+		c.Assert(err, qt.Not(qt.IsNil), qt.Commentf("%s value %v", f.typ, f.value))
+	}
+}
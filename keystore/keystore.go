@@ -0,0 +1,88 @@
+// Package keystore provides the backends that manage the ElGamal encryption
+// keys of the voting processes. The private keys never leave the backend:
+// the rest of the sequencer only gets the public keys and the partial
+// decryptions computed with them, so the keys can be moved to a hardware
+// security module without touching the vote path.
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/curves"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/elgamal"
+	"github.com/vocdoni/vocdoni-z-sandbox/metrics"
+	"github.com/vocdoni/vocdoni-z-sandbox/state"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+// ErrKeyNotFound is returned when there are no keys for the process.
+var ErrKeyNotFound = errors.New("key not found")
+
+// CurveType is the curve of the keys generated by the keystores. It must be
+// the one used by the state to accumulate the encrypted ballots.
+var CurveType = curves.Type(state.Curve)
+
+// KeyStore is the interface implemented by the encryption key backends.
+type KeyStore interface {
+	// GenerateKey creates a new key pair for the process and returns its
+	// public key. It fails if the process already has a key.
+	GenerateKey(pid types.ProcessID) (ecc.Point, error)
+
+	// PublicKey returns the public key of the process, or ErrKeyNotFound.
+	PublicKey(pid types.ProcessID) (ecc.Point, error)
+
+	// PartialDecrypt returns privateKey*c1, the point that must be
+	// subtracted from c2 to decrypt the ciphertext (c1, c2).
+	PartialDecrypt(pid types.ProcessID, c1 ecc.Point) (ecc.Point, error)
+
+	// Decrypt decrypts the ciphertext (c1, c2) encrypted with the public key
+	// of the process and returns the message, which must be in the range
+	// [0, maxMessage].
+	Decrypt(pid types.ProcessID, c1, c2 ecc.Point, maxMessage uint64) (*big.Int, error)
+}
+
+// decrypt decrypts the ciphertext (c1, c2) using only the partial
+// decryption computed by the keystore, so the backends that can not export
+// the private key share the same decryption logic.
+func decrypt(ks KeyStore, pid types.ProcessID, c1, c2 ecc.Point, maxMessage uint64) (*big.Int, error) {
+	partial, err := ks.PartialDecrypt(pid, c1)
+	if err != nil {
+		return nil, err
+	}
+	// M = c2 - d*c1
+	M := c2.New()
+	M.Neg(partial)
+	M.Add(M, c2)
+
+	G := c2.New()
+	G.SetGenerator()
+	start := time.Now()
+	message, err := elgamal.BabyStepGiantStepECC(M, G, maxMessage)
+	metrics.BSGSDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt: %w", err)
+	}
+	return message, nil
+}
+
+// Tally decrypts the results of a process with the key held by the keystore.
+// The results are the sum of the encrypted ballots added to the state
+// (resultsAdd) minus the sum of the ones overwritten (resultsSub), which is
+// computed homomorphically so a single decryption is needed. The result
+// must be in the range [0, maxValue].
+func Tally(ks KeyStore, pid types.ProcessID, resultsAdd, resultsSub *elgamal.Ciphertext, maxValue uint64) (*big.Int, error) {
+	c1, c2 := resultsSub.C1.New(), resultsSub.C2.New()
+	c1.Neg(resultsSub.C1)
+	c1.Add(c1, resultsAdd.C1)
+	c2.Neg(resultsSub.C2)
+	c2.Add(c2, resultsAdd.C2)
+	results, err := ks.Decrypt(pid, c1, c2, maxValue)
+	if err != nil {
+		return nil, fmt.Errorf("could not tally results: %w", err)
+	}
+	return results, nil
+}
@@ -0,0 +1,83 @@
+package keystore
+
+import (
+	"bytes"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/curves"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/elgamal"
+	"github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/db/metadb"
+)
+
+func newTestLocal(c *qt.C) *Local {
+	database, err := metadb.New(db.TypePebble, filepath.Join(c.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	stg, err := storage.New(database, bytes.Repeat([]byte{1}, storage.MasterKeySize))
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(stg.Close)
+	return NewLocal(stg)
+}
+
+func testKeyStore(c *qt.C, ks KeyStore) {
+	pid := types.ProcessID{Address: common.Address{1}, Nonce: 1, ChainID: 1}
+
+	_, err := ks.PublicKey(pid)
+	c.Assert(err, qt.ErrorIs, ErrKeyNotFound)
+	g := curves.New(CurveType).New()
+	g.SetGenerator()
+	_, err = ks.Decrypt(pid, g, g, 10)
+	c.Assert(err, qt.ErrorIs, ErrKeyNotFound)
+
+	publicKey, err := ks.GenerateKey(pid)
+	c.Assert(err, qt.IsNil)
+	_, err = ks.GenerateKey(pid)
+	c.Assert(err, qt.IsNotNil, qt.Commentf("the key of a process can not be replaced"))
+
+	stored, err := ks.PublicKey(pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stored.Equal(publicKey), qt.IsTrue)
+
+	msg := big.NewInt(42)
+	c1, c2, _, err := elgamal.Encrypt(publicKey, msg)
+	c.Assert(err, qt.IsNil)
+	decrypted, err := ks.Decrypt(pid, c1, c2, 100)
+	c.Assert(err, qt.IsNil)
+	c.Assert(decrypted.Cmp(msg), qt.Equals, 0)
+
+	// the results are the ballots added minus the ones overwritten
+	add := elgamal.NewCiphertext(publicKey)
+	sub := elgamal.NewCiphertext(publicKey)
+	for _, v := range []int64{3, 5, 7} {
+		ct, err := elgamal.NewCiphertext(publicKey).Encrypt(big.NewInt(v), publicKey, nil)
+		c.Assert(err, qt.IsNil)
+		add.Add(add, ct)
+	}
+	ct, err := elgamal.NewCiphertext(publicKey).Encrypt(big.NewInt(5), publicKey, nil)
+	c.Assert(err, qt.IsNil)
+	sub.Add(sub, ct)
+	results, err := Tally(ks, pid, add, sub, 100)
+	c.Assert(err, qt.IsNil)
+	c.Assert(results.Int64(), qt.Equals, int64(10))
+}
+
+func TestLocal(t *testing.T) {
+	c := qt.New(t)
+	testKeyStore(c, newTestLocal(c))
+}
+
+func TestSocket(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(c.TempDir(), "keystore.sock")
+	srv, err := NewSocketServer(path, newTestLocal(c))
+	c.Assert(err, qt.IsNil)
+	defer srv.Close()
+
+	testKeyStore(c, NewSocket(path))
+}
@@ -0,0 +1,84 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/curves"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/elgamal"
+	"github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+// Local is a KeyStore that keeps the keys in the sequencer database,
+// encrypted with the storage master key.
+type Local struct {
+	storage *storage.Storage
+}
+
+// NewLocal creates a new Local keystore backed by the storage provided.
+func NewLocal(stg *storage.Storage) *Local {
+	return &Local{storage: stg}
+}
+
+// GenerateKey creates a new key pair for the process, stores it and
+// returns the public key.
+func (l *Local) GenerateKey(pid types.ProcessID) (ecc.Point, error) {
+	publicKey, privateKey, err := elgamal.GenerateKey(curves.New(CurveType))
+	if err != nil {
+		return nil, fmt.Errorf("could not generate key: %w", err)
+	}
+	defer ecc.ZeroBigInt(privateKey)
+	if err := l.storage.SetEncryptionKeys(pid, publicKey, privateKey); err != nil {
+		return nil, fmt.Errorf("could not store key: %w", err)
+	}
+	return publicKey, nil
+}
+
+// PublicKey returns the public key of the process. The private key is not
+// unsealed to read it.
+func (l *Local) PublicKey(pid types.ProcessID) (ecc.Point, error) {
+	publicKey, err := l.storage.EncryptionPublicKey(pid)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
+	return publicKey, nil
+}
+
+// PartialDecrypt returns privateKey*c1 for the key of the process.
+func (l *Local) PartialDecrypt(pid types.ProcessID, c1 ecc.Point) (ecc.Point, error) {
+	_, privateKey, err := l.keys(pid)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ecc.NewSecretScalar(privateKey)
+	ecc.ZeroBigInt(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Zero()
+	partial := c1.New()
+	partial.SecretScalarMult(c1, secret)
+	return partial, nil
+}
+
+// Decrypt decrypts the ciphertext (c1, c2) with the key of the process.
+func (l *Local) Decrypt(pid types.ProcessID, c1, c2 ecc.Point, maxMessage uint64) (*big.Int, error) {
+	return decrypt(l, pid, c1, c2, maxMessage)
+}
+
+func (l *Local) keys(pid types.ProcessID) (ecc.Point, *big.Int, error) {
+	publicKey, privateKey, err := l.storage.EncryptionKeys(pid)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil, ErrKeyNotFound
+		}
+		return nil, nil, err
+	}
+	return publicKey, privateKey, nil
+}
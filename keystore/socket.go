@@ -0,0 +1,203 @@
+package keystore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/curves"
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+// Socket operations, modelled after the PKCS#11 functions used to manage
+// key pairs in a token: the private key is an opaque object that can only
+// be used to derive points, never read.
+const (
+	socketOpGenerateKey    = "generateKeyPair" // C_GenerateKeyPair
+	socketOpPublicKey      = "getPublicKey"    // C_GetAttributeValue(CKA_EC_POINT)
+	socketOpPartialDecrypt = "derive"          // C_DeriveKey(CKM_ECDH1_DERIVE)
+)
+
+// socketRequest is the message sent by the Socket client.
+type socketRequest struct {
+	Op        string         `json:"op"`
+	ProcessID types.HexBytes `json:"processId"`
+	Point     types.HexBytes `json:"point,omitempty"`
+}
+
+// socketResponse is the message returned by the SocketServer.
+type socketResponse struct {
+	Point    types.HexBytes `json:"point,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	NotFound bool           `json:"notFound,omitempty"`
+}
+
+// Socket is a KeyStore client for a key management service listening on a
+// Unix socket, as served by SocketServer. It is a stand-in for a PKCS#11
+// token: the keys are generated and used by the service, and only the
+// public keys and partial decryptions are sent over the socket.
+type Socket struct {
+	path string
+}
+
+// NewSocket creates a new Socket keystore client connected to the Unix
+// socket in the path provided.
+func NewSocket(path string) *Socket {
+	return &Socket{path: path}
+}
+
+// GenerateKey asks the service to create a new key pair for the process and
+// returns the public key.
+func (s *Socket) GenerateKey(pid types.ProcessID) (ecc.Point, error) {
+	return s.call(&socketRequest{Op: socketOpGenerateKey, ProcessID: pid.Marshal()})
+}
+
+// PublicKey returns the public key of the process.
+func (s *Socket) PublicKey(pid types.ProcessID) (ecc.Point, error) {
+	return s.call(&socketRequest{Op: socketOpPublicKey, ProcessID: pid.Marshal()})
+}
+
+// PartialDecrypt asks the service to compute privateKey*c1 for the key of
+// the process.
+func (s *Socket) PartialDecrypt(pid types.ProcessID, c1 ecc.Point) (ecc.Point, error) {
+	return s.call(&socketRequest{
+		Op:        socketOpPartialDecrypt,
+		ProcessID: pid.Marshal(),
+		Point:     c1.Marshal(),
+	})
+}
+
+// Decrypt decrypts the ciphertext (c1, c2) with the key of the process. Only
+// the partial decryption is computed by the service.
+func (s *Socket) Decrypt(pid types.ProcessID, c1, c2 ecc.Point, maxMessage uint64) (*big.Int, error) {
+	return decrypt(s, pid, c1, c2, maxMessage)
+}
+
+func (s *Socket) call(req *socketRequest) (ecc.Point, error) {
+	conn, err := net.Dial("unix", s.path)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to keystore: %w", err)
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("could not send keystore request: %w", err)
+	}
+	resp := &socketResponse{}
+	if err := json.NewDecoder(conn).Decode(resp); err != nil {
+		return nil, fmt.Errorf("could not read keystore response: %w", err)
+	}
+	if resp.NotFound {
+		return nil, ErrKeyNotFound
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("keystore error: %s", resp.Error)
+	}
+	point := curves.New(CurveType).New()
+	if err := point.Unmarshal(resp.Point); err != nil {
+		return nil, fmt.Errorf("could not decode keystore point: %w", err)
+	}
+	return point, nil
+}
+
+// SocketServer serves a KeyStore backend over a Unix socket, to be used by
+// the Socket client.
+type SocketServer struct {
+	backend  KeyStore
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+// NewSocketServer starts listening on the Unix socket in the path provided
+// and serves the requests with the backend in the background until Close
+// is called.
+func NewSocketServer(path string, backend KeyStore) (*SocketServer, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %s: %w", path, err)
+	}
+	srv := &SocketServer{backend: backend, listener: listener}
+	srv.wg.Add(1)
+	go srv.serve()
+	return srv, nil
+}
+
+// Close stops the server and waits for the requests being served.
+func (srv *SocketServer) Close() error {
+	err := srv.listener.Close()
+	srv.wg.Wait()
+	return err
+}
+
+func (srv *SocketServer) serve() {
+	defer srv.wg.Done()
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Warnw("keystore socket accept failed", "error", err.Error())
+			}
+			return
+		}
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			srv.handle(conn)
+		}()
+	}
+}
+
+// handle serves the requests of a connection until it is closed.
+func (srv *SocketServer) handle(conn net.Conn) {
+	defer conn.Close()
+	dec, enc := json.NewDecoder(conn), json.NewEncoder(conn)
+	for {
+		req := &socketRequest{}
+		if err := dec.Decode(req); err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Warnw("could not decode keystore request", "error", err.Error())
+			}
+			return
+		}
+		resp := &socketResponse{}
+		point, err := srv.process(req)
+		switch {
+		case errors.Is(err, ErrKeyNotFound):
+			resp.NotFound = true
+		case err != nil:
+			resp.Error = err.Error()
+		default:
+			resp.Point = point.Marshal()
+		}
+		if err := enc.Encode(resp); err != nil {
+			log.Warnw("could not send keystore response", "error", err.Error())
+			return
+		}
+	}
+}
+
+func (srv *SocketServer) process(req *socketRequest) (ecc.Point, error) {
+	pid := types.ProcessID{}
+	if err := pid.Unmarshal(req.ProcessID); err != nil {
+		return nil, fmt.Errorf("invalid process ID: %w", err)
+	}
+	switch req.Op {
+	case socketOpGenerateKey:
+		return srv.backend.GenerateKey(pid)
+	case socketOpPublicKey:
+		return srv.backend.PublicKey(pid)
+	case socketOpPartialDecrypt:
+		c1 := curves.New(CurveType).New()
+		if err := c1.Unmarshal(req.Point); err != nil {
+			return nil, fmt.Errorf("invalid point: %w", err)
+		}
+		return srv.backend.PartialDecrypt(pid, c1)
+	default:
+		return nil, fmt.Errorf("unknown operation %q", req.Op)
+	}
+}
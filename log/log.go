@@ -3,6 +3,7 @@ package log
 import (
 	"bytes"
 	"cmp"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -50,6 +52,22 @@ func (*testHook) Run(e *zerolog.Event, _ zerolog.Level, _ string) {
 	e.Stringer("time", logTestTime)
 }
 
+// traceHook adds the trace and span IDs of the context of the event, if it
+// has a span, so the log entries can be matched with the traces.
+type traceHook struct{}
+
+func (*traceHook) Run(e *zerolog.Event, _ zerolog.Level, _ string) {
+	ctx := e.GetCtx()
+	if ctx == nil {
+		return
+	}
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	e.Str("traceId", sc.TraceID().String()).Str("spanId", sc.SpanID().String())
+}
+
 type errorLevelWriter struct {
 	io.Writer
 }
@@ -127,7 +145,7 @@ func Init(level, output string, errorOutput io.Writer) {
 	}
 
 	// Init the global logger var, with millisecond timestamps
-	log = zerolog.New(out).With().Timestamp().Logger()
+	log = zerolog.New(out).With().Timestamp().Logger().Hook(&traceHook{})
 	if output == logTestWriterName {
 		log = log.Hook(&testHook{})
 	}
@@ -251,6 +269,26 @@ func Warnw(msg string, keyvalues ...any) {
 	Logger().Warn().Fields(keyvalues).Msg(msg)
 }
 
+// DebugwCtx is Debugw including the trace and span IDs of the context.
+func DebugwCtx(ctx context.Context, msg string, keyvalues ...any) {
+	Logger().Debug().Ctx(ctx).Fields(keyvalues).Msg(msg)
+}
+
+// InfowCtx is Infow including the trace and span IDs of the context.
+func InfowCtx(ctx context.Context, msg string, keyvalues ...any) {
+	Logger().Info().Ctx(ctx).Fields(keyvalues).Msg(msg)
+}
+
+// WarnwCtx is Warnw including the trace and span IDs of the context.
+func WarnwCtx(ctx context.Context, msg string, keyvalues ...any) {
+	Logger().Warn().Ctx(ctx).Fields(keyvalues).Msg(msg)
+}
+
+// ErrorwCtx is Errorw including the trace and span IDs of the context.
+func ErrorwCtx(ctx context.Context, err error, msg string) {
+	Logger().Error().Ctx(ctx).Err(err).Msg(msg)
+}
+
 // Errorw sends an error level log message with a special format for errors.
 func Errorw(err error, msg string) {
 	Logger().Error().Err(err).Msg(msg)
@@ -1,10 +1,15 @@
 package log
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"io"
+	"strings"
 	"testing"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -57,3 +62,26 @@ func BenchmarkLogger(b *testing.B) {
 		doLogs()
 	}
 }
+
+func TestTraceIDs(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logTestWriter = buf
+	t.Cleanup(func() { Init("error", "stderr", nil) })
+	Init("debug", logTestWriterName, nil)
+
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{1, 2, 3},
+		SpanID:  trace.SpanID{4, 5, 6},
+	})
+	InfowCtx(trace.ContextWithSpanContext(context.Background(), sc), "traced", "key", "value")
+	if out := buf.String(); !strings.Contains(out, sc.TraceID().String()) || !strings.Contains(out, sc.SpanID().String()) {
+		t.Errorf("log entry without the trace and span IDs: %q", out)
+	}
+
+	// Without a span the IDs are not added
+	buf.Reset()
+	InfowCtx(context.Background(), "not traced")
+	if out := buf.String(); strings.Contains(out, "traceId") {
+		t.Errorf("log entry with trace ID: %q", out)
+	}
+}
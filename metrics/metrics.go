@@ -0,0 +1,119 @@
+// Package metrics defines the Prometheus metrics of the node and the handler
+// that serves them. The metrics are registered in their own registry, so the
+// handler only exports the metrics of this package, the collectors registered
+// with Register and the Go runtime and process metrics.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace is the prefix of the names of all the metrics.
+const namespace = "vocdoni"
+
+// registry is the registry of the metrics served by Handler.
+var registry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequests counts the API requests by route pattern, method, HTTP
+	// status and API error code (zero if the request succeeded).
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "API requests by route, method, status and error code.",
+	}, []string{"route", "method", "status", "code"})
+
+	// HTTPRequestDuration measures the time to serve the API requests by
+	// route pattern and method.
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time to serve the API requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// ProvingDuration measures the time to process the jobs of each stage
+	// (ballot verification, aggregation and state transition), by result.
+	ProvingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "prover",
+		Name:      "duration_seconds",
+		Help:      "Time to generate the proofs of each processing stage, by result.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"stage", "result"})
+
+	// StateTreeLeaves is the number of leaves of the state tree of each
+	// process, updated when a batch is committed. The series of a process
+	// is removed once it is closed, see DeleteProcess.
+	StateTreeLeaves = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "state",
+		Name:      "tree_leaves",
+		Help:      "Number of leaves of the state tree of each process.",
+	}, []string{"process"})
+
+	// BSGSDuration measures the time to solve the discrete logarithm of the
+	// decrypted results with the baby-step giant-step algorithm.
+	BSGSDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "elgamal",
+		Name:      "bsgs_duration_seconds",
+		Help:      "Time to solve the discrete logarithm of a decrypted message.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPRequestDuration,
+		ProvingDuration,
+		StateTreeLeaves,
+		BSGSDuration,
+	)
+}
+
+// Register registers a collector whose metrics are served by Handler, like
+// the ones that read their values when they are scraped. It returns an
+// error if the collector, or another one with the same metrics, is already
+// registered.
+func Register(c prometheus.Collector) error {
+	return registry.Register(c)
+}
+
+// Unregister removes a collector registered with Register.
+func Unregister(c prometheus.Collector) bool {
+	return registry.Unregister(c)
+}
+
+// Handler returns the HTTP handler that serves the metrics in the Prometheus
+// exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// DeleteProcess removes the series of the process provided, given its
+// hex-encoded ID, so the processes that ended or were canceled are not
+// exported forever.
+func DeleteProcess(processID string) {
+	StateTreeLeaves.DeleteLabelValues(processID)
+}
+
+// ObserveProving records the time spent processing a job of the stage
+// provided, labelled by whether it failed.
+func ObserveProving(stage string, d time.Duration, failed bool) {
+	result := "ok"
+	if failed {
+		result = "error"
+	}
+	ProvingDuration.WithLabelValues(stage, result).Observe(d.Seconds())
+}
@@ -1,11 +1,21 @@
 package state
 
 import (
+	"context"
+	"encoding/hex"
 	"math/big"
 
 	"github.com/vocdoni/arbo"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc"
 	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/curves"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/format"
 	"github.com/vocdoni/vocdoni-z-sandbox/crypto/elgamal"
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	"github.com/vocdoni/vocdoni-z-sandbox/metrics"
+	"github.com/vocdoni/vocdoni-z-sandbox/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.vocdoni.io/dvote/db"
 	"go.vocdoni.io/dvote/db/prefixeddb"
 )
@@ -41,6 +51,8 @@ type State struct {
 	processID []byte
 	db        db.Database
 	dbTx      db.WriteTx
+	// batchSpan traces the batch from StartBatch to EndBatch
+	batchSpan trace.Span
 
 	// TODO: unexport these, add ArboProofs and only export those via a method
 	ResultsAdd     *elgamal.Ciphertext
@@ -96,6 +108,15 @@ func (o *State) Initialize(censusRoot, ballotMode, encryptionKey []byte) error {
 	return nil
 }
 
+// SerializeEncryptionKey returns the representation of the encryption key
+// stored in the state: the X and Y coordinates in reduced twisted edwards
+// form, 32 bytes little-endian each, the same format used to serialize the
+// ciphertexts.
+func SerializeEncryptionKey(encryptionKey ecc.Point) []byte {
+	x, y := format.FromTEtoRTE(encryptionKey.Point())
+	return append(arbo.BigIntToBytes(32, x), arbo.BigIntToBytes(32, y)...)
+}
+
 // Close the database, no more operations can be done after this.
 func (o *State) Close() error {
 	return o.db.Close()
@@ -104,6 +125,23 @@ func (o *State) Close() error {
 // StartBatch resets counters and sums to zero,
 // and creates a new write transaction in the db
 func (o *State) StartBatch() error {
+	return o.StartBatchWithContext(context.Background())
+}
+
+// StartBatchWithContext is StartBatch, tracing the state transition of the
+// batch until EndBatch as a span of the trace of the context, like the one of
+// the aggregated batch (see tracing.Extract).
+func (o *State) StartBatchWithContext(ctx context.Context) error {
+	_, o.batchSpan = tracing.Start(ctx, "state transition",
+		trace.WithAttributes(attribute.String("vocdoni.processId", hex.EncodeToString(o.processID))))
+	if err := o.startBatch(); err != nil {
+		o.endBatchSpan(err)
+		return err
+	}
+	return nil
+}
+
+func (o *State) startBatch() error {
 	o.dbTx = o.db.WriteTx()
 	if o.ResultsAdd == nil {
 		o.ResultsAdd = elgamal.NewCiphertext(Curve)
@@ -140,7 +178,35 @@ func (o *State) StartBatch() error {
 }
 
 func (o *State) EndBatch() error {
-	return o.dbTx.Commit()
+	if err := o.dbTx.Commit(); err != nil {
+		o.endBatchSpan(err)
+		return err
+	}
+	o.endBatchSpan(nil)
+	leaves, err := o.tree.GetNLeafs()
+	if err != nil {
+		log.Warnw("could not count state tree leaves", "processId", hex.EncodeToString(o.processID), "error", err.Error())
+		return nil
+	}
+	metrics.StateTreeLeaves.WithLabelValues(hex.EncodeToString(o.processID)).Set(float64(leaves))
+	return nil
+}
+
+// endBatchSpan ends the span of the current batch, if any.
+func (o *State) endBatchSpan(err error) {
+	if o.batchSpan == nil {
+		return
+	}
+	o.batchSpan.SetAttributes(
+		attribute.Int("vocdoni.batch.ballots", o.ballotCount),
+		attribute.Int("vocdoni.batch.overwrites", o.overwriteCount),
+	)
+	if err != nil {
+		o.batchSpan.RecordError(err)
+		o.batchSpan.SetStatus(codes.Error, err.Error())
+	}
+	o.batchSpan.End()
+	o.batchSpan = nil
 }
 
 func (o *State) RootAsBigInt() (*big.Int, error) {
@@ -18,27 +18,47 @@ type Vote struct {
 // AddVote adds a vote to the state
 //   - if nullifier exists, it counts as vote overwrite
 func (o *State) AddVote(v *Vote) error {
+	return o.AddVotes([]*Vote{v})
+}
+
+// AddVotes adds the votes to the state, as AddVote does for each of them.
+// The ballots and the overwritten votes are added to BallotSum and
+// OverwriteSum with a single multi-scalar multiplication each (see
+// elgamal.Ciphertext.Sum), instead of one addition per vote.
+func (o *State) AddVotes(votes []*Vote) error {
 	if o.dbTx == nil {
 		return fmt.Errorf("need to StartBatch() first")
 	}
-	if len(o.votes) >= VoteBatchSize {
+	if len(o.votes)+len(votes) > VoteBatchSize {
 		return fmt.Errorf("too many votes for this batch")
 	}
 
-	// if nullifier exists, it's a vote overwrite, need to count the overwritten vote
-	// so it's later added to circuit.ResultsSub
-	if _, value, err := o.tree.Get(v.Nullifier); err == nil {
-		oldVote := elgamal.NewCiphertext(Curve)
-		if err := oldVote.Deserialize(value); err != nil {
-			return err
+	ballots := []*elgamal.Ciphertext{o.BallotSum}
+	overwritten := []*elgamal.Ciphertext{o.OverwriteSum}
+	for _, v := range votes {
+		// if nullifier exists, it's a vote overwrite, need to count the overwritten vote
+		// so it's later added to circuit.ResultsSub
+		if _, value, err := o.tree.Get(v.Nullifier); err == nil {
+			oldVote := elgamal.NewCiphertext(Curve)
+			if err := oldVote.Deserialize(value); err != nil {
+				return err
+			}
+			overwritten = append(overwritten, oldVote)
 		}
-		o.OverwriteSum.Add(o.OverwriteSum, oldVote)
-		o.overwriteCount++
+		ballots = append(ballots, v.Ballot)
+	}
+	ballotSum, err := elgamal.NewCiphertext(Curve).Sum(ballots)
+	if err != nil {
+		return fmt.Errorf("failed to sum ballots: %w", err)
+	}
+	overwriteSum, err := elgamal.NewCiphertext(Curve).Sum(overwritten)
+	if err != nil {
+		return fmt.Errorf("failed to sum overwritten votes: %w", err)
 	}
 
-	o.BallotSum.Add(o.BallotSum, v.Ballot)
-	o.ballotCount++
-
-	o.votes = append(o.votes, v)
+	o.BallotSum, o.OverwriteSum = ballotSum, overwriteSum
+	o.ballotCount += len(ballots) - 1
+	o.overwriteCount += len(overwritten) - 1
+	o.votes = append(o.votes, votes...)
 	return nil
 }
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/db/prefixeddb"
+)
+
+// versionMarker is the first byte of the versioned artifact encodings, it is
+// followed by the version number and the encoding of the artifact, gob unless
+// the codec defines another one. A gob stream never starts with a zero byte,
+// so the records stored before the encodings were versioned are recognized as
+// version 0.
+const versionMarker = 0x00
+
+// migration upgrades the encoded artifact stored in the key provided from
+// one version to the next one. It receives and returns the encoding of each
+// version, without the version header.
+type migration func(s *Storage, key, data []byte) ([]byte, error)
+
+// artifactCodec describes how an artifact type is stored: its prefix, the
+// current version of its encoding and the migrations from the previous
+// versions. Every time the stored type changes in an incompatible way, the
+// version must be increased and a migration from the previous one appended,
+// so the existing records are not stranded.
+type artifactCodec[T any] struct {
+	name    string
+	prefix  []byte
+	version uint8
+	// migrations[v] upgrades an encoding of version v to version v+1
+	migrations []migration
+	// marshal and unmarshal encode the current version of the artifact, gob
+	// is used if they are nil
+	marshal   func(*T) ([]byte, error)
+	unmarshal func([]byte, *T) error
+	// skipInvalid makes migrateAll leave the records that cannot be decoded
+	// as they are, instead of failing. It is used by the queue artifacts,
+	// which are moved to the dead letters when they are pulled.
+	skipInvalid bool
+}
+
+// migrator is implemented by the artifact codecs to upgrade all the stored
+// records of a type, or a single encoding, to the current version.
+type migrator interface {
+	migrateAll(s *Storage) (int, error)
+	reencode(s *Storage, key, data []byte) ([]byte, bool, error)
+}
+
+// artifactCodecs is the list of the codecs whose records are migrated when
+// the storage is created.
+// The queue artifacts are not migrated, since the queues can be large and
+// they are decoded from any version (see Storage.MigrateQueues).
+var artifactCodecs = []migrator{encryptionKeysCodec, metadataCodec, metadataHashCodec, overwritePolicyCodec, deadLetterCodec, processCodec, auditCodec, resultsCodec}
+
+// encode returns the versioned encoding of the artifact.
+func (c *artifactCodec[T]) encode(artifact *T) ([]byte, error) {
+	var data []byte
+	var err error
+	if c.marshal != nil {
+		data, err = c.marshal(artifact)
+	} else {
+		data, err = encodeArtifact(artifact)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not encode %s: %w", c.name, err)
+	}
+	return append([]byte{versionMarker, c.version}, data...), nil
+}
+
+// decode decodes the versioned encoding of the artifact stored in the key
+// provided, applying the migrations needed if it is from a previous version.
+func (c *artifactCodec[T]) decode(s *Storage, key, data []byte) (*T, error) {
+	data, err := c.upgrade(s, key, data)
+	if err != nil {
+		return nil, err
+	}
+	artifact := new(T)
+	if c.unmarshal != nil {
+		err = c.unmarshal(data, artifact)
+	} else {
+		err = decodeArtifact(data, artifact)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s: %w", c.name, err)
+	}
+	return artifact, nil
+}
+
+// upgrade returns the encoding of the artifact in the current version.
+func (c *artifactCodec[T]) upgrade(s *Storage, key, data []byte) ([]byte, error) {
+	version, data, err := c.split(data)
+	if err != nil {
+		return nil, err
+	}
+	for ; version < c.version; version++ {
+		if data, err = c.migrations[version](s, key, data); err != nil {
+			return nil, fmt.Errorf("could not migrate %s %x from version %d: %w", c.name, key, version, err)
+		}
+	}
+	return data, nil
+}
+
+// split returns the version and the encoding of a stored artifact.
+func (c *artifactCodec[T]) split(data []byte) (uint8, []byte, error) {
+	if len(data) == 0 || data[0] != versionMarker {
+		return 0, data, nil
+	}
+	if len(data) < 2 {
+		return 0, nil, fmt.Errorf("invalid %s encoding", c.name)
+	}
+	if data[1] > c.version {
+		return 0, nil, fmt.Errorf("unsupported %s version %d", c.name, data[1])
+	}
+	return data[1], data[2:], nil
+}
+
+// reencode returns the encoding of the artifact in the current version, and
+// whether it was from a previous one.
+func (c *artifactCodec[T]) reencode(s *Storage, key, data []byte) ([]byte, bool, error) {
+	version, _, err := c.split(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("%x: %w", key, err)
+	}
+	if version == c.version {
+		return data, false, nil
+	}
+	artifact, err := c.decode(s, key, data)
+	if err != nil {
+		return nil, false, err
+	}
+	data, err = c.encode(artifact)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// migrateAll rewrites all the stored records of a previous version in the
+// current one, in a single transaction. It returns the number of records
+// migrated.
+func (c *artifactCodec[T]) migrateAll(s *Storage) (int, error) {
+	wTx := s.db.WriteTx()
+	defer wTx.Discard()
+	pwTx := prefixeddb.NewPrefixedWriteTx(wTx, c.prefix)
+
+	migrated := 0
+	var iterErr error
+	if err := prefixeddb.NewPrefixedReader(s.db, c.prefix).Iterate(nil, func(k, v []byte) bool {
+		data, changed, err := c.reencode(s, k, v)
+		if err != nil {
+			if c.skipInvalid {
+				log.Warnw("skipping invalid record", "type", c.name, "key", hex.EncodeToString(k), "error", err.Error())
+				return true
+			}
+			iterErr = err
+			return false
+		}
+		if !changed {
+			return true
+		}
+		if err := pwTx.Set(bytes.Clone(k), data); err != nil {
+			iterErr = err
+			return false
+		}
+		migrated++
+		return true
+	}); err != nil {
+		return 0, fmt.Errorf("could not iterate %s: %w", c.name, err)
+	}
+	if iterErr != nil {
+		return 0, iterErr
+	}
+	if migrated == 0 {
+		return 0, nil
+	}
+	if err := wTx.Commit(); err != nil {
+		return 0, fmt.Errorf("could not commit %s migration: %w", c.name, err)
+	}
+	return migrated, nil
+}
+
+// migrateArtifacts upgrades the records of all the artifact types to their
+// current version.
+func (s *Storage) migrateArtifacts() error {
+	for _, c := range artifactCodecs {
+		if _, err := c.migrateAll(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setArtifact helper function stores an artifact in the storage using the
+// versioned encoding of its codec. It receives the key and the artifact to
+// store. If the key is not provided, it generates it by hashing the encoded
+// artifact. It returns ErrKeyAlreadyExists if the key already exists. The
+// key is checked and written in the same transaction, under the artifact
+// lock, so only one of the concurrent calls with the same key succeeds.
+func setArtifact[T any](s *Storage, c *artifactCodec[T], key []byte, artifact *T) error {
+	data, err := c.encode(artifact)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		key = hashKey(data)
+	}
+
+	s.artifactLock.Lock()
+	defer s.artifactLock.Unlock()
+
+	wTx := s.db.WriteTx()
+	defer wTx.Discard()
+	// check if key already exists
+	if _, err := prefixeddb.NewPrefixedReader(wTx, c.prefix).Get(key); err == nil {
+		return ErrKeyAlreadyExists
+	}
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, c.prefix).Set(key, data); err != nil {
+		return err
+	}
+	return wTx.Commit()
+}
+
+// getArtifact helper function retrieves an artifact from the storage and
+// decodes it with its codec, migrating it if it was stored with a previous
+// version. It returns ErrNotFound if the key does not exist. If the key is
+// not provided, it retrieves the first artifact found for the prefix, and
+// returns ErrNoMoreElements if there are no more elements.
+func getArtifact[T any](s *Storage, c *artifactCodec[T], key []byte) (*T, error) {
+	var data []byte
+	rd := prefixeddb.NewPrefixedReader(s.db, c.prefix)
+	if key != nil {
+		var err error
+		data, err = rd.Get(key)
+		if err != nil {
+			if errors.Is(err, db.ErrKeyNotFound) {
+				return nil, ErrNotFound
+			}
+			return nil, fmt.Errorf("could not read %s: %w", c.name, err)
+		}
+	} else {
+		// iterate over the keys in the database, take the first one
+		if err := rd.Iterate(nil, func(k, v []byte) bool {
+			key = bytes.Clone(k)
+			data = bytes.Clone(v)
+			return false
+		}); err != nil {
+			return nil, fmt.Errorf("could not iterate %s: %w", c.name, err)
+		}
+		if data == nil {
+			return nil, ErrNoMoreElements
+		}
+	}
+	return c.decode(s, key, data)
+}
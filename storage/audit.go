@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+// AuditCursorSize is the size of the IDs of the audit entries, which are
+// also the cursors of the audit log listing.
+const AuditCursorSize = 8
+
+// AuditEntry is a record of the audit log of the admin actions: who did
+// what, when, and with which result.
+type AuditEntry struct {
+	ID     types.HexBytes `json:"id"`
+	Time   time.Time      `json:"time"`
+	Actor  string         `json:"actor"`
+	Role   string         `json:"role"`
+	Action string         `json:"action"`
+	Path   string         `json:"path,omitempty"`
+	Status int            `json:"status"`
+}
+
+// auditCodec stores the audit log entries, sorted by time.
+var auditCodec = &artifactCodec[AuditEntry]{
+	name:    "audit entry",
+	prefix:  auditPrefix,
+	version: 1,
+}
+
+// AddAuditEntry appends an entry to the audit log. Its ID and time are set
+// by the storage: the ID is the time of the entry in nanoseconds, increased
+// if needed so the IDs are unique and in the order the entries were added.
+func (s *Storage) AddAuditEntry(e *AuditEntry) error {
+	s.auditLock.Lock()
+	defer s.auditLock.Unlock()
+	now := time.Now()
+	ts := now.UnixNano()
+	if ts <= s.lastAudit {
+		ts = s.lastAudit + 1
+	}
+	e.Time = now
+	e.ID = binary.BigEndian.AppendUint64(nil, uint64(ts))
+	if err := setArtifact(s, auditCodec, e.ID, e); err != nil {
+		return fmt.Errorf("could not store audit entry: %w", err)
+	}
+	s.lastAudit = ts
+	return nil
+}
+
+// loadLastAudit sets the ID of the last audit entry, so the IDs of the new
+// entries follow the stored ones even if the clock went backwards. The
+// entries are stored by time, so only the ones from now on are iterated.
+func (s *Storage) loadLastAudit() error {
+	now := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	return iterateFrom(s.db, auditPrefix, now, func(k, _ []byte) bool {
+		if len(k) == AuditCursorSize {
+			s.lastAudit = max(s.lastAudit, int64(binary.BigEndian.Uint64(k)))
+		}
+		return true
+	})
+}
+
+// AuditLog returns up to limit entries of the audit log in the order they
+// were added, starting after the cursor provided (nil to start from the
+// first one). It also returns the cursor of the next page, or nil if there
+// are no more entries. The listing starts at the cursor, so each page costs
+// the same regardless of the size of the log.
+func (s *Storage) AuditLog(cursor []byte, limit int) ([]*AuditEntry, []byte, error) {
+	if cursor != nil && len(cursor) != AuditCursorSize {
+		return nil, nil, fmt.Errorf("invalid cursor size %d", len(cursor))
+	}
+	entries := []*AuditEntry{}
+	if limit <= 0 {
+		return entries, nil, nil
+	}
+	var next []byte
+	var decodeErr error
+	if err := iterateFrom(s.db, auditPrefix, cursor, func(k, v []byte) bool {
+		if cursor != nil && bytes.Compare(k, cursor) <= 0 {
+			return true
+		}
+		if len(entries) == limit {
+			next = bytes.Clone(entries[limit-1].ID)
+			return false
+		}
+		e, err := auditCodec.decode(s, bytes.Clone(k), bytes.Clone(v))
+		if err != nil {
+			decodeErr = fmt.Errorf("decode audit entry %x: %w", k, err)
+			return false
+		}
+		entries = append(entries, e)
+		return true
+	}); err != nil {
+		return nil, nil, fmt.Errorf("iterate audit log: %w", err)
+	}
+	if decodeErr != nil {
+		return nil, nil, decodeErr
+	}
+	return entries, next, nil
+}
@@ -1,233 +1,683 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/hex"
 	"errors"
 	"fmt"
 
 	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	"github.com/vocdoni/vocdoni-z-sandbox/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.vocdoni.io/dvote/db"
 	"go.vocdoni.io/dvote/db/prefixeddb"
 )
 
-// PushBallot stores a new ballot into the pending ballots queue.
+// PushBallot stores a new ballot into the pending ballots queue. If a ballot
+// with the same nullifier was pushed before for the process, the overwrite
+// policy of the process is applied (see OverwritePolicy): the new ballot
+// supersedes the queued one, or it is rejected with ErrNullifierQueued or
+// ErrTooManyOverwrites. The ballots without nullifier are rejected with
+// ErrMissingNullifier, the ballots without a valid process ID with
+// ErrInvalidProcessID, the ballots of a process with the maximum number of
+// pending ballots with ErrPendingQuotaExceeded (see SetPendingBallotsQuota),
+// and the ballots of a process that has ended or was canceled with
+// ErrProcessClosed.
+//
+// The push starts the trace of the ballot, as a child of its trace context if
+// it has one, like the one of the request that submitted it. The context of
+// the trace is stored with the ballot, so the next stages continue it.
 func (s *Storage) PushBallot(b *Ballot) error {
-	val, err := encodeArtifact(b)
+	if len(b.Nullifier) == 0 {
+		return ErrMissingNullifier
+	}
+	if len(b.ProcessID) != processIDLen {
+		return ErrInvalidProcessID
+	}
+	// the key is derived from the ballot without its trace context, which is
+	// different every time it is submitted
+	traced := *b
+	traced.TraceContext = nil
+	val, err := ballotCodec.encode(&traced)
 	if err != nil {
-		return fmt.Errorf("encode ballot: %w", err)
+		return err
 	}
-	wTx := prefixeddb.NewPrefixedWriteTx(s.db.WriteTx(), ballotPrefix)
-	key := hashKey(val)
-	if err := wTx.Set(key, val); err != nil {
-		wTx.Discard()
+	// the key is prefixed with the process ID, like the keys of every queue
+	key := append(bytes.Clone(b.ProcessID), hashKey(val)...)
+
+	ctx, span := startQueueSpan(s.ballots, "push", b.TraceContext, key)
+	if traced.TraceContext = tracing.Inject(ctx); traced.TraceContext != nil {
+		if val, err = ballotCodec.encode(&traced); err != nil {
+			endSpan(span, err)
+			return err
+		}
+	}
+	err = s.pushBallot(&traced, key, val)
+	endSpan(span, err)
+	return err
+}
+
+// pushBallot stores the encoded ballot under the key provided, see
+// PushBallot.
+func (s *Storage) pushBallot(b *Ballot, key, val []byte) error {
+	nmu := s.nullifiers.lock(b.ProcessID)
+	nmu.Lock()
+	defer nmu.Unlock()
+
+	if err := s.checkProcessOpen(b.ProcessID); err != nil {
+		return err
+	}
+	rec, err := s.nullifierRecord(b.ProcessID, b.Nullifier)
+	if err != nil {
+		return err
+	}
+	// the pushes of the process are serialized by the nullifier lock, and
+	// the counters are updated before it is released, so the quota cannot
+	// be exceeded by concurrent pushes. A ballot that supersedes a pending
+	// one does not add a pending ballot.
+	if quota := s.PendingBallotsQuota(); quota > 0 && (rec == nil || rec.Stage != nullifierStagePending) &&
+		s.PendingBallots(b.ProcessID) >= quota {
+		return fmt.Errorf("%w: %d ballots waiting to be verified", ErrPendingQuotaExceeded, quota)
+	}
+	wTx := s.writeTx()
+	defer wTx.Discard()
+	overwrites, unlock, err := s.supersede(wTx, b.ProcessID, rec)
+	if err != nil {
 		return err
 	}
+	defer unlock()
+	seq, err := s.ballots.push(wTx, b.ProcessID, key[processIDLen:], val)
+	if err != nil {
+		return err
+	}
+	if err := setNullifierRecord(wTx, b.ProcessID, b.Nullifier, &nullifierRecord{
+		Stage:      nullifierStagePending,
+		Key:        key,
+		Seq:        seq,
+		Overwrites: overwrites,
+	}); err != nil {
+		return fmt.Errorf("set nullifier: %w", err)
+	}
 	return wTx.Commit()
 }
 
+// SetPendingBallotsQuota sets the maximum number of ballots of each process
+// waiting to be verified or being verified, zero means unlimited. Once
+// reached, the new ballots of the process are rejected by PushBallot with
+// ErrPendingQuotaExceeded.
+func (s *Storage) SetPendingBallotsQuota(quota int) {
+	s.pendingQuotaLock.Lock()
+	defer s.pendingQuotaLock.Unlock()
+	s.pendingQuota = quota
+}
+
+// PendingBallotsQuota returns the maximum number of pending ballots of each
+// process, zero if it is unlimited.
+func (s *Storage) PendingBallotsQuota() int {
+	s.pendingQuotaLock.RLock()
+	defer s.pendingQuotaLock.RUnlock()
+	return s.pendingQuota
+}
+
 // NextBallot returns the next non-reserved ballot, creates a reservation, and returns it.
 // It returns the ballot, the key, and an error. If no ballots are available, returns ErrNoMoreElements.
 // The key is used to mark the ballot as done after processing and to pass it to the next stage.
+// The ballots are returned in the order they were pushed. The ballots that
+// cannot be decoded, and the ones of the processes that have ended or were
+// canceled, are moved to the dead letters.
 func (s *Storage) NextBallot() (*Ballot, []byte, error) {
-	s.globalLock.Lock()
-	defer s.globalLock.Unlock()
-
-	pr := prefixeddb.NewPrefixedReader(s.db, ballotPrefix)
-	var chosenKey, chosenVal []byte
-	pr.Iterate(nil, func(k, v []byte) bool {
-		// check if reserved
-		if s.isReserved(ballotReservationPrefix, k) {
-			return true
-		}
-		chosenKey = k
-		chosenVal = v
-		return false
-	})
-	if chosenVal == nil {
-		return nil, nil, ErrNoMoreElements
-	}
-
-	var b Ballot
-	if err := decodeArtifact(chosenVal, &b); err != nil {
-		return nil, nil, fmt.Errorf("decode ballot: %w", err)
-	}
+	return s.NextBallotForWorker("")
+}
 
-	// set reservation
-	if err := s.setReservation(ballotReservationPrefix, chosenKey); err != nil {
-		// can't reserve? try next would be ideal, but let's return no elements
-		return nil, nil, ErrNoMoreElements
+// NextBallotForWorker is like NextBallot, but the reservation is held by the
+// worker provided, which is the only one that can extend it.
+func (s *Storage) NextBallotForWorker(workerID string) (*Ballot, []byte, error) {
+	for {
+		keys, vals, err := s.ballots.pull(s, nil, 1, workerID)
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := ballotCodec.decode(s, keys[0], vals[0])
+		if err == nil {
+			err = s.checkProcessOpen(b.ProcessID)
+		}
+		if err != nil {
+			if err := s.deadLetterReserved(s.ballots, keys[0], err); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		traceQueueOp(s.ballots, "reserve", b.TraceContext, keys[0], attribute.String("vocdoni.worker", workerID))
+		return b, keys[0], nil
 	}
+}
 
-	return &b, chosenKey, nil
+// ExtendBallotReservation renews the reservation of a ballot held by the
+// worker provided, so it is not released as stale. It returns ErrNotFound if
+// the ballot is not reserved and ErrNotReservationOwner if it is reserved by
+// another worker.
+func (s *Storage) ExtendBallotReservation(k []byte, workerID string) error {
+	return s.ballots.extend(s, k, workerID)
 }
 
 // MarkBallotDone called after we have processed the ballot. We push the verified ballot to the next queue.
 // In this scenario, next stage is verifiedBallot so we do not store the original ballot.
+// If the ballot is not reserved (it was already done or its reservation was
+// released), the verified ballot is discarded. It is also discarded if the
+// ballot was superseded by a newer one with the same nullifier.
+//
+// The verified ballot continues the trace of the ballot, unless it has its
+// own trace context.
 func (s *Storage) MarkBallotDone(k []byte, vb *VerifiedBallot) error {
-	s.globalLock.Lock()
-	defer s.globalLock.Unlock()
+	return s.traceMarkBallotDone(k, vb, nil)
+}
 
-	// remove reservation
-	if err := s.deleteArtifact(ballotReservationPrefix, k); err != nil && !errors.Is(err, ErrNotFound) {
-		return fmt.Errorf("delete reservation: %w", err)
+// MarkBallotDoneForWorker is like MarkBallotDone, but the ballot must be
+// reserved by the worker provided, and the verified ballot must be of the
+// process and nullifier of the ballot. Otherwise, it returns ErrNotFound,
+// ErrNotReservationOwner or ErrResultMismatch, and the ballot is kept. The
+// verified ballot stored is built from the ballot, so only its proof and
+// trace context are taken from the worker.
+func (s *Storage) MarkBallotDoneForWorker(k []byte, workerID string, vb *VerifiedBallot) error {
+	verified, err := s.workerVerifiedBallot(k, vb)
+	if err != nil {
+		return err
 	}
+	return s.traceMarkBallotDone(k, verified, &workerID)
+}
 
-	// remove from pending queue
-	if err := s.deleteArtifact(ballotPrefix, k); err != nil && !errors.Is(err, ErrNotFound) {
-		return fmt.Errorf("delete pending ballot: %w", err)
+// traceMarkBallotDone traces the verified ballot of markBallotDone.
+func (s *Storage) traceMarkBallotDone(k []byte, vb *VerifiedBallot, workerID *string) error {
+	traced := *vb
+	if traced.TraceContext == nil {
+		traced.TraceContext = s.storedTraceContext(s.ballots, k)
 	}
+	ctx, span := startQueueSpan(s.ballots, "done", traced.TraceContext, k)
+	if tc := tracing.Inject(ctx); tc != nil {
+		traced.TraceContext = tc
+	}
+	err := s.markBallotDone(k, &traced, workerID)
+	endSpan(span, err)
+	return err
+}
+
+// markBallotDone moves the reserved ballot to the verified ballots queue, see
+// MarkBallotDone. If workerID is not nil, the ballot must be reserved by the
+// worker and match the verified ballot, see MarkBallotDoneForWorker.
+func (s *Storage) markBallotDone(k []byte, vb *VerifiedBallot, workerID *string) error {
+	nmu := s.nullifiers.lock(vb.ProcessID)
+	nmu.Lock()
+	defer nmu.Unlock()
+	mu := s.ballots.keyLock(k)
+	mu.Lock()
+	defer mu.Unlock()
 
-	// store verified ballot
-	val, err := encodeArtifact(vb)
+	val, err := verifiedBallotCodec.encode(vb)
 	if err != nil {
-		return fmt.Errorf("encode verified ballot: %w", err)
+		return err
 	}
-	wTx := prefixeddb.NewPrefixedWriteTx(s.db.WriteTx(), verifiedBallotPrefix)
-	// key with processID as prefix + unique portion from original key
-	combKey := append(vb.ProcessID, k...)
-	if err := wTx.Set(combKey, val); err != nil {
-		wTx.Discard()
+	if workerID != nil {
+		if _, err := s.ballots.reservation(s, k, *workerID); err != nil {
+			return err
+		}
+	}
+	rec, err := s.nullifierRecord(vb.ProcessID, vb.Nullifier)
+	if err != nil {
 		return err
 	}
-	return wTx.Commit()
+	wTx := s.writeTx()
+	defer wTx.Discard()
+	if err := s.ballots.remove(s, wTx, k); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			log.Debugw("ballot not reserved, ignoring", "key", hex.EncodeToString(k))
+			return nil
+		}
+		return fmt.Errorf("remove pending ballot: %w", err)
+	}
+	if !isCurrentBallot(rec, k) {
+		log.Debugw("ballot superseded, dropping", "key", hex.EncodeToString(k))
+		return wTx.Commit()
+	}
+	// the verified ballot keeps the unique portion of the pending key
+	_, id, err := s.ballots.splitKey(k)
+	if err != nil {
+		return err
+	}
+	seq, err := s.verifiedBallots.push(wTx, vb.ProcessID, id, val)
+	if err != nil {
+		return fmt.Errorf("push verified ballot: %w", err)
+	}
+	if rec != nil {
+		rec.Stage = nullifierStageVerified
+		rec.Key = append(bytes.Clone(vb.ProcessID), id...)
+		rec.Seq = seq
+		if err := setNullifierRecord(wTx, vb.ProcessID, vb.Nullifier, rec); err != nil {
+			return fmt.Errorf("set nullifier: %w", err)
+		}
+	}
+	if err := wTx.Commit(); err != nil {
+		return err
+	}
+	s.ballots.stats.done(vb.ProcessID)
+	return nil
+}
+
+// workerVerifiedBallot returns the verified ballot of the stored ballot,
+// with the proof and the trace context of the one computed by a worker. It
+// returns ErrNotFound if the ballot is not stored, and ErrResultMismatch if
+// the verified ballot is not of the process and nullifier of the ballot.
+func (s *Storage) workerVerifiedBallot(k []byte, vb *VerifiedBallot) (*VerifiedBallot, error) {
+	val, err := prefixeddb.NewPrefixedReader(s.db, ballotPrefix).Get(k)
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get ballot: %w", err)
+	}
+	b, err := ballotCodec.decode(s, k, val)
+	if err != nil {
+		return nil, fmt.Errorf("decode ballot: %w", err)
+	}
+	if !bytes.Equal(vb.ProcessID, b.ProcessID) || !bytes.Equal(vb.Nullifier, b.Nullifier) {
+		return nil, fmt.Errorf("%w: the verified ballot is not of the ballot leased", ErrResultMismatch)
+	}
+	return &VerifiedBallot{
+		ProcessID:       b.ProcessID,
+		VoterWeight:     b.VoterWeight,
+		Nullifier:       b.Nullifier,
+		Commitment:      b.Commitment,
+		EncryptedBallot: b.EncryptedBallot,
+		Address:         b.Address,
+		Proof:           vb.Proof,
+		TraceContext:    vb.TraceContext,
+	}, nil
 }
 
 // PullVerifiedBallots returns a list of non-reserved verified ballots for a given processID
 // and creates reservations for them. The maxCount parameter is used to limit the number of results.
-// If no ballots are available, returns ErrNotFound.
+// The ballots are returned in the order they were verified.
+// If no ballots are available, returns ErrNotFound, and ErrProcessClosed if
+// the process has ended or was canceled.
 func (s *Storage) PullVerifiedBallots(processID []byte, maxCount int) ([]*VerifiedBallot, [][]byte, error) {
-	s.globalLock.Lock()
-	defer s.globalLock.Unlock()
+	return s.PullVerifiedBallotsForWorker(processID, maxCount, "")
+}
 
+// PullVerifiedBallotsForWorker is like PullVerifiedBallots, but the
+// reservations are held by the worker provided, which is the only one that
+// can extend them.
+func (s *Storage) PullVerifiedBallotsForWorker(processID []byte, maxCount int, workerID string) ([]*VerifiedBallot, [][]byte, error) {
 	if maxCount == 0 {
 		return []*VerifiedBallot{}, nil, nil
 	}
-
-	rd := prefixeddb.NewPrefixedReader(s.db, verifiedBallotPrefix)
-	var res []*VerifiedBallot
-	var keys [][]byte
-	rd.Iterate(processID, func(k, v []byte) bool {
-		key := append(processID, k...)
-		if maxCount > 0 && len(res) >= maxCount {
-			return false
-		}
-		// Skip if already reserved
-		if s.isReserved(verifiedBallotReservPrefix, key) {
-			return true
-		}
-		var vb VerifiedBallot
-		if err := decodeArtifact(v, &vb); err != nil {
-			log.Warnw("failed to decode verified ballot", "key", hex.EncodeToString(key), "error", err.Error())
-			return true
-		}
-		// Set reservation before adding to results
-		if err := s.setReservation(verifiedBallotReservPrefix, key); err != nil {
-			log.Warnw("failed to set reservation for verified ballot", "key", hex.EncodeToString(key), "error", err.Error())
-			return true
-		}
-		// Make a copy of the key to avoid any potential modification
-		keyCopy := make([]byte, len(key))
-		copy(keyCopy, key)
-		res = append(res, &vb)
-		keys = append(keys, keyCopy)
-		return true
-	})
-
-	// Return ErrNotFound if we found no ballots at all
+	if err := s.checkProcessOpen(processID); err != nil {
+		return nil, nil, err
+	}
+	keys, vals, err := s.verifiedBallots.pull(s, processID, maxCount, workerID)
+	if err != nil {
+		if errors.Is(err, ErrNoMoreElements) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+	res := make([]*VerifiedBallot, 0, len(vals))
+	resKeys := make([][]byte, 0, len(keys))
+	var superseded [][]byte
+	for i, v := range vals {
+		vb, err := verifiedBallotCodec.decode(s, keys[i], v)
+		if err != nil {
+			if err := s.deadLetterReserved(s.verifiedBallots, keys[i], err); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		rec, err := s.nullifierRecord(processID, vb.Nullifier)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !isCurrentBallot(rec, keys[i]) {
+			superseded = append(superseded, keys[i])
+			continue
+		}
+		traceQueueOp(s.verifiedBallots, "reserve", vb.TraceContext, keys[i], attribute.String("vocdoni.worker", workerID))
+		res = append(res, vb)
+		resKeys = append(resKeys, keys[i])
+	}
+	for _, k := range superseded {
+		log.Debugw("verified ballot superseded, dropping", "key", hex.EncodeToString(k))
+		if _, err := s.markDone(s.verifiedBallots, k, nil, nil); err != nil {
+			return nil, nil, err
+		}
+	}
 	if len(res) == 0 {
 		return nil, nil, ErrNotFound
 	}
+	return res, resKeys, nil
+}
 
-	return res, keys, nil
+// ExtendVerifiedBallotReservation renews the reservation of a verified
+// ballot held by the worker provided, as in ExtendBallotReservation.
+func (s *Storage) ExtendVerifiedBallotReservation(k []byte, workerID string) error {
+	return s.verifiedBallots.extend(s, k, workerID)
 }
 
 // CountVerifiedBallots returns the number of verified ballots for a given processID.
 func (s *Storage) CountVerifiedBallots(processID []byte) int {
-	s.globalLock.Lock()
-	defer s.globalLock.Unlock()
-
-	rd := prefixeddb.NewPrefixedReader(s.db, verifiedBallotPrefix)
-	count := 0
-	rd.Iterate(processID, func(_, _ []byte) bool {
-		count++
-		return true
-	})
-	return count
+	return s.verifiedBallots.count(s, processID)
 }
 
 // PushBallotBatch pushes an aggregated ballot batch to the aggregator queue.
+// The push starts the trace of the batch, unless it has a trace context,
+// linked to the traces of its ballots.
 func (s *Storage) PushBallotBatch(abb *AggregatedBallotBatch) error {
-	val, err := encodeArtifact(abb)
+	key, val, span, err := s.encodeBallotBatch(abb)
 	if err != nil {
-		return fmt.Errorf("encode batch: %w", err)
+		return err
 	}
-	wTx := prefixeddb.NewPrefixedWriteTx(s.db.WriteTx(), aggregBatchPrefix)
-	key := hashKey(val)
-	if err := wTx.Set(append(abb.ProcessID, key...), val); err != nil {
-		wTx.Discard()
+	wTx := s.writeTx()
+	defer wTx.Discard()
+	if _, err := s.batches.push(wTx, abb.ProcessID, key, val); err != nil {
+		endSpan(span, err)
 		return err
 	}
-	return wTx.Commit()
+	err = wTx.Commit()
+	endSpan(span, err)
+	return err
 }
 
-// NextBallotBatch returns the next aggregated ballot batch for a given processID, sets a reservation.
-func (s *Storage) NextBallotBatch(processID []byte) (*AggregatedBallotBatch, []byte, error) {
-	s.globalLock.Lock()
-	defer s.globalLock.Unlock()
-
-	pr := prefixeddb.NewPrefixedReader(s.db, aggregBatchPrefix)
-	var chosenKey, chosenVal []byte
-	pr.Iterate(processID, func(k, v []byte) bool {
-		key := append(processID, k...)
-		if s.isReserved(aggregBatchReservPrefix, key) {
-			return true
-		}
-		chosenKey = key
-		chosenVal = v
-		return false
-	})
-	if chosenVal == nil {
-		return nil, nil, ErrNoMoreElements
+// encodeBallotBatch returns the key and the encoding of an aggregated batch
+// to be pushed, and starts the span of the push, which the caller must end.
+func (s *Storage) encodeBallotBatch(abb *AggregatedBallotBatch) ([]byte, []byte, trace.Span, error) {
+	traced := *abb
+	traced.TraceContext = nil
+	val, err := ballotBatchCodec.encode(&traced)
+	if err != nil {
+		return nil, nil, nil, err
 	}
+	key := hashKey(val)
 
-	var abb AggregatedBallotBatch
-	if err := decodeArtifact(chosenVal, &abb); err != nil {
-		return nil, nil, fmt.Errorf("decode agg batch: %w", err)
+	links := []trace.Link{}
+	for _, b := range abb.Ballots {
+		if link, ok := tracing.Link(b.TraceContext, attribute.String("vocdoni.nullifier", b.Nullifier.String())); ok {
+			links = append(links, link)
+		}
+	}
+	ctx, span := startQueueSpan(s.batches, "push", abb.TraceContext, append(bytes.Clone(abb.ProcessID), key...),
+		trace.WithLinks(links...), trace.WithAttributes(attribute.Int("vocdoni.batch.ballots", len(abb.Ballots))))
+	if traced.TraceContext = tracing.Inject(ctx); traced.TraceContext != nil {
+		if val, err = ballotBatchCodec.encode(&traced); err != nil {
+			endSpan(span, err)
+			return nil, nil, nil, err
+		}
 	}
+	return key, val, span, nil
+}
+
+// NextBallotBatch returns the next aggregated ballot batch for a given processID, sets a reservation.
+// The batches are returned in the order they were pushed. The batches that
+// cannot be decoded are moved to the dead letters. It returns
+// ErrProcessClosed if the process has ended or was canceled.
+func (s *Storage) NextBallotBatch(processID []byte) (*AggregatedBallotBatch, []byte, error) {
+	return s.NextBallotBatchForWorker(processID, "")
+}
 
-	if err := s.setReservation(aggregBatchReservPrefix, chosenKey); err != nil {
-		return nil, nil, ErrNoMoreElements
+// NextBallotBatchForWorker is like NextBallotBatch, but the reservation is
+// held by the worker provided, which is the only one that can extend it.
+func (s *Storage) NextBallotBatchForWorker(processID []byte, workerID string) (*AggregatedBallotBatch, []byte, error) {
+	if err := s.checkProcessOpen(processID); err != nil {
+		return nil, nil, err
+	}
+	for {
+		keys, vals, err := s.batches.pull(s, processID, 1, workerID)
+		if err != nil {
+			return nil, nil, err
+		}
+		abb, err := ballotBatchCodec.decode(s, keys[0], vals[0])
+		if err != nil {
+			if err := s.deadLetterReserved(s.batches, keys[0], err); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		traceQueueOp(s.batches, "reserve", abb.TraceContext, keys[0], attribute.String("vocdoni.worker", workerID))
+		return abb, keys[0], nil
 	}
+}
 
-	return &abb, chosenKey, nil
+// ExtendBallotBatchReservation renews the reservation of an aggregated batch
+// held by the worker provided, as in ExtendBallotReservation.
+func (s *Storage) ExtendBallotBatchReservation(k []byte, workerID string) error {
+	return s.batches.extend(s, k, workerID)
 }
 
 // MarkVerifiedBallotDone removes the reservation and the verified ballot.
+// If it is the current ballot of its nullifier, the nullifier is no longer
+// considered queued.
 func (s *Storage) MarkVerifiedBallotDone(k []byte) error {
-	s.globalLock.Lock()
-	defer s.globalLock.Unlock()
+	pid, _, err := s.verifiedBallots.splitKey(k)
+	if err != nil {
+		return err
+	}
+	nmu := s.nullifiers.lock(pid)
+	nmu.Lock()
+	defer nmu.Unlock()
+	mu := s.verifiedBallots.lock(pid)
+	mu.Lock()
+	defer mu.Unlock()
 
-	// remove reservation
-	if err := s.deleteArtifact(verifiedBallotReservPrefix, k); err != nil && !errors.Is(err, ErrNotFound) {
-		return fmt.Errorf("delete verified ballot reservation: %w", err)
+	val, err := prefixeddb.NewPrefixedReader(s.db, verifiedBallotPrefix).Get(k)
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return nil
 	}
+	if err != nil {
+		return fmt.Errorf("get verified ballot: %w", err)
+	}
+	vb, _ := verifiedBallotCodec.decode(s, k, val)
+	wTx := s.writeTx()
+	defer wTx.Discard()
+	if err := s.removeVerifiedBallot(wTx, pid, k, vb); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if err := wTx.Commit(); err != nil {
+		return err
+	}
+	s.verifiedBallots.stats.done(pid)
+	if vb != nil {
+		traceQueueOp(s.verifiedBallots, "done", vb.TraceContext, k)
+	}
+	return nil
+}
 
-	// remove from verified queue
-	if err := s.deleteArtifact(verifiedBallotPrefix, k); err != nil && !errors.Is(err, ErrNotFound) {
-		return fmt.Errorf("delete verified ballot: %w", err)
+// MarkVerifiedBallotsDoneForWorker completes the aggregation of the verified
+// ballots reserved by the worker provided: in a single transaction, the
+// aggregated batch is pushed and the verified ballots are removed. The batch
+// must be of the process of the ballots, and have their nullifiers in the
+// same order. The ballots of the batch stored are built from the verified
+// ballots, so only its proof is taken from the worker. If the ballots are
+// not reserved by the worker, it returns ErrNotFound or
+// ErrNotReservationOwner, and ErrResultMismatch if the batch does not match
+// them.
+func (s *Storage) MarkVerifiedBallotsDoneForWorker(keys [][]byte, workerID string, abb *AggregatedBallotBatch) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("%w: no verified ballots", ErrResultMismatch)
+	}
+	pid, _, err := s.verifiedBallots.splitKey(keys[0])
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(abb.ProcessID, pid) {
+		return fmt.Errorf("%w: the batch is of another process", ErrResultMismatch)
+	}
+	if len(abb.Ballots) != len(keys) {
+		return fmt.Errorf("%w: %d ballots aggregated, %d leased", ErrResultMismatch, len(abb.Ballots), len(keys))
+	}
+	nmu := s.nullifiers.lock(pid)
+	nmu.Lock()
+	defer nmu.Unlock()
+	mu := s.verifiedBallots.lock(pid)
+	mu.Lock()
+	defer mu.Unlock()
+
+	data := prefixeddb.NewPrefixedReader(s.db, verifiedBallotPrefix)
+	batch := &AggregatedBallotBatch{ProcessID: pid, Proof: abb.Proof, TraceContext: abb.TraceContext}
+	vbs := make([]*VerifiedBallot, len(keys))
+	for i, k := range keys {
+		if kpid, _, err := s.verifiedBallots.splitKey(k); err != nil || !bytes.Equal(kpid, pid) {
+			return fmt.Errorf("%w: the verified ballots are of several processes", ErrResultMismatch)
+		}
+		if _, err := s.verifiedBallots.reservation(s, k, workerID); err != nil {
+			return err
+		}
+		val, err := data.Get(k)
+		if err != nil {
+			return fmt.Errorf("get verified ballot: %w", err)
+		}
+		if vbs[i], err = verifiedBallotCodec.decode(s, k, val); err != nil {
+			return fmt.Errorf("decode verified ballot: %w", err)
+		}
+		if !bytes.Equal(abb.Ballots[i].Nullifier, vbs[i].Nullifier) {
+			return fmt.Errorf("%w: ballot %d has nullifier %s, leased %s", ErrResultMismatch,
+				i, abb.Ballots[i].Nullifier, vbs[i].Nullifier)
+		}
+		batch.Ballots = append(batch.Ballots, AggregatedBallot{
+			Nullifier:       vbs[i].Nullifier,
+			Commitment:      vbs[i].Commitment,
+			Address:         vbs[i].Address,
+			EncryptedBallot: vbs[i].EncryptedBallot,
+			TraceContext:    vbs[i].TraceContext,
+		})
 	}
 
+	key, val, span, err := s.encodeBallotBatch(batch)
+	if err != nil {
+		return err
+	}
+	wTx := s.writeTx()
+	defer wTx.Discard()
+	if _, err := s.batches.push(wTx, pid, key, val); err != nil {
+		endSpan(span, err)
+		return fmt.Errorf("push aggregated batch: %w", err)
+	}
+	for i, k := range keys {
+		if err := s.removeVerifiedBallot(wTx, pid, k, vbs[i]); err != nil {
+			endSpan(span, err)
+			return err
+		}
+	}
+	err = wTx.Commit()
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+	for i, k := range keys {
+		s.verifiedBallots.stats.done(pid)
+		traceQueueOp(s.verifiedBallots, "done", vbs[i].TraceContext, k)
+	}
+	return nil
+}
+
+// removeVerifiedBallot removes the reserved verified ballot in the write
+// transaction provided and, if it is the current ballot of its nullifier,
+// marks the nullifier as done. The verified ballot is nil if it cannot be
+// decoded. The caller must hold the locks of the process.
+func (s *Storage) removeVerifiedBallot(wTx *statsTx, pid, k []byte, vb *VerifiedBallot) error {
+	if err := s.verifiedBallots.remove(s, wTx, k); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return fmt.Errorf("remove verified ballot: %w", err)
+	}
+	if vb == nil {
+		return nil
+	}
+	rec, err := s.nullifierRecord(pid, vb.Nullifier)
+	if err != nil {
+		return err
+	}
+	if rec != nil && isCurrentBallot(rec, k) {
+		rec.Stage = nullifierStageDone
+		if err := setNullifierRecord(wTx, pid, vb.Nullifier, rec); err != nil {
+			return fmt.Errorf("set nullifier: %w", err)
+		}
+	}
 	return nil
 }
 
 // MarkBallotBatchDone called after processing aggregator batch. For simplicity, we just remove it from aggregator queue and reservation.
 func (s *Storage) MarkBallotBatchDone(k []byte) error {
-	s.globalLock.Lock()
-	defer s.globalLock.Unlock()
-	if err := s.deleteArtifact(aggregBatchReservPrefix, k); err != nil && !errors.Is(err, ErrNotFound) {
+	return s.markBallotBatchDone(k, nil)
+}
+
+// MarkBallotBatchDoneForWorker is like MarkBallotBatchDone, but the batch
+// must be reserved by the worker provided. Otherwise, it returns ErrNotFound
+// or ErrNotReservationOwner.
+func (s *Storage) MarkBallotBatchDoneForWorker(k []byte, workerID string) error {
+	return s.markBallotBatchDone(k, &workerID)
+}
+
+// markBallotBatchDone removes the reserved batch and adds its ballots to
+// the results of the process in the same transaction, see markDone.
+func (s *Storage) markBallotBatchDone(k []byte, workerID *string) error {
+	pid, _, err := s.batches.splitKey(k)
+	if err != nil {
 		return err
 	}
-	if err := s.deleteArtifact(aggregBatchPrefix, k); err != nil && !errors.Is(err, ErrNotFound) {
+	nmu := s.nullifiers.lock(pid)
+	nmu.Lock()
+	defer nmu.Unlock()
+
+	traceContext := s.storedTraceContext(s.batches, k)
+	done, err := s.markDone(s.batches, k, workerID, func(wTx *statsTx) error {
+		return s.countBatch(wTx, k)
+	})
+	if err != nil {
 		return err
 	}
+	if done {
+		s.batches.stats.done(s.batches.processID(k))
+		traceQueueOp(s.batches, "done", traceContext, k)
+	}
 	return nil
 }
+
+// markDone removes a reserved item from the queue provided. It does nothing
+// if the item is not reserved, and returns whether it was removed. If
+// workerID is not nil, the item must be reserved by the worker, otherwise
+// the error of queue.reservation is returned. If apply is not nil, it is
+// called with the transaction before the item is removed.
+func (s *Storage) markDone(q *queue, k []byte, workerID *string, apply func(*statsTx) error) (bool, error) {
+	if _, _, err := q.splitKey(k); err != nil {
+		return false, err
+	}
+	mu := q.keyLock(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if workerID != nil {
+		if _, err := q.reservation(s, k, *workerID); err != nil {
+			return false, err
+		}
+	}
+
+	wTx := s.writeTx()
+	defer wTx.Discard()
+	if apply != nil {
+		// the items not reserved are not removed, so nothing is applied
+		if _, err := q.reservation(s, k, ""); errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		if err := apply(wTx); err != nil {
+			return false, err
+		}
+	}
+	if err := q.remove(s, wTx, k); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("remove %s: %w", q.name, err)
+	}
+	return true, wTx.Commit()
+}
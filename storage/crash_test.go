@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/db/metadb"
+	"go.vocdoni.io/dvote/db/prefixeddb"
+)
+
+// errCrash is the value used to panic when a crash is injected.
+var errCrash = errors.New("injected crash")
+
+// crashDB wraps a database to simulate a crash of the node: the write
+// operation number crashAt (counting every Set, Delete and Commit) panics
+// with errCrash before being applied. A crashAt of zero disables it.
+type crashDB struct {
+	db.Database
+	ops     int
+	crashAt int
+}
+
+func (d *crashDB) WriteTx() db.WriteTx {
+	return &crashTx{WriteTx: d.Database.WriteTx(), db: d}
+}
+
+// step counts a write operation and panics if it is the one to crash.
+func (d *crashDB) step() {
+	d.ops++
+	if d.crashAt > 0 && d.ops == d.crashAt {
+		panic(errCrash)
+	}
+}
+
+type crashTx struct {
+	db.WriteTx
+	db *crashDB
+}
+
+func (tx *crashTx) Set(k, v []byte) error {
+	tx.db.step()
+	return tx.WriteTx.Set(k, v)
+}
+
+func (tx *crashTx) Delete(k []byte) error {
+	tx.db.step()
+	return tx.WriteTx.Delete(k)
+}
+
+func (tx *crashTx) Commit() error {
+	tx.db.step()
+	return tx.WriteTx.Commit()
+}
+
+func (tx *crashTx) Unwrap() db.WriteTx {
+	return tx.WriteTx
+}
+
+// crashWorkload moves the ballots provided through the queues, until they
+// are done or the crash is injected. It returns the number of ballots
+// pushed and the number of verified ballots marked done before the crash.
+func crashWorkload(st *Storage, pid types.ProcessID, n int) (pushed, done int, crashed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != errCrash {
+				panic(r)
+			}
+			crashed = true
+		}
+	}()
+	for i := 0; i < n; i++ {
+		if err := st.PushBallot(&Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{byte(i)}}); err != nil {
+			panic(err)
+		}
+		pushed++
+	}
+	for {
+		b, k, err := st.NextBallot()
+		if errors.Is(err, ErrNoMoreElements) {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		vb := &VerifiedBallot{ProcessID: b.ProcessID, Nullifier: b.Nullifier}
+		if err := st.MarkBallotDone(k, vb); err != nil {
+			panic(err)
+		}
+	}
+	for {
+		_, keys, err := st.PullVerifiedBallots(pid.Marshal(), 2)
+		if errors.Is(err, ErrNotFound) {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		for _, k := range keys {
+			if err := st.MarkVerifiedBallotDone(k); err != nil {
+				panic(err)
+			}
+			done++
+		}
+	}
+	return pushed, done, false
+}
+
+// checkQueueInvariants checks that every item of the queues is available
+// exactly once and not reserved, as expected after a restart.
+func checkQueueInvariants(c *qt.C, st *Storage) {
+	for _, q := range st.queues() {
+		items := make(map[string]int)
+		prefixeddb.NewPrefixedReader(st.db, q.dataPrefix).Iterate(nil, func(k, _ []byte) bool {
+			items[string(k)] = 0
+			return true
+		})
+		prefixeddb.NewPrefixedReader(st.db, q.indexPrefix).Iterate(nil, func(k, _ []byte) bool {
+			key, _, err := q.indexEntryKey(k)
+			c.Assert(err, qt.IsNil)
+			_, ok := items[string(key)]
+			c.Assert(ok, qt.IsTrue, qt.Commentf("%s index entry without data", q.name))
+			items[string(key)]++
+			return true
+		})
+		for key, indexed := range items {
+			c.Assert(indexed, qt.Equals, 1, qt.Commentf("%s item %x indexed %d times", q.name, key, indexed))
+		}
+		reservations := 0
+		prefixeddb.NewPrefixedReader(st.db, q.reservPrefix).Iterate(nil, func(_, _ []byte) bool {
+			reservations++
+			return true
+		})
+		c.Assert(reservations, qt.Equals, 0, qt.Commentf("%s reservations left after restart", q.name))
+	}
+	// no ballot can be pending and verified at the same time
+	pending := prefixeddb.NewPrefixedReader(st.db, ballotPrefix)
+	prefixeddb.NewPrefixedReader(st.db, verifiedBallotPrefix).Iterate(nil, func(k, _ []byte) bool {
+		_, err := pending.Get(k)
+		c.Assert(err, qt.ErrorIs, db.ErrKeyNotFound, qt.Commentf("ballot %x pending and verified", k))
+		return true
+	})
+}
+
+func TestCrashRecovery(t *testing.T) {
+	c := qt.New(t)
+	pid := types.ProcessID{Nonce: 1}
+	const n = 4
+
+	// Crash at every write operation of the workload until it completes
+	for crashAt := 1; ; crashAt++ {
+		database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+		c.Assert(err, qt.IsNil)
+		cdb := &crashDB{Database: database}
+		st, err := New(cdb, testMasterKey)
+		c.Assert(err, qt.IsNil)
+
+		cdb.ops, cdb.crashAt = 0, crashAt
+		pushed, done, crashed := crashWorkload(st, pid, n)
+
+		// Restart the storage on the same database
+		cdb.crashAt = 0
+		st, err = New(cdb, testMasterKey)
+		c.Assert(err, qt.IsNil)
+		checkQueueInvariants(c, st)
+
+		// No ballot is lost or duplicated: they are pending, verified or done
+		pending := st.ballots.count(st, nil)
+		verified := st.CountVerifiedBallots(pid.Marshal())
+		c.Assert(pending+verified+done, qt.Equals, pushed,
+			qt.Commentf("crash at op %d: %d pending, %d verified, %d done", crashAt, pending, verified, done))
+
+		// The workload can be resumed after the restart
+		_, resumedDone, _ := crashWorkload(st, pid, 0)
+		c.Assert(done+resumedDone, qt.Equals, pushed)
+		st.Close()
+
+		if !crashed {
+			break
+		}
+	}
+}
+
+func TestRecoverRepairsInconsistencies(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+
+	pid := types.ProcessID{Nonce: 1}
+	for i := 0; i < 3; i++ {
+		c.Assert(st.PushBallot(&Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{byte(i)}}), qt.IsNil)
+	}
+	_, k0, err := st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.MarkBallotDone(k0, &VerifiedBallot{ProcessID: pid.Marshal()}), qt.IsNil)
+	_, k1, err := st.NextBallot()
+	c.Assert(err, qt.IsNil)
+
+	// Break the invariants as a crash between non-atomic operations would
+	wTx := database.WriteTx()
+	// the verified ballot k0 is still pending
+	c.Assert(prefixeddb.NewPrefixedWriteTx(wTx, ballotPrefix).Set(k0, []byte{1}), qt.IsNil)
+	// the reserved ballot k1 is also available
+	c.Assert(prefixeddb.NewPrefixedWriteTx(wTx, ballotIndexPrefix).Set(st.ballots.indexKey(pid.Marshal(), 1, k1[processIDLen:]), nil), qt.IsNil)
+	// index entries and reservations without data
+	c.Assert(prefixeddb.NewPrefixedWriteTx(wTx, ballotIndexPrefix).Set(st.ballots.indexKey(pid.Marshal(), 2, []byte("missing")), nil), qt.IsNil)
+	c.Assert(prefixeddb.NewPrefixedWriteTx(wTx, verifiedBallotReservPrefix).Set(append(pid.Marshal(), 1), nil), qt.IsNil)
+	// a verified ballot stored without index entry
+	c.Assert(prefixeddb.NewPrefixedWriteTx(wTx, verifiedBallotPrefix).Set(append(pid.Marshal(), 2), []byte{1}), qt.IsNil)
+	c.Assert(wTx.Commit(), qt.IsNil)
+
+	st, err = New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	checkQueueInvariants(c, st)
+	c.Assert(st.ballots.count(st, nil), qt.Equals, 2)
+	c.Assert(st.CountVerifiedBallots(pid.Marshal()), qt.Equals, 2)
+}
+
+func TestMigrateLegacyBallotKeys(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+
+	// Store a reserved ballot keyed without its process ID, as they were
+	// stored before the queues were keyed by process
+	pid := types.ProcessID{Nonce: 1}
+	val, err := ballotCodec.encode(&Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{1}})
+	c.Assert(err, qt.IsNil)
+	legacyKey := hashKey(val)
+	wTx := database.WriteTx()
+	c.Assert(prefixeddb.NewPrefixedWriteTx(wTx, ballotPrefix).Set(legacyKey, val), qt.IsNil)
+	c.Assert(prefixeddb.NewPrefixedWriteTx(wTx, ballotReservationPrefix).Set(legacyKey, nil), qt.IsNil)
+	c.Assert(wTx.Commit(), qt.IsNil)
+
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	checkQueueInvariants(c, st)
+	c.Assert(st.PendingBallots(pid.Marshal()), qt.Equals, 1)
+	b, k, err := st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(b.Nullifier, qt.DeepEquals, types.HexBytes{1})
+	c.Assert(k, qt.DeepEquals, append(pid.Marshal(), legacyKey...))
+}
+
+func TestQueueOrderAfterRestart(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+
+	// Queue a ballot with a sequence number far in the future, as if the
+	// clock went backwards before the restart
+	pid := types.ProcessID{Nonce: 1}
+	last := lastSeq.Load()
+	t.Cleanup(func() { lastSeq.Store(last) })
+	lastSeq.Store(uint64(time.Now().Add(time.Hour).UnixNano()))
+	c.Assert(st.PushBallot(&Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{0}}), qt.IsNil)
+	lastSeq.Store(0)
+
+	st, err = New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	c.Assert(st.PushBallot(&Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{1}}), qt.IsNil)
+	for i := range 2 {
+		b, _, err := st.NextBallot()
+		c.Assert(err, qt.IsNil)
+		c.Assert(b.Nullifier, qt.DeepEquals, types.HexBytes{byte(i)})
+	}
+}
@@ -0,0 +1,335 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.vocdoni.io/dvote/db/prefixeddb"
+)
+
+// RetryPolicy defines how many times a failed queue item is processed
+// again before it is moved to the dead letters, and how long it waits
+// between the attempts.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times an item is processed before it is
+	// moved to the dead letters. Values lower than 1 are treated as 1.
+	MaxAttempts int
+	// Backoff is the time to wait before the first retry, it is doubled on
+	// every attempt.
+	Backoff time.Duration
+	// MaxBackoff is the maximum time to wait between two attempts, zero
+	// means unlimited.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy used by the storage unless another
+// one is set.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     10 * time.Second,
+	MaxBackoff:  5 * time.Minute,
+}
+
+// delay returns the time to wait before retrying an item that failed the
+// number of attempts provided.
+func (p RetryPolicy) delay(attempts int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempts && (p.MaxBackoff == 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 {
+		d = min(d, p.MaxBackoff)
+	}
+	return d
+}
+
+// DeadLetter is a queue item that could not be processed, either because it
+// failed all its attempts or because it could not be decoded. It keeps the
+// encoded artifact, so it can be inspected and requeued.
+type DeadLetter struct {
+	ID        types.HexBytes `json:"id"`
+	Stage     string         `json:"stage"`
+	ProcessID types.HexBytes `json:"processId,omitempty"`
+	Key       types.HexBytes `json:"key"`
+	Artifact  types.HexBytes `json:"artifact"`
+	Error     string         `json:"error"`
+	Attempts  int            `json:"attempts"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+// deadLetterCodec stores the dead letters of all the queues.
+var deadLetterCodec = &artifactCodec[DeadLetter]{
+	name:    "dead letter",
+	prefix:  deadLetterPrefix,
+	version: 1,
+}
+
+// SetRetryPolicy sets the retry policy of the failed queue items.
+func (s *Storage) SetRetryPolicy(policy RetryPolicy) {
+	s.retryLock.Lock()
+	defer s.retryLock.Unlock()
+	s.retryPolicy = policy
+}
+
+// RetryPolicy returns the retry policy of the failed queue items.
+func (s *Storage) RetryPolicy() RetryPolicy {
+	s.retryLock.RLock()
+	defer s.retryLock.RUnlock()
+	return s.retryPolicy
+}
+
+// MarkBallotFailed is called when the verification of a reserved ballot
+// fails. The ballot is retried after the backoff of the retry policy, or
+// moved to the dead letters if it failed all its attempts.
+func (s *Storage) MarkBallotFailed(k []byte, cause error) error {
+	return s.fail(s.ballots, k, cause, nil)
+}
+
+// MarkVerifiedBallotFailed is called when the aggregation of a reserved
+// verified ballot fails. It is retried or moved to the dead letters as in
+// MarkBallotFailed.
+func (s *Storage) MarkVerifiedBallotFailed(k []byte, cause error) error {
+	return s.fail(s.verifiedBallots, k, cause, nil)
+}
+
+// MarkBallotBatchFailed is called when the processing of a reserved
+// aggregated batch fails. It is retried or moved to the dead letters as in
+// MarkBallotFailed.
+func (s *Storage) MarkBallotBatchFailed(k []byte, cause error) error {
+	return s.fail(s.batches, k, cause, nil)
+}
+
+// MarkFailedForWorker is like MarkBallotFailed for the items of the stage
+// provided, but the item must be reserved by the worker provided. Otherwise, it returns
+// ErrNotFound or ErrNotReservationOwner, and the attempt is not recorded.
+func (s *Storage) MarkFailedForWorker(stage string, k []byte, workerID string, cause error) error {
+	q, err := s.stageQueue(stage)
+	if err != nil {
+		return err
+	}
+	return s.fail(q, k, cause, &workerID)
+}
+
+// fail records a failed attempt of the reserved item of the queue provided,
+// and makes it available again after the backoff, or moves it to the dead
+// letters if it reached the maximum number of attempts. It does nothing if
+// the item is not reserved. If workerID is not nil, the item must be
+// reserved by the worker, otherwise the error of queue.reservation is
+// returned.
+func (s *Storage) fail(q *queue, k []byte, cause error, workerID *string) error {
+	if _, _, err := q.splitKey(k); err != nil {
+		return err
+	}
+	mu := q.keyLock(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if workerID != nil {
+		if _, err := q.reservation(s, k, *workerID); err != nil {
+			return err
+		}
+	}
+	if !s.isReserved(q.reservPrefix, k) {
+		log.Debugw("failed item not reserved, ignoring", "queue", q.name, "key", hex.EncodeToString(k))
+		return nil
+	}
+	attempt, err := q.attempts(s, k)
+	if err != nil {
+		return err
+	}
+	if attempt == nil {
+		attempt = &attemptRecord{}
+	}
+	attempt.Attempts++
+	attempt.LastError = cause.Error()
+
+	ctx, span := startQueueSpan(q, "fail", s.storedTraceContext(q, k), k,
+		trace.WithAttributes(attribute.Int("vocdoni.queue.attempts", attempt.Attempts)))
+	defer endSpan(span, cause)
+	wTx := s.writeTx()
+	defer wTx.Discard()
+	policy := s.RetryPolicy()
+	if attempt.Attempts >= max(policy.MaxAttempts, 1) {
+		log.WarnwCtx(ctx, "moving failed item to dead letters", "queue", q.name, "key", hex.EncodeToString(k),
+			"attempts", attempt.Attempts, "error", cause.Error())
+		span.SetAttributes(attribute.Bool("vocdoni.queue.deadLetter", true))
+		if err := s.deadLetter(wTx, q, k, cause, attempt.Attempts); err != nil {
+			return err
+		}
+		return wTx.Commit()
+	}
+	delay := policy.delay(attempt.Attempts)
+	attempt.Seq = uint64(time.Now().Add(delay).UnixNano())
+	log.DebugwCtx(ctx, "retrying failed item", "queue", q.name, "key", hex.EncodeToString(k),
+		"attempts", attempt.Attempts, "delay", delay.String(), "error", cause.Error())
+	span.SetAttributes(attribute.String("vocdoni.queue.retryDelay", delay.String()))
+	if err := q.retry(s, wTx, k, attempt); err != nil {
+		return fmt.Errorf("retry %s: %w", q.name, err)
+	}
+	return wTx.Commit()
+}
+
+// deadLetterReserved moves a reserved item that cannot be processed, like
+// one that cannot be decoded, to the dead letters without retrying it.
+func (s *Storage) deadLetterReserved(q *queue, k []byte, cause error) error {
+	if _, _, err := q.splitKey(k); err != nil {
+		return err
+	}
+	mu := q.keyLock(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !s.isReserved(q.reservPrefix, k) {
+		return nil
+	}
+	attempt, err := q.attempts(s, k)
+	if err != nil {
+		return err
+	}
+	attempts := 1
+	if attempt != nil {
+		attempts += attempt.Attempts
+	}
+	log.Warnw("moving invalid item to dead letters", "queue", q.name, "key", hex.EncodeToString(k), "error", cause.Error())
+	wTx := s.writeTx()
+	defer wTx.Discard()
+	if err := s.deadLetter(wTx, q, k, cause, attempts); err != nil {
+		return err
+	}
+	return wTx.Commit()
+}
+
+// deadLetterID returns the ID of the dead letter of a queue item.
+func deadLetterID(q *queue, k []byte) []byte {
+	return hashKey(q.attemptKey(k))
+}
+
+// deadLetter removes the reserved item from the queue and stores it as a
+// dead letter in the write transaction provided. The caller must hold the
+// lock of the process.
+func (s *Storage) deadLetter(wTx *statsTx, q *queue, k []byte, cause error, attempts int) error {
+	val, err := prefixeddb.NewPrefixedReader(s.db, q.dataPrefix).Get(k)
+	if err != nil {
+		return fmt.Errorf("get %s %x: %w", q.name, k, err)
+	}
+	dl := &DeadLetter{
+		ID:        deadLetterID(q, k),
+		Stage:     q.name,
+		ProcessID: bytes.Clone(q.processID(k)),
+		Key:       bytes.Clone(k),
+		Artifact:  bytes.Clone(val),
+		Error:     cause.Error(),
+		Attempts:  attempts,
+		CreatedAt: time.Now(),
+	}
+	data, err := deadLetterCodec.encode(dl)
+	if err != nil {
+		return err
+	}
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, deadLetterPrefix).Set(dl.ID, data); err != nil {
+		return err
+	}
+	if err := q.remove(s, wTx, k); err != nil {
+		return fmt.Errorf("remove %s: %w", q.name, err)
+	}
+	wTx.onCommit(func() { s.dead.add(dl.ProcessID, 1) })
+	return nil
+}
+
+// DeadLetters returns all the dead letters, sorted by ID.
+func (s *Storage) DeadLetters() ([]*DeadLetter, error) {
+	dls := []*DeadLetter{}
+	var decodeErr error
+	if err := prefixeddb.NewPrefixedReader(s.db, deadLetterPrefix).Iterate(nil, func(k, v []byte) bool {
+		dl, err := deadLetterCodec.decode(s, bytes.Clone(k), bytes.Clone(v))
+		if err != nil {
+			decodeErr = fmt.Errorf("decode dead letter %x: %w", k, err)
+			return false
+		}
+		dls = append(dls, dl)
+		return true
+	}); err != nil {
+		return nil, fmt.Errorf("iterate dead letters: %w", err)
+	}
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	return dls, nil
+}
+
+// DeadLetter returns the dead letter with the ID provided. It returns
+// ErrNotFound if it does not exist.
+func (s *Storage) DeadLetter(id []byte) (*DeadLetter, error) {
+	return getArtifact(s, deadLetterCodec, id)
+}
+
+// RequeueDeadLetter pushes the artifact of the dead letter back to the end
+// of its queue, with no failed attempts, and removes the dead letter. It
+// returns ErrNotFound if the dead letter does not exist, and
+// ErrKeyAlreadyExists if the item is already queued.
+func (s *Storage) RequeueDeadLetter(id []byte) error {
+	dl, err := s.DeadLetter(id)
+	if err != nil {
+		return err
+	}
+	q, err := s.stageQueue(dl.Stage)
+	if err != nil {
+		return err
+	}
+	pid, itemID, err := q.splitKey(dl.Key)
+	if err != nil {
+		return err
+	}
+	mu := q.keyLock(dl.Key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, err := prefixeddb.NewPrefixedReader(s.db, q.dataPrefix).Get(dl.Key); err == nil {
+		return ErrKeyAlreadyExists
+	}
+	wTx := s.writeTx()
+	defer wTx.Discard()
+	seq, err := q.push(wTx, pid, itemID, dl.Artifact)
+	if err != nil {
+		return fmt.Errorf("push %s: %w", q.name, err)
+	}
+	// the attempt record keeps the new sequence number, so the item can
+	// still be cancelled if it is superseded
+	data, err := encodeArtifact(&attemptRecord{Seq: seq})
+	if err != nil {
+		return err
+	}
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, attemptPrefix).Set(q.attemptKey(dl.Key), data); err != nil {
+		return err
+	}
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, deadLetterPrefix).Delete(id); err != nil {
+		return err
+	}
+	wTx.onCommit(func() { s.dead.add(dl.ProcessID, -1) })
+	return wTx.Commit()
+}
+
+// PurgeDeadLetter removes the dead letter with the ID provided. It returns
+// ErrNotFound if it does not exist.
+func (s *Storage) PurgeDeadLetter(id []byte) error {
+	dl, err := s.DeadLetter(id)
+	if err != nil {
+		return err
+	}
+	wTx := s.db.WriteTx()
+	defer wTx.Discard()
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, deadLetterPrefix).Delete(id); err != nil {
+		return err
+	}
+	if err := wTx.Commit(); err != nil {
+		return err
+	}
+	s.dead.add(dl.ProcessID, -1)
+	return nil
+}
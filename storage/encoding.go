@@ -0,0 +1,473 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/curves"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/elgamal"
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+	"go.vocdoni.io/dvote/db/prefixeddb"
+)
+
+// The queue artifacts are encoded as CBOR (RFC 8949) maps with integer keys,
+// using the core deterministic encoding, so the same artifact always has the
+// same encoding and the keys derived by hashing it are stable. The schema of
+// each artifact is defined by the *Encoding types below: the keys of the
+// fields must never change or be reused, new optional fields can be added
+// with new keys, and any other change requires a new version of the codec.
+var (
+	cborEncMode cbor.EncMode
+	cborDecMode cbor.DecMode
+)
+
+func init() {
+	var err error
+	if cborEncMode, err = cbor.CoreDetEncOptions().EncMode(); err != nil {
+		panic(err)
+	}
+	if cborDecMode, err = (cbor.DecOptions{
+		DupMapKey:   cbor.DupMapKeyEnforcedAPF,
+		IndefLength: cbor.IndefLengthForbidden,
+	}).DecMode(); err != nil {
+		panic(err)
+	}
+}
+
+// ballotCodec stores the ballots of the pending queue. Version 0 is the
+// legacy gob encoding.
+var ballotCodec = &artifactCodec[Ballot]{
+	name:        "ballot",
+	prefix:      ballotPrefix,
+	version:     1,
+	migrations:  []migration{gobToCBOR[Ballot](encodeBallot)},
+	marshal:     encodeBallot,
+	unmarshal:   decodeBallot,
+	skipInvalid: true,
+}
+
+// verifiedBallotCodec stores the ballots of the verified queue. Version 0
+// is the legacy gob encoding.
+var verifiedBallotCodec = &artifactCodec[VerifiedBallot]{
+	name:        "verified ballot",
+	prefix:      verifiedBallotPrefix,
+	version:     1,
+	migrations:  []migration{gobToCBOR[VerifiedBallot](encodeVerifiedBallot)},
+	marshal:     encodeVerifiedBallot,
+	unmarshal:   decodeVerifiedBallot,
+	skipInvalid: true,
+}
+
+// ballotBatchCodec stores the batches of the aggregated queue. Version 0 is
+// the legacy gob encoding.
+var ballotBatchCodec = &artifactCodec[AggregatedBallotBatch]{
+	name:        "aggregated batch",
+	prefix:      aggregBatchPrefix,
+	version:     1,
+	migrations:  []migration{gobToCBOR[AggregatedBallotBatch](encodeBallotBatch)},
+	marshal:     encodeBallotBatch,
+	unmarshal:   decodeBallotBatch,
+	skipInvalid: true,
+}
+
+// gobToCBOR returns the migration of a queue artifact from the legacy gob
+// encoding to the CBOR one. The gob encoding could not hold proofs or
+// ciphertexts, so they are always empty in the legacy records.
+func gobToCBOR[T any](marshal func(*T) ([]byte, error)) migration {
+	return func(_ *Storage, _, data []byte) ([]byte, error) {
+		artifact := new(T)
+		if err := decodeArtifact(data, artifact); err != nil {
+			return nil, err
+		}
+		return marshal(artifact)
+	}
+}
+
+// stageCodecs are the codecs of the artifacts of each processing stage.
+var stageCodecs = map[string]migrator{
+	StageBallot:         ballotCodec,
+	StageVerifiedBallot: verifiedBallotCodec,
+	StageBallotBatch:    ballotBatchCodec,
+}
+
+// MigrateQueues rewrites the artifacts of the queues and the dead letters
+// stored with a previous version of their encoding in the current one. The
+// artifacts of previous versions are still decoded, so it is not required,
+// but it lets the older decoders be removed once every database is migrated.
+// The artifacts that cannot be decoded are left as they are. It returns the
+// number of artifacts migrated by stage, and it must not be called while the
+// queues are being processed.
+func (s *Storage) MigrateQueues() (map[string]int, error) {
+	migrated := make(map[string]int)
+	for stage, c := range stageCodecs {
+		n, err := c.migrateAll(s)
+		if err != nil {
+			return nil, err
+		}
+		migrated[stage] += n
+	}
+	dls, err := s.DeadLetters()
+	if err != nil {
+		return nil, err
+	}
+	wTx := s.db.WriteTx()
+	defer wTx.Discard()
+	pwTx := prefixeddb.NewPrefixedWriteTx(wTx, deadLetterPrefix)
+	updated := 0
+	for _, dl := range dls {
+		c, ok := stageCodecs[dl.Stage]
+		if !ok {
+			continue
+		}
+		artifact, changed, err := c.reencode(s, dl.Key, dl.Artifact)
+		if err != nil {
+			log.Warnw("skipping invalid dead letter artifact", "id", dl.ID.String(), "error", err.Error())
+			continue
+		}
+		if !changed {
+			continue
+		}
+		dl.Artifact = artifact
+		data, err := deadLetterCodec.encode(dl)
+		if err != nil {
+			return nil, err
+		}
+		if err := pwTx.Set(dl.ID, data); err != nil {
+			return nil, err
+		}
+		migrated[dl.Stage]++
+		updated++
+	}
+	if updated == 0 {
+		return migrated, nil
+	}
+	if err := wTx.Commit(); err != nil {
+		return nil, fmt.Errorf("could not commit dead letters migration: %w", err)
+	}
+	return migrated, nil
+}
+
+// queueCodec returns the codec of a queue artifact type.
+func queueCodec[T Artifact]() *artifactCodec[T] {
+	var c any
+	switch any((*T)(nil)).(type) {
+	case *Ballot:
+		c = ballotCodec
+	case *VerifiedBallot:
+		c = verifiedBallotCodec
+	case *AggregatedBallotBatch:
+		c = ballotBatchCodec
+	}
+	return c.(*artifactCodec[T])
+}
+
+type ciphertextEncoding struct {
+	Curve string `cbor:"1,keyasint"`
+	C1    []byte `cbor:"2,keyasint"`
+	C2    []byte `cbor:"3,keyasint"`
+}
+
+type proofEncoding struct {
+	Curve string `cbor:"1,keyasint"`
+	Data  []byte `cbor:"2,keyasint"`
+}
+
+type circomProofEncoding struct {
+	A        []string   `cbor:"1,keyasint"`
+	B        [][]string `cbor:"2,keyasint"`
+	C        []string   `cbor:"3,keyasint"`
+	Protocol string     `cbor:"4,keyasint"`
+}
+
+type censusProofEncoding struct {
+	Root     types.HexBytes   `cbor:"1,keyasint"`
+	Siblings []types.HexBytes `cbor:"2,keyasint"`
+}
+
+type ballotEncoding struct {
+	ProcessID        types.HexBytes      `cbor:"1,keyasint"`
+	VoterWeight      *big.Int            `cbor:"2,keyasint"`
+	EncryptedBallot  *ciphertextEncoding `cbor:"3,keyasint"`
+	Nullifier        types.HexBytes      `cbor:"4,keyasint"`
+	Commitment       types.HexBytes      `cbor:"5,keyasint"`
+	Address          types.HexBytes      `cbor:"6,keyasint"`
+	BallotInputsHash types.HexBytes      `cbor:"7,keyasint"`
+	BallotProof      circomProofEncoding `cbor:"8,keyasint"`
+	Signature        types.HexBytes      `cbor:"9,keyasint"`
+	CensusProof      censusProofEncoding `cbor:"10,keyasint"`
+	TraceContext     map[string]string   `cbor:"11,keyasint,omitempty"`
+}
+
+type verifiedBallotEncoding struct {
+	ProcessID       types.HexBytes      `cbor:"1,keyasint"`
+	VoterWeight     *big.Int            `cbor:"2,keyasint"`
+	Nullifier       types.HexBytes      `cbor:"3,keyasint"`
+	Commitment      types.HexBytes      `cbor:"4,keyasint"`
+	EncryptedBallot *ciphertextEncoding `cbor:"5,keyasint"`
+	Address         types.HexBytes      `cbor:"6,keyasint"`
+	Proof           *proofEncoding      `cbor:"7,keyasint"`
+	TraceContext    map[string]string   `cbor:"8,keyasint,omitempty"`
+}
+
+type aggregatedBallotEncoding struct {
+	Nullifier       types.HexBytes      `cbor:"1,keyasint"`
+	Commitment      types.HexBytes      `cbor:"2,keyasint"`
+	Address         types.HexBytes      `cbor:"3,keyasint"`
+	EncryptedBallot *ciphertextEncoding `cbor:"4,keyasint"`
+	TraceContext    map[string]string   `cbor:"5,keyasint,omitempty"`
+}
+
+type ballotBatchEncoding struct {
+	ProcessID    types.HexBytes             `cbor:"1,keyasint"`
+	Proof        *proofEncoding             `cbor:"2,keyasint"`
+	Ballots      []aggregatedBallotEncoding `cbor:"3,keyasint"`
+	TraceContext map[string]string          `cbor:"4,keyasint,omitempty"`
+}
+
+func encodeBallot(b *Ballot) ([]byte, error) {
+	ct, err := encodeCiphertext(&b.EncryptedBallot)
+	if err != nil {
+		return nil, err
+	}
+	return cborEncMode.Marshal(&ballotEncoding{
+		ProcessID:        b.ProcessID,
+		VoterWeight:      b.VoterWeight,
+		EncryptedBallot:  ct,
+		Nullifier:        b.Nullifier,
+		Commitment:       b.Commitment,
+		Address:          b.Address,
+		BallotInputsHash: b.BallotInputsHash,
+		BallotProof: circomProofEncoding{
+			A:        b.BallotProof.A,
+			B:        b.BallotProof.B,
+			C:        b.BallotProof.C,
+			Protocol: b.BallotProof.Protocol,
+		},
+		Signature: b.Signature,
+		CensusProof: censusProofEncoding{
+			Root:     b.CensusProof.Root,
+			Siblings: b.CensusProof.Siblings,
+		},
+		TraceContext: b.TraceContext,
+	})
+}
+
+func decodeBallot(data []byte, b *Ballot) error {
+	var enc ballotEncoding
+	if err := cborDecMode.Unmarshal(data, &enc); err != nil {
+		return err
+	}
+	ct, err := decodeCiphertext(enc.EncryptedBallot)
+	if err != nil {
+		return err
+	}
+	*b = Ballot{
+		ProcessID:        enc.ProcessID,
+		VoterWeight:      enc.VoterWeight,
+		EncryptedBallot:  ct,
+		Nullifier:        enc.Nullifier,
+		Commitment:       enc.Commitment,
+		Address:          enc.Address,
+		BallotInputsHash: enc.BallotInputsHash,
+		BallotProof: CircomProof{
+			A:        enc.BallotProof.A,
+			B:        enc.BallotProof.B,
+			C:        enc.BallotProof.C,
+			Protocol: enc.BallotProof.Protocol,
+		},
+		Signature: enc.Signature,
+		CensusProof: CensusProof{
+			Root:     enc.CensusProof.Root,
+			Siblings: enc.CensusProof.Siblings,
+		},
+		TraceContext: enc.TraceContext,
+	}
+	return nil
+}
+
+func encodeVerifiedBallot(vb *VerifiedBallot) ([]byte, error) {
+	ct, err := encodeCiphertext(&vb.EncryptedBallot)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := encodeProof(vb.Proof)
+	if err != nil {
+		return nil, err
+	}
+	return cborEncMode.Marshal(&verifiedBallotEncoding{
+		ProcessID:       vb.ProcessID,
+		VoterWeight:     vb.VoterWeight,
+		Nullifier:       vb.Nullifier,
+		Commitment:      vb.Commitment,
+		EncryptedBallot: ct,
+		Address:         vb.Address,
+		Proof:           proof,
+		TraceContext:    vb.TraceContext,
+	})
+}
+
+func decodeVerifiedBallot(data []byte, vb *VerifiedBallot) error {
+	var enc verifiedBallotEncoding
+	if err := cborDecMode.Unmarshal(data, &enc); err != nil {
+		return err
+	}
+	ct, err := decodeCiphertext(enc.EncryptedBallot)
+	if err != nil {
+		return err
+	}
+	proof, err := decodeProof(enc.Proof)
+	if err != nil {
+		return err
+	}
+	*vb = VerifiedBallot{
+		ProcessID:       enc.ProcessID,
+		VoterWeight:     enc.VoterWeight,
+		Nullifier:       enc.Nullifier,
+		Commitment:      enc.Commitment,
+		EncryptedBallot: ct,
+		Address:         enc.Address,
+		Proof:           proof,
+		TraceContext:    enc.TraceContext,
+	}
+	return nil
+}
+
+func encodeBallotBatch(abb *AggregatedBallotBatch) ([]byte, error) {
+	proof, err := encodeProof(abb.Proof)
+	if err != nil {
+		return nil, err
+	}
+	enc := &ballotBatchEncoding{
+		ProcessID:    abb.ProcessID,
+		Proof:        proof,
+		TraceContext: abb.TraceContext,
+	}
+	if abb.Ballots != nil {
+		enc.Ballots = make([]aggregatedBallotEncoding, len(abb.Ballots))
+	}
+	for i, b := range abb.Ballots {
+		ct, err := encodeCiphertext(&b.EncryptedBallot)
+		if err != nil {
+			return nil, fmt.Errorf("ballot %d: %w", i, err)
+		}
+		enc.Ballots[i] = aggregatedBallotEncoding{
+			Nullifier:       b.Nullifier,
+			Commitment:      b.Commitment,
+			Address:         b.Address,
+			EncryptedBallot: ct,
+			TraceContext:    b.TraceContext,
+		}
+	}
+	return cborEncMode.Marshal(enc)
+}
+
+func decodeBallotBatch(data []byte, abb *AggregatedBallotBatch) error {
+	var enc ballotBatchEncoding
+	if err := cborDecMode.Unmarshal(data, &enc); err != nil {
+		return err
+	}
+	proof, err := decodeProof(enc.Proof)
+	if err != nil {
+		return err
+	}
+	*abb = AggregatedBallotBatch{
+		ProcessID:    enc.ProcessID,
+		Proof:        proof,
+		TraceContext: enc.TraceContext,
+	}
+	if enc.Ballots != nil {
+		abb.Ballots = make([]AggregatedBallot, len(enc.Ballots))
+	}
+	for i, b := range enc.Ballots {
+		ct, err := decodeCiphertext(b.EncryptedBallot)
+		if err != nil {
+			return fmt.Errorf("ballot %d: %w", i, err)
+		}
+		abb.Ballots[i] = AggregatedBallot{
+			Nullifier:       b.Nullifier,
+			Commitment:      b.Commitment,
+			Address:         b.Address,
+			EncryptedBallot: ct,
+			TraceContext:    b.TraceContext,
+		}
+	}
+	return nil
+}
+
+// encodeCiphertext returns the encoding of the ciphertext points, with the
+// curve needed to decode them, or nil if the ciphertext is empty.
+func encodeCiphertext(ct *elgamal.Ciphertext) (*ciphertextEncoding, error) {
+	if ct.C1 == nil && ct.C2 == nil {
+		return nil, nil
+	}
+	if ct.C1 == nil || ct.C2 == nil {
+		return nil, fmt.Errorf("incomplete ciphertext")
+	}
+	curve := curves.Type(ct.C1)
+	if curve == "" || curves.Type(ct.C2) != curve {
+		return nil, fmt.Errorf("unsupported ciphertext curve %T", ct.C1)
+	}
+	return &ciphertextEncoding{
+		Curve: curve,
+		C1:    ct.C1.Marshal(),
+		C2:    ct.C2.Marshal(),
+	}, nil
+}
+
+func decodeCiphertext(enc *ciphertextEncoding) (elgamal.Ciphertext, error) {
+	if enc == nil {
+		return elgamal.Ciphertext{}, nil
+	}
+	if !curves.IsValid(enc.Curve) {
+		return elgamal.Ciphertext{}, fmt.Errorf("unsupported ciphertext curve %q", enc.Curve)
+	}
+	ct := elgamal.NewCiphertext(curves.New(enc.Curve))
+	if err := ct.C1.Unmarshal(enc.C1); err != nil {
+		return elgamal.Ciphertext{}, fmt.Errorf("could not decode ciphertext C1: %w", err)
+	}
+	if err := ct.C2.Unmarshal(enc.C2); err != nil {
+		return elgamal.Ciphertext{}, fmt.Errorf("could not decode ciphertext C2: %w", err)
+	}
+	return *ct, nil
+}
+
+// encodeProof returns the compressed gnark encoding of the proof, with its
+// curve, or nil if there is no proof.
+func encodeProof(proof groth16.Proof) (*proofEncoding, error) {
+	if proof == nil {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if _, err := proof.WriteTo(&buf); err != nil {
+		return nil, fmt.Errorf("could not encode proof: %w", err)
+	}
+	return &proofEncoding{
+		Curve: proof.CurveID().String(),
+		Data:  buf.Bytes(),
+	}, nil
+}
+
+func decodeProof(enc *proofEncoding) (groth16.Proof, error) {
+	if enc == nil {
+		return nil, nil
+	}
+	curve, err := ecc.IDFromString(enc.Curve)
+	if err != nil {
+		return nil, err
+	}
+	switch curve {
+	case ecc.BN254, ecc.BLS12_377, ecc.BLS12_381, ecc.BW6_761, ecc.BLS24_315, ecc.BLS24_317, ecc.BW6_633:
+	default:
+		return nil, fmt.Errorf("unsupported proof curve %s", curve)
+	}
+	proof := groth16.NewProof(curve)
+	if _, err := proof.ReadFrom(bytes.NewReader(enc.Data)); err != nil {
+		return nil, fmt.Errorf("could not decode proof: %w", err)
+	}
+	return proof, nil
+}
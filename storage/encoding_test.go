@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/curves"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/elgamal"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/db/metadb"
+	"go.vocdoni.io/dvote/db/prefixeddb"
+)
+
+type squareCircuit struct {
+	X frontend.Variable
+	Y frontend.Variable `gnark:",public"`
+}
+
+func (c *squareCircuit) Define(api frontend.API) error {
+	api.AssertIsEqual(api.Mul(c.X, c.X), c.Y)
+	return nil
+}
+
+// testProof returns a groth16 proof of a small circuit.
+func testProof(c *qt.C) groth16.Proof {
+	ccs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &squareCircuit{})
+	c.Assert(err, qt.IsNil)
+	pk, _, err := groth16.Setup(ccs)
+	c.Assert(err, qt.IsNil)
+	witness, err := frontend.NewWitness(&squareCircuit{X: 3, Y: 9}, ecc.BN254.ScalarField())
+	c.Assert(err, qt.IsNil)
+	proof, err := groth16.Prove(ccs, pk, witness)
+	c.Assert(err, qt.IsNil)
+	return proof
+}
+
+func testCiphertext(c *qt.C) elgamal.Ciphertext {
+	publicKey, _, err := elgamal.GenerateKey(curves.New(curves.CurveTypeBN254))
+	c.Assert(err, qt.IsNil)
+	ct, err := elgamal.NewCiphertext(publicKey).Encrypt(big.NewInt(7), publicKey, nil)
+	c.Assert(err, qt.IsNil)
+	return *ct
+}
+
+func TestArtifactEncoding(t *testing.T) {
+	c := qt.New(t)
+	pid := types.ProcessID{Nonce: 1}
+	ct := testCiphertext(c)
+	proof := testProof(c)
+
+	b := &Ballot{
+		ProcessID:       pid.Marshal(),
+		VoterWeight:     big.NewInt(10),
+		EncryptedBallot: ct,
+		Nullifier:       []byte{1},
+		BallotProof:     CircomProof{A: []string{"1", "2"}, B: [][]string{{"3"}}, Protocol: "groth16"},
+		CensusProof:     CensusProof{Root: []byte{2}, Siblings: []types.HexBytes{{3}, {4}}},
+		TraceContext:    map[string]string{"traceparent": "00-0102-0304-01"},
+	}
+	data, err := EncodeArtifact(b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(data[:2], qt.DeepEquals, []byte{versionMarker, ballotCodec.version})
+	// the encoding is deterministic
+	again, err := EncodeArtifact(b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(again, qt.DeepEquals, data)
+	decoded, err := DecodeArtifact[Ballot](data)
+	c.Assert(err, qt.IsNil)
+	c.Assert(decoded.VoterWeight.Cmp(b.VoterWeight), qt.Equals, 0)
+	c.Assert(decoded.EncryptedBallot.C1.Equal(ct.C1), qt.IsTrue)
+	c.Assert(decoded.EncryptedBallot.C2.Equal(ct.C2), qt.IsTrue)
+	c.Assert(decoded.BallotProof, qt.DeepEquals, b.BallotProof)
+	c.Assert(decoded.CensusProof, qt.DeepEquals, b.CensusProof)
+	c.Assert(decoded.TraceContext, qt.DeepEquals, b.TraceContext)
+	again, err = EncodeArtifact(decoded)
+	c.Assert(err, qt.IsNil)
+	c.Assert(again, qt.DeepEquals, data)
+
+	vb := &VerifiedBallot{
+		ProcessID:       pid.Marshal(),
+		VoterWeight:     big.NewInt(10),
+		Nullifier:       []byte{1},
+		EncryptedBallot: ct,
+		Proof:           proof,
+	}
+	data, err = EncodeArtifact(vb)
+	c.Assert(err, qt.IsNil)
+	decodedVB, err := DecodeArtifact[VerifiedBallot](data)
+	c.Assert(err, qt.IsNil)
+	c.Assert(decodedVB.Proof.CurveID(), qt.Equals, ecc.BN254)
+	again, err = EncodeArtifact(decodedVB)
+	c.Assert(err, qt.IsNil)
+	c.Assert(again, qt.DeepEquals, data)
+
+	abb := &AggregatedBallotBatch{
+		ProcessID: pid.Marshal(),
+		Proof:     proof,
+		Ballots:   []AggregatedBallot{{Nullifier: []byte{1}, EncryptedBallot: ct}, {Nullifier: []byte{2}}},
+	}
+	data, err = EncodeArtifact(abb)
+	c.Assert(err, qt.IsNil)
+	decodedABB, err := DecodeArtifact[AggregatedBallotBatch](data)
+	c.Assert(err, qt.IsNil)
+	c.Assert(decodedABB.Ballots, qt.HasLen, 2)
+	c.Assert(decodedABB.Ballots[0].EncryptedBallot.C1.Equal(ct.C1), qt.IsTrue)
+	c.Assert(decodedABB.Ballots[1].EncryptedBallot.C1, qt.IsNil)
+	again, err = EncodeArtifact(decodedABB)
+	c.Assert(err, qt.IsNil)
+	c.Assert(again, qt.DeepEquals, data)
+
+	// Invalid encodings are rejected
+	_, err = DecodeArtifact[Ballot]([]byte{versionMarker, ballotCodec.version, 0xff})
+	c.Assert(err, qt.IsNotNil)
+	_, err = DecodeArtifact[Ballot]([]byte{versionMarker, ballotCodec.version + 1})
+	c.Assert(err, qt.ErrorMatches, "unsupported ballot version.*")
+}
+
+func TestQueueMigration(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	st.SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+
+	// Queue the ballots as they were encoded before being versioned
+	pid := types.ProcessID{Nonce: 1}
+	wTx := st.writeTx()
+	for i := 0; i < 3; i++ {
+		legacy, err := encodeArtifact(&Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{byte(i)}})
+		c.Assert(err, qt.IsNil)
+		_, err = st.ballots.push(wTx, pid.Marshal(), hashKey(legacy), legacy)
+		c.Assert(err, qt.IsNil)
+	}
+	c.Assert(wTx.Commit(), qt.IsNil)
+
+	// The legacy ballots are still decoded
+	b, k, err := st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(b.Nullifier, qt.DeepEquals, types.HexBytes{0})
+	c.Assert(st.MarkBallotFailed(k, errCrash), qt.IsNil)
+
+	// The queued ballots and the dead letters are migrated
+	migrated, err := st.MigrateQueues()
+	c.Assert(err, qt.IsNil)
+	c.Assert(migrated[StageBallot], qt.Equals, 3)
+	c.Assert(migrated[StageVerifiedBallot], qt.Equals, 0)
+	prefixeddb.NewPrefixedReader(database, ballotPrefix).Iterate(nil, func(_, v []byte) bool {
+		c.Assert(v[:2], qt.DeepEquals, []byte{versionMarker, ballotCodec.version})
+		return true
+	})
+	dls, err := st.DeadLetters()
+	c.Assert(err, qt.IsNil)
+	c.Assert(dls, qt.HasLen, 1)
+	c.Assert([]byte(dls[0].Artifact[:2]), qt.DeepEquals, []byte{versionMarker, ballotCodec.version})
+
+	// Migrating again does nothing
+	migrated, err = st.MigrateQueues()
+	c.Assert(err, qt.IsNil)
+	c.Assert(migrated[StageBallot], qt.Equals, 0)
+	b, _, err = st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(b.Nullifier, qt.DeepEquals, types.HexBytes{1})
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// MasterKeySize is the size in bytes of the node master key used to encrypt
+// the process private keys at rest (AES-256-GCM).
+const MasterKeySize = 32
+
+// masterKeyCheck is the plaintext sealed with the master key and stored in
+// the database, so the storage can detect if it is opened with a different
+// master key than the one used to encrypt the existing keys.
+var masterKeyCheck = []byte("vocdoni sequencer master key check")
+
+var (
+	// ErrMissingMasterKey is returned when the storage is created without a
+	// master key.
+	ErrMissingMasterKey = errors.New("missing master key")
+	// ErrInvalidMasterKey is returned when the master key has an invalid
+	// size or does not match the one used to encrypt the stored keys.
+	ErrInvalidMasterKey = errors.New("invalid master key")
+)
+
+// validateMasterKey checks that the key has the expected size.
+func validateMasterKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrMissingMasterKey
+	}
+	if len(key) != MasterKeySize {
+		return fmt.Errorf("%w: expected %d bytes, got %d", ErrInvalidMasterKey, MasterKeySize, len(key))
+	}
+	return nil
+}
+
+// masterKeyID returns a short fingerprint of the key, stored next to the
+// data sealed with it to know which key should be used to open it.
+func masterKeyID(key []byte) []byte {
+	hash := sha256.Sum256(key)
+	return hash[:8]
+}
+
+// seal encrypts and authenticates the plaintext with AES-256-GCM using the
+// key provided. The additional data is authenticated but not encrypted, and
+// must be provided again to open the result. The random nonce is prepended
+// to the ciphertext returned.
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts a ciphertext produced by seal with the same key and
+// additional data.
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed data too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt sealed data: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
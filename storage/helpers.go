@@ -4,9 +4,30 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/gob"
+	"time"
+
+	"go.vocdoni.io/dvote/db"
 )
 
-// Artifact encoding/decoding
+// Artifact is the set of artifacts moved through the processing queues.
+type Artifact interface {
+	Ballot | VerifiedBallot | AggregatedBallotBatch
+}
+
+// EncodeArtifact returns the versioned encoding of the artifact used by the
+// storage, which is also used to send it to the remote workers. It is
+// deterministic, so it can be hashed to identify the artifact.
+func EncodeArtifact[T Artifact](a *T) ([]byte, error) {
+	return queueCodec[T]().encode(a)
+}
+
+// DecodeArtifact decodes an artifact encoded with EncodeArtifact, or with
+// any of the previous versions of the encoding.
+func DecodeArtifact[T Artifact](data []byte) (*T, error) {
+	return queueCodec[T]().decode(nil, nil, data)
+}
+
+// Gob encoding/decoding of the internal records
 func encodeArtifact(a any) ([]byte, error) {
 	var buf bytes.Buffer
 	if err := gob.NewEncoder(&buf).Encode(a); err != nil {
@@ -20,6 +41,7 @@ func decodeArtifact(data []byte, out any) error {
 }
 
 func encodeReservation(r *reservationRecord) ([]byte, error) {
+	r.Version = reservationVersion
 	return encodeArtifact(r)
 }
 
@@ -28,9 +50,43 @@ func decodeReservation(data []byte) (*reservationRecord, error) {
 	if err := decodeArtifact(data, &r); err != nil {
 		return nil, err
 	}
+	if r.Version == 0 {
+		r.Timestamp = time.Unix(r.Timestamp, 0).UnixNano()
+		r.Version = reservationVersion
+	}
 	return &r, nil
 }
 
+// iterateFrom calls the callback with the keys starting with prefix that
+// are greater than or equal to prefix+start, in order, with the keys
+// relative to prefix as in Iterate. The database iterators cannot seek, so
+// the keys following start are iterated as the ranges of the prefixes that
+// follow it: the keys starting with start, and then, from its last byte to
+// the first one, the keys starting with start[:i] followed by a greater
+// byte. Each empty range costs an iterator, so start should be short.
+func iterateFrom(reader db.Reader, prefix, start []byte, callback func(k, v []byte) bool) error {
+	stopped := false
+	iterate := func(sub []byte) error {
+		return reader.Iterate(append(bytes.Clone(prefix), sub...), func(k, v []byte) bool {
+			if !callback(append(bytes.Clone(sub), k...), v) {
+				stopped = true
+			}
+			return !stopped
+		})
+	}
+	if err := iterate(start); err != nil || stopped {
+		return err
+	}
+	for i := len(start) - 1; i >= 0; i-- {
+		for b := int(start[i]) + 1; b <= 0xff; b++ {
+			if err := iterate(append(bytes.Clone(start[:i]), byte(b))); err != nil || stopped {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func hashKey(data []byte) []byte {
 	hash := sha256.Sum256(data)
 	return hash[:maxKeySize]
@@ -1,39 +1,338 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
 
 	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc"
 	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/curves"
 	"github.com/vocdoni/vocdoni-z-sandbox/types"
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/db/prefixeddb"
 )
 
-// SetEncryptionKeys stores the encryption keys for a process.
+// masterKeyCheckKey is the key under masterKeyPrefix where the master key
+// check value is stored.
+var masterKeyCheckKey = []byte("check")
+
+// storedEncryptionKeys is the representation of the encryption keys of a
+// process in the database. The private key is never stored in clear, it is
+// sealed with the node master key identified by MasterKeyID.
+type storedEncryptionKeys struct {
+	Curve            string
+	X                *big.Int
+	Y                *big.Int
+	MasterKeyID      []byte
+	SealedPrivateKey []byte
+}
+
+// encryptionKeysCodec stores the encryption keys of the processes.
+var encryptionKeysCodec = &artifactCodec[storedEncryptionKeys]{
+	name:       "encryption keys",
+	prefix:     encryptionKeyPrefix,
+	version:    1,
+	migrations: []migration{migrateEncryptionKeysV0},
+}
+
+// encryptionKeysV0 is the version 0 of the stored encryption keys, the gob
+// encoding of EncryptionKeys (with the private key in clear) or of the
+// sealed keys before the curve was stored, both on BN254.
+type encryptionKeysV0 struct {
+	X                *big.Int
+	Y                *big.Int
+	PrivateKey       *big.Int
+	MasterKeyID      []byte
+	SealedPrivateKey []byte
+}
+
+// migrateEncryptionKeysV0 seals the private keys stored in clear with the
+// master key and sets the curve of the keys to BN254.
+func migrateEncryptionKeysV0(s *Storage, key, data []byte) ([]byte, error) {
+	var v0 encryptionKeysV0
+	if err := decodeArtifact(data, &v0); err != nil {
+		return nil, err
+	}
+	eks := storedEncryptionKeys{
+		Curve:            curves.CurveTypeBN254,
+		X:                v0.X,
+		Y:                v0.Y,
+		MasterKeyID:      v0.MasterKeyID,
+		SealedPrivateKey: v0.SealedPrivateKey,
+	}
+	if len(eks.SealedPrivateKey) == 0 {
+		pid := types.ProcessID{}
+		if err := pid.Unmarshal(key); err != nil {
+			return nil, fmt.Errorf("could not decode process ID: %w", err)
+		}
+		sealed, err := sealPrivateKey(s.masterKey, pid, v0.PrivateKey)
+		ecc.ZeroBigInt(v0.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		eks.MasterKeyID = masterKeyID(s.masterKey)
+		eks.SealedPrivateKey = sealed
+	}
+	return encodeArtifact(&eks)
+}
+
+// KeyBackup is the exported representation of the encryption keys of a
+// process. The private key is sealed with the backup key provided to
+// ExportKey, so it is safe to store it outside of the node.
+type KeyBackup struct {
+	Curve            string         `json:"curve"`
+	ProcessID        types.HexBytes `json:"processId"`
+	X                *types.BigInt  `json:"publicKeyX"`
+	Y                *types.BigInt  `json:"publicKeyY"`
+	SealedPrivateKey types.HexBytes `json:"sealedPrivateKey"`
+}
+
+// initMasterKey checks that the master key provided is the one used to
+// encrypt the keys already stored in the database. If the database has no
+// master key check value yet, it stores a new one sealed with the key.
+func (s *Storage) initMasterKey(masterKey []byte) error {
+	if err := validateMasterKey(masterKey); err != nil {
+		return err
+	}
+	sealed, err := prefixeddb.NewPrefixedReader(s.db, masterKeyPrefix).Get(masterKeyCheckKey)
+	switch {
+	case err == nil:
+		if _, err := open(masterKey, sealed, masterKeyCheckKey); err != nil {
+			return fmt.Errorf("%w: it does not match the stored keys", ErrInvalidMasterKey)
+		}
+	case errors.Is(err, db.ErrKeyNotFound):
+		sealed, err := seal(masterKey, masterKeyCheck, masterKeyCheckKey)
+		if err != nil {
+			return err
+		}
+		wTx := prefixeddb.NewPrefixedWriteTx(s.db.WriteTx(), masterKeyPrefix)
+		if err := wTx.Set(masterKeyCheckKey, sealed); err != nil {
+			wTx.Discard()
+			return err
+		}
+		if err := wTx.Commit(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("could not read master key check: %w", err)
+	}
+	s.masterKey = bytes.Clone(masterKey)
+	return nil
+}
+
+// SetEncryptionKeys stores the encryption keys for a process. The private
+// key is encrypted with the node master key before being stored.
 func (s *Storage) SetEncryptionKeys(pid types.ProcessID, publicKey ecc.Point, privateKey *big.Int) error {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+
+	curveType := curves.Type(publicKey)
+	if curveType == "" {
+		return fmt.Errorf("unsupported public key curve")
+	}
 	x, y := publicKey.Point()
-	eks := EncryptionKeys{
-		X:          x,
-		Y:          y,
-		PrivateKey: privateKey,
+	sealed, err := sealPrivateKey(s.masterKey, pid, privateKey)
+	if err != nil {
+		return fmt.Errorf("could not encrypt private key: %w", err)
 	}
-
-	return s.setArtifact(encryptionKeyPrefix, pid.Marshal(), eks)
+	eks := &storedEncryptionKeys{
+		Curve:            curveType,
+		X:                x,
+		Y:                y,
+		MasterKeyID:      masterKeyID(s.masterKey),
+		SealedPrivateKey: sealed,
+	}
+	return setArtifact(s, encryptionKeysCodec, pid.Marshal(), eks)
 }
 
 // EncryptionKeys loads the encryption keys for a process. Returns ErrNotFound if the keys do not exist
 func (s *Storage) EncryptionKeys(pid types.ProcessID) (ecc.Point, *big.Int, error) {
-	artifact, err := s.getArtifact(encryptionKeyPrefix, pid.Marshal())
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+
+	eks, err := getArtifact(s, encryptionKeysCodec, pid.Marshal())
 	if err != nil {
-		return nil, nil, fmt.Errorf("could not read encryption keys: %w", err)
+		return nil, nil, err
 	}
-	if artifact == nil {
-		return nil, nil, ErrNotFound
+	if !bytes.Equal(eks.MasterKeyID, masterKeyID(s.masterKey)) {
+		return nil, nil, fmt.Errorf("%w: keys sealed with master key %x", ErrInvalidMasterKey, eks.MasterKeyID)
+	}
+	privateKey, err := openPrivateKey(s.masterKey, pid, eks.SealedPrivateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not decrypt private key: %w", err)
+	}
+	pubKey := curves.New(eks.Curve).SetPoint(eks.X, eks.Y)
+	return pubKey, privateKey, nil
+}
+
+// EncryptionPublicKey loads the public encryption key of a process, without
+// opening its sealed private key. Returns ErrNotFound if the keys do not
+// exist.
+func (s *Storage) EncryptionPublicKey(pid types.ProcessID) (ecc.Point, error) {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+
+	eks, err := getArtifact(s, encryptionKeysCodec, pid.Marshal())
+	if err != nil {
+		return nil, err
+	}
+	return curves.New(eks.Curve).SetPoint(eks.X, eks.Y), nil
+}
+
+// RotateMasterKey re-encrypts all the stored private keys with the new
+// master key and replaces the current one. All the keys are re-encrypted
+// in a single transaction, so if it fails the database is left untouched
+// and the current master key is still valid.
+func (s *Storage) RotateMasterKey(newMasterKey []byte) error {
+	if err := validateMasterKey(newMasterKey); err != nil {
+		return err
 	}
-	eks, ok := artifact.(EncryptionKeys)
-	if !ok {
-		panic("unexpected artifact type")
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+
+	wTx := s.db.WriteTx()
+	defer wTx.Discard()
+	ekWTx := prefixeddb.NewPrefixedWriteTx(wTx, encryptionKeyPrefix)
+
+	newID := masterKeyID(newMasterKey)
+	var iterErr error
+	if err := prefixeddb.NewPrefixedReader(s.db, encryptionKeyPrefix).Iterate(nil, func(k, v []byte) bool {
+		eks, err := encryptionKeysCodec.decode(s, k, v)
+		if err != nil {
+			iterErr = err
+			return false
+		}
+		pid := types.ProcessID{}
+		if err := pid.Unmarshal(k); err != nil {
+			iterErr = fmt.Errorf("could not decode process ID %x: %w", k, err)
+			return false
+		}
+		privateKey, err := openPrivateKey(s.masterKey, pid, eks.SealedPrivateKey)
+		if err != nil {
+			iterErr = fmt.Errorf("could not decrypt private key of process %x: %w", k, err)
+			return false
+		}
+		eks.SealedPrivateKey, err = sealPrivateKey(newMasterKey, pid, privateKey)
+		ecc.ZeroBigInt(privateKey)
+		if err != nil {
+			iterErr = fmt.Errorf("could not encrypt private key of process %x: %w", k, err)
+			return false
+		}
+		eks.MasterKeyID = newID
+		data, err := encryptionKeysCodec.encode(eks)
+		if err != nil {
+			iterErr = err
+			return false
+		}
+		if err := ekWTx.Set(bytes.Clone(k), data); err != nil {
+			iterErr = err
+			return false
+		}
+		return true
+	}); err != nil {
+		return fmt.Errorf("could not iterate encryption keys: %w", err)
+	}
+	if iterErr != nil {
+		return iterErr
+	}
+
+	check, err := seal(newMasterKey, masterKeyCheck, masterKeyCheckKey)
+	if err != nil {
+		return err
+	}
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, masterKeyPrefix).Set(masterKeyCheckKey, check); err != nil {
+		return err
+	}
+	if err := wTx.Commit(); err != nil {
+		return fmt.Errorf("could not commit master key rotation: %w", err)
+	}
+	clear(s.masterKey)
+	s.masterKey = bytes.Clone(newMasterKey)
+	return nil
+}
+
+// ExportKey returns a backup of the encryption keys of a process, with the
+// private key sealed with the backup key provided instead of the master
+// key. The backup can be restored with ImportKey on any node.
+func (s *Storage) ExportKey(pid types.ProcessID, backupKey []byte) ([]byte, error) {
+	if err := validateMasterKey(backupKey); err != nil {
+		return nil, fmt.Errorf("invalid backup key: %w", err)
+	}
+	pubKey, privateKey, err := s.EncryptionKeys(pid)
+	if err != nil {
+		return nil, err
+	}
+	defer ecc.ZeroBigInt(privateKey)
+	sealed, err := sealPrivateKey(backupKey, pid, privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt private key: %w", err)
+	}
+	x, y := pubKey.Point()
+	return json.Marshal(&KeyBackup{
+		Curve:            curves.Type(pubKey),
+		ProcessID:        pid.Marshal(),
+		X:                (*types.BigInt)(x),
+		Y:                (*types.BigInt)(y),
+		SealedPrivateKey: sealed,
+	})
+}
+
+// ImportKey restores the encryption keys of a process from a backup created
+// with ExportKey and the same backup key. The private key is checked against
+// the public key of the backup before storing it sealed with the master key.
+func (s *Storage) ImportKey(backup, backupKey []byte) error {
+	if err := validateMasterKey(backupKey); err != nil {
+		return fmt.Errorf("invalid backup key: %w", err)
+	}
+	kb := &KeyBackup{}
+	if err := json.Unmarshal(backup, kb); err != nil {
+		return fmt.Errorf("could not decode key backup: %w", err)
+	}
+	if kb.X == nil || kb.Y == nil {
+		return fmt.Errorf("key backup without public key")
+	}
+	if !curves.IsValid(kb.Curve) {
+		return fmt.Errorf("unsupported key backup curve %q", kb.Curve)
+	}
+	pid := types.ProcessID{}
+	if err := pid.Unmarshal(kb.ProcessID); err != nil {
+		return fmt.Errorf("could not decode process ID: %w", err)
+	}
+	privateKey, err := openPrivateKey(backupKey, pid, kb.SealedPrivateKey)
+	if err != nil {
+		return fmt.Errorf("could not decrypt private key: %w", err)
+	}
+	defer ecc.ZeroBigInt(privateKey)
+
+	pubKey := curves.New(kb.Curve).SetPoint(kb.X.MathBigInt(), kb.Y.MathBigInt())
+	expected := pubKey.New()
+	expected.ScalarBaseMult(privateKey)
+	if !expected.Equal(pubKey) {
+		return fmt.Errorf("private key does not match the public key of the backup")
+	}
+	return s.SetEncryptionKeys(pid, pubKey, privateKey)
+}
+
+// sealPrivateKey encrypts the private key with the key provided, binding it
+// to the process ID so it can not be swapped with the key of another process.
+func sealPrivateKey(key []byte, pid types.ProcessID, privateKey *big.Int) ([]byte, error) {
+	if privateKey == nil || privateKey.Sign() < 0 || privateKey.BitLen() > ecc.SecretScalarBits {
+		return nil, fmt.Errorf("invalid private key")
+	}
+	var buf [ecc.SecretScalarSize]byte
+	defer clear(buf[:])
+	privateKey.FillBytes(buf[:])
+	return seal(key, buf[:], pid.Marshal())
+}
+
+// openPrivateKey decrypts a private key sealed with sealPrivateKey.
+func openPrivateKey(key []byte, pid types.ProcessID, sealed []byte) (*big.Int, error) {
+	buf, err := open(key, sealed, pid.Marshal())
+	if err != nil {
+		return nil, err
 	}
-	pubKey := curves.New(curves.CurveTypeBN254).SetPoint(eks.X, eks.Y)
-	return pubKey, eks.PrivateKey, nil
+	defer clear(buf)
+	return new(big.Int).SetBytes(buf), nil
 }
@@ -2,32 +2,57 @@ package storage
 
 import (
 	"encoding/json"
+	"errors"
 
 	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ethereum"
 	"github.com/vocdoni/vocdoni-z-sandbox/types"
 )
 
+// metadataCodec stores the process metadata. Version 0 is the gob encoding
+// of types.Metadata without version header.
+var metadataCodec = &artifactCodec[types.Metadata]{
+	name:    "metadata",
+	prefix:  metadataPrefix,
+	version: 1,
+	migrations: []migration{
+		func(_ *Storage, _, data []byte) ([]byte, error) { return data, nil },
+	},
+}
+
+// metadataHashCodec stores the metadata uploaded by the organizers under its
+// hash, which the processes reference (see Process.MetadataHash).
+var metadataHashCodec = &artifactCodec[types.Metadata]{
+	name:    "metadata by hash",
+	prefix:  metadataHashPrefix,
+	version: 1,
+}
+
 // Metadata retrieves the metadata from the storage. It returns an error if
 // the metadata is not found or if there is an error while retrieving it. If
 // the metadata is found, it returns the metadata unmarshalled.
 func (s *Storage) Metadata(pid types.ProcessID) (*types.Metadata, error) {
-	artifact, err := s.getArtifact(metadataPrefix, pid.Marshal())
-	if err != nil {
-		return nil, err
-	}
-	if artifact == nil {
-		return nil, ErrNotFound
-	}
-	metadata, ok := artifact.(*types.Metadata)
-	if !ok {
-		panic("unexpected artifact type")
-	}
-	return metadata, nil
+	return getArtifact(s, metadataCodec, pid.Marshal())
 }
 
 // SetMetadata stores the metadata in the storage.
 func (s *Storage) SetMetadata(pid types.ProcessID, metadata *types.Metadata) error {
-	return s.setArtifact(metadataPrefix, pid.Marshal(), metadata)
+	return setArtifact(s, metadataCodec, pid.Marshal(), metadata)
+}
+
+// MetadataByHash retrieves the metadata stored under its hash (see
+// MetadataHash). It returns ErrNotFound if the metadata is not found.
+func (s *Storage) MetadataByHash(hash types.HexBytes) (*types.Metadata, error) {
+	return getArtifact(s, metadataHashCodec, hash)
+}
+
+// StoreMetadata stores the metadata under its hash, and returns it. Storing
+// the same metadata again has no effect.
+func (s *Storage) StoreMetadata(metadata *types.Metadata) (types.HexBytes, error) {
+	hash := MetadataHash(metadata)
+	if err := setArtifact(s, metadataHashCodec, hash, metadata); err != nil && !errors.Is(err, ErrKeyAlreadyExists) {
+		return nil, err
+	}
+	return hash, nil
 }
 
 // MetadataHash returns the hash of the metadata.
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/db/prefixeddb"
+)
+
+var (
+	// ErrNullifierQueued is returned when a ballot is pushed with the
+	// nullifier of a ballot that is still queued, and the process policy
+	// rejects the overwrites of queued ballots.
+	ErrNullifierQueued = errors.New("a ballot with the same nullifier is already queued")
+	// ErrTooManyOverwrites is returned when a ballot is pushed with a
+	// nullifier that reached the maximum number of overwrites of the process.
+	ErrTooManyOverwrites = errors.New("maximum number of ballot overwrites reached")
+	// ErrMissingNullifier is returned when a ballot without nullifier is
+	// pushed, since it would share the nullifier record of the process.
+	ErrMissingNullifier = errors.New("ballot without nullifier")
+)
+
+// Stages of the ballot referenced by a nullifier record.
+const (
+	// nullifierStageDone means the last ballot left the verified queue, so
+	// it is already aggregated.
+	nullifierStageDone uint8 = iota
+	nullifierStagePending
+	nullifierStageVerified
+)
+
+// OverwritePolicy defines what happens when a ballot is pushed with the
+// nullifier of a previous ballot of the same process. The zero value
+// supersedes the queued ballots and does not limit the overwrites, and it is
+// the default policy of the processes unless SetDefaultOverwritePolicy is
+// called.
+type OverwritePolicy struct {
+	// RejectQueued rejects the new ballot with ErrNullifierQueued while the
+	// previous one is still pending or verified. Otherwise, the new ballot
+	// supersedes the queued one, which is removed from the queues.
+	RejectQueued bool `json:"rejectQueued"`
+	// MaxOverwrites is the maximum number of times a nullifier can be
+	// overwritten, zero means unlimited. Once reached, the new ballots are
+	// rejected with ErrTooManyOverwrites.
+	MaxOverwrites uint32 `json:"maxOverwrites"`
+}
+
+// overwritePolicyCodec stores the overwrite policy of the processes.
+var overwritePolicyCodec = &artifactCodec[OverwritePolicy]{
+	name:    "overwrite policy",
+	prefix:  overwritePolicyPrefix,
+	version: 1,
+}
+
+// nullifierRecord is the entry of the nullifier index. It references the
+// current ballot of the nullifier, the only one that can move to the next
+// stage, and counts how many times the nullifier has been overwritten.
+type nullifierRecord struct {
+	Stage      uint8
+	Key        []byte
+	Seq        uint64
+	Overwrites uint32
+}
+
+// nullifierLocks protects the nullifier index. Its shards are picked by
+// process ID, and they must be acquired before the queue locks.
+type nullifierLocks [queueLockShards]sync.Mutex
+
+func (l *nullifierLocks) lock(pid []byte) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write(pid)
+	return &l[h.Sum32()%queueLockShards]
+}
+
+// SetOverwritePolicy sets the overwrite policy of the process, replacing the
+// previous one if any, like the one it was created with (see
+// Process.OverwritePolicy).
+func (s *Storage) SetOverwritePolicy(pid types.ProcessID, policy OverwritePolicy) error {
+	data, err := overwritePolicyCodec.encode(&policy)
+	if err != nil {
+		return err
+	}
+	wTx := s.db.WriteTx()
+	defer wTx.Discard()
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, overwritePolicyPrefix).Set(pid.Marshal(), data); err != nil {
+		return err
+	}
+	return wTx.Commit()
+}
+
+// SetDefaultOverwritePolicy sets the overwrite policy of the processes that
+// have no policy of their own (see SetOverwritePolicy).
+func (s *Storage) SetDefaultOverwritePolicy(policy OverwritePolicy) {
+	s.overwriteLock.Lock()
+	defer s.overwriteLock.Unlock()
+	s.defaultOverwritePolicy = policy
+}
+
+// DefaultOverwritePolicy returns the overwrite policy of the processes that
+// have no policy of their own.
+func (s *Storage) DefaultOverwritePolicy() OverwritePolicy {
+	s.overwriteLock.RLock()
+	defer s.overwriteLock.RUnlock()
+	return s.defaultOverwritePolicy
+}
+
+// OverwritePolicy returns the overwrite policy of the process, or the
+// default one if it was not set.
+func (s *Storage) OverwritePolicy(pid types.ProcessID) (OverwritePolicy, error) {
+	return s.overwritePolicy(pid.Marshal())
+}
+
+func (s *Storage) overwritePolicy(pid []byte) (OverwritePolicy, error) {
+	policy, err := getArtifact(s, overwritePolicyCodec, pid)
+	if errors.Is(err, ErrNotFound) {
+		return s.DefaultOverwritePolicy(), nil
+	}
+	if err != nil {
+		return OverwritePolicy{}, err
+	}
+	return *policy, nil
+}
+
+// NullifierOverwrites returns the number of times the ballot of the
+// nullifier has been overwritten in the process. It returns ErrNotFound if
+// no ballot with the nullifier has been pushed.
+func (s *Storage) NullifierOverwrites(pid types.ProcessID, nullifier []byte) (uint32, error) {
+	rec, err := s.nullifierRecord(pid.Marshal(), nullifier)
+	if err != nil {
+		return 0, err
+	}
+	if rec == nil {
+		return 0, ErrNotFound
+	}
+	return rec.Overwrites, nil
+}
+
+func nullifierKey(pid, nullifier []byte) []byte {
+	return append(bytes.Clone(pid), nullifier...)
+}
+
+// nullifierRecord returns the record of the nullifier, or nil if there is
+// none.
+func (s *Storage) nullifierRecord(pid, nullifier []byte) (*nullifierRecord, error) {
+	data, err := prefixeddb.NewPrefixedReader(s.db, nullifierPrefix).Get(nullifierKey(pid, nullifier))
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get nullifier: %w", err)
+	}
+	rec := &nullifierRecord{}
+	if err := decodeArtifact(data, rec); err != nil {
+		return nil, fmt.Errorf("decode nullifier: %w", err)
+	}
+	return rec, nil
+}
+
+// setNullifierRecord stores the record of the nullifier in the write
+// transaction provided.
+func setNullifierRecord(wTx db.WriteTx, pid, nullifier []byte, rec *nullifierRecord) error {
+	data, err := encodeArtifact(rec)
+	if err != nil {
+		return err
+	}
+	return prefixeddb.NewPrefixedWriteTx(wTx, nullifierPrefix).Set(nullifierKey(pid, nullifier), data)
+}
+
+// isCurrentBallot returns true if the queue key is the current ballot of the
+// nullifier. A ballot without nullifier record is considered current, so the
+// ballots queued before the index existed are still processed.
+func isCurrentBallot(rec *nullifierRecord, key []byte) bool {
+	return rec == nil || bytes.Equal(rec.Key, key)
+}
+
+// supersede applies the overwrite policy of the process to a new ballot
+// with the nullifier of the record provided, removing the previous ballot
+// from its queue in the write transaction if it is not reserved. It returns
+// the overwrite count of the new ballot and a function that must be called
+// once the transaction is committed or discarded, since the queue lock is
+// held until then. The caller must hold the nullifier lock of the process.
+func (s *Storage) supersede(wTx *statsTx, pid []byte, rec *nullifierRecord) (uint32, func(), error) {
+	if rec == nil {
+		return 0, func() {}, nil
+	}
+	policy, err := s.overwritePolicy(pid)
+	if err != nil {
+		return 0, nil, err
+	}
+	if policy.MaxOverwrites > 0 && rec.Overwrites >= policy.MaxOverwrites {
+		return 0, nil, ErrTooManyOverwrites
+	}
+	var q *queue
+	switch rec.Stage {
+	case nullifierStagePending:
+		q = s.ballots
+	case nullifierStageVerified:
+		q = s.verifiedBallots
+	default:
+		return rec.Overwrites + 1, func() {}, nil
+	}
+	if policy.RejectQueued {
+		return 0, nil, ErrNullifierQueued
+	}
+	if _, _, err := q.splitKey(rec.Key); err != nil {
+		return 0, nil, err
+	}
+	mu := q.keyLock(rec.Key)
+	mu.Lock()
+	// if the previous ballot is reserved it is left to the worker, and
+	// dropped when it tries to move it to the next stage
+	if _, err := q.cancel(s, wTx, rec.Key, rec.Seq); err != nil {
+		mu.Unlock()
+		return 0, nil, fmt.Errorf("remove superseded ballot: %w", err)
+	}
+	return rec.Overwrites + 1, mu.Unlock, nil
+}
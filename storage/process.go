@@ -0,0 +1,452 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/vocdoni-z-sandbox/metrics"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/db/prefixeddb"
+)
+
+// ProcessStatus is the status of a process.
+type ProcessStatus string
+
+const (
+	// ProcessStatusReady is the status of the processes accepting ballots.
+	ProcessStatusReady ProcessStatus = "ready"
+	// ProcessStatusEnded is the status of the processes that finished.
+	ProcessStatusEnded ProcessStatus = "ended"
+	// ProcessStatusCanceled is the status of the processes canceled before
+	// they finished.
+	ProcessStatusCanceled ProcessStatus = "canceled"
+)
+
+// Valid returns whether the status is one of the known statuses.
+func (st ProcessStatus) Valid() bool {
+	switch st {
+	case ProcessStatusReady, ProcessStatusEnded, ProcessStatusCanceled:
+		return true
+	}
+	return false
+}
+
+// ProcessCursorSize is the size of the cursors of the process listing: the
+// creation time of the last process listed, in nanoseconds (8 bytes), and
+// its marshaled ID (32 bytes).
+const ProcessCursorSize = 8 + 32
+
+// processCodec stores the processes. The private key of the encryption keys
+// is never stored with the process, it is kept by the keystore.
+var processCodec = &artifactCodec[Process]{
+	name:    "process",
+	prefix:  processPrefix,
+	version: 1,
+	marshal: func(p *Process) ([]byte, error) {
+		stored := *p
+		stored.EncryptionKey.PrivateKey = nil
+		return encodeArtifact(&stored)
+	},
+}
+
+// The processes are indexed by creation time, and by organizer address,
+// chain ID and status followed by the creation time, so the processes
+// matching any of them are found in creation order:
+//
+//	time:      createdAt pid
+//	organizer: address createdAt pid
+//	chain:     chainID createdAt pid
+//	status:    status 0x00 createdAt pid
+//
+// The index entries have no value, and the part after the indexed field is
+// the sort key, also used as the listing cursor.
+
+// processSortKey returns the sort key of a process in the indexes.
+func processSortKey(pid *types.ProcessID, p *Process) []byte {
+	key := binary.BigEndian.AppendUint64(make([]byte, 0, ProcessCursorSize), uint64(p.CreatedAt.UnixNano()))
+	return append(key, pid.Marshal()...)
+}
+
+// processIndexKey returns the index key of the field provided, which is the
+// prefix of the entries of the processes with the same value.
+func processIndexKey(field []byte, sortKey []byte) []byte {
+	return append(bytes.Clone(field), sortKey...)
+}
+
+func organizerIndexField(address common.Address) []byte {
+	return address.Bytes()
+}
+
+func chainIndexField(chainID uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, chainID)
+}
+
+func statusIndexField(status ProcessStatus) []byte {
+	return append([]byte(status), 0x00)
+}
+
+// setProcessIndexes writes (or deletes, if del is true) the index entries of
+// the process in the write transaction provided.
+func setProcessIndexes(wTx db.WriteTx, pid *types.ProcessID, p *Process, del bool) error {
+	sortKey := processSortKey(pid, p)
+	for prefix, key := range map[string][]byte{
+		string(processTimeIndexPrefix):      sortKey,
+		string(processOrganizerIndexPrefix): processIndexKey(organizerIndexField(pid.Address), sortKey),
+		string(processChainIndexPrefix):     processIndexKey(chainIndexField(pid.ChainID), sortKey),
+		string(processStatusIndexPrefix):    processIndexKey(statusIndexField(p.Status), sortKey),
+	} {
+		pwTx := prefixeddb.NewPrefixedWriteTx(wTx, []byte(prefix))
+		var err error
+		if del {
+			err = pwTx.Delete(key)
+		} else {
+			err = pwTx.Set(key, []byte{})
+		}
+		if err != nil {
+			return fmt.Errorf("could not update process index: %w", err)
+		}
+	}
+	return nil
+}
+
+// OrganizerNonce returns the next nonce of the organizer, which is the
+// lowest nonce that can be used to create a process. The nonces are shared
+// by all the chains, so a signature cannot be replayed on another chain with
+// the same nonce.
+func (s *Storage) OrganizerNonce(organizer common.Address) (uint64, error) {
+	return organizerNonce(s.db, organizer)
+}
+
+// organizerNonce reads the next nonce of the organizer from the reader
+// provided, which is the write transaction that updates it when a process
+// is created.
+func organizerNonce(reader db.Reader, organizer common.Address) (uint64, error) {
+	val, err := prefixeddb.NewPrefixedReader(reader, organizerNoncePrefix).Get(organizer.Bytes())
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not read organizer nonce: %w", err)
+	}
+	if len(val) != 8 {
+		return 0, fmt.Errorf("invalid organizer nonce of %d bytes", len(val))
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+// ReserveProcess uses the nonce of the process ID before the process is
+// created, so the keys of the process are only generated by one of the
+// concurrent requests with the same signature. It returns
+// ErrKeyAlreadyExists if the process already exists, and ErrNonceUsed if the
+// nonce is lower than the next nonce of the organizer, which is set to the
+// following one. The nonce stays used if the process is not stored
+// afterwards. SetProcess accepts the reserved process without checking its
+// nonce again.
+func (s *Storage) ReserveProcess(pid types.ProcessID) error {
+	s.processLock.Lock()
+	defer s.processLock.Unlock()
+
+	wTx := s.db.WriteTx()
+	defer wTx.Discard()
+	key := pid.Marshal()
+	if _, err := prefixeddb.NewPrefixedReader(wTx, processPrefix).Get(key); err == nil {
+		return ErrKeyAlreadyExists
+	}
+	if err := useOrganizerNonce(wTx, &pid); err != nil {
+		return err
+	}
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, processReservationPrefix).Set(key, []byte{}); err != nil {
+		return fmt.Errorf("could not reserve process: %w", err)
+	}
+	return wTx.Commit()
+}
+
+// useOrganizerNonce checks the nonce of the process ID against the next
+// nonce of the organizer, in the write transaction provided, and sets the
+// next nonce to the following one. It returns ErrNonceUsed if the nonce is
+// lower than the next nonce.
+func useOrganizerNonce(wTx db.WriteTx, pid *types.ProcessID) error {
+	nextNonce, err := organizerNonce(wTx, pid.Address)
+	if err != nil {
+		return err
+	}
+	if pid.Nonce < nextNonce || pid.Nonce == math.MaxUint64 {
+		return fmt.Errorf("%w: the next nonce of %s is %d", ErrNonceUsed, pid.Address.Hex(), nextNonce)
+	}
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, organizerNoncePrefix).Set(
+		pid.Address.Bytes(), binary.BigEndian.AppendUint64(nil, pid.Nonce+1)); err != nil {
+		return fmt.Errorf("could not update organizer nonce: %w", err)
+	}
+	return nil
+}
+
+// SetProcess stores a new process and indexes it. If the process has no
+// creation time or status, they are set to now and ready, and if it has an
+// overwrite policy, it is stored as the policy of the process. It returns
+// ErrKeyAlreadyExists if the process already exists. If the process was
+// not reserved with ReserveProcess, it returns ErrNonceUsed if the nonce of
+// the process ID is lower than the next nonce of the organizer, which is set
+// to the following one. The nonce is checked and updated in the same
+// transaction, under the process lock, so it is used only once by the
+// concurrent requests.
+func (s *Storage) SetProcess(pid types.ProcessID, process *Process) error {
+	s.processLock.Lock()
+	defer s.processLock.Unlock()
+
+	wTx := s.db.WriteTx()
+	defer wTx.Discard()
+	key := pid.Marshal()
+	if _, err := prefixeddb.NewPrefixedReader(wTx, processPrefix).Get(key); err == nil {
+		return ErrKeyAlreadyExists
+	}
+	reservations := prefixeddb.NewPrefixedWriteTx(wTx, processReservationPrefix)
+	_, err := reservations.Get(key)
+	switch {
+	case err == nil:
+		if err := reservations.Delete(key); err != nil {
+			return fmt.Errorf("could not delete process reservation: %w", err)
+		}
+	case errors.Is(err, db.ErrKeyNotFound):
+		if err := useOrganizerNonce(wTx, &pid); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("could not read process reservation: %w", err)
+	}
+	if process.CreatedAt.IsZero() {
+		process.CreatedAt = time.Now()
+	}
+	if process.Status == "" {
+		process.Status = ProcessStatusReady
+	}
+	if !process.Status.Valid() {
+		return fmt.Errorf("invalid process status %q", process.Status)
+	}
+	data, err := processCodec.encode(process)
+	if err != nil {
+		return err
+	}
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, processPrefix).Set(key, data); err != nil {
+		return err
+	}
+	if process.OverwritePolicy != nil {
+		policy, err := overwritePolicyCodec.encode(process.OverwritePolicy)
+		if err != nil {
+			return err
+		}
+		if err := prefixeddb.NewPrefixedWriteTx(wTx, overwritePolicyPrefix).Set(key, policy); err != nil {
+			return err
+		}
+	}
+	if err := setProcessIndexes(wTx, &pid, process, false); err != nil {
+		return err
+	}
+	return wTx.Commit()
+}
+
+// Process retrieves a process from the storage. It returns ErrNotFound if
+// the process does not exist.
+func (s *Storage) Process(pid types.ProcessID) (*Process, error) {
+	return getArtifact(s, processCodec, pid.Marshal())
+}
+
+// checkProcessOpen returns ErrProcessClosed if the process has ended or was
+// canceled. The processes that are not stored are not checked, so their
+// queues keep working.
+func (s *Storage) checkProcessOpen(processID []byte) error {
+	if len(processID) == 0 {
+		return nil
+	}
+	process, err := getArtifact(s, processCodec, processID)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if process.Status != ProcessStatusReady {
+		return fmt.Errorf("%w: the process is %s", ErrProcessClosed, process.Status)
+	}
+	return nil
+}
+
+// SetProcessStatus updates the status of a process and its index entry. Once
+// the process is closed, its per-process metrics are deleted. It
+// returns ErrNotFound if the process does not exist.
+func (s *Storage) SetProcessStatus(pid types.ProcessID, status ProcessStatus) error {
+	if !status.Valid() {
+		return fmt.Errorf("invalid process status %q", status)
+	}
+	s.processLock.Lock()
+	defer s.processLock.Unlock()
+
+	process, err := s.Process(pid)
+	if err != nil {
+		return err
+	}
+	if process.Status == status {
+		return nil
+	}
+	wTx := s.db.WriteTx()
+	defer wTx.Discard()
+	if err := setProcessIndexes(wTx, &pid, process, true); err != nil {
+		return err
+	}
+	process.Status = status
+	data, err := processCodec.encode(process)
+	if err != nil {
+		return err
+	}
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, processPrefix).Set(pid.Marshal(), data); err != nil {
+		return err
+	}
+	if err := setProcessIndexes(wTx, &pid, process, false); err != nil {
+		return err
+	}
+	if err := wTx.Commit(); err != nil {
+		return err
+	}
+	if status != ProcessStatusReady {
+		metrics.DeleteProcess(hex.EncodeToString(pid.Marshal()))
+	}
+	return nil
+}
+
+// ProcessOpen returns whether the process accepts ballots and its queued
+// items are leased to the workers, see ErrProcessClosed. The processes that
+// are not stored are open.
+func (s *Storage) ProcessOpen(pid []byte) bool {
+	return s.checkProcessOpen(pid) == nil
+}
+
+// ProcessFilter selects the processes listed by ListProcesses. The zero
+// value of each field matches all the processes.
+type ProcessFilter struct {
+	Organizer *common.Address
+	ChainID   *uint32
+	Status    ProcessStatus
+	// CreatedFrom and CreatedTo limit the creation time of the processes,
+	// both included.
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+}
+
+// index returns the prefix and the indexed field of the most selective
+// index for the filter.
+func (f *ProcessFilter) index() ([]byte, []byte) {
+	switch {
+	case f.Organizer != nil:
+		return processOrganizerIndexPrefix, organizerIndexField(*f.Organizer)
+	case f.ChainID != nil:
+		return processChainIndexPrefix, chainIndexField(*f.ChainID)
+	case f.Status != "":
+		return processStatusIndexPrefix, statusIndexField(f.Status)
+	default:
+		return processTimeIndexPrefix, nil
+	}
+}
+
+// matches returns whether the process matches the filter.
+func (f *ProcessFilter) matches(pid *types.ProcessID, p *Process) bool {
+	return (f.Organizer == nil || *f.Organizer == pid.Address) &&
+		(f.ChainID == nil || *f.ChainID == pid.ChainID) &&
+		(f.Status == "" || f.Status == p.Status)
+}
+
+// ProcessEntry is a process returned by ListProcesses.
+type ProcessEntry struct {
+	ID      types.ProcessID
+	Process *Process
+}
+
+// ListProcesses returns up to limit processes matching the filter, in
+// creation order, starting after the cursor provided (nil to start from the
+// first one). It also returns the cursor of the next page, or nil if there
+// are no more processes.
+//
+// The processes are found using the index of the organizer, the chain ID or
+// the status, in this order, and the other fields of the filter are checked
+// on each process. The index is scanned from the creation time of the
+// cursor or of the filter, and only until the next page is found, but the
+// processes that do not match the other fields are scanned too, so the
+// organizer and chain filters should be used when possible.
+func (s *Storage) ListProcesses(filter *ProcessFilter, cursor []byte, limit int) ([]*ProcessEntry, []byte, error) {
+	if cursor != nil && len(cursor) != ProcessCursorSize {
+		return nil, nil, fmt.Errorf("invalid cursor size %d", len(cursor))
+	}
+	if limit <= 0 {
+		return []*ProcessEntry{}, nil, nil
+	}
+	var from, to []byte
+	if !filter.CreatedFrom.IsZero() {
+		from = binary.BigEndian.AppendUint64(nil, uint64(filter.CreatedFrom.UnixNano()))
+	}
+	if !filter.CreatedTo.IsZero() {
+		to = binary.BigEndian.AppendUint64(nil, uint64(filter.CreatedTo.UnixNano()))
+	}
+	// the iteration starts at the creation time of the cursor, or of the
+	// filter if it is later
+	start := from
+	if cursor != nil && bytes.Compare(cursor[:8], from) > 0 {
+		start = cursor[:8]
+	}
+
+	prefix, field := filter.index()
+	entries := []*ProcessEntry{}
+	var next []byte
+	var iterErr error
+	if err := iterateFrom(prefixeddb.NewPrefixedReader(s.db, prefix), field, start, func(k, _ []byte) bool {
+		if len(k) != ProcessCursorSize {
+			return true
+		}
+		createdAt := k[:8]
+		if cursor != nil && bytes.Compare(k, cursor) <= 0 ||
+			from != nil && bytes.Compare(createdAt, from) < 0 {
+			return true
+		}
+		if to != nil && bytes.Compare(createdAt, to) > 0 {
+			// the entries are sorted by creation time
+			return false
+		}
+		pid := types.ProcessID{}
+		if err := pid.Unmarshal(k[8:]); err != nil {
+			iterErr = err
+			return false
+		}
+		p, err := s.Process(pid)
+		if err != nil {
+			iterErr = fmt.Errorf("could not read process %x: %w", k[8:], err)
+			return false
+		}
+		if !filter.matches(&pid, p) {
+			return true
+		}
+		if len(entries) == limit {
+			next = bytes.Clone(entries[limit-1].cursor())
+			return false
+		}
+		entries = append(entries, &ProcessEntry{ID: pid, Process: p})
+		return true
+	}); err != nil {
+		return nil, nil, fmt.Errorf("could not iterate processes: %w", err)
+	}
+	if iterErr != nil {
+		if errors.Is(iterErr, ErrNotFound) {
+			iterErr = fmt.Errorf("inconsistent process index: %w", iterErr)
+		}
+		return nil, nil, iterErr
+	}
+	return entries, next, nil
+}
+
+// cursor returns the listing cursor of the process.
+func (e *ProcessEntry) cursor() []byte {
+	return processSortKey(&e.ID, e.Process)
+}
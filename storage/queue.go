@@ -0,0 +1,617 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/db/prefixeddb"
+)
+
+// queueLockShards is the number of locks of each queue. The processes are
+// spread among them by the hash of their ID, so workers pulling from
+// different processes rarely wait for each other.
+const queueLockShards = 64
+
+// seqSize is the size in bytes of the arrival sequence numbers.
+const seqSize = 8
+
+// queue is a FIFO queue of artifacts stored in the database. Each item is
+// stored under three prefixes:
+//
+//	data:     pid id        -> encoded artifact
+//	index:    pid seq id    -> empty, only while the item is available
+//	reserved: pid id        -> reservationRecord, only while it is reserved
+//
+// The available index is sorted by arrival sequence, so the next items are
+// the first ones found iterating it, and pulling them moves their entries to
+// the reserved prefix in the same transaction. When the queue is
+// partitioned, the index entries start with the process ID, which gives
+// every process its own order. Otherwise they are seq pid id, so the order
+// is shared by all the processes. The key returned to the callers is always
+// pid id, and the items are locked by the shard of their process.
+type queue struct {
+	name         string
+	dataPrefix   []byte
+	indexPrefix  []byte
+	reservPrefix []byte
+	partitioned  bool
+
+	// valueTraceContext returns the trace context of an encoded item
+	valueTraceContext func(val []byte) map[string]string
+
+	locks [queueLockShards]sync.Mutex
+	// reclaimed counts the stale reservations released
+	reclaimed atomic.Uint64
+	stats     queueStats
+}
+
+// lastSeq is the last arrival sequence number assigned to a queue item. It
+// is restored from the stored queues on startup, see Storage.loadLastSeq.
+var lastSeq atomic.Uint64
+
+// nextSeq returns a new arrival sequence number. It is based on the current
+// time in nanoseconds, but it is always greater than the last one assigned,
+// so the order is kept even if the clock goes backwards.
+func nextSeq() uint64 {
+	for {
+		last := lastSeq.Load()
+		seq := max(uint64(time.Now().UnixNano()), last+1)
+		if lastSeq.CompareAndSwap(last, seq) {
+			return seq
+		}
+	}
+}
+
+// observeSeq makes the arrival sequence numbers assigned from now on greater
+// than the one provided.
+func observeSeq(seq uint64) {
+	for {
+		last := lastSeq.Load()
+		if seq <= last || lastSeq.CompareAndSwap(last, seq) {
+			return
+		}
+	}
+}
+
+// lock returns the lock shard of the process provided.
+func (q *queue) lock(pid []byte) *sync.Mutex {
+	return &q.locks[lockShard(pid)]
+}
+
+// keyLock returns the lock shard of the item with the key provided, which is
+// the one of its process.
+func (q *queue) keyLock(key []byte) *sync.Mutex {
+	return q.lock(q.processID(key))
+}
+
+// lockKeys acquires the lock shards of all the keys provided, in ascending
+// order so it can not deadlock with another caller, and returns a function
+// to release them.
+func (q *queue) lockKeys(keys [][]byte) func() {
+	var shards [queueLockShards]bool
+	for _, k := range keys {
+		shards[lockShard(q.processID(k))] = true
+	}
+	for i, locked := range shards {
+		if locked {
+			q.locks[i].Lock()
+		}
+	}
+	return func() {
+		for i, locked := range shards {
+			if locked {
+				q.locks[i].Unlock()
+			}
+		}
+	}
+}
+
+// lockShard returns the index of the lock shard of the process provided.
+func lockShard(pid []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(pid)
+	return h.Sum32() % queueLockShards
+}
+
+// lockAll acquires all the lock shards of the queue, and returns a function
+// to release them.
+func (q *queue) lockAll() func() {
+	for i := range q.locks {
+		q.locks[i].Lock()
+	}
+	return func() {
+		for i := range q.locks {
+			q.locks[i].Unlock()
+		}
+	}
+}
+
+// splitKey returns the process ID and the item ID of a queue key.
+func (q *queue) splitKey(key []byte) ([]byte, []byte, error) {
+	if len(key) <= processIDLen {
+		return nil, nil, fmt.Errorf("%w: invalid %s key %x", ErrNotFound, q.name, key)
+	}
+	return key[:processIDLen], key[processIDLen:], nil
+}
+
+// processID returns the process ID of an item, which prefixes its key, or
+// nil if the key is too short to be valid.
+func (q *queue) processID(key []byte) []byte {
+	if len(key) < processIDLen {
+		return nil
+	}
+	return key[:processIDLen]
+}
+
+// indexKey returns the available index key of an item, see queue.
+func (q *queue) indexKey(pid []byte, seq uint64, id []byte) []byte {
+	key := make([]byte, 0, len(pid)+seqSize+len(id))
+	if q.partitioned {
+		key = append(key, pid...)
+		key = binary.BigEndian.AppendUint64(key, seq)
+	} else {
+		key = binary.BigEndian.AppendUint64(key, seq)
+		key = append(key, pid...)
+	}
+	return append(key, id...)
+}
+
+// push adds the item of the process provided to the queue in the write
+// transaction provided, under the key pid id. It returns the arrival
+// sequence number assigned to the item.
+func (q *queue) push(wTx *statsTx, pid, id, val []byte) (uint64, error) {
+	key := append(bytes.Clone(pid), id...)
+	if len(pid) != processIDLen || len(id) == 0 {
+		return 0, fmt.Errorf("invalid %s key %x", q.name, key)
+	}
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, q.dataPrefix).Set(key, val); err != nil {
+		return 0, err
+	}
+	seq := nextSeq()
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, q.indexPrefix).Set(q.indexKey(pid, seq, id), nil); err != nil {
+		return 0, err
+	}
+	wTx.updateStats(&q.stats, pid, 1, 0)
+	return seq, nil
+}
+
+// cancel removes an available item from the queue in the write transaction
+// provided, given its key and arrival sequence number. If the item was
+// re-indexed to be retried, the sequence number of its attempt record is
+// used instead. Reserved items are not removed, since a worker is
+// processing them, and false is returned. The caller must hold the lock of
+// the process.
+func (q *queue) cancel(s *Storage, wTx *statsTx, key []byte, seq uint64) (bool, error) {
+	if s.isReserved(q.reservPrefix, key) {
+		return false, nil
+	}
+	pid, id, err := q.splitKey(key)
+	if err != nil {
+		return false, err
+	}
+	attempt, err := q.attempts(s, key)
+	if err != nil {
+		return false, err
+	}
+	if attempt != nil {
+		seq = attempt.Seq
+	}
+	wTx.updateStats(&q.stats, q.processID(key), -1, 0)
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, q.indexPrefix).Delete(q.indexKey(pid, seq, id)); err != nil {
+		return false, err
+	}
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, q.dataPrefix).Delete(key); err != nil {
+		return false, err
+	}
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, attemptPrefix).Delete(q.attemptKey(key)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// pull reserves up to maxCount available items of the process for the
+// worker provided, in arrival order, and returns their keys and values. If
+// maxCount is negative, all the available items are reserved. The items
+// waiting to be retried are not available until their backoff expires. It
+// returns ErrNoMoreElements if there are no available items.
+func (q *queue) pull(s *Storage, pid []byte, maxCount int, workerID string) ([][]byte, [][]byte, error) {
+	if q.partitioned {
+		mu := q.lock(pid)
+		mu.Lock()
+		defer mu.Unlock()
+	}
+
+	// the items retried later are indexed with a sequence number in the
+	// future, so the iteration stops when the first one is found
+	maxSeq := max(uint64(time.Now().UnixNano()), lastSeq.Load())
+
+	type entry struct {
+		indexKey []byte
+		key      []byte
+		seq      uint64
+	}
+	var entries []entry
+	if err := prefixeddb.NewPrefixedReader(s.db, q.indexPrefix).Iterate(pid, func(k, _ []byte) bool {
+		if len(k) < seqSize {
+			return true
+		}
+		seq := binary.BigEndian.Uint64(k[:seqSize])
+		if seq > maxSeq {
+			return false
+		}
+		entries = append(entries, entry{
+			indexKey: append(bytes.Clone(pid), k...),
+			key:      append(bytes.Clone(pid), k[seqSize:]...),
+			seq:      seq,
+		})
+		return maxCount < 0 || len(entries) < maxCount
+	}); err != nil {
+		return nil, nil, fmt.Errorf("iterate %s index: %w", q.name, err)
+	}
+	if len(entries) == 0 {
+		return nil, nil, ErrNoMoreElements
+	}
+	if !q.partitioned {
+		// the index of the queue is shared by all the processes, so the
+		// entries are found before locking their processes and the ones
+		// reserved or removed meanwhile are skipped
+		keys := make([][]byte, len(entries))
+		for i, e := range entries {
+			keys[i] = e.key
+		}
+		defer q.lockKeys(keys)()
+		indexReader := prefixeddb.NewPrefixedReader(s.db, q.indexPrefix)
+		available := entries[:0]
+		for _, e := range entries {
+			if _, err := indexReader.Get(e.indexKey); err == nil {
+				available = append(available, e)
+			}
+		}
+		if entries = available; len(entries) == 0 {
+			return nil, nil, ErrNoMoreElements
+		}
+	}
+
+	wTx := s.writeTx()
+	defer wTx.Discard()
+	data := prefixeddb.NewPrefixedReader(s.db, q.dataPrefix)
+	index := prefixeddb.NewPrefixedWriteTx(wTx, q.indexPrefix)
+	reserv := prefixeddb.NewPrefixedWriteTx(wTx, q.reservPrefix)
+	now := time.Now().UnixNano()
+	keys := make([][]byte, 0, len(entries))
+	vals := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		val, err := data.Get(e.key)
+		if errors.Is(err, db.ErrKeyNotFound) {
+			// the item was removed but not its index entry
+			log.Warnw("dropping queue index entry without data", "queue", q.name, "key", hex.EncodeToString(e.key))
+			if err := index.Delete(e.indexKey); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("get %s %x: %w", q.name, e.key, err)
+		}
+		rec, err := encodeReservation(&reservationRecord{Timestamp: now, Seq: e.seq, WorkerID: workerID})
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := index.Delete(e.indexKey); err != nil {
+			return nil, nil, err
+		}
+		if err := reserv.Set(e.key, rec); err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, e.key)
+		vals = append(vals, val)
+		wTx.updateStats(&q.stats, q.processID(e.key), -1, 1)
+	}
+	if err := wTx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("commit %s reservation: %w", q.name, err)
+	}
+	if len(keys) == 0 {
+		return nil, nil, ErrNoMoreElements
+	}
+	return keys, vals, nil
+}
+
+// remove deletes a reserved item from the queue in the write transaction
+// provided. It returns ErrNotFound if the item is not reserved.
+func (q *queue) remove(s *Storage, wTx *statsTx, key []byte) error {
+	if !s.isReserved(q.reservPrefix, key) {
+		return ErrNotFound
+	}
+	wTx.updateStats(&q.stats, q.processID(key), 0, -1)
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, q.reservPrefix).Delete(key); err != nil {
+		return err
+	}
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, attemptPrefix).Delete(q.attemptKey(key)); err != nil {
+		return err
+	}
+	return prefixeddb.NewPrefixedWriteTx(wTx, q.dataPrefix).Delete(key)
+}
+
+// extend renews the reservation of an item held by the worker provided, so
+// it is not released as stale while the worker is still processing it. It
+// returns ErrNotFound if the item is not reserved, and ErrNotReservationOwner
+// if it is reserved by another worker.
+func (q *queue) extend(s *Storage, key []byte, workerID string) error {
+	if _, _, err := q.splitKey(key); err != nil {
+		return err
+	}
+	mu := q.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	r, err := q.reservation(s, key, workerID)
+	if err != nil {
+		return err
+	}
+	r.Timestamp = time.Now().UnixNano()
+	data, err := encodeReservation(r)
+	if err != nil {
+		return err
+	}
+	wTx := s.db.WriteTx()
+	defer wTx.Discard()
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, q.reservPrefix).Set(key, data); err != nil {
+		return err
+	}
+	return wTx.Commit()
+}
+
+// reservation returns the reservation of an item held by the worker
+// provided. It returns ErrNotFound if the item is not reserved, and
+// ErrNotReservationOwner if it is reserved by another worker. The caller
+// must hold the lock of the item, so the reservation does not change until
+// it acts on it.
+func (q *queue) reservation(s *Storage, key []byte, workerID string) (*reservationRecord, error) {
+	data, err := prefixeddb.NewPrefixedReader(s.db, q.reservPrefix).Get(key)
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get %s reservation: %w", q.name, err)
+	}
+	r, err := decodeReservation(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s reservation: %w", q.name, err)
+	}
+	if r.WorkerID != workerID {
+		return nil, ErrNotReservationOwner
+	}
+	return r, nil
+}
+
+// attemptKey returns the key of the attempt record of an item, which is
+// shared by all the queues.
+func (q *queue) attemptKey(key []byte) []byte {
+	return append(bytes.Clone(q.dataPrefix), key...)
+}
+
+// attempts returns the attempt record of an item, or nil if it never
+// failed.
+func (q *queue) attempts(s *Storage, key []byte) (*attemptRecord, error) {
+	data, err := prefixeddb.NewPrefixedReader(s.db, attemptPrefix).Get(q.attemptKey(key))
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get %s attempts: %w", q.name, err)
+	}
+	rec := &attemptRecord{}
+	if err := decodeArtifact(data, rec); err != nil {
+		return nil, fmt.Errorf("decode %s attempts: %w", q.name, err)
+	}
+	return rec, nil
+}
+
+// retry makes a reserved item available again in the write transaction
+// provided, with the arrival sequence number of the attempt record, which
+// is stored too. The caller must hold the lock of the process.
+func (q *queue) retry(s *Storage, wTx *statsTx, key []byte, attempt *attemptRecord) error {
+	pid, id, err := q.splitKey(key)
+	if err != nil {
+		return err
+	}
+	data, err := encodeArtifact(attempt)
+	if err != nil {
+		return err
+	}
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, attemptPrefix).Set(q.attemptKey(key), data); err != nil {
+		return err
+	}
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, q.reservPrefix).Delete(key); err != nil {
+		return err
+	}
+	if err := prefixeddb.NewPrefixedWriteTx(wTx, q.indexPrefix).Set(q.indexKey(pid, attempt.Seq, id), nil); err != nil {
+		return err
+	}
+	wTx.updateStats(&q.stats, q.processID(key), 1, -1)
+	return nil
+}
+
+// release makes the reserved items older than maxAge available again, in
+// their original position of the queue. A zero maxAge releases all of them.
+// If reclaim is true, the items released are added to the stored counter of
+// reclaimed reservations in the same transaction. It returns the number of
+// items released.
+func (q *queue) release(s *Storage, maxAge time.Duration, reclaim bool) (int, error) {
+	defer q.lockAll()()
+
+	type stale struct {
+		key []byte
+		seq uint64
+	}
+	now := time.Now().UnixNano()
+	var staleItems []stale
+	var iterErr error
+	if err := prefixeddb.NewPrefixedReader(s.db, q.reservPrefix).Iterate(nil, func(k, v []byte) bool {
+		r, err := decodeReservation(v)
+		if err != nil {
+			iterErr = fmt.Errorf("decode %s reservation %x: %w", q.name, k, err)
+			return false
+		}
+		if maxAge == 0 || now-r.Timestamp > maxAge.Nanoseconds() {
+			if maxAge > 0 {
+				log.Debugw("releasing stale reservation", "queue", q.name, "key", hex.EncodeToString(k),
+					"worker", r.WorkerID, "age", time.Duration(now-r.Timestamp).String())
+			}
+			staleItems = append(staleItems, stale{key: bytes.Clone(k), seq: r.Seq})
+		}
+		return true
+	}); err != nil {
+		return 0, fmt.Errorf("iterate %s reservations: %w", q.name, err)
+	}
+	if iterErr != nil {
+		return 0, iterErr
+	}
+	if len(staleItems) == 0 {
+		return 0, nil
+	}
+
+	wTx := s.writeTx()
+	defer wTx.Discard()
+	index := prefixeddb.NewPrefixedWriteTx(wTx, q.indexPrefix)
+	reserv := prefixeddb.NewPrefixedWriteTx(wTx, q.reservPrefix)
+	for _, item := range staleItems {
+		pid, id, err := q.splitKey(item.key)
+		if err != nil {
+			return 0, err
+		}
+		if err := reserv.Delete(item.key); err != nil {
+			return 0, fmt.Errorf("delete %s reservation: %w", q.name, err)
+		}
+		if err := index.Set(q.indexKey(pid, item.seq, id), nil); err != nil {
+			return 0, fmt.Errorf("restore %s index: %w", q.name, err)
+		}
+		wTx.updateStats(&q.stats, q.processID(item.key), 1, -1)
+	}
+	reclaimed := q.reclaimed.Load() + uint64(len(staleItems))
+	if reclaim {
+		if err := prefixeddb.NewPrefixedWriteTx(wTx, reclaimedPrefix).Set([]byte(q.name),
+			binary.BigEndian.AppendUint64(nil, reclaimed)); err != nil {
+			return 0, fmt.Errorf("count %s reclaimed reservations: %w", q.name, err)
+		}
+	}
+	if err := wTx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit %s release: %w", q.name, err)
+	}
+	if reclaim {
+		q.reclaimed.Store(reclaimed)
+	}
+	return len(staleItems), nil
+}
+
+// count returns the number of items of the process in the queue, both
+// available and reserved.
+func (q *queue) count(s *Storage, pid []byte) int {
+	count := 0
+	prefixeddb.NewPrefixedReader(s.db, q.dataPrefix).Iterate(pid, func(_, _ []byte) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// repair checks the invariants of the queue and fixes the items that break
+// them, in a single transaction. Every item must have its data and be either
+// available (one index entry) or reserved, never both. Index entries and
+// reservations without data are removed, duplicated index entries and the
+// reservations of available items are dropped, and the items that are
+// neither available nor reserved are appended to the queue. It returns the
+// number of fixes applied.
+func (q *queue) repair(s *Storage) (int, error) {
+	defer q.lockAll()()
+
+	items := make(map[string]bool) // key -> available or reserved
+	prefixeddb.NewPrefixedReader(s.db, q.dataPrefix).Iterate(nil, func(k, _ []byte) bool {
+		items[string(k)] = false
+		return true
+	})
+
+	wTx := s.db.WriteTx()
+	defer wTx.Discard()
+	index := prefixeddb.NewPrefixedWriteTx(wTx, q.indexPrefix)
+	reserv := prefixeddb.NewPrefixedWriteTx(wTx, q.reservPrefix)
+	fixes := 0
+	var txErr error
+	fix := func(err error) bool {
+		fixes++
+		txErr = err
+		return err == nil
+	}
+
+	prefixeddb.NewPrefixedReader(s.db, q.indexPrefix).Iterate(nil, func(k, _ []byte) bool {
+		key, _, err := q.indexEntryKey(k)
+		if err != nil {
+			return fix(index.Delete(bytes.Clone(k)))
+		}
+		if tracked, ok := items[string(key)]; !ok || tracked {
+			log.Warnw("dropping invalid queue index entry", "queue", q.name, "key", hex.EncodeToString(key))
+			return fix(index.Delete(bytes.Clone(k)))
+		}
+		items[string(key)] = true
+		return true
+	})
+	if txErr != nil {
+		return 0, fmt.Errorf("repair %s index: %w", q.name, txErr)
+	}
+
+	prefixeddb.NewPrefixedReader(s.db, q.reservPrefix).Iterate(nil, func(k, _ []byte) bool {
+		if tracked, ok := items[string(k)]; !ok || tracked {
+			log.Warnw("dropping invalid queue reservation", "queue", q.name, "key", hex.EncodeToString(k))
+			return fix(reserv.Delete(bytes.Clone(k)))
+		}
+		items[string(k)] = true
+		return true
+	})
+	if txErr != nil {
+		return 0, fmt.Errorf("repair %s reservations: %w", q.name, txErr)
+	}
+
+	for key, tracked := range items {
+		if tracked {
+			continue
+		}
+		pid, id, err := q.splitKey([]byte(key))
+		if err != nil {
+			return 0, err
+		}
+		log.Warnw("restoring unindexed queue item", "queue", q.name, "key", hex.EncodeToString([]byte(key)))
+		if !fix(index.Set(q.indexKey(pid, nextSeq(), id), nil)) {
+			return 0, fmt.Errorf("repair %s item: %w", q.name, txErr)
+		}
+	}
+
+	if fixes == 0 {
+		return 0, nil
+	}
+	if err := wTx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit %s repair: %w", q.name, err)
+	}
+	return fixes, nil
+}
+
+// indexEntryKey returns the item key and the arrival sequence number of an
+// available index entry.
+func (q *queue) indexEntryKey(k []byte) ([]byte, uint64, error) {
+	if len(k) <= processIDLen+seqSize {
+		return nil, 0, fmt.Errorf("invalid %s index key %x", q.name, k)
+	}
+	if !q.partitioned {
+		return bytes.Clone(k[seqSize:]), binary.BigEndian.Uint64(k[:seqSize]), nil
+	}
+	seq := binary.BigEndian.Uint64(k[processIDLen : processIDLen+seqSize])
+	return append(bytes.Clone(k[:processIDLen]), k[processIDLen+seqSize:]...), seq, nil
+}
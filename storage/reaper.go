@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/db/prefixeddb"
+)
+
+// ErrReaperRunning is returned when the reaper is started twice.
+var ErrReaperRunning = errors.New("reaper already running")
+
+// ReaperConfig defines how often the reaper looks for stale reservations,
+// and how long the items of each stage can be reserved without being
+// released. The zero fields take the value of DefaultReaperConfig.
+type ReaperConfig struct {
+	Interval             time.Duration
+	BallotMaxAge         time.Duration
+	VerifiedBallotMaxAge time.Duration
+	BallotBatchMaxAge    time.Duration
+}
+
+// DefaultReaperConfig is the reaper configuration used for the fields that
+// are not set.
+var DefaultReaperConfig = ReaperConfig{
+	Interval:             30 * time.Second,
+	BallotMaxAge:         5 * time.Minute,
+	VerifiedBallotMaxAge: 5 * time.Minute,
+	BallotBatchMaxAge:    15 * time.Minute,
+}
+
+// withDefaults returns the configuration with the zero fields set to their
+// default value.
+func (c ReaperConfig) withDefaults() ReaperConfig {
+	or := func(v, def time.Duration) time.Duration {
+		if v == 0 {
+			return def
+		}
+		return v
+	}
+	return ReaperConfig{
+		Interval:             or(c.Interval, DefaultReaperConfig.Interval),
+		BallotMaxAge:         or(c.BallotMaxAge, DefaultReaperConfig.BallotMaxAge),
+		VerifiedBallotMaxAge: or(c.VerifiedBallotMaxAge, DefaultReaperConfig.VerifiedBallotMaxAge),
+		BallotBatchMaxAge:    or(c.BallotBatchMaxAge, DefaultReaperConfig.BallotBatchMaxAge),
+	}
+}
+
+// StartReaper starts a background goroutine that releases the stale
+// reservations of every stage periodically, so the items reserved by the
+// workers that crashed or hung are processed by others. The workers
+// processing an item for longer than the max age of its stage must extend
+// its reservation. The reaper runs until StopReaper or Close are called.
+func (s *Storage) StartReaper(conf ReaperConfig) error {
+	s.reaperLock.Lock()
+	defer s.reaperLock.Unlock()
+	if s.stopReaper != nil {
+		return ErrReaperRunning
+	}
+	conf = conf.withDefaults()
+	maxAges := map[*queue]time.Duration{
+		s.ballots:         conf.BallotMaxAge,
+		s.verifiedBallots: conf.VerifiedBallotMaxAge,
+		s.batches:         conf.BallotBatchMaxAge,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	s.stopReaper = func() {
+		cancel()
+		<-done
+	}
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(conf.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.reap(maxAges)
+			}
+		}
+	}()
+	log.Infow("reservation reaper started", "interval", conf.Interval.String())
+	return nil
+}
+
+// StopReaper stops the reaper and waits for it to finish. It does nothing if
+// the reaper is not running.
+func (s *Storage) StopReaper() {
+	s.reaperLock.Lock()
+	defer s.reaperLock.Unlock()
+	if s.stopReaper == nil {
+		return
+	}
+	s.stopReaper()
+	s.stopReaper = nil
+}
+
+// reap releases the reservations of each queue older than its max age.
+func (s *Storage) reap(maxAges map[*queue]time.Duration) {
+	for q, maxAge := range maxAges {
+		n, err := q.release(s, maxAge, true)
+		if err != nil {
+			log.Warnw("could not release stale reservations", "queue", q.name, "error", err.Error())
+			continue
+		}
+		if n > 0 {
+			log.Infow("released stale reservations", "queue", q.name, "count", n)
+		}
+	}
+}
+
+// ReclaimedReservations returns the number of stale reservations released,
+// by stage name. The counters are stored, so they are kept across restarts.
+func (s *Storage) ReclaimedReservations() map[string]uint64 {
+	reclaimed := make(map[string]uint64)
+	for _, q := range s.queues() {
+		reclaimed[q.name] = q.reclaimed.Load()
+	}
+	return reclaimed
+}
+
+// loadReclaimed loads the stored counters of reclaimed reservations.
+func (s *Storage) loadReclaimed() error {
+	reader := prefixeddb.NewPrefixedReader(s.db, reclaimedPrefix)
+	for _, q := range s.queues() {
+		data, err := reader.Get([]byte(q.name))
+		if errors.Is(err, db.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(data) != 8 {
+			return fmt.Errorf("invalid %s reclaimed counter %x", q.name, data)
+		}
+		q.reclaimed.Store(binary.BigEndian.Uint64(data))
+	}
+	return nil
+}
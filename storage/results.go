@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/elgamal"
+	"github.com/vocdoni/vocdoni-z-sandbox/state"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/db/prefixeddb"
+)
+
+// BallotStatus is the stage of the current ballot of a nullifier.
+type BallotStatus string
+
+const (
+	// BallotStatusPending is the status of the ballots waiting to be
+	// verified.
+	BallotStatusPending BallotStatus = "pending"
+	// BallotStatusVerified is the status of the ballots waiting to be
+	// aggregated.
+	BallotStatusVerified BallotStatus = "verified"
+	// BallotStatusAggregated is the status of the ballots included in an
+	// aggregated batch.
+	BallotStatusAggregated BallotStatus = "aggregated"
+)
+
+// ProcessResults are the encrypted results of a process: the sum of the
+// ballots of the aggregated batches processed (ResultsAdd) and the sum of
+// the ballots they overwrote (ResultsSub), as accumulated by the state, so
+// the results are ResultsAdd - ResultsSub (see keystore.Tally).
+type ProcessResults struct {
+	ResultsAdd *elgamal.Ciphertext
+	ResultsSub *elgamal.Ciphertext
+	// Ballots counts the ballots added, and Overwrites the ones subtracted.
+	Ballots    uint64
+	Overwrites uint64
+}
+
+// resultsRecord is the stored encoding of the results, with the ciphertexts
+// serialized as in the state.
+type resultsRecord struct {
+	ResultsAdd []byte
+	ResultsSub []byte
+	Ballots    uint64
+	Overwrites uint64
+}
+
+// resultsCodec stores the encrypted results of the processes.
+var resultsCodec = &artifactCodec[ProcessResults]{
+	name:    "results",
+	prefix:  resultsPrefix,
+	version: 1,
+	marshal: func(r *ProcessResults) ([]byte, error) {
+		return encodeArtifact(&resultsRecord{
+			ResultsAdd: r.ResultsAdd.Serialize(),
+			ResultsSub: r.ResultsSub.Serialize(),
+			Ballots:    r.Ballots,
+			Overwrites: r.Overwrites,
+		})
+	},
+	unmarshal: func(data []byte, r *ProcessResults) error {
+		rec := &resultsRecord{}
+		if err := decodeArtifact(data, rec); err != nil {
+			return err
+		}
+		var err error
+		if r.ResultsAdd, err = deserializeCiphertext(rec.ResultsAdd); err != nil {
+			return err
+		}
+		if r.ResultsSub, err = deserializeCiphertext(rec.ResultsSub); err != nil {
+			return err
+		}
+		r.Ballots, r.Overwrites = rec.Ballots, rec.Overwrites
+		return nil
+	},
+}
+
+// deserializeCiphertext decodes a ciphertext serialized in the curve of the
+// state.
+func deserializeCiphertext(data []byte) (*elgamal.Ciphertext, error) {
+	ct := elgamal.NewCiphertext(state.Curve)
+	if err := ct.Deserialize(data); err != nil {
+		return nil, err
+	}
+	return ct, nil
+}
+
+// BallotStatus returns the status of the current ballot of the nullifier in
+// the process. It returns ErrNotFound if no ballot was pushed with the
+// nullifier.
+func (s *Storage) BallotStatus(processID, nullifier []byte) (BallotStatus, error) {
+	rec, err := s.nullifierRecord(processID, nullifier)
+	if err != nil {
+		return "", err
+	}
+	if rec == nil {
+		return "", ErrNotFound
+	}
+	switch rec.Stage {
+	case nullifierStagePending:
+		return BallotStatusPending, nil
+	case nullifierStageVerified:
+		return BallotStatusVerified, nil
+	default:
+		return BallotStatusAggregated, nil
+	}
+}
+
+// Results returns the encrypted results of the process, which are empty
+// until an aggregated batch of the process is processed.
+func (s *Storage) Results(pid types.ProcessID) (*ProcessResults, error) {
+	return s.results(pid.Marshal())
+}
+
+func (s *Storage) results(processID []byte) (*ProcessResults, error) {
+	results, err := getArtifact(s, resultsCodec, processID)
+	if errors.Is(err, ErrNotFound) {
+		return &ProcessResults{
+			ResultsAdd: elgamal.NewCiphertext(state.Curve),
+			ResultsSub: elgamal.NewCiphertext(state.Curve),
+		}, nil
+	}
+	return results, err
+}
+
+// countBatch adds the ballots of the aggregated batch stored in the key
+// provided to the results of its process, in the write transaction
+// provided. The last ballot counted of each nullifier is kept, so it is
+// subtracted when the nullifier is overwritten. The ballots without
+// encrypted ballot add nothing. The ballots and the overwritten ones are
+// added with a single multi-scalar multiplication each (see
+// elgamal.Ciphertext.Sum). The caller must hold the nullifier lock of the
+// process.
+func (s *Storage) countBatch(wTx db.WriteTx, k []byte) error {
+	val, err := prefixeddb.NewPrefixedReader(s.db, aggregBatchPrefix).Get(k)
+	if err != nil {
+		return fmt.Errorf("get aggregated batch: %w", err)
+	}
+	abb, err := ballotBatchCodec.decode(s, k, val)
+	if err != nil {
+		return fmt.Errorf("decode aggregated batch: %w", err)
+	}
+	results, err := s.results(abb.ProcessID)
+	if err != nil {
+		return err
+	}
+	added := []*elgamal.Ciphertext{results.ResultsAdd}
+	subtracted := []*elgamal.Ciphertext{results.ResultsSub}
+	counted := prefixeddb.NewPrefixedWriteTx(wTx, countedBallotPrefix)
+	for _, b := range abb.Ballots {
+		if b.EncryptedBallot.C1 == nil || b.EncryptedBallot.C2 == nil {
+			continue
+		}
+		ballot, err := deserializeCiphertext(b.EncryptedBallot.Serialize())
+		if err != nil {
+			return err
+		}
+		key := nullifierKey(abb.ProcessID, b.Nullifier)
+		previous, err := counted.Get(key)
+		switch {
+		case err == nil:
+			overwritten, err := deserializeCiphertext(previous)
+			if err != nil {
+				return err
+			}
+			subtracted = append(subtracted, overwritten)
+		case !errors.Is(err, db.ErrKeyNotFound):
+			return fmt.Errorf("get counted ballot: %w", err)
+		}
+		added = append(added, ballot)
+		if err := counted.Set(key, ballot.Serialize()); err != nil {
+			return fmt.Errorf("set counted ballot: %w", err)
+		}
+	}
+	if len(added) == 1 {
+		return nil
+	}
+	if results.ResultsAdd, err = elgamal.NewCiphertext(state.Curve).Sum(added); err != nil {
+		return fmt.Errorf("sum ballots: %w", err)
+	}
+	if results.ResultsSub, err = elgamal.NewCiphertext(state.Curve).Sum(subtracted); err != nil {
+		return fmt.Errorf("sum overwritten ballots: %w", err)
+	}
+	results.Ballots += uint64(len(added) - 1)
+	results.Overwrites += uint64(len(subtracted) - 1)
+	data, err := resultsCodec.encode(results)
+	if err != nil {
+		return err
+	}
+	return prefixeddb.NewPrefixedWriteTx(wTx, resultsPrefix).Set(abb.ProcessID, data)
+}
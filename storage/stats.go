@@ -0,0 +1,358 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/db/prefixeddb"
+)
+
+// throughputBucket is the time span of each throughput bucket, and
+// throughputBuckets the number of buckets kept, which covers the largest
+// throughput window.
+const (
+	throughputBucket  = 10 * time.Second
+	throughputBuckets = 90
+)
+
+// ThroughputWindows are the sliding windows over which the throughput of
+// the stages is reported, by name.
+var ThroughputWindows = map[string]time.Duration{
+	"1m":  time.Minute,
+	"5m":  5 * time.Minute,
+	"15m": 15 * time.Minute,
+}
+
+// throughput counts the items processed in the last throughputBuckets
+// buckets, as a ring indexed by the bucket number.
+type throughput struct {
+	counts  [throughputBuckets]uint64
+	buckets [throughputBuckets]int64
+}
+
+// add counts n items processed at the time provided.
+func (t *throughput) add(now time.Time, n int) {
+	b := now.UnixNano() / int64(throughputBucket)
+	i := b % throughputBuckets
+	if t.buckets[i] != b {
+		t.buckets[i], t.counts[i] = b, 0
+	}
+	t.counts[i] += uint64(n)
+}
+
+// rate returns the items processed per second in the window that ends at
+// the time provided.
+func (t *throughput) rate(now time.Time, window time.Duration) float64 {
+	last := now.UnixNano() / int64(throughputBucket)
+	first := last - int64(window/throughputBucket) + 1
+	var total uint64
+	for i, b := range t.buckets {
+		if b >= first && b <= last {
+			total += t.counts[i]
+		}
+	}
+	return float64(total) / window.Seconds()
+}
+
+// rates returns the rate of every throughput window, by name.
+func (t *throughput) rates(now time.Time) map[string]float64 {
+	rates := make(map[string]float64, len(ThroughputWindows))
+	for name, window := range ThroughputWindows {
+		rates[name] = t.rate(now, window)
+	}
+	return rates
+}
+
+// processStats are the counters of the items of a process in a queue.
+type processStats struct {
+	available int
+	reserved  int
+	processed throughput
+}
+
+// queueStats keeps the counters of a queue by process ID in memory. They
+// are updated by the queue operations, and rebuilt from the database when
+// the storage is created.
+type queueStats struct {
+	mu        sync.Mutex
+	processes map[string]*processStats
+	processed throughput
+}
+
+// process returns the counters of the process, creating them if needed. The
+// caller must hold the lock.
+func (qs *queueStats) process(pid []byte) *processStats {
+	if qs.processes == nil {
+		qs.processes = make(map[string]*processStats)
+	}
+	ps, ok := qs.processes[string(pid)]
+	if !ok {
+		ps = &processStats{}
+		qs.processes[string(pid)] = ps
+	}
+	return ps
+}
+
+// update adds the deltas provided to the available and reserved counters of
+// the process.
+func (qs *queueStats) update(pid []byte, available, reserved int) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	ps := qs.process(pid)
+	ps.available = max(ps.available+available, 0)
+	ps.reserved = max(ps.reserved+reserved, 0)
+}
+
+// done counts an item of the process moved to the next stage.
+func (qs *queueStats) done(pid []byte) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	now := time.Now()
+	qs.process(pid).processed.add(now, 1)
+	qs.processed.add(now, 1)
+}
+
+// reset removes all the counters.
+func (qs *queueStats) reset() {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	qs.processes = nil
+	qs.processed = throughput{}
+}
+
+// statsTx is a write transaction that applies the changes of the in-memory
+// statistics of the queues once it is committed, so they are not changed by
+// the transactions that fail or are discarded.
+type statsTx struct {
+	db.WriteTx
+	updates []func()
+}
+
+// writeTx returns a new write transaction that updates the statistics when
+// it is committed.
+func (s *Storage) writeTx() *statsTx {
+	return &statsTx{WriteTx: s.db.WriteTx()}
+}
+
+// onCommit defers the update provided until the transaction is committed.
+func (tx *statsTx) onCommit(update func()) {
+	tx.updates = append(tx.updates, update)
+}
+
+// updateStats adds the deltas provided to the counters of the process once
+// the transaction is committed, see queueStats.update.
+func (tx *statsTx) updateStats(qs *queueStats, pid []byte, available, reserved int) {
+	tx.onCommit(func() { qs.update(pid, available, reserved) })
+}
+
+// Commit commits the transaction and then applies the updates deferred.
+func (tx *statsTx) Commit() error {
+	if err := tx.WriteTx.Commit(); err != nil {
+		return err
+	}
+	for _, update := range tx.updates {
+		update()
+	}
+	tx.updates = nil
+	return nil
+}
+
+// StageStats are the statistics of the queue of a processing stage.
+type StageStats struct {
+	// Available is the number of items waiting to be reserved by a worker.
+	Available int `json:"available"`
+	// Reserved is the number of items being processed by a worker.
+	Reserved int `json:"reserved"`
+	// OldestAge is how long the oldest available item has been waiting.
+	OldestAge time.Duration `json:"oldestAge"`
+	// Throughput is the number of items processed per second, by window
+	// name (see ThroughputWindows).
+	Throughput map[string]float64 `json:"throughput"`
+	// Reclaimed is the number of stale reservations released, it is only
+	// reported for all the processes.
+	Reclaimed uint64 `json:"reclaimed,omitempty"`
+}
+
+// QueueStats summarizes the backlog of the processing stages, of a process
+// or of all of them.
+type QueueStats struct {
+	// Pending is the number of ballots waiting to be verified.
+	Pending int `json:"pending"`
+	// Reserved is the number of items being processed by the workers, in
+	// any stage.
+	Reserved int `json:"reserved"`
+	// Verified is the number of verified ballots waiting to be aggregated.
+	Verified int `json:"verified"`
+	// Aggregated is the number of aggregated batches waiting to be
+	// processed.
+	Aggregated int `json:"aggregated"`
+	// Dead is the number of dead letters.
+	Dead int `json:"dead"`
+	// Stages are the statistics of each stage, by name.
+	Stages map[string]*StageStats `json:"stages"`
+}
+
+// QueueStats returns the queue statistics of the process provided, or of all
+// the processes if it is nil. The oldest age of the ballot stage is only
+// reported for all the processes, since its queue is shared by all of them
+// in arrival order.
+func (s *Storage) QueueStats(pid []byte) *QueueStats {
+	now := time.Now()
+	stats := &QueueStats{Stages: make(map[string]*StageStats)}
+	for _, q := range s.queues() {
+		ss := &StageStats{}
+		q.stats.mu.Lock()
+		if pid == nil {
+			for _, ps := range q.stats.processes {
+				ss.Available += ps.available
+				ss.Reserved += ps.reserved
+			}
+			ss.Throughput = q.stats.processed.rates(now)
+			ss.Reclaimed = q.reclaimed.Load()
+		} else if ps, ok := q.stats.processes[string(pid)]; ok {
+			ss.Available, ss.Reserved = ps.available, ps.reserved
+			ss.Throughput = ps.processed.rates(now)
+		} else {
+			ss.Throughput = (&throughput{}).rates(now)
+		}
+		q.stats.mu.Unlock()
+		if pid == nil || q.partitioned {
+			ss.OldestAge = q.oldestAge(s, pid, now)
+		}
+		stats.Stages[q.name] = ss
+		stats.Reserved += ss.Reserved
+	}
+	stats.Pending = stats.Stages[StageBallot].Available
+	verified := stats.Stages[StageVerifiedBallot]
+	stats.Verified = verified.Available + verified.Reserved
+	aggregated := stats.Stages[StageBallotBatch]
+	stats.Aggregated = aggregated.Available + aggregated.Reserved
+	stats.Dead = s.dead.count(pid)
+	return stats
+}
+
+// PendingBallots returns the number of ballots of the process waiting to be
+// verified or being verified. It only reads the counters in memory, so it is
+// cheap enough to check it for every ballot submitted.
+func (s *Storage) PendingBallots(pid []byte) int {
+	s.ballots.stats.mu.Lock()
+	defer s.ballots.stats.mu.Unlock()
+	ps, ok := s.ballots.stats.processes[string(pid)]
+	if !ok {
+		return 0
+	}
+	return ps.available + ps.reserved
+}
+
+// QueueProcesses returns the IDs of the processes with items in any queue
+// or dead letters.
+func (s *Storage) QueueProcesses() [][]byte {
+	seen := make(map[string]bool)
+	var pids [][]byte
+	add := func(pid string) {
+		if pid != "" && !seen[pid] {
+			seen[pid] = true
+			pids = append(pids, []byte(pid))
+		}
+	}
+	for _, q := range s.queues() {
+		q.stats.mu.Lock()
+		for pid, ps := range q.stats.processes {
+			if ps.available > 0 || ps.reserved > 0 {
+				add(pid)
+			}
+		}
+		q.stats.mu.Unlock()
+	}
+	s.dead.mu.Lock()
+	for pid, n := range s.dead.processes {
+		if n > 0 {
+			add(pid)
+		}
+	}
+	s.dead.mu.Unlock()
+	return pids
+}
+
+// oldestAge returns how long the oldest available item of the process has
+// been waiting, using the arrival sequence number of the first entry of the
+// index. The items waiting for a retry are not taken into account.
+func (q *queue) oldestAge(s *Storage, pid []byte, now time.Time) time.Duration {
+	var oldest uint64
+	prefixeddb.NewPrefixedReader(s.db, q.indexPrefix).Iterate(pid, func(k, _ []byte) bool {
+		if len(k) >= seqSize {
+			oldest = binary.BigEndian.Uint64(k[:seqSize])
+		}
+		return false
+	})
+	if oldest == 0 || oldest > uint64(now.UnixNano()) {
+		return 0
+	}
+	return now.Sub(time.Unix(0, int64(oldest)))
+}
+
+// deadStats counts the dead letters by process ID in memory.
+type deadStats struct {
+	mu        sync.Mutex
+	processes map[string]int
+}
+
+// add adds the delta provided to the dead letters of the process.
+func (ds *deadStats) add(pid []byte, delta int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.processes == nil {
+		ds.processes = make(map[string]int)
+	}
+	ds.processes[string(pid)] = max(ds.processes[string(pid)]+delta, 0)
+}
+
+// reset removes all the counters.
+func (ds *deadStats) reset() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.processes = nil
+}
+
+// count returns the dead letters of the process, or of all the processes if
+// it is nil.
+func (ds *deadStats) count(pid []byte) int {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if pid != nil {
+		return ds.processes[string(pid)]
+	}
+	total := 0
+	for _, n := range ds.processes {
+		total += n
+	}
+	return total
+}
+
+// rebuildStats counts the items of the queues and the dead letters stored
+// in the database. It must be called without reservations, after recover.
+func (s *Storage) rebuildStats() error {
+	for _, q := range s.queues() {
+		q.stats.reset()
+		var pids [][]byte
+		prefixeddb.NewPrefixedReader(s.db, q.dataPrefix).Iterate(nil, func(k, _ []byte) bool {
+			pids = append(pids, bytes.Clone(q.processID(k)))
+			return true
+		})
+		for _, pid := range pids {
+			q.stats.update(pid, 1, 0)
+		}
+	}
+	s.dead.reset()
+	dls, err := s.DeadLetters()
+	if err != nil {
+		return err
+	}
+	for _, dl := range dls {
+		s.dead.add(dl.ProcessID, 1)
+	}
+	return nil
+}
@@ -2,264 +2,372 @@ package storage
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/gob"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/vocdoni/vocdoni-z-sandbox/log"
 	"go.vocdoni.io/dvote/db"
 	"go.vocdoni.io/dvote/db/prefixeddb"
 )
 
+// Names of the processing stages, which are also the names of their queues.
+const (
+	StageBallot         = "ballot"
+	StageVerifiedBallot = "verified ballot"
+	StageBallotBatch    = "aggregated batch"
+)
+
 var (
-	ErrKeyAlreadyExists = errors.New("key already exists")
-	ErrNotFound         = errors.New("not found")
-	ErrNoMoreElements   = errors.New("no more elements")
+	ErrKeyAlreadyExists    = errors.New("key already exists")
+	ErrNotFound            = errors.New("not found")
+	ErrNoMoreElements      = errors.New("no more elements")
+	ErrNotReservationOwner = errors.New("reservation held by another worker")
+	ErrUnknownStage        = errors.New("unknown processing stage")
+	ErrNonceUsed           = errors.New("nonce already used")
+	ErrResultMismatch      = errors.New("the job result does not match the leased items")
+	// ErrPendingQuotaExceeded is returned when a ballot is pushed for a
+	// process with the maximum number of pending ballots, see
+	// SetPendingBallotsQuota.
+	ErrPendingQuotaExceeded = errors.New("pending ballots quota of the process exceeded")
+	// ErrProcessClosed is returned when a ballot is pushed, or the items of
+	// a process are leased, once the process has ended or was canceled.
+	ErrProcessClosed = errors.New("the process is not accepting ballots")
+	// ErrInvalidProcessID is returned when an artifact is pushed without a
+	// valid process ID, which prefixes the keys of the queue items.
+	ErrInvalidProcessID = errors.New("invalid process ID")
 
 	// Prefixes
-	ballotPrefix               = []byte("b/")
-	ballotReservationPrefix    = []byte("br/")
-	verifiedBallotPrefix       = []byte("vb/")
-	verifiedBallotReservPrefix = []byte("vbr/")
-	aggregBatchPrefix          = []byte("ag/")
-	aggregBatchReservPrefix    = []byte("agr/")
-	encryptionKeyPrefix        = []byte("ek/")
-	metadataPrefix             = []byte("m/")
+	ballotPrefix                = []byte("b/")
+	ballotIndexPrefix           = []byte("bi/")
+	ballotReservationPrefix     = []byte("br/")
+	verifiedBallotPrefix        = []byte("vb/")
+	verifiedBallotIndexPrefix   = []byte("vbi/")
+	verifiedBallotReservPrefix  = []byte("vbr/")
+	aggregBatchPrefix           = []byte("ag/")
+	aggregBatchIndexPrefix      = []byte("agi/")
+	aggregBatchReservPrefix     = []byte("agr/")
+	encryptionKeyPrefix         = []byte("ek/")
+	metadataPrefix              = []byte("m/")
+	metadataHashPrefix          = []byte("mh/")
+	masterKeyPrefix             = []byte("mk/")
+	nullifierPrefix             = []byte("n/")
+	overwritePolicyPrefix       = []byte("op/")
+	attemptPrefix               = []byte("qa/")
+	deadLetterPrefix            = []byte("dl/")
+	processPrefix               = []byte("p/")
+	processTimeIndexPrefix      = []byte("pit/")
+	processOrganizerIndexPrefix = []byte("pio/")
+	processChainIndexPrefix     = []byte("pic/")
+	processStatusIndexPrefix    = []byte("pis/")
+	processReservationPrefix    = []byte("pr/")
+	organizerNoncePrefix        = []byte("on/")
+	auditPrefix                 = []byte("al/")
+	reclaimedPrefix             = []byte("rc/")
+	resultsPrefix               = []byte("r/")
+	countedBallotPrefix         = []byte("rn/")
 
 	maxKeySize = 12
+	// processIDLen is the size of a marshaled types.ProcessID
+	processIDLen = 32
 )
 
-// reservationRecord stores metadata about a reservation (timestamp, etc.)
+// reservationVersion is the current version of the reservation records.
+// The records without version were stored with the timestamp in seconds,
+// and they are converted to nanoseconds when decoded.
+const reservationVersion = 1
+
+// reservationRecord stores metadata about a reservation: when it was made or
+// last extended (in nanoseconds), the worker holding it, and the arrival
+// sequence of the item, to restore its position in the queue if the
+// reservation is released.
 type reservationRecord struct {
+	Version   uint8
 	Timestamp int64
+	Seq       uint64
+	WorkerID  string
+}
+
+// attemptRecord stores the failed processing attempts of a queue item, and
+// the arrival sequence number it was indexed with to be retried, which is
+// in the future while its backoff lasts.
+type attemptRecord struct {
+	Attempts  int
+	Seq       uint64
+	LastError string
 }
 
 // Storage manages artifacts in various stages with reservations.
 type Storage struct {
 	db db.Database
 
-	globalLock sync.Mutex
+	// queues of each processing stage
+	ballots         *queue
+	verifiedBallots *queue
+	batches         *queue
+
+	// nullifiers protects the nullifier index, see nullifierLocks
+	nullifiers nullifierLocks
+	// dead counts the dead letters of each process
+	dead deadStats
+
+	// masterKey is used to encrypt the process private keys at rest, it is
+	// protected by keysLock since it can be rotated.
+	masterKey []byte
+	keysLock  sync.RWMutex
+
+	// retryPolicy defines how the failed items are retried, see RetryPolicy
+	retryPolicy RetryPolicy
+	retryLock   sync.RWMutex
+
+	// defaultOverwritePolicy is the overwrite policy of the processes that
+	// have none, see SetDefaultOverwritePolicy
+	defaultOverwritePolicy OverwritePolicy
+	overwriteLock          sync.RWMutex
+
+	// pendingQuota is the maximum number of pending ballots of each
+	// process, see SetPendingBallotsQuota
+	pendingQuota     int
+	pendingQuotaLock sync.RWMutex
+
+	// processLock serializes the updates of the processes, their indexes and
+	// the organizer nonces
+	processLock sync.Mutex
+
+	// artifactLock serializes setArtifact, so the existence check and the
+	// write of an artifact are not interleaved with another one
+	artifactLock sync.Mutex
+
+	// lastAudit is the ID of the last audit entry, see AddAuditEntry
+	lastAudit int64
+	auditLock sync.Mutex
+
+	// stopReaper stops the stale reservation reaper, if it is running
+	stopReaper func()
+	reaperLock sync.Mutex
 }
 
-// New creates a new Storage instance and attempts to recover from a previous crash.
-func New(db db.Database) *Storage {
-	s := &Storage{db: db}
-	go func() {
-		if err := s.recover(); err != nil {
-			// If we fail here, we may panic because we must ensure consistency.
-			panic(fmt.Errorf("failed to recover from crash: %w", err))
-		}
-	}()
-	return s
+// New creates a new Storage instance and attempts to recover from a previous
+// crash. The master key is used to encrypt the process private keys at rest,
+// it must be MasterKeySize bytes long and match the one used to encrypt the
+// keys already stored in the database, otherwise an error is returned.
+func New(db db.Database, masterKey []byte) (*Storage, error) {
+	s := &Storage{
+		db:          db,
+		retryPolicy: DefaultRetryPolicy,
+		ballots: &queue{
+			name:              StageBallot,
+			dataPrefix:        ballotPrefix,
+			indexPrefix:       ballotIndexPrefix,
+			reservPrefix:      ballotReservationPrefix,
+			valueTraceContext: traceContextOf(ballotCodec),
+		},
+		verifiedBallots: &queue{
+			name:              StageVerifiedBallot,
+			dataPrefix:        verifiedBallotPrefix,
+			indexPrefix:       verifiedBallotIndexPrefix,
+			reservPrefix:      verifiedBallotReservPrefix,
+			partitioned:       true,
+			valueTraceContext: traceContextOf(verifiedBallotCodec),
+		},
+		batches: &queue{
+			name:              StageBallotBatch,
+			dataPrefix:        aggregBatchPrefix,
+			indexPrefix:       aggregBatchIndexPrefix,
+			reservPrefix:      aggregBatchReservPrefix,
+			partitioned:       true,
+			valueTraceContext: traceContextOf(ballotBatchCodec),
+		},
+	}
+	if err := s.initMasterKey(masterKey); err != nil {
+		return nil, err
+	}
+	if err := s.migrateArtifacts(); err != nil {
+		return nil, fmt.Errorf("failed to migrate stored artifacts: %w", err)
+	}
+	if err := s.migrateLegacyBallotKeys(); err != nil {
+		return nil, fmt.Errorf("failed to migrate legacy ballot keys: %w", err)
+	}
+	if err := s.recover(); err != nil {
+		return nil, fmt.Errorf("failed to recover from crash: %w", err)
+	}
+	if err := s.loadLastSeq(); err != nil {
+		return nil, fmt.Errorf("failed to load queue sequence: %w", err)
+	}
+	if err := s.rebuildStats(); err != nil {
+		return nil, fmt.Errorf("failed to count queue items: %w", err)
+	}
+	if err := s.loadReclaimed(); err != nil {
+		return nil, fmt.Errorf("failed to load reclaimed reservations: %w", err)
+	}
+	if err := s.loadLastAudit(); err != nil {
+		return nil, fmt.Errorf("failed to load audit log: %w", err)
+	}
+	return s, nil
 }
 
 // recover cleans up any stale reservations and ensures that no items are blocked.
-// After a crash, any reservations left behind must be cleared so that
+// After a crash, any reservations left behind must be released so that
 // the corresponding ballots or aggregated batches are available for processing again.
+// Before that, the invariants of the queues are checked and the items that
+// break them are fixed (see queue.repair), and the pending ballots that were
+// already verified are removed, so no ballot is processed twice.
 func (s *Storage) recover() error {
-	s.globalLock.Lock()
-	defer s.globalLock.Unlock()
-
-	// Clear all reservations
-	if err := s.clearAllReservations(ballotReservationPrefix); err != nil {
-		return fmt.Errorf("failed to clear ballot reservations: %w", err)
-	}
-	if err := s.clearAllReservations(verifiedBallotReservPrefix); err != nil {
-		return fmt.Errorf("failed to clear verified ballot reservations: %w", err)
+	if err := s.removeVerifiedPendingBallots(); err != nil {
+		return fmt.Errorf("failed to remove verified pending ballots: %w", err)
 	}
-	if err := s.clearAllReservations(aggregBatchReservPrefix); err != nil {
-		return fmt.Errorf("failed to clear aggregated batch reservations: %w", err)
+	for _, q := range s.queues() {
+		fixes, err := q.repair(s)
+		if err != nil {
+			return fmt.Errorf("failed to repair %s queue: %w", q.name, err)
+		}
+		if fixes > 0 {
+			log.Warnw("repaired inconsistent queue", "queue", q.name, "fixes", fixes)
+		}
+		if _, err := q.release(s, 0, false); err != nil {
+			return fmt.Errorf("failed to release %s reservations: %w", q.name, err)
+		}
 	}
-
 	return nil
 }
 
-// clearAllReservations iterates over the given reservation prefix and removes all reservation entries.
-// This ensures that no item remains "reserved" after a crash.
-func (s *Storage) clearAllReservations(prefix []byte) error {
-	rd := prefixeddb.NewPrefixedReader(s.db, prefix)
-	var keysToDelete [][]byte
-
-	// Collect all keys to delete
-	rd.Iterate(nil, func(k, _ []byte) bool {
-		kCopy := make([]byte, len(k))
-		copy(kCopy, k)
-		keysToDelete = append(keysToDelete, kCopy)
+// removeVerifiedPendingBallots deletes the data of the pending ballots that
+// are also in the verified ballots queue, which keeps their keys. Their
+// index entries and reservations are removed afterwards by the ballots
+// queue repair.
+func (s *Storage) removeVerifiedPendingBallots() error {
+	pending := prefixeddb.NewPrefixedReader(s.db, ballotPrefix)
+	var duplicated [][]byte
+	prefixeddb.NewPrefixedReader(s.db, verifiedBallotPrefix).Iterate(nil, func(k, _ []byte) bool {
+		if _, err := pending.Get(k); err == nil {
+			duplicated = append(duplicated, bytes.Clone(k))
+		}
 		return true
 	})
-
-	// Delete them in a write transaction
-	if len(keysToDelete) > 0 {
-		wTx := s.db.WriteTx()
-		pwt := prefixeddb.NewPrefixedWriteTx(wTx, prefix)
-		for _, kk := range keysToDelete {
-			if err := pwt.Delete(kk); err != nil {
-				pwt.Discard()
-				return fmt.Errorf("failed to delete reservation key %x: %w", kk, err)
-			}
-		}
-		if err := pwt.Commit(); err != nil {
-			return fmt.Errorf("failed to commit reservation deletion: %w", err)
+	if len(duplicated) == 0 {
+		return nil
+	}
+	wTx := s.db.WriteTx()
+	defer wTx.Discard()
+	pwTx := prefixeddb.NewPrefixedWriteTx(wTx, ballotPrefix)
+	for _, k := range duplicated {
+		log.Warnw("removing already verified pending ballot", "key", hex.EncodeToString(k))
+		if err := pwTx.Delete(k); err != nil {
+			return err
 		}
 	}
-	return nil
-}
-
-func (s *Storage) Close() {
-	s.db.Close()
+	return wTx.Commit()
 }
 
-// releaseStaleReservations checks and frees stale reservations.
-func (s *Storage) ReleaseStaleReservations(maxAge time.Duration) error {
-	s.globalLock.Lock()
-	defer s.globalLock.Unlock()
-
-	now := time.Now().Unix()
-
-	// Release stale ballot reservations
-	if err := s.releaseStaleInPrefix(ballotReservationPrefix, now, maxAge); err != nil {
-		return err
+// migrateLegacyBallotKeys prefixes the keys of the pending ballots stored
+// before they were keyed by process with the process ID of the ballot. Their
+// reservations are dropped, and the ballots are indexed again by the queue
+// repair, see recover.
+func (s *Storage) migrateLegacyBallotKeys() error {
+	type legacy struct {
+		key, val []byte
 	}
-
-	// Release stale verified ballot reservations
-	if err := s.releaseStaleInPrefix(verifiedBallotReservPrefix, now, maxAge); err != nil {
-		return err
-	}
-
-	// Release stale aggregated batch reservations
-	if err := s.releaseStaleInPrefix(aggregBatchReservPrefix, now, maxAge); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (s *Storage) releaseStaleInPrefix(prefix []byte, now int64, maxAge time.Duration) error {
-	rd := prefixeddb.NewPrefixedReader(s.db, prefix)
-	var staleKeys [][]byte
-	rd.Iterate(nil, func(k, v []byte) bool {
-		r, err := decodeReservation(v)
-		if err != nil {
-			staleKeys = append(staleKeys, append([]byte(nil), k...))
-			return true
-		}
-		if now-r.Timestamp > int64(maxAge.Seconds()) {
-			staleKeys = append(staleKeys, append([]byte(nil), k...))
+	var ballots []legacy
+	prefixeddb.NewPrefixedReader(s.db, ballotPrefix).Iterate(nil, func(k, v []byte) bool {
+		if len(k) == maxKeySize {
+			ballots = append(ballots, legacy{key: bytes.Clone(k), val: bytes.Clone(v)})
 		}
 		return true
 	})
-
-	if len(staleKeys) == 0 {
+	if len(ballots) == 0 {
 		return nil
 	}
-
 	wTx := s.db.WriteTx()
-	for _, sk := range staleKeys {
-		pwt := prefixeddb.NewPrefixedWriteTx(wTx, prefix)
-		if err := pwt.Delete(sk); err != nil {
-			pwt.Discard()
-			return fmt.Errorf("delete stale reservation: %w", err)
+	defer wTx.Discard()
+	data := prefixeddb.NewPrefixedWriteTx(wTx, ballotPrefix)
+	reserv := prefixeddb.NewPrefixedWriteTx(wTx, ballotReservationPrefix)
+	for _, b := range ballots {
+		ballot, err := ballotCodec.decode(nil, nil, b.val)
+		if err != nil {
+			return fmt.Errorf("decode ballot %x: %w", b.key, err)
 		}
-		if err := pwt.Commit(); err != nil {
-			return fmt.Errorf("commit stale deletion: %w", err)
+		if len(ballot.ProcessID) != processIDLen {
+			return fmt.Errorf("invalid process ID of ballot %x", b.key)
+		}
+		if err := data.Set(append(bytes.Clone(ballot.ProcessID), b.key...), b.val); err != nil {
+			return err
+		}
+		if err := data.Delete(b.key); err != nil {
+			return err
+		}
+		if err := reserv.Delete(b.key); err != nil {
+			return err
 		}
 	}
-
-	return nil
+	log.Infow("migrated legacy ballot keys", "count", len(ballots))
+	return wTx.Commit()
 }
 
-func (s *Storage) setReservation(prefix, key []byte) error {
-	val, err := encodeReservation(&reservationRecord{Timestamp: time.Now().Unix()})
-	if err != nil {
-		return err
-	}
-	if _, err := prefixeddb.NewPrefixedReader(s.db, prefix).Get(key); err == nil {
-		return ErrKeyAlreadyExists
-	}
-	wTx := prefixeddb.NewPrefixedWriteTx(s.db.WriteTx(), prefix)
-	if err := wTx.Set(key, val); err != nil {
-		wTx.Discard()
-		return err
+// loadLastSeq restores the last arrival sequence number assigned from the
+// available items of the queues, so the items pushed after a restart are
+// queued behind them even if the clock went backwards. The items waiting to
+// be retried are skipped, since their sequence number is the end of their
+// backoff. It must be called after recover, when no item is reserved.
+func (s *Storage) loadLastSeq() error {
+	for _, q := range s.queues() {
+		var iterErr error
+		prefixeddb.NewPrefixedReader(s.db, q.indexPrefix).Iterate(nil, func(k, _ []byte) bool {
+			key, seq, err := q.indexEntryKey(k)
+			if err != nil {
+				return true
+			}
+			attempt, err := q.attempts(s, key)
+			if err != nil {
+				iterErr = err
+				return false
+			}
+			if attempt == nil || attempt.Seq != seq {
+				observeSeq(seq)
+			}
+			return true
+		})
+		if iterErr != nil {
+			return iterErr
+		}
 	}
-	return wTx.Commit()
+	return nil
 }
 
-func (s *Storage) isReserved(prefix, key []byte) bool {
-	_, err := prefixeddb.NewPrefixedReader(s.db, prefix).Get(key)
-	return err == nil
+// Close stops the reaper, if it is running, and closes the database.
+func (s *Storage) Close() {
+	s.StopReaper()
+	s.db.Close()
 }
 
-func (s *Storage) deleteArtifact(prefix, key []byte) error {
-	wTx := prefixeddb.NewPrefixedWriteTx(s.db.WriteTx(), prefix)
-	if err := wTx.Delete(key); err != nil {
-		wTx.Discard()
-		return err
-	}
-	return wTx.Commit()
+// queues returns the queues of all the processing stages.
+func (s *Storage) queues() []*queue {
+	return []*queue{s.ballots, s.verifiedBallots, s.batches}
 }
 
-// setArtifact helper function stores any kind of artifact in the storage. It
-// receives the prefix of the key, the key itself and the artifact to store. If
-// the key is not provided, it generates it by hashing the artifact itself.
-// It returns ErrKeyAlreadyExists if the key already exists.
-func (s *Storage) setArtifact(prefix []byte, key []byte, artifact any) error {
-	// encode the artifact
-	data := bytes.NewBuffer(nil)
-	if err := gob.NewEncoder(data).Encode(artifact); err != nil {
-		return fmt.Errorf("could not encode: %w", err)
-	}
-	// if the string key is provided, decode it
-	if key == nil {
-		hash := sha256.Sum256(data.Bytes())
-		key = hash[:maxKeySize]
-	}
-
-	// check if key already exists
-	if _, err := prefixeddb.NewPrefixedReader(s.db, prefix).Get(key); err == nil {
-		return ErrKeyAlreadyExists
-	}
-
-	// instance a write transaction with the prefix provided
-	wTx := prefixeddb.NewPrefixedWriteTx(s.db.WriteTx(), prefix)
-	// store the artifact in the database with the key generated
-	if err := wTx.Set(key, data.Bytes()); err != nil {
-		return err
+// stageQueue returns the queue of the processing stage provided.
+func (s *Storage) stageQueue(stage string) (*queue, error) {
+	for _, q := range s.queues() {
+		if q.name == stage {
+			return q, nil
+		}
 	}
-	// commit the transaction
-	return wTx.Commit()
+	return nil, fmt.Errorf("%w: %q", ErrUnknownStage, stage)
 }
 
-// getArtifact helper function retrieves any kind of artifact from the storage. It
-// receives the prefix of the key. It returns the artifact unmarshalled.
-// If the key is not provided, it retrieves the first artifact found for the prefix,
-// and returns ErrNoMoreElements if there are no more elements.
-func (s *Storage) getArtifact(prefix []byte, key []byte) (any, error) {
-	var data []byte
-	var err error
-	if key != nil {
-		data, err = prefixeddb.NewPrefixedReader(s.db, prefix).Get(key)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		// iterate over the keys in the database, take the next key
-		// and get the artifact
-		prefixeddb.NewPrefixedReader(s.db, prefix).Iterate(nil, func(_, value []byte) bool {
-			data = value
-			return false
-		})
-		if data == nil {
-			return nil, ErrNoMoreElements
+// ReleaseStaleReservations releases the reservations older than maxAge, so
+// the items are available again in their original position of the queue.
+func (s *Storage) ReleaseStaleReservations(maxAge time.Duration) error {
+	for _, q := range s.queues() {
+		if _, err := q.release(s, maxAge, true); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	var artifact any
-	r := bytes.NewReader(data)
-	if err := gob.NewDecoder(r).Decode(artifact); err != nil {
-		return nil, fmt.Errorf("could not decode artifact: %w", err)
-	}
-
-	return artifact, nil
+func (s *Storage) isReserved(prefix, key []byte) bool {
+	_, err := prefixeddb.NewPrefixedReader(s.db, prefix).Get(key)
+	return err == nil
 }
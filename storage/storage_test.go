@@ -2,17 +2,30 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"math/big"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ecc/curves"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/elgamal"
+	"github.com/vocdoni/vocdoni-z-sandbox/state"
 	"github.com/vocdoni/vocdoni-z-sandbox/types"
 	"go.vocdoni.io/dvote/db"
 	"go.vocdoni.io/dvote/db/metadb"
+	"go.vocdoni.io/dvote/db/prefixeddb"
 )
 
+var testMasterKey = bytes.Repeat([]byte{0x42}, MasterKeySize)
+
 func TestBallotQueue(t *testing.T) {
 	c := qt.New(t)
 	tempDir := t.TempDir()
@@ -21,7 +34,8 @@ func TestBallotQueue(t *testing.T) {
 	db, err := metadb.New(db.TypePebble, dbPath)
 	c.Assert(err, qt.IsNil)
 
-	st := New(db)
+	st, err := New(db, testMasterKey)
+	c.Assert(err, qt.IsNil)
 	defer st.Close()
 
 	processID := types.ProcessID{
@@ -162,7 +176,8 @@ func TestBallotBatchQueue(t *testing.T) {
 	db, err := metadb.New(db.TypePebble, dbPath)
 	c.Assert(err, qt.IsNil)
 
-	st := New(db)
+	st, err := New(db, testMasterKey)
+	c.Assert(err, qt.IsNil)
 	defer st.Close()
 
 	processID := types.ProcessID{
@@ -261,3 +276,1317 @@ func TestBallotBatchQueue(t *testing.T) {
 	_, _, err = st.NextBallotBatch(anotherPID.Marshal())
 	c.Assert(err, qt.Equals, ErrNoMoreElements)
 }
+
+func TestEncryptionKeys(t *testing.T) {
+	c := qt.New(t)
+	dbPath := filepath.Join(t.TempDir(), "db")
+
+	database, err := metadb.New(db.TypePebble, dbPath)
+	c.Assert(err, qt.IsNil)
+
+	// The storage refuses to start without a valid master key
+	_, err = New(database, nil)
+	c.Assert(err, qt.ErrorIs, ErrMissingMasterKey)
+	_, err = New(database, []byte("short"))
+	c.Assert(err, qt.ErrorIs, ErrInvalidMasterKey)
+
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+
+	pid := types.ProcessID{Address: common.Address{}, Nonce: 1, ChainID: 1}
+	_, _, err = st.EncryptionKeys(pid)
+	c.Assert(err, qt.ErrorIs, ErrNotFound)
+
+	publicKey, privateKey, err := elgamal.GenerateKey(curves.New(curves.CurveTypeBN254))
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.SetEncryptionKeys(pid, publicKey, privateKey), qt.IsNil)
+
+	// The private key is not stored in clear
+	raw, err := prefixeddb.NewPrefixedReader(database, encryptionKeyPrefix).Get(pid.Marshal())
+	c.Assert(err, qt.IsNil)
+	c.Assert(bytes.Contains(raw, privateKey.Bytes()), qt.IsFalse)
+
+	pub, priv, err := st.EncryptionKeys(pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pub.Equal(publicKey), qt.IsTrue)
+	c.Assert(priv.Cmp(privateKey), qt.Equals, 0)
+	pub, err = st.EncryptionPublicKey(pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pub.Equal(publicKey), qt.IsTrue)
+
+	// The keys of a process are stored once, by one of the concurrent calls
+	other := types.ProcessID{Address: common.Address{}, Nonce: 2, ChainID: 1}
+	stored := make(chan ecc.Point, 8)
+	var wg sync.WaitGroup
+	for range cap(stored) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pub, priv, err := elgamal.GenerateKey(curves.New(curves.CurveTypeBN254))
+			c.Check(err, qt.IsNil)
+			if err := st.SetEncryptionKeys(other, pub, priv); err != nil {
+				c.Check(err, qt.ErrorIs, ErrKeyAlreadyExists)
+				return
+			}
+			stored <- pub
+		}()
+	}
+	wg.Wait()
+	close(stored)
+	c.Assert(stored, qt.HasLen, 1)
+	pub, err = st.EncryptionPublicKey(other)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pub.Equal(<-stored), qt.IsTrue)
+
+	// Rotate the master key, the keys are still readable
+	newMasterKey := bytes.Repeat([]byte{0x43}, MasterKeySize)
+	c.Assert(st.RotateMasterKey(newMasterKey), qt.IsNil)
+	_, priv, err = st.EncryptionKeys(pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(priv.Cmp(privateKey), qt.Equals, 0)
+
+	// Export the key to be imported in another node
+	backupKey := bytes.Repeat([]byte{0x44}, MasterKeySize)
+	backup, err := st.ExportKey(pid, backupKey)
+	c.Assert(err, qt.IsNil)
+	st.Close()
+
+	// Reopening with the old master key fails, the new one works
+	database, err = metadb.New(db.TypePebble, dbPath)
+	c.Assert(err, qt.IsNil)
+	_, err = New(database, testMasterKey)
+	c.Assert(err, qt.ErrorIs, ErrInvalidMasterKey)
+	st, err = New(database, newMasterKey)
+	c.Assert(err, qt.IsNil)
+	_, priv, err = st.EncryptionKeys(pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(priv.Cmp(privateKey), qt.Equals, 0)
+	st.Close()
+
+	// Import the backup in a new node with a different master key
+	database2, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db2"))
+	c.Assert(err, qt.IsNil)
+	st2, err := New(database2, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st2.Close()
+
+	c.Assert(st2.ImportKey(backup, bytes.Repeat([]byte{0x45}, MasterKeySize)), qt.IsNotNil)
+	c.Assert(st2.ImportKey(backup, backupKey), qt.IsNil)
+	pub, priv, err = st2.EncryptionKeys(pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pub.Equal(publicKey), qt.IsTrue)
+	c.Assert(priv.Cmp(privateKey), qt.Equals, 0)
+}
+
+func TestArtifactMigrations(t *testing.T) {
+	c := qt.New(t)
+	dbPath := filepath.Join(t.TempDir(), "db")
+	database, err := metadb.New(db.TypePebble, dbPath)
+	c.Assert(err, qt.IsNil)
+
+	// Store the artifacts as they were encoded before being versioned
+	pid := types.ProcessID{Address: common.Address{1}, Nonce: 1, ChainID: 1}
+	publicKey, privateKey, err := elgamal.GenerateKey(curves.New(curves.CurveTypeBN254))
+	c.Assert(err, qt.IsNil)
+	x, y := publicKey.Point()
+	legacyKeys, err := encodeArtifact(EncryptionKeys{X: x, Y: y, PrivateKey: privateKey})
+	c.Assert(err, qt.IsNil)
+	metadata := &types.Metadata{
+		Title:      types.MultilingualString{"default": "test"},
+		BallotMode: types.BallotMode{MaxCount: 3},
+	}
+	legacyMetadata, err := encodeArtifact(metadata)
+	c.Assert(err, qt.IsNil)
+
+	wTx := database.WriteTx()
+	c.Assert(prefixeddb.NewPrefixedWriteTx(wTx, encryptionKeyPrefix).Set(pid.Marshal(), legacyKeys), qt.IsNil)
+	c.Assert(prefixeddb.NewPrefixedWriteTx(wTx, metadataPrefix).Set(pid.Marshal(), legacyMetadata), qt.IsNil)
+	c.Assert(wTx.Commit(), qt.IsNil)
+
+	// Opening the storage migrates the records to the current version
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+
+	raw, err := prefixeddb.NewPrefixedReader(database, encryptionKeyPrefix).Get(pid.Marshal())
+	c.Assert(err, qt.IsNil)
+	c.Assert(raw[:2], qt.DeepEquals, []byte{versionMarker, encryptionKeysCodec.version})
+	c.Assert(bytes.Contains(raw, privateKey.Bytes()), qt.IsFalse)
+	raw, err = prefixeddb.NewPrefixedReader(database, metadataPrefix).Get(pid.Marshal())
+	c.Assert(err, qt.IsNil)
+	c.Assert(raw[:2], qt.DeepEquals, []byte{versionMarker, metadataCodec.version})
+
+	pub, priv, err := st.EncryptionKeys(pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pub.Equal(publicKey), qt.IsTrue)
+	c.Assert(priv.Cmp(privateKey), qt.Equals, 0)
+
+	md, err := st.Metadata(pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(md.Title, qt.DeepEquals, metadata.Title)
+	c.Assert(md.BallotMode.MaxCount, qt.Equals, metadata.BallotMode.MaxCount)
+
+	// Records of an unknown version are rejected
+	futureKey := types.ProcessID{Address: common.Address{2}, Nonce: 1, ChainID: 1}
+	wTx = database.WriteTx()
+	c.Assert(prefixeddb.NewPrefixedWriteTx(wTx, metadataPrefix).Set(futureKey.Marshal(),
+		append([]byte{versionMarker, metadataCodec.version + 1}, legacyMetadata...)), qt.IsNil)
+	c.Assert(wTx.Commit(), qt.IsNil)
+	_, err = st.Metadata(futureKey)
+	c.Assert(err, qt.ErrorMatches, "unsupported metadata version.*")
+
+	// Missing artifacts return ErrNotFound
+	_, err = st.Metadata(types.ProcessID{Nonce: 99})
+	c.Assert(err, qt.ErrorIs, ErrNotFound)
+}
+
+func TestQueueOrder(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+
+	// The ballots are pulled in the order they were pushed, regardless of
+	// their key hash
+	const n = 20
+	pid := types.ProcessID{Nonce: 1}
+	for i := 0; i < n; i++ {
+		c.Assert(st.PushBallot(&Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{byte(i)}}), qt.IsNil)
+	}
+	var keys [][]byte
+	for i := 0; i < n/2; i++ {
+		b, k, err := st.NextBallot()
+		c.Assert(err, qt.IsNil)
+		c.Assert(b.Nullifier, qt.DeepEquals, types.HexBytes{byte(i)})
+		keys = append(keys, k)
+	}
+
+	// Released ballots go back to their original position
+	c.Assert(st.ReleaseStaleReservations(0), qt.IsNil)
+	for i := 0; i < n; i++ {
+		b, _, err := st.NextBallot()
+		c.Assert(err, qt.IsNil)
+		c.Assert(b.Nullifier, qt.DeepEquals, types.HexBytes{byte(i)})
+	}
+	_, _, err = st.NextBallot()
+	c.Assert(err, qt.Equals, ErrNoMoreElements)
+
+	// Marking done a ballot whose reservation was released does not push
+	// a verified ballot
+	c.Assert(st.ReleaseStaleReservations(0), qt.IsNil)
+	c.Assert(st.MarkBallotDone([]byte("unknown"), &VerifiedBallot{ProcessID: pid.Marshal()}), qt.IsNil)
+	c.Assert(st.CountVerifiedBallots(pid.Marshal()), qt.Equals, 0)
+
+	// Verified ballots are pulled in the order they were verified, and
+	// each process has its own queue
+	pids := []types.ProcessID{{Nonce: 1}, {Nonce: 2}}
+	for i := 0; i < n; i++ {
+		_, k, err := st.NextBallot()
+		c.Assert(err, qt.IsNil)
+		c.Assert(st.MarkBallotDone(k, &VerifiedBallot{
+			ProcessID: pids[i%2].Marshal(),
+			Nullifier: []byte{byte(i)},
+		}), qt.IsNil)
+	}
+	for p, pid := range pids {
+		vbs, vkeys, err := st.PullVerifiedBallots(pid.Marshal(), -1)
+		c.Assert(err, qt.IsNil)
+		c.Assert(vbs, qt.HasLen, n/2)
+		for i, vb := range vbs {
+			c.Assert(vb.Nullifier, qt.DeepEquals, types.HexBytes{byte(2*i + p)})
+			c.Assert(st.MarkVerifiedBallotDone(vkeys[i]), qt.IsNil)
+		}
+		c.Assert(st.CountVerifiedBallots(pid.Marshal()), qt.Equals, 0)
+	}
+}
+
+func TestQueueConcurrentWorkers(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+
+	const n, workers = 200, 8
+	pid := (&types.ProcessID{Nonce: 1}).Marshal()
+	for i := 0; i < n; i++ {
+		c.Assert(st.PushBallot(&Ballot{ProcessID: pid, Nullifier: []byte{byte(i), byte(i >> 8)}}), qt.IsNil)
+	}
+
+	// Every ballot is processed exactly once
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				b, k, err := st.NextBallot()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				seen[string(b.Nullifier)]++
+				mu.Unlock()
+				pid := types.ProcessID{Nonce: uint64(b.Nullifier[0] % 4)}
+				if err := st.MarkBallotDone(k, &VerifiedBallot{ProcessID: pid.Marshal(), Nullifier: b.Nullifier}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	c.Assert(seen, qt.HasLen, n)
+	for _, times := range seen {
+		c.Assert(times, qt.Equals, 1)
+	}
+	total := 0
+	for i := 0; i < 4; i++ {
+		total += st.CountVerifiedBallots((&types.ProcessID{Nonce: uint64(i)}).Marshal())
+	}
+	c.Assert(total, qt.Equals, n)
+}
+
+func TestBallotQueueLocks(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+
+	// The ballots of a process share its lock shard, and the ones of other
+	// processes do not wait for it
+	pids := []types.ProcessID{{Nonce: 1}, {Nonce: 2}}
+	c.Assert(lockShard(pids[0].Marshal()), qt.Not(qt.Equals), lockShard(pids[1].Marshal()))
+	keys := make([][]byte, len(pids))
+	for i, pid := range pids {
+		c.Assert(st.PushBallot(&Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{byte(i)}}), qt.IsNil)
+		_, keys[i], err = st.NextBallot()
+		c.Assert(err, qt.IsNil)
+		c.Assert(st.ballots.keyLock(keys[i]), qt.Equals, st.ballots.lock(pid.Marshal()))
+	}
+	mu := st.ballots.keyLock(keys[0])
+	mu.Lock()
+	done := make(chan error)
+	go func() {
+		done <- st.MarkBallotDone(keys[1], &VerifiedBallot{ProcessID: pids[1].Marshal(), Nullifier: []byte{1}})
+	}()
+	select {
+	case err := <-done:
+		c.Assert(err, qt.IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("the ballots of another process are blocked")
+	}
+	mu.Unlock()
+	c.Assert(st.CountVerifiedBallots(pids[1].Marshal()), qt.Equals, 1)
+}
+
+func TestCompleteForWorker(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+
+	pid := (&types.ProcessID{Nonce: 1}).Marshal()
+	for i := 0; i < 3; i++ {
+		c.Assert(st.PushBallot(&Ballot{
+			ProcessID:   pid,
+			Nullifier:   []byte{byte(i)},
+			Commitment:  []byte{byte(i)},
+			VoterWeight: big.NewInt(1),
+		}), qt.IsNil)
+	}
+
+	// The verified ballot must be of the ballot leased by the worker, and
+	// only its proof is taken from it
+	b, k, err := st.NextBallotForWorker("verifier")
+	c.Assert(err, qt.IsNil)
+	vb := &VerifiedBallot{
+		ProcessID:   pid,
+		Nullifier:   b.Nullifier,
+		Commitment:  []byte("forged"),
+		VoterWeight: big.NewInt(1000),
+		Address:     []byte("forged"),
+	}
+	c.Assert(st.MarkBallotDoneForWorker(k, "other", vb), qt.ErrorIs, ErrNotReservationOwner)
+	c.Assert(st.MarkBallotDoneForWorker(k, "verifier", &VerifiedBallot{ProcessID: pid, Nullifier: []byte{9}}),
+		qt.ErrorIs, ErrResultMismatch)
+	c.Assert(st.MarkBallotDoneForWorker(k, "verifier", vb), qt.IsNil)
+	c.Assert(st.MarkBallotDoneForWorker(k, "verifier", vb), qt.ErrorIs, ErrNotFound)
+	for i := 1; i < 3; i++ {
+		b, k, err := st.NextBallot()
+		c.Assert(err, qt.IsNil)
+		c.Assert(st.MarkBallotDone(k, &VerifiedBallot{ProcessID: pid, Nullifier: b.Nullifier}), qt.IsNil)
+	}
+
+	// The aggregated batch must have the nullifiers of the verified ballots
+	// leased by the worker, in the same order
+	vbs, keys, err := st.PullVerifiedBallotsForWorker(pid, 3, "aggregator")
+	c.Assert(err, qt.IsNil)
+	c.Assert(vbs, qt.HasLen, 3)
+	c.Assert(vbs[0].Commitment, qt.DeepEquals, b.Commitment)
+	c.Assert(vbs[0].VoterWeight.Int64(), qt.Equals, int64(1))
+	c.Assert(vbs[0].Address, qt.HasLen, 0)
+	batch := func(pid []byte, vbs ...*VerifiedBallot) *AggregatedBallotBatch {
+		abb := &AggregatedBallotBatch{ProcessID: pid}
+		for _, vb := range vbs {
+			abb.Ballots = append(abb.Ballots, AggregatedBallot{Nullifier: vb.Nullifier, Commitment: []byte("forged")})
+		}
+		return abb
+	}
+	c.Assert(st.MarkVerifiedBallotsDoneForWorker(keys, "other", batch(pid, vbs...)), qt.ErrorIs, ErrNotReservationOwner)
+	c.Assert(st.MarkVerifiedBallotsDoneForWorker(keys, "aggregator", batch((&types.ProcessID{Nonce: 2}).Marshal(), vbs...)), qt.ErrorIs, ErrResultMismatch)
+	c.Assert(st.MarkVerifiedBallotsDoneForWorker(keys, "aggregator", batch(pid, vbs[:2]...)), qt.ErrorIs, ErrResultMismatch)
+	c.Assert(st.MarkVerifiedBallotsDoneForWorker(keys, "aggregator", batch(pid, vbs[1], vbs[0], vbs[2])), qt.ErrorIs, ErrResultMismatch)
+	_, _, err = st.NextBallotBatch(pid)
+	c.Assert(err, qt.ErrorIs, ErrNoMoreElements)
+	c.Assert(st.CountVerifiedBallots(pid), qt.Equals, 3)
+
+	// The batch is pushed and the verified ballots are removed together, and
+	// the ballots of the batch are the verified ballots
+	c.Assert(st.MarkVerifiedBallotsDoneForWorker(keys, "aggregator", batch(pid, vbs...)), qt.IsNil)
+	c.Assert(st.CountVerifiedBallots(pid), qt.Equals, 0)
+	abb, bk, err := st.NextBallotBatchForWorker(pid, "sequencer")
+	c.Assert(err, qt.IsNil)
+	c.Assert(abb.Ballots, qt.HasLen, 3)
+	for i, ab := range abb.Ballots {
+		c.Assert(ab.Nullifier, qt.DeepEquals, vbs[i].Nullifier)
+		c.Assert(ab.Commitment, qt.DeepEquals, vbs[i].Commitment)
+	}
+	c.Assert(st.MarkVerifiedBallotsDoneForWorker(keys, "aggregator", batch(pid, vbs...)), qt.ErrorIs, ErrNotFound)
+
+	c.Assert(st.MarkBallotBatchDoneForWorker(bk, "aggregator"), qt.ErrorIs, ErrNotReservationOwner)
+	c.Assert(st.MarkFailedForWorker(StageBallotBatch, bk, "aggregator", errors.New("failed")), qt.ErrorIs, ErrNotReservationOwner)
+	c.Assert(st.MarkFailedForWorker("unknown", bk, "sequencer", errors.New("failed")), qt.ErrorIs, ErrUnknownStage)
+	c.Assert(st.MarkBallotBatchDoneForWorker(bk, "sequencer"), qt.IsNil)
+	c.Assert(st.MarkBallotBatchDoneForWorker(bk, "sequencer"), qt.ErrorIs, ErrNotFound)
+}
+
+func TestNullifierOverwrites(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+
+	pid := types.ProcessID{Nonce: 1}
+	nullifier := []byte{1}
+	ballot := func(weight int64) *Ballot {
+		return &Ballot{ProcessID: pid.Marshal(), Nullifier: nullifier, VoterWeight: big.NewInt(weight)}
+	}
+	_, err = st.NullifierOverwrites(pid, nullifier)
+	c.Assert(err, qt.ErrorIs, ErrNotFound)
+
+	// A pending ballot is superseded by the newer one
+	c.Assert(st.PushBallot(ballot(1)), qt.IsNil)
+	c.Assert(st.PushBallot(ballot(2)), qt.IsNil)
+	c.Assert(st.ballots.count(st, nil), qt.Equals, 1)
+	overwrites, err := st.NullifierOverwrites(pid, nullifier)
+	c.Assert(err, qt.IsNil)
+	c.Assert(overwrites, qt.Equals, uint32(1))
+
+	// A verified ballot is superseded too
+	b, k, err := st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(b.VoterWeight.Int64(), qt.Equals, int64(2))
+	c.Assert(st.MarkBallotDone(k, &VerifiedBallot{ProcessID: pid.Marshal(), Nullifier: nullifier}), qt.IsNil)
+	c.Assert(st.CountVerifiedBallots(pid.Marshal()), qt.Equals, 1)
+	c.Assert(st.PushBallot(ballot(3)), qt.IsNil)
+	c.Assert(st.CountVerifiedBallots(pid.Marshal()), qt.Equals, 0)
+	c.Assert(st.ballots.count(st, nil), qt.Equals, 1)
+
+	// A reserved ballot is dropped when the worker is done with it
+	_, k, err = st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.PushBallot(ballot(4)), qt.IsNil)
+	c.Assert(st.MarkBallotDone(k, &VerifiedBallot{ProcessID: pid.Marshal(), Nullifier: nullifier}), qt.IsNil)
+	c.Assert(st.CountVerifiedBallots(pid.Marshal()), qt.Equals, 0)
+	b, k, err = st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(b.VoterWeight.Int64(), qt.Equals, int64(4))
+	c.Assert(st.MarkBallotDone(k, &VerifiedBallot{ProcessID: pid.Marshal(), Nullifier: nullifier}), qt.IsNil)
+	overwrites, err = st.NullifierOverwrites(pid, nullifier)
+	c.Assert(err, qt.IsNil)
+	c.Assert(overwrites, qt.Equals, uint32(3))
+
+	// The queued ballots are kept if the policy rejects the overwrites
+	c.Assert(st.SetOverwritePolicy(pid, OverwritePolicy{RejectQueued: true, MaxOverwrites: 4}), qt.IsNil)
+	c.Assert(st.PushBallot(ballot(5)), qt.ErrorIs, ErrNullifierQueued)
+	c.Assert(st.CountVerifiedBallots(pid.Marshal()), qt.Equals, 1)
+
+	// Once aggregated, the nullifier can be overwritten up to the limit
+	_, keys, err := st.PullVerifiedBallots(pid.Marshal(), 1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.MarkVerifiedBallotDone(keys[0]), qt.IsNil)
+	c.Assert(st.PushBallot(ballot(5)), qt.IsNil)
+	_, k, err = st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.MarkBallotDone(k, &VerifiedBallot{ProcessID: pid.Marshal(), Nullifier: nullifier}), qt.IsNil)
+	_, keys, err = st.PullVerifiedBallots(pid.Marshal(), 1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.MarkVerifiedBallotDone(keys[0]), qt.IsNil)
+	c.Assert(st.PushBallot(ballot(6)), qt.ErrorIs, ErrTooManyOverwrites)
+
+	// Other processes keep the default policy
+	other := types.ProcessID{Nonce: 2}
+	c.Assert(st.PushBallot(&Ballot{ProcessID: other.Marshal(), Nullifier: nullifier}), qt.IsNil)
+	c.Assert(st.PushBallot(&Ballot{ProcessID: other.Marshal(), Nullifier: nullifier, VoterWeight: big.NewInt(1)}), qt.IsNil)
+	policy, err := st.OverwritePolicy(other)
+	c.Assert(err, qt.IsNil)
+	c.Assert(policy, qt.Equals, OverwritePolicy{})
+
+	// The default policy applies to the processes without their own
+	st.SetDefaultOverwritePolicy(OverwritePolicy{RejectQueued: true})
+	c.Assert(st.PushBallot(&Ballot{ProcessID: other.Marshal(), Nullifier: nullifier}), qt.ErrorIs, ErrNullifierQueued)
+	policy, err = st.OverwritePolicy(pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(policy, qt.Equals, OverwritePolicy{RejectQueued: true, MaxOverwrites: 4})
+
+	// The ballots without nullifier are rejected, they would share the
+	// nullifier record of the process
+	c.Assert(st.PushBallot(&Ballot{ProcessID: other.Marshal()}), qt.ErrorIs, ErrMissingNullifier)
+}
+
+func TestNullifierConcurrentResubmissions(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+
+	pid := types.ProcessID{Nonce: 1}
+	const voters, resubmissions, workers = 10, 20, 4
+
+	// Workers verify and aggregate the ballots while the voters resubmit them
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if b, k, err := st.NextBallot(); err == nil {
+					vb := &VerifiedBallot{ProcessID: b.ProcessID, Nullifier: b.Nullifier, VoterWeight: b.VoterWeight}
+					if err := st.MarkBallotDone(k, vb); err != nil {
+						t.Error(err)
+					}
+				}
+				if _, keys, err := st.PullVerifiedBallots(pid.Marshal(), 1); err == nil {
+					if err := st.MarkVerifiedBallotDone(keys[0]); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}()
+	}
+	var voterWg sync.WaitGroup
+	for v := 0; v < voters; v++ {
+		voterWg.Add(1)
+		go func() {
+			defer voterWg.Done()
+			for i := 0; i < resubmissions; i++ {
+				b := &Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{byte(v)}, VoterWeight: big.NewInt(int64(i))}
+				if err := st.PushBallot(b); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	voterWg.Wait()
+	cancel()
+	wg.Wait()
+
+	// Every nullifier has been overwritten by every resubmission, and at
+	// most one ballot per nullifier is queued, which is the last one
+	queued := make(map[string]int)
+	for {
+		vbs, keys, err := st.PullVerifiedBallots(pid.Marshal(), 1)
+		if errors.Is(err, ErrNotFound) {
+			break
+		}
+		c.Assert(err, qt.IsNil)
+		c.Assert(vbs[0].VoterWeight.Int64(), qt.Equals, int64(resubmissions-1))
+		queued[string(vbs[0].Nullifier)]++
+		c.Assert(st.MarkVerifiedBallotDone(keys[0]), qt.IsNil)
+	}
+	for {
+		b, _, err := st.NextBallot()
+		if errors.Is(err, ErrNoMoreElements) {
+			break
+		}
+		c.Assert(err, qt.IsNil)
+		c.Assert(b.VoterWeight.Int64(), qt.Equals, int64(resubmissions-1))
+		queued[string(b.Nullifier)]++
+	}
+	for nullifier, n := range queued {
+		c.Assert(n, qt.Equals, 1, qt.Commentf("nullifier %x queued %d times", nullifier, n))
+	}
+	for v := 0; v < voters; v++ {
+		overwrites, err := st.NullifierOverwrites(pid, []byte{byte(v)})
+		c.Assert(err, qt.IsNil)
+		c.Assert(overwrites, qt.Equals, uint32(resubmissions-1))
+	}
+}
+
+func TestPendingBallotsQuota(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+
+	pid := types.ProcessID{Nonce: 1}
+	const quota, voters = 4, 20
+	st.SetPendingBallotsQuota(quota)
+	c.Assert(st.PendingBallotsQuota(), qt.Equals, quota)
+
+	// The concurrent pushes cannot exceed the quota
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var accepted [][]byte
+	for v := 0; v < voters; v++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := st.PushBallot(&Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{byte(v)}, VoterWeight: big.NewInt(1)})
+			if err == nil {
+				mu.Lock()
+				accepted = append(accepted, []byte{byte(v)})
+				mu.Unlock()
+				return
+			}
+			if !errors.Is(err, ErrPendingQuotaExceeded) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	c.Assert(accepted, qt.HasLen, quota)
+	c.Assert(st.PendingBallots(pid.Marshal()), qt.Equals, quota)
+
+	// A ballot that supersedes a pending one is accepted at the quota
+	c.Assert(st.PushBallot(&Ballot{ProcessID: pid.Marshal(), Nullifier: accepted[0], VoterWeight: big.NewInt(2)}), qt.IsNil)
+	c.Assert(st.PendingBallots(pid.Marshal()), qt.Equals, quota)
+
+	// the other processes have their own quota
+	other := types.ProcessID{Nonce: 2}
+	c.Assert(st.PushBallot(&Ballot{ProcessID: other.Marshal(), Nullifier: []byte{0}, VoterWeight: big.NewInt(1)}), qt.IsNil)
+
+	// and it is unlimited without quota
+	st.SetPendingBallotsQuota(0)
+	c.Assert(st.PushBallot(&Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{voters}, VoterWeight: big.NewInt(1)}), qt.IsNil)
+}
+
+func TestDeadLetters(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+
+	const backoff = 100 * time.Millisecond
+	st.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, Backoff: backoff})
+	pid := types.ProcessID{Nonce: 1}
+	c.Assert(st.PushBallot(&Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{1}}), qt.IsNil)
+
+	// A failed ballot is retried after the backoff
+	_, k, err := st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.MarkBallotFailed(k, fmt.Errorf("prover crashed")), qt.IsNil)
+	_, _, err = st.NextBallot()
+	c.Assert(err, qt.ErrorIs, ErrNoMoreElements)
+	time.Sleep(backoff)
+	_, retried, err := st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(retried, qt.DeepEquals, k)
+
+	// Once it fails all its attempts, it is moved to the dead letters
+	c.Assert(st.MarkBallotFailed(k, fmt.Errorf("prover crashed again")), qt.IsNil)
+	c.Assert(st.ballots.count(st, nil), qt.Equals, 0)
+	dls, err := st.DeadLetters()
+	c.Assert(err, qt.IsNil)
+	c.Assert(dls, qt.HasLen, 1)
+	c.Assert(dls[0].Stage, qt.Equals, "ballot")
+	c.Assert(dls[0].Attempts, qt.Equals, 2)
+	c.Assert(dls[0].Error, qt.Equals, "prover crashed again")
+	c.Assert([]byte(dls[0].Key), qt.DeepEquals, k)
+	dl, err := st.DeadLetter(dls[0].ID)
+	c.Assert(err, qt.IsNil)
+	c.Assert(dl.Artifact, qt.DeepEquals, dls[0].Artifact)
+
+	// A requeued dead letter is processed again from scratch
+	c.Assert(st.RequeueDeadLetter(dl.ID), qt.IsNil)
+	_, err = st.DeadLetter(dl.ID)
+	c.Assert(err, qt.ErrorIs, ErrNotFound)
+	b, k, err := st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(b.Nullifier, qt.DeepEquals, types.HexBytes{1})
+	c.Assert(st.MarkBallotDone(k, &VerifiedBallot{ProcessID: pid.Marshal(), Nullifier: b.Nullifier}), qt.IsNil)
+	c.Assert(st.CountVerifiedBallots(pid.Marshal()), qt.Equals, 1)
+
+	// A verified ballot that cannot be decoded is not skipped forever
+	wTx := st.writeTx()
+	_, err = st.verifiedBallots.push(wTx, pid.Marshal(), []byte("broken"), []byte{1, 2, 3})
+	c.Assert(err, qt.IsNil)
+	c.Assert(wTx.Commit(), qt.IsNil)
+	vbs, _, err := st.PullVerifiedBallots(pid.Marshal(), 10)
+	c.Assert(err, qt.IsNil)
+	c.Assert(vbs, qt.HasLen, 1)
+	c.Assert(st.CountVerifiedBallots(pid.Marshal()), qt.Equals, 1)
+	dls, err = st.DeadLetters()
+	c.Assert(err, qt.IsNil)
+	c.Assert(dls, qt.HasLen, 1)
+	c.Assert(dls[0].Stage, qt.Equals, "verified ballot")
+	c.Assert(dls[0].Attempts, qt.Equals, 1)
+
+	// It cannot be requeued twice, and it can be purged
+	c.Assert(st.RequeueDeadLetter(dls[0].ID), qt.IsNil)
+	_, _, err = st.PullVerifiedBallots(pid.Marshal(), 10)
+	c.Assert(err, qt.ErrorIs, ErrNotFound)
+	dls, err = st.DeadLetters()
+	c.Assert(err, qt.IsNil)
+	c.Assert(dls, qt.HasLen, 1)
+	c.Assert(st.PurgeDeadLetter(dls[0].ID), qt.IsNil)
+	c.Assert(st.PurgeDeadLetter(dls[0].ID), qt.ErrorIs, ErrNotFound)
+	c.Assert(st.RequeueDeadLetter(dls[0].ID), qt.ErrorIs, ErrNotFound)
+	dls, err = st.DeadLetters()
+	c.Assert(err, qt.IsNil)
+	c.Assert(dls, qt.HasLen, 0)
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	c := qt.New(t)
+	p := RetryPolicy{MaxAttempts: 10, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for i, want := range []time.Duration{1, 2, 4, 5, 5} {
+		c.Assert(p.delay(i+1), qt.Equals, want*time.Second)
+	}
+}
+
+func TestReaper(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+
+	const maxAge = 200 * time.Millisecond
+	c.Assert(st.StartReaper(ReaperConfig{Interval: 20 * time.Millisecond, BallotMaxAge: maxAge}), qt.IsNil)
+	c.Assert(st.StartReaper(ReaperConfig{}), qt.ErrorIs, ErrReaperRunning)
+
+	pid := (&types.ProcessID{Nonce: 1}).Marshal()
+	for i := 0; i < 2; i++ {
+		c.Assert(st.PushBallot(&Ballot{ProcessID: pid, Nullifier: []byte{byte(i)}}), qt.IsNil)
+	}
+	_, alive, err := st.NextBallotForWorker("alive")
+	c.Assert(err, qt.IsNil)
+	_, hung, err := st.NextBallotForWorker("hung")
+	c.Assert(err, qt.IsNil)
+
+	// The reservations record the worker holding them
+	data, err := prefixeddb.NewPrefixedReader(database, ballotReservationPrefix).Get(hung)
+	c.Assert(err, qt.IsNil)
+	r, err := decodeReservation(data)
+	c.Assert(err, qt.IsNil)
+	c.Assert(r.WorkerID, qt.Equals, "hung")
+
+	// Only the owner can extend a reservation
+	c.Assert(st.ExtendBallotReservation(alive, "hung"), qt.ErrorIs, ErrNotReservationOwner)
+	c.Assert(st.ExtendBallotReservation([]byte("unknown"), "alive"), qt.ErrorIs, ErrNotFound)
+
+	// The hung worker reservation is reclaimed, while the alive worker keeps
+	// its reservation sending heartbeats
+	deadline := time.Now().Add(5 * time.Second)
+	for st.ReclaimedReservations()[StageBallot] == 0 {
+		c.Assert(time.Now().Before(deadline), qt.IsTrue, qt.Commentf("stale reservation not reclaimed"))
+		c.Assert(st.ExtendBallotReservation(alive, "alive"), qt.IsNil)
+		time.Sleep(maxAge / 4)
+	}
+	for i := 0; i < 4; i++ {
+		c.Assert(st.ExtendBallotReservation(alive, "alive"), qt.IsNil)
+		time.Sleep(maxAge / 4)
+	}
+	c.Assert(st.ReclaimedReservations()[StageBallot], qt.Equals, uint64(1))
+	_, k, err := st.NextBallotForWorker("other")
+	c.Assert(err, qt.IsNil)
+	c.Assert(k, qt.DeepEquals, hung)
+	_, _, err = st.NextBallot()
+	c.Assert(err, qt.ErrorIs, ErrNoMoreElements)
+
+	// The reaper is stopped by Close
+	st.StopReaper()
+	c.Assert(st.StartReaper(ReaperConfig{Interval: time.Hour}), qt.IsNil)
+}
+
+func TestReservationRecords(t *testing.T) {
+	c := qt.New(t)
+
+	// The records without version have the timestamp in seconds
+	legacy, err := encodeArtifact(&struct {
+		Timestamp int64
+		Seq       uint64
+	}{Timestamp: 1700000000, Seq: 3})
+	c.Assert(err, qt.IsNil)
+	r, err := decodeReservation(legacy)
+	c.Assert(err, qt.IsNil)
+	c.Assert(r.Timestamp, qt.Equals, time.Unix(1700000000, 0).UnixNano())
+	c.Assert(r.Seq, qt.Equals, uint64(3))
+	c.Assert(r.Version, qt.Equals, uint8(reservationVersion))
+
+	data, err := encodeReservation(&reservationRecord{Timestamp: 42, WorkerID: "w"})
+	c.Assert(err, qt.IsNil)
+	r, err = decodeReservation(data)
+	c.Assert(err, qt.IsNil)
+	c.Assert(r.Timestamp, qt.Equals, int64(42))
+
+	// The counters of reclaimed reservations are kept across restarts, and
+	// the reservations released on recovery are not counted
+	dbPath := filepath.Join(t.TempDir(), "db")
+	database, err := metadb.New(db.TypePebble, dbPath)
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	pid := (&types.ProcessID{Nonce: 1}).Marshal()
+	for i := 0; i < 3; i++ {
+		c.Assert(st.PushBallot(&Ballot{ProcessID: pid, Nullifier: []byte{byte(i)}}), qt.IsNil)
+	}
+	for i := 0; i < 3; i++ {
+		_, _, err := st.NextBallot()
+		c.Assert(err, qt.IsNil)
+	}
+	c.Assert(st.ReleaseStaleReservations(time.Nanosecond), qt.IsNil)
+	c.Assert(st.ReclaimedReservations()[StageBallot], qt.Equals, uint64(3))
+	_, _, err = st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	st.Close()
+
+	database, err = metadb.New(db.TypePebble, dbPath)
+	c.Assert(err, qt.IsNil)
+	st, err = New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	c.Assert(st.ReclaimedReservations()[StageBallot], qt.Equals, uint64(3))
+	c.Assert(st.ReclaimedReservations()[StageVerifiedBallot], qt.Equals, uint64(0))
+}
+
+// BenchmarkNextBallot measures the time to dequeue a ballot with different
+// numbers of pending ballots, which should not depend on the queue length.
+func BenchmarkNextBallot(b *testing.B) {
+	for _, pending := range []int{1_000, 100_000, 1_000_000} {
+		b.Run(fmt.Sprintf("pending=%d", pending), func(b *testing.B) {
+			c := qt.New(b)
+			database, err := metadb.New(db.TypePebble, filepath.Join(b.TempDir(), "db"))
+			c.Assert(err, qt.IsNil)
+			st, err := New(database, testMasterKey)
+			c.Assert(err, qt.IsNil)
+			defer st.Close()
+
+			val, err := encodeArtifact(&Ballot{ProcessID: bytes.Repeat([]byte{1}, processIDLen)})
+			c.Assert(err, qt.IsNil)
+			// push the ballots in batches, since one transaction per ballot
+			// would make the setup too slow
+			const batchSize = 10_000
+			for i := 0; i < pending+b.N; i += batchSize {
+				wTx := st.writeTx()
+				for j := i; j < min(i+batchSize, pending+b.N); j++ {
+					_, err := st.ballots.push(wTx, nil, binary.BigEndian.AppendUint64(nil, uint64(j)), val)
+					c.Assert(err, qt.IsNil)
+				}
+				c.Assert(wTx.Commit(), qt.IsNil)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := st.NextBallot(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestQueueStats(t *testing.T) {
+	c := qt.New(t)
+	dbPath := filepath.Join(t.TempDir(), "db")
+	database, err := metadb.New(db.TypePebble, dbPath)
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	st.SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+
+	pid1, pid2 := types.ProcessID{Nonce: 1}, types.ProcessID{Nonce: 2}
+	for i := 0; i < 3; i++ {
+		c.Assert(st.PushBallot(&Ballot{ProcessID: pid1.Marshal(), Nullifier: []byte{byte(i)}}), qt.IsNil)
+	}
+	c.Assert(st.PushBallot(&Ballot{ProcessID: pid2.Marshal(), Nullifier: []byte{1}}), qt.IsNil)
+	stats := st.QueueStats(pid1.Marshal())
+	c.Assert(stats.Pending, qt.Equals, 3)
+	c.Assert(stats.Reserved, qt.Equals, 0)
+	c.Assert(st.QueueStats(nil).Pending, qt.Equals, 4)
+	c.Assert(st.QueueStats(nil).Stages[StageBallot].OldestAge > 0, qt.IsTrue)
+	c.Assert(st.QueueProcesses(), qt.HasLen, 2)
+
+	// Verify one ballot and fail another one, which is moved to the dead
+	// letters
+	b, k, err := st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	stats = st.QueueStats(pid1.Marshal())
+	c.Assert(stats.Pending, qt.Equals, 2)
+	c.Assert(stats.Reserved, qt.Equals, 1)
+	c.Assert(st.MarkBallotDone(k, &VerifiedBallot{ProcessID: b.ProcessID, Nullifier: b.Nullifier}), qt.IsNil)
+	_, k, err = st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.MarkBallotFailed(k, fmt.Errorf("invalid proof")), qt.IsNil)
+	stats = st.QueueStats(pid1.Marshal())
+	c.Assert(stats.Pending, qt.Equals, 1)
+	c.Assert(stats.Reserved, qt.Equals, 0)
+	c.Assert(stats.Verified, qt.Equals, 1)
+	c.Assert(stats.Dead, qt.Equals, 1)
+	c.Assert(stats.Stages[StageBallot].Throughput["1m"] > 0, qt.IsTrue)
+	c.Assert(stats.Stages[StageVerifiedBallot].OldestAge > 0, qt.IsTrue)
+	c.Assert(st.CountVerifiedBallots(pid1.Marshal()), qt.Equals, 1)
+	c.Assert(st.QueueStats(pid2.Marshal()).Dead, qt.Equals, 0)
+
+	// The counters are rebuilt on restart
+	st.Close()
+	database, err = metadb.New(db.TypePebble, dbPath)
+	c.Assert(err, qt.IsNil)
+	st, err = New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	stats = st.QueueStats(pid1.Marshal())
+	c.Assert(stats.Pending, qt.Equals, 1)
+	c.Assert(stats.Verified, qt.Equals, 1)
+	c.Assert(stats.Dead, qt.Equals, 1)
+	c.Assert(st.QueueStats(nil).Pending, qt.Equals, 2)
+
+	// Requeuing and purging the dead letters update the counters
+	dls, err := st.DeadLetters()
+	c.Assert(err, qt.IsNil)
+	c.Assert(dls, qt.HasLen, 1)
+	c.Assert([]byte(dls[0].ProcessID), qt.DeepEquals, pid1.Marshal())
+	c.Assert(st.RequeueDeadLetter(dls[0].ID), qt.IsNil)
+	stats = st.QueueStats(pid1.Marshal())
+	c.Assert(stats.Pending, qt.Equals, 2)
+	c.Assert(stats.Dead, qt.Equals, 0)
+
+	// Aggregating the verified ballot empties the verified queue
+	_, keys, err := st.PullVerifiedBallots(pid1.Marshal(), 10)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.QueueStats(pid1.Marshal()).Reserved, qt.Equals, 1)
+	for _, k := range keys {
+		c.Assert(st.MarkVerifiedBallotDone(k), qt.IsNil)
+	}
+	stats = st.QueueStats(pid1.Marshal())
+	c.Assert(stats.Verified, qt.Equals, 0)
+	c.Assert(stats.Reserved, qt.Equals, 0)
+	c.Assert(stats.Stages[StageVerifiedBallot].Throughput["1m"] > 0, qt.IsTrue)
+
+	// The counters only change when the transactions are committed
+	pending := st.QueueStats(nil).Pending
+	wTx := st.writeTx()
+	_, err = st.ballots.push(wTx, pid1.Marshal(), []byte("discarded"), []byte{1})
+	c.Assert(err, qt.IsNil)
+	wTx.Discard()
+	c.Assert(st.QueueStats(nil).Pending, qt.Equals, pending)
+
+	// Reading the statistics of a process does not add it to the counters
+	pid3 := types.ProcessID{Nonce: 3}
+	c.Assert(st.QueueStats(pid3.Marshal()).Pending, qt.Equals, 0)
+	for _, q := range st.queues() {
+		_, ok := q.stats.processes[string(pid3.Marshal())]
+		c.Assert(ok, qt.IsFalse)
+	}
+}
+
+func TestProcessesAndMetadata(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+
+	// The metadata is stored under its hash
+	metadata := &types.Metadata{Title: types.MultilingualString{"default": "test"}}
+	hash, err := st.StoreMetadata(metadata)
+	c.Assert(err, qt.IsNil)
+	c.Assert(hash, qt.DeepEquals, types.HexBytes(MetadataHash(metadata)))
+	again, err := st.StoreMetadata(metadata)
+	c.Assert(err, qt.IsNil)
+	c.Assert(again, qt.DeepEquals, hash)
+	md, err := st.MetadataByHash(hash)
+	c.Assert(err, qt.IsNil)
+	c.Assert(md.Title, qt.DeepEquals, metadata.Title)
+
+	// The private key is not stored with the process
+	pid := types.ProcessID{Address: common.Address{1}, Nonce: 1, ChainID: 1}
+	publicKey, privateKey, err := elgamal.GenerateKey(curves.New(curves.CurveTypeBN254))
+	c.Assert(err, qt.IsNil)
+	x, y := publicKey.Point()
+	process := &Process{
+		CensusRoot:      []byte{1},
+		BallotMode:      types.BallotMode{MaxCount: 3},
+		MetadataHash:    hash,
+		EncryptionKey:   EncryptionKeys{X: x, Y: y, PrivateKey: privateKey},
+		OverwritePolicy: &OverwritePolicy{MaxOverwrites: 2},
+	}
+	c.Assert(st.SetProcess(pid, process), qt.IsNil)
+	c.Assert(process.EncryptionKey.PrivateKey, qt.Equals, privateKey)
+	p, err := st.Process(pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(p.MetadataHash, qt.DeepEquals, hash)
+	c.Assert(p.BallotMode.MaxCount, qt.Equals, uint8(3))
+	c.Assert(p.EncryptionKey.X.Cmp(x), qt.Equals, 0)
+	c.Assert(p.EncryptionKey.PrivateKey, qt.IsNil)
+	// and its overwrite policy is the policy of the process
+	c.Assert(p.OverwritePolicy, qt.DeepEquals, process.OverwritePolicy)
+	policy, err := st.OverwritePolicy(pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(policy, qt.Equals, OverwritePolicy{MaxOverwrites: 2})
+
+	c.Assert(st.SetProcess(pid, process), qt.ErrorIs, ErrKeyAlreadyExists)
+	_, err = st.Process(types.ProcessID{Nonce: 2})
+	c.Assert(err, qt.ErrorIs, ErrNotFound)
+
+	// The nonces of an organizer cannot be reused, on any chain
+	nonce, err := st.OrganizerNonce(pid.Address)
+	c.Assert(err, qt.IsNil)
+	c.Assert(nonce, qt.Equals, uint64(2))
+	nonce, err = st.OrganizerNonce(common.Address{2})
+	c.Assert(err, qt.IsNil)
+	c.Assert(nonce, qt.Equals, uint64(0))
+	for _, used := range []types.ProcessID{
+		{Address: pid.Address, Nonce: 0, ChainID: 1},
+		{Address: pid.Address, Nonce: 1, ChainID: 2},
+	} {
+		c.Assert(st.SetProcess(used, &Process{}), qt.ErrorIs, ErrNonceUsed)
+	}
+	c.Assert(st.SetProcess(types.ProcessID{Address: pid.Address, Nonce: 7, ChainID: 2}, &Process{}), qt.IsNil)
+	nonce, err = st.OrganizerNonce(pid.Address)
+	c.Assert(err, qt.IsNil)
+	c.Assert(nonce, qt.Equals, uint64(8))
+
+	// A nonce is used once by the concurrent requests, on any chain
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := st.SetProcess(types.ProcessID{Address: pid.Address, Nonce: 8, ChainID: uint32(i)}, &Process{})
+			if err != nil {
+				c.Check(err, qt.ErrorIs, ErrNonceUsed)
+				return
+			}
+			mu.Lock()
+			created++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	c.Assert(created, qt.Equals, 1)
+	nonce, err = st.OrganizerNonce(pid.Address)
+	c.Assert(err, qt.IsNil)
+	c.Assert(nonce, qt.Equals, uint64(9))
+
+	// A reserved process uses its nonce once, and is stored without checking
+	// it again
+	reserved := types.ProcessID{Address: pid.Address, Nonce: 9, ChainID: 1}
+	c.Assert(st.ReserveProcess(reserved), qt.IsNil)
+	c.Assert(st.ReserveProcess(reserved), qt.ErrorIs, ErrNonceUsed)
+	c.Assert(st.SetProcess(types.ProcessID{Address: pid.Address, Nonce: 9, ChainID: 2}, &Process{}), qt.ErrorIs, ErrNonceUsed)
+	c.Assert(st.SetProcess(reserved, &Process{}), qt.IsNil)
+	c.Assert(st.SetProcess(reserved, &Process{}), qt.ErrorIs, ErrKeyAlreadyExists)
+	c.Assert(st.ReserveProcess(reserved), qt.ErrorIs, ErrKeyAlreadyExists)
+	nonce, err = st.OrganizerNonce(pid.Address)
+	c.Assert(err, qt.IsNil)
+	c.Assert(nonce, qt.Equals, uint64(10))
+}
+
+func TestResults(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+
+	pid := types.ProcessID{Nonce: 1}
+	publicKey, _, err := elgamal.GenerateKey(state.Curve)
+	c.Assert(err, qt.IsNil)
+	encrypt := func(v int64) *elgamal.Ciphertext {
+		ct, err := elgamal.NewCiphertext(state.Curve).Encrypt(big.NewInt(v), publicKey, nil)
+		c.Assert(err, qt.IsNil)
+		return ct
+	}
+	sum := func(cts ...*elgamal.Ciphertext) []byte {
+		total := elgamal.NewCiphertext(state.Curve)
+		for _, ct := range cts {
+			total.Add(total, ct)
+		}
+		return total.Serialize()
+	}
+	complete := func(ballots ...AggregatedBallot) []byte {
+		c.Assert(st.PushBallotBatch(&AggregatedBallotBatch{ProcessID: pid.Marshal(), Ballots: ballots}), qt.IsNil)
+		_, k, err := st.NextBallotBatch(pid.Marshal())
+		c.Assert(err, qt.IsNil)
+		c.Assert(st.MarkBallotBatchDone(k), qt.IsNil)
+		return k
+	}
+
+	// The results are empty until a batch is processed
+	results, err := st.Results(pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(results.ResultsAdd.Serialize(), qt.DeepEquals, sum())
+	c.Assert(results.Ballots, qt.Equals, uint64(0))
+
+	// The ballots of the batches processed are added, and the ones
+	// overwritten are subtracted
+	first, second, overwrite := encrypt(3), encrypt(5), encrypt(7)
+	complete(AggregatedBallot{Nullifier: []byte{1}, EncryptedBallot: *first},
+		AggregatedBallot{Nullifier: []byte{2}, EncryptedBallot: *second},
+		AggregatedBallot{Nullifier: []byte{3}})
+	k := complete(AggregatedBallot{Nullifier: []byte{1}, EncryptedBallot: *overwrite})
+	// the batches are counted once
+	c.Assert(st.MarkBallotBatchDone(k), qt.IsNil)
+	results, err = st.Results(pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(results.ResultsAdd.Serialize(), qt.DeepEquals, sum(first, second, overwrite))
+	c.Assert(results.ResultsSub.Serialize(), qt.DeepEquals, sum(first))
+	c.Assert(results.Ballots, qt.Equals, uint64(3))
+	c.Assert(results.Overwrites, qt.Equals, uint64(1))
+
+	// The status of the ballots follows their stage
+	_, err = st.BallotStatus(pid.Marshal(), []byte{5})
+	c.Assert(err, qt.ErrorIs, ErrNotFound)
+	c.Assert(st.PushBallot(&Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{5}, VoterWeight: big.NewInt(1)}), qt.IsNil)
+	status, err := st.BallotStatus(pid.Marshal(), []byte{5})
+	c.Assert(err, qt.IsNil)
+	c.Assert(status, qt.Equals, BallotStatusPending)
+	b, bk, err := st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.MarkBallotDone(bk, &VerifiedBallot{ProcessID: b.ProcessID, Nullifier: b.Nullifier}), qt.IsNil)
+	status, err = st.BallotStatus(pid.Marshal(), []byte{5})
+	c.Assert(err, qt.IsNil)
+	c.Assert(status, qt.Equals, BallotStatusVerified)
+	_, keys, err := st.PullVerifiedBallots(pid.Marshal(), 1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.MarkVerifiedBallotDone(keys[0]), qt.IsNil)
+	status, err = st.BallotStatus(pid.Marshal(), []byte{5})
+	c.Assert(err, qt.IsNil)
+	c.Assert(status, qt.Equals, BallotStatusAggregated)
+}
+
+func TestListProcesses(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+
+	// 6 processes of 2 organizers and 3 chains, one per minute
+	start := time.Unix(1700000000, 0)
+	pids := []types.ProcessID{}
+	for i := range 6 {
+		pid := types.ProcessID{Address: common.Address{byte(i % 2)}, ChainID: uint32(i % 3), Nonce: uint64(i)}
+		c.Assert(st.SetProcess(pid, &Process{
+			EncryptionKey: EncryptionKeys{X: big.NewInt(1), Y: big.NewInt(2)},
+			CreatedAt:     start.Add(time.Duration(i) * time.Minute),
+		}), qt.IsNil)
+		pids = append(pids, pid)
+	}
+	c.Assert(st.SetProcessStatus(pids[1], ProcessStatusEnded), qt.IsNil)
+	c.Assert(st.SetProcessStatus(pids[4], ProcessStatusCanceled), qt.IsNil)
+	c.Assert(st.SetProcessStatus(pids[4], "paused"), qt.Not(qt.IsNil))
+	c.Assert(st.SetProcessStatus(types.ProcessID{Nonce: 9}, ProcessStatusEnded), qt.ErrorIs, ErrNotFound)
+
+	list := func(filter *ProcessFilter, cursor []byte, limit int) ([]uint64, []byte) {
+		entries, next, err := st.ListProcesses(filter, cursor, limit)
+		c.Assert(err, qt.IsNil)
+		nonces := []uint64{}
+		for _, e := range entries {
+			nonces = append(nonces, e.ID.Nonce)
+		}
+		return nonces, next
+	}
+	organizer := common.Address{1}
+	chainID := uint32(0)
+	for _, tc := range []struct {
+		name   string
+		filter ProcessFilter
+		want   []uint64
+	}{
+		{"all", ProcessFilter{}, []uint64{0, 1, 2, 3, 4, 5}},
+		{"organizer", ProcessFilter{Organizer: &organizer}, []uint64{1, 3, 5}},
+		{"chain", ProcessFilter{ChainID: &chainID}, []uint64{0, 3}},
+		{"status", ProcessFilter{Status: ProcessStatusReady}, []uint64{0, 2, 3, 5}},
+		{"organizer and status", ProcessFilter{Organizer: &organizer, Status: ProcessStatusReady}, []uint64{3, 5}},
+		{"time range", ProcessFilter{CreatedFrom: start.Add(time.Minute), CreatedTo: start.Add(3 * time.Minute)}, []uint64{1, 2, 3}},
+		{"empty", ProcessFilter{Status: ProcessStatusEnded, ChainID: &chainID}, []uint64{}},
+	} {
+		got, next := list(&tc.filter, nil, 10)
+		c.Assert(got, qt.DeepEquals, tc.want, qt.Commentf("filter %s", tc.name))
+		c.Assert(next, qt.IsNil, qt.Commentf("filter %s", tc.name))
+	}
+
+	// The pages continue from the cursor of the previous one
+	got, next := list(&ProcessFilter{}, nil, 4)
+	c.Assert(got, qt.DeepEquals, []uint64{0, 1, 2, 3})
+	c.Assert(next, qt.HasLen, ProcessCursorSize)
+	got, next = list(&ProcessFilter{}, next, 4)
+	c.Assert(got, qt.DeepEquals, []uint64{4, 5})
+	c.Assert(next, qt.IsNil)
+	got, next = list(&ProcessFilter{Status: ProcessStatusReady}, nil, 2)
+	c.Assert(got, qt.DeepEquals, []uint64{0, 2})
+	got, next = list(&ProcessFilter{Status: ProcessStatusReady}, next, 2)
+	c.Assert(got, qt.DeepEquals, []uint64{3, 5})
+	c.Assert(next, qt.IsNil)
+
+	// A cursor before the creation time filter starts from the filter, and
+	// the processes created at the same time are paged by their ID
+	got, cursor := list(&ProcessFilter{}, nil, 1)
+	c.Assert(got, qt.DeepEquals, []uint64{0})
+	got, _ = list(&ProcessFilter{CreatedFrom: start.Add(3 * time.Minute)}, cursor, 10)
+	c.Assert(got, qt.DeepEquals, []uint64{3, 4, 5})
+	for i := 6; i < 9; i++ {
+		pid := types.ProcessID{Address: common.Address{2}, Nonce: uint64(i)}
+		c.Assert(st.SetProcess(pid, &Process{
+			EncryptionKey: EncryptionKeys{X: big.NewInt(1), Y: big.NewInt(2)},
+			CreatedAt:     start.Add(10 * time.Minute),
+		}), qt.IsNil)
+	}
+	got, next = list(&ProcessFilter{CreatedFrom: start.Add(5 * time.Minute)}, nil, 2)
+	c.Assert(got, qt.DeepEquals, []uint64{5, 6})
+	got, next = list(&ProcessFilter{CreatedFrom: start.Add(5 * time.Minute)}, next, 2)
+	c.Assert(got, qt.DeepEquals, []uint64{7, 8})
+	c.Assert(next, qt.IsNil)
+
+	_, _, err = st.ListProcesses(&ProcessFilter{}, []byte{1}, 1)
+	c.Assert(err, qt.Not(qt.IsNil))
+
+	// The status is updated in the stored process
+	p, err := st.Process(pids[4])
+	c.Assert(err, qt.IsNil)
+	c.Assert(p.Status, qt.Equals, ProcessStatusCanceled)
+	c.Assert(p.CreatedAt.Equal(start.Add(4*time.Minute)), qt.IsTrue)
+}
+
+func TestIterateFrom(t *testing.T) {
+	c := qt.New(t)
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	defer database.Close()
+
+	wTx := database.WriteTx()
+	pwTx := prefixeddb.NewPrefixedWriteTx(wTx, []byte("x/"))
+	keys := [][]byte{{0x00}, {0x01, 0x00}, {0x01, 0x02}, {0x01, 0xff, 0x01}, {0x02}, {0xff, 0xff}}
+	for _, k := range keys {
+		c.Assert(pwTx.Set(k, k), qt.IsNil)
+	}
+	c.Assert(wTx.Commit(), qt.IsNil)
+	// the keys after the prefix are not visited
+	wTx = database.WriteTx()
+	c.Assert(wTx.Set([]byte("y/"), []byte{}), qt.IsNil)
+	c.Assert(wTx.Commit(), qt.IsNil)
+
+	visit := func(start []byte, limit int) [][]byte {
+		visited := [][]byte{}
+		c.Assert(iterateFrom(database, []byte("x/"), start, func(k, v []byte) bool {
+			c.Assert(k, qt.DeepEquals, v)
+			visited = append(visited, k)
+			return len(visited) < limit
+		}), qt.IsNil)
+		return visited
+	}
+	c.Assert(visit(nil, 10), qt.DeepEquals, keys)
+	c.Assert(visit([]byte{0x01}, 10), qt.DeepEquals, keys[1:])
+	c.Assert(visit([]byte{0x01, 0x01}, 10), qt.DeepEquals, keys[2:])
+	c.Assert(visit([]byte{0x01, 0x01}, 2), qt.DeepEquals, keys[2:4])
+	c.Assert(visit([]byte{0x03}, 10), qt.DeepEquals, keys[5:])
+	c.Assert(visit([]byte{0xff, 0xff, 0x00}, 10), qt.DeepEquals, [][]byte{})
+}
+
+func TestAuditLog(t *testing.T) {
+	c := qt.New(t)
+	dir := filepath.Join(t.TempDir(), "db")
+	database, err := metadb.New(db.TypePebble, dir)
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+
+	entries, next, err := st.AuditLog(nil, 10)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 0)
+	c.Assert(next, qt.IsNil)
+
+	for i := range 5 {
+		c.Assert(st.AddAuditEntry(&AuditEntry{
+			Actor:  "alice",
+			Role:   "operator",
+			Action: fmt.Sprintf("action %d", i),
+			Status: 200,
+		}), qt.IsNil)
+	}
+
+	// Pages of two entries, in the order they were added
+	var cursor []byte
+	actions := []string{}
+	for page := 0; ; page++ {
+		entries, next, err := st.AuditLog(cursor, 2)
+		c.Assert(err, qt.IsNil)
+		c.Assert(len(entries) <= 2, qt.IsTrue)
+		for _, e := range entries {
+			c.Assert(e.ID, qt.HasLen, AuditCursorSize)
+			c.Assert(e.Time.IsZero(), qt.IsFalse)
+			actions = append(actions, e.Action)
+		}
+		if next == nil {
+			c.Assert(page, qt.Equals, 2)
+			break
+		}
+		cursor = next
+	}
+	c.Assert(actions, qt.DeepEquals, []string{"action 0", "action 1", "action 2", "action 3", "action 4"})
+
+	_, _, err = st.AuditLog([]byte{1}, 2)
+	c.Assert(err, qt.IsNotNil)
+
+	// The audit log survives a restart, and the new entries follow the
+	// stored ones even if they were stored with a clock ahead of the current
+	// one
+	future := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Add(time.Hour).UnixNano()))
+	c.Assert(setArtifact(st, auditCodec, future, &AuditEntry{ID: future, Actor: "carol", Action: "action 5"}), qt.IsNil)
+	st.Close()
+	database, err = metadb.New(db.TypePebble, dir)
+	c.Assert(err, qt.IsNil)
+	st, err = New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	c.Assert(st.AddAuditEntry(&AuditEntry{Actor: "bob", Role: "auditor", Action: "action 6"}), qt.IsNil)
+	entries, _, err = st.AuditLog(nil, 10)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 7)
+	c.Assert(entries[5].Actor, qt.Equals, "carol")
+	c.Assert(entries[6].Actor, qt.Equals, "bob")
+
+	// the pages start at the cursor
+	entries, next, err = st.AuditLog(entries[4].ID, 1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 1)
+	c.Assert(entries[0].Actor, qt.Equals, "carol")
+	c.Assert(next, qt.DeepEquals, []byte(future))
+}
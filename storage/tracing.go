@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+
+	"github.com/vocdoni/vocdoni-z-sandbox/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.vocdoni.io/dvote/db/prefixeddb"
+)
+
+// The trace of a ballot starts when it is pushed, and its context is stored
+// with the artifact of each stage (see Ballot.TraceContext), so every queue
+// operation on it records a span of the same trace: pushed, reserved, done,
+// retried or dead lettered. The aggregated batches start their own trace,
+// linked to the traces of their ballots.
+
+// ArtifactTraceContext returns the trace context stored with an artifact.
+func ArtifactTraceContext[T Artifact](a *T) map[string]string {
+	switch a := any(a).(type) {
+	case *Ballot:
+		return a.TraceContext
+	case *VerifiedBallot:
+		return a.TraceContext
+	case *AggregatedBallotBatch:
+		return a.TraceContext
+	}
+	return nil
+}
+
+// startQueueSpan starts the span of an operation on an item of the queue
+// provided, continuing the trace context stored with it. The span is named
+// after the stage and the operation, like "verified ballot reserve".
+func startQueueSpan(q *queue, op string, traceContext map[string]string, key []byte,
+	opts ...trace.SpanStartOption,
+) (context.Context, trace.Span) {
+	opts = append(opts, trace.WithAttributes(
+		attribute.String("vocdoni.stage", q.name),
+		attribute.String("vocdoni.queue.key", hex.EncodeToString(key)),
+	))
+	return tracing.Start(tracing.Extract(context.Background(), traceContext), q.name+" "+op, opts...)
+}
+
+// traceQueueOp records the span of an operation on an item of the queue,
+// which has already happened, continuing its trace context.
+func traceQueueOp(q *queue, op string, traceContext map[string]string, key []byte, attrs ...attribute.KeyValue) {
+	_, span := startQueueSpan(q, op, traceContext, key, trace.WithAttributes(attrs...))
+	span.End()
+}
+
+// endSpan ends a span, recording the error if it is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceContextOf returns a function that decodes the trace context of the
+// items of a queue, see queue.valueTraceContext.
+func traceContextOf[T Artifact](codec *artifactCodec[T]) func([]byte) map[string]string {
+	return func(val []byte) map[string]string {
+		a, err := codec.decode(nil, nil, val)
+		if err != nil {
+			return nil
+		}
+		return ArtifactTraceContext(a)
+	}
+}
+
+// storedTraceContext returns the trace context of the item stored in the
+// queue provided, or nil if it cannot be read.
+func (s *Storage) storedTraceContext(q *queue, key []byte) map[string]string {
+	if q.valueTraceContext == nil {
+		return nil
+	}
+	val, err := prefixeddb.NewPrefixedReader(s.db, q.dataPrefix).Get(key)
+	if err != nil {
+		return nil
+	}
+	return q.valueTraceContext(val)
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/tracing"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/db/metadb"
+)
+
+// exportedSpan is the part of a span written by the stdout exporter checked
+// by the tests.
+type exportedSpan struct {
+	Name        string
+	SpanContext struct{ TraceID, SpanID string }
+	Parent      struct{ TraceID, SpanID string }
+	Links       []struct {
+		SpanContext struct{ TraceID, SpanID string }
+	}
+}
+
+func decodeSpans(c *qt.C, data []byte) map[string]exportedSpan {
+	spans := map[string]exportedSpan{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var span exportedSpan
+		c.Assert(dec.Decode(&span), qt.IsNil)
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+func TestBallotTracing(t *testing.T) {
+	c := qt.New(t)
+	out := new(bytes.Buffer)
+	shutdown, err := tracing.Init(context.Background(), tracing.Config{Exporter: tracing.ExporterStdout, Writer: out})
+	c.Assert(err, qt.IsNil)
+	t.Cleanup(func() {
+		c.Assert(shutdown(context.Background()), qt.IsNil)
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+
+	database, err := metadb.New(db.TypePebble, filepath.Join(t.TempDir(), "db"))
+	c.Assert(err, qt.IsNil)
+	st, err := New(database, testMasterKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	pid := types.ProcessID{Nonce: 1}
+
+	// The ballot continues the trace of the request that submitted it
+	ctx, request := tracing.Start(context.Background(), "request")
+	c.Assert(st.PushBallot(&Ballot{
+		ProcessID:    pid.Marshal(),
+		Nullifier:    []byte{1},
+		TraceContext: tracing.Inject(ctx),
+	}), qt.IsNil)
+	request.End()
+
+	b, k, err := st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(b.TraceContext, qt.Not(qt.HasLen), 0)
+	c.Assert(st.MarkBallotDone(k, &VerifiedBallot{ProcessID: pid.Marshal(), Nullifier: []byte{1}}), qt.IsNil)
+	vbs, keys, err := st.PullVerifiedBallots(pid.Marshal(), 1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(vbs[0].TraceContext, qt.Not(qt.HasLen), 0)
+	c.Assert(st.PushBallotBatch(&AggregatedBallotBatch{
+		ProcessID: pid.Marshal(),
+		Ballots:   []AggregatedBallot{{Nullifier: vbs[0].Nullifier, TraceContext: vbs[0].TraceContext}},
+	}), qt.IsNil)
+	c.Assert(st.MarkVerifiedBallotDone(keys[0]), qt.IsNil)
+	abb, k, err := st.NextBallotBatch(pid.Marshal())
+	c.Assert(err, qt.IsNil)
+	c.Assert(abb.TraceContext, qt.Not(qt.HasLen), 0)
+	c.Assert(st.MarkBallotBatchDone(k), qt.IsNil)
+
+	spans := decodeSpans(c, out.Bytes())
+	traceID := spans["request"].SpanContext.TraceID
+	c.Assert(traceID, qt.Not(qt.Equals), "")
+	push := spans["ballot push"]
+	c.Assert(push.Parent.SpanID, qt.Equals, spans["request"].SpanContext.SpanID)
+	// the stages of the ballot are recorded in the same trace
+	for _, name := range []string{"ballot push", "ballot reserve", "ballot done", "verified ballot reserve", "verified ballot done"} {
+		c.Assert(spans[name].SpanContext.TraceID, qt.Equals, traceID, qt.Commentf("span %q", name))
+	}
+	c.Assert(spans["ballot reserve"].Parent.SpanID, qt.Equals, push.SpanContext.SpanID)
+	c.Assert(spans["verified ballot done"].Parent.SpanID, qt.Equals, spans["ballot done"].SpanContext.SpanID)
+
+	// the batch has its own trace, linked to the ballot
+	batch := spans["aggregated batch push"]
+	c.Assert(batch.SpanContext.TraceID, qt.Not(qt.Equals), traceID)
+	c.Assert(batch.Links, qt.HasLen, 1)
+	c.Assert(batch.Links[0].SpanContext.SpanID, qt.Equals, spans["ballot done"].SpanContext.SpanID)
+	c.Assert(spans["aggregated batch done"].SpanContext.TraceID, qt.Equals, batch.SpanContext.TraceID)
+
+	// the failures are recorded in the trace of the item
+	out.Reset()
+	st.SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+	c.Assert(st.PushBallot(&Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{2}}), qt.IsNil)
+	_, k, err = st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.MarkBallotFailed(k, errCrash), qt.IsNil)
+	spans = decodeSpans(c, out.Bytes())
+	c.Assert(spans["ballot fail"].SpanContext.TraceID, qt.Equals, spans["ballot push"].SpanContext.TraceID)
+}
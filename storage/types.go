@@ -2,6 +2,7 @@ package storage
 
 import (
 	"math/big"
+	"time"
 
 	"github.com/consensys/gnark/backend/groth16"
 	"github.com/vocdoni/vocdoni-z-sandbox/crypto/elgamal"
@@ -13,6 +14,16 @@ type Process struct {
 	BallotMode    types.BallotMode `json:"ballotMode"`
 	MetadataHash  types.HexBytes   `json:"metadataID"`
 	EncryptionKey EncryptionKeys   `json:"encryptionKey"`
+	Status        ProcessStatus    `json:"status"`
+	CreatedAt     time.Time        `json:"createdAt"`
+	// StartTime and EndTime are the voting period of the process, zero if
+	// it was not defined.
+	StartTime time.Time `json:"startTime,omitempty"`
+	EndTime   time.Time `json:"endTime,omitempty"`
+	// OverwritePolicy is the overwrite policy the process was created with,
+	// nil if it uses the default one. It is stored as the policy of the
+	// process by SetProcess, see SetOverwritePolicy.
+	OverwritePolicy *OverwritePolicy `json:"overwritePolicy,omitempty"`
 }
 
 type EncryptionKeys struct {
@@ -29,6 +40,8 @@ type VerifiedBallot struct {
 	EncryptedBallot elgamal.Ciphertext `json:"encryptedBallot"`
 	Address         types.HexBytes     `json:"address"`
 	Proof           groth16.Proof      `json:"proof"`
+	// TraceContext continues the trace of the ballot (see tracing.Inject).
+	TraceContext map[string]string `json:"traceContext,omitempty"`
 }
 
 type Ballot struct {
@@ -42,6 +55,9 @@ type Ballot struct {
 	BallotProof      CircomProof        `json:"ballotProof"`
 	Signature        types.HexBytes     `json:"signature"`
 	CensusProof      CensusProof        `json:"censusProof"`
+	// TraceContext continues the trace started when the ballot was
+	// submitted (see tracing.Inject).
+	TraceContext map[string]string `json:"traceContext,omitempty"`
 }
 
 type CensusProof struct {
@@ -60,10 +76,15 @@ type AggregatedBallotBatch struct {
 	ProcessID types.HexBytes     `json:"processId"`
 	Proof     groth16.Proof      `json:"proof"`
 	Ballots   []AggregatedBallot `json:"ballots"`
+	// TraceContext continues the trace of the batch, whose spans are linked
+	// to the traces of its ballots (see tracing.Inject).
+	TraceContext map[string]string `json:"traceContext,omitempty"`
 }
 type AggregatedBallot struct {
 	Nullifier       types.HexBytes     `json:"nullifiers"`
 	Commitment      types.HexBytes     `json:"commitments"`
 	Address         types.HexBytes     `json:"address"`
 	EncryptedBallot elgamal.Ciphertext `json:"encryptedBallots"`
+	// TraceContext is the trace context of the verified ballot.
+	TraceContext map[string]string `json:"traceContext,omitempty"`
 }
@@ -0,0 +1,215 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/api"
+	"github.com/vocdoni/vocdoni-z-sandbox/api/client"
+	"github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+	"github.com/vocdoni/vocdoni-z-sandbox/util"
+)
+
+func TestAdmin(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	operator, err := NewTestSigner()
+	c.Assert(err, qt.IsNil)
+	auditor, err := NewTestSigner()
+	c.Assert(err, qt.IsNil)
+	node, port, err := SetupAPIWithConfig(t, &api.APIConfig{
+		AdminTokens: map[string]api.Admin{"auditor-token": {Name: "audit", Role: api.AdminRoleAuditor}},
+		AdminAddresses: map[common.Address]api.AdminRole{
+			operator.Address(): api.AdminRoleOperator,
+			auditor.Address():  api.AdminRoleAuditor,
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	newClient := func() *client.HTTPclient {
+		cli, err := NewTestClient(port)
+		c.Assert(err, qt.IsNil)
+		return cli
+	}
+
+	organizer, err := NewTestSigner()
+	c.Assert(err, qt.IsNil)
+	process := CreateTestProcess(c, newClient(), organizer)
+	pid := types.ProcessID{}
+	c.Assert(pid.Unmarshal(process.ProcessID), qt.IsNil)
+
+	c.Run("unauthenticated", func(c *qt.C) {
+		cli := newClient()
+		err := cli.CancelProcess(ctx, process.ProcessID)
+		c.Assert(errors.Is(err, api.ErrUnauthorized), qt.IsTrue, qt.Commentf("error: %v", err))
+		cli.SetAuthToken("unknown-token")
+		_, err = cli.AuditLog(ctx, nil, 0)
+		c.Assert(errors.Is(err, api.ErrUnauthorized), qt.IsTrue, qt.Commentf("error: %v", err))
+	})
+
+	c.Run("auditor", func(c *qt.C) {
+		cli := newClient()
+		cli.SetAuthToken("auditor-token")
+		_, code, err := cli.Request(http.MethodGet, nil, nil, "admin", "queues")
+		c.Assert(err, qt.IsNil)
+		c.Assert(code, qt.Equals, http.StatusOK)
+		err = cli.CancelProcess(ctx, process.ProcessID)
+		c.Assert(errors.Is(err, api.ErrForbidden), qt.IsTrue, qt.Commentf("error: %v", err))
+
+		// the auditors that log in with their address have the same role
+		session, err := newClient().AdminLogin(ctx, auditor)
+		c.Assert(err, qt.IsNil)
+		c.Assert(session.Role, qt.Equals, api.AdminRoleAuditor)
+	})
+
+	c.Run("login", func(c *qt.C) {
+		cli := newClient()
+		challenge := &api.AdminChallengeResponse{}
+		body, code, err := cli.Request(http.MethodGet, nil, nil, "admin", "challenge")
+		c.Assert(err, qt.IsNil)
+		c.Assert(code, qt.Equals, http.StatusOK)
+		c.Assert(json.Unmarshal(body, challenge), qt.IsNil)
+
+		// signed by an address that is not an admin
+		signature, err := organizer.SignEthereum([]byte(challenge.Challenge))
+		c.Assert(err, qt.IsNil)
+		_, code, err = cli.Request(http.MethodPost, &api.AdminLoginRequest{
+			Challenge: challenge.Challenge,
+			Signature: signature,
+		}, nil, "admin", "login")
+		c.Assert(err, qt.IsNil)
+		c.Assert(code, qt.Equals, http.StatusUnauthorized)
+
+		// the challenges are not issued by the node if they are modified
+		signature, err = operator.SignEthereum([]byte(challenge.Challenge + "00"))
+		c.Assert(err, qt.IsNil)
+		_, code, err = cli.Request(http.MethodPost, &api.AdminLoginRequest{
+			Challenge: challenge.Challenge + "00",
+			Signature: signature,
+		}, nil, "admin", "login")
+		c.Assert(err, qt.IsNil)
+		c.Assert(code, qt.Equals, http.StatusUnauthorized)
+
+		// signed by an admin address, the challenge can only be used once
+		signature, err = operator.SignEthereum([]byte(challenge.Challenge))
+		c.Assert(err, qt.IsNil)
+		for _, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+			_, code, err = cli.Request(http.MethodPost, &api.AdminLoginRequest{
+				Challenge: challenge.Challenge,
+				Signature: signature,
+			}, nil, "admin", "login")
+			c.Assert(err, qt.IsNil)
+			c.Assert(code, qt.Equals, want)
+		}
+	})
+
+	cli := newClient()
+	session, err := cli.AdminLogin(ctx, operator)
+	c.Assert(err, qt.IsNil)
+	c.Assert(session.Role, qt.Equals, api.AdminRoleOperator)
+
+	c.Run("export key", func(c *qt.C) {
+		backupKey := util.RandomBytes(storage.MasterKeySize)
+		backup, err := cli.ExportKey(ctx, process.ProcessID, backupKey)
+		c.Assert(err, qt.IsNil)
+		c.Assert(backup, qt.Not(qt.HasLen), 0)
+
+		// the backup restores the key of the process on another node
+		other, _, err := SetupAPIWithConfig(t, &api.APIConfig{})
+		c.Assert(err, qt.IsNil)
+		c.Assert(other.Storage().ImportKey(backup, backupKey), qt.IsNil)
+		_, _, err = other.Storage().EncryptionKeys(pid)
+		c.Assert(err, qt.IsNil)
+
+		_, err = cli.ExportKey(ctx, process.ProcessID, []byte{1, 2, 3})
+		c.Assert(errors.Is(err, api.ErrMalformedBody), qt.IsTrue, qt.Commentf("error: %v", err))
+		unknown := types.ProcessID{Nonce: 99}
+		_, err = cli.ExportKey(ctx, unknown.Marshal(), backupKey)
+		c.Assert(errors.Is(err, api.ErrKeyNotFound), qt.IsTrue, qt.Commentf("error: %v", err))
+	})
+
+	c.Run("cancel process", func(c *qt.C) {
+		c.Assert(cli.CancelProcess(ctx, process.ProcessID), qt.IsNil)
+		p, err := node.Storage().Process(pid)
+		c.Assert(err, qt.IsNil)
+		c.Assert(p.Status, qt.Equals, storage.ProcessStatusCanceled)
+		// canceling it again has no effect
+		c.Assert(cli.CancelProcess(ctx, process.ProcessID), qt.IsNil)
+
+		// the process does not accept more ballots
+		err = newClient().SubmitBallot(ctx, &storage.Ballot{
+			ProcessID:   process.ProcessID,
+			Nullifier:   util.RandomBytes(32),
+			VoterWeight: big.NewInt(1),
+		})
+		c.Assert(errors.Is(err, api.ErrProcessClosed), qt.IsTrue, qt.Commentf("error: %v", err))
+		err = node.Storage().PushBallot(&storage.Ballot{ProcessID: process.ProcessID, Nullifier: []byte{1}})
+		c.Assert(err, qt.ErrorIs, storage.ErrProcessClosed)
+
+		unknown := types.ProcessID{Nonce: 99}
+		err = cli.CancelProcess(ctx, unknown.Marshal())
+		c.Assert(errors.Is(err, api.ErrProcessNotFound), qt.IsTrue, qt.Commentf("error: %v", err))
+
+		// the processes that ended can not be canceled
+		organizer, err := NewTestSigner()
+		c.Assert(err, qt.IsNil)
+		ended := CreateTestProcess(c, newClient(), organizer)
+		endedID := types.ProcessID{}
+		c.Assert(endedID.Unmarshal(ended.ProcessID), qt.IsNil)
+		c.Assert(node.Storage().SetProcessStatus(endedID, storage.ProcessStatusEnded), qt.IsNil)
+		err = cli.CancelProcess(ctx, ended.ProcessID)
+		c.Assert(errors.Is(err, api.ErrProcessNotCancelable), qt.IsTrue, qt.Commentf("error: %v", err))
+	})
+
+	c.Run("audit log", func(c *qt.C) {
+		resp, err := cli.AuditLog(ctx, nil, 0)
+		c.Assert(err, qt.IsNil)
+		type action struct {
+			Actor, Action string
+			Status        int
+		}
+		got := []action{}
+		for _, e := range resp.Entries {
+			got = append(got, action{e.Actor, e.Action, e.Status})
+		}
+		c.Assert(got, qt.DeepEquals, []action{
+			{"audit", "GET " + api.AdminQueuesEndpoint, http.StatusOK},
+			{"audit", "POST " + api.AdminProcessCancelEndpoint, http.StatusForbidden},
+			{auditor.Address().Hex(), "login", http.StatusOK},
+			{operator.Address().Hex(), "login", http.StatusOK},
+			{operator.Address().Hex(), "login", http.StatusOK},
+			{operator.Address().Hex(), "POST " + api.AdminProcessKeyEndpoint, http.StatusOK},
+			{operator.Address().Hex(), "POST " + api.AdminProcessKeyEndpoint, http.StatusBadRequest},
+			{operator.Address().Hex(), "POST " + api.AdminProcessKeyEndpoint, http.StatusNotFound},
+			{operator.Address().Hex(), "POST " + api.AdminProcessCancelEndpoint, http.StatusOK},
+			{operator.Address().Hex(), "POST " + api.AdminProcessCancelEndpoint, http.StatusOK},
+			{operator.Address().Hex(), "POST " + api.AdminProcessCancelEndpoint, http.StatusNotFound},
+			{operator.Address().Hex(), "POST " + api.AdminProcessCancelEndpoint, http.StatusConflict},
+		}, qt.Commentf("audit log %+v", resp.Entries))
+
+		// pages of the audit log
+		page, err := cli.AuditLog(ctx, nil, 4)
+		c.Assert(err, qt.IsNil)
+		c.Assert(page.Entries, qt.HasLen, 4)
+		c.Assert(page.NextCursor, qt.IsNotNil)
+		page, err = cli.AuditLog(ctx, page.NextCursor, 4)
+		c.Assert(err, qt.IsNil)
+		c.Assert(page.Entries[0].ID, qt.DeepEquals, resp.Entries[4].ID)
+	})
+
+	c.Run("invalid role", func(c *qt.C) {
+		_, err := api.New(&api.APIConfig{
+			DataDir:     t.TempDir(),
+			MasterKey:   util.RandomBytes(storage.MasterKeySize),
+			AdminTokens: map[string]api.Admin{"token": {Name: "root", Role: "root"}},
+		})
+		c.Assert(err, qt.ErrorMatches, `invalid role "root".*`)
+	})
+}
@@ -0,0 +1,362 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/arbo"
+	"github.com/vocdoni/arbo/memdb"
+	"github.com/vocdoni/vocdoni-z-sandbox/api"
+	"github.com/vocdoni/vocdoni-z-sandbox/api/client"
+	"github.com/vocdoni/vocdoni-z-sandbox/ballot"
+	"github.com/vocdoni/vocdoni-z-sandbox/keystore"
+	"github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+	"github.com/vocdoni/vocdoni-z-sandbox/util"
+)
+
+// testCensus is a census tree of voters with their weights, like the ones
+// verified by the vote verifier circuit.
+type testCensus struct {
+	tree *arbo.Tree
+}
+
+func newTestCensus(c *qt.C) *testCensus {
+	tree, err := arbo.NewTree(arbo.Config{
+		Database:     memdb.New(),
+		MaxLevels:    types.CensusLevels,
+		HashFunction: arbo.HashFunctionMiMC_BLS12_377,
+	})
+	c.Assert(err, qt.IsNil)
+	return &testCensus{tree: tree}
+}
+
+func (tc *testCensus) key(address []byte) []byte {
+	return arbo.BigToFF(arbo.BLS12377BaseField, new(big.Int).SetBytes(address)).Bytes()
+}
+
+// add adds a voter to the census and returns its address.
+func (tc *testCensus) add(c *qt.C, weight int64) []byte {
+	signer, err := NewTestSigner()
+	c.Assert(err, qt.IsNil)
+	address := signer.Address().Bytes()
+	c.Assert(tc.tree.Add(tc.key(address), big.NewInt(weight).Bytes()), qt.IsNil)
+	return address
+}
+
+func (tc *testCensus) root(c *qt.C) []byte {
+	root, err := tc.tree.Root()
+	c.Assert(err, qt.IsNil)
+	return root
+}
+
+// ballot returns a ballot of the voter with its census proof.
+func (tc *testCensus) ballot(c *qt.C, pid, address []byte, weight int64) *storage.Ballot {
+	_, _, packed, exists, err := tc.tree.GenProof(tc.key(address))
+	c.Assert(err, qt.IsNil)
+	c.Assert(exists, qt.IsTrue)
+	siblings, err := arbo.UnpackSiblings(arbo.HashFunctionMiMC_BLS12_377, packed)
+	c.Assert(err, qt.IsNil)
+	proof := storage.CensusProof{Root: tc.root(c)}
+	for _, s := range siblings {
+		proof.Siblings = append(proof.Siblings, s)
+	}
+	return &storage.Ballot{
+		ProcessID:   pid,
+		VoterWeight: big.NewInt(weight),
+		Nullifier:   util.RandomBytes(32),
+		Address:     address,
+		CensusProof: proof,
+	}
+}
+
+// createCensusProcess creates a process with the census provided.
+func createCensusProcess(c *qt.C, cli *client.HTTPclient, tc *testCensus) types.HexBytes {
+	signer, err := NewTestSigner()
+	c.Assert(err, qt.IsNil)
+	process := NewTestProcess(c, signer)
+	process.CensusRoot = tc.root(c)
+	resp, err := cli.CreateProcess(context.Background(), signer, process)
+	c.Assert(err, qt.IsNil)
+	return resp.ProcessID
+}
+
+func TestBallots(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	_, port, err := SetupAPIWithConfig(t, &api.APIConfig{
+		BallotLimits: &api.BallotLimits{
+			PerIP:                &api.RateLimit{Rate: 0.01, Burst: 10},
+			PerAddress:           &api.RateLimit{Rate: 0.01, Burst: 2},
+			MaxPendingPerProcess: 4,
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	cli, err := NewTestClient(port)
+	c.Assert(err, qt.IsNil)
+
+	census := newTestCensus(c)
+	voters := [][]byte{census.add(c, 1), census.add(c, 10), census.add(c, 100), census.add(c, 1000)}
+	pid := createCensusProcess(c, cli, census)
+
+	c.Run("accepted", func(c *qt.C) {
+		c.Assert(cli.SubmitBallot(ctx, census.ballot(c, pid, voters[0], 1)), qt.IsNil)
+		stats, err := cli.ProcessQueue(ctx, pid)
+		c.Assert(err, qt.IsNil)
+		c.Assert(stats.Pending, qt.Equals, 1)
+	})
+
+	c.Run("not in census", func(c *qt.C) {
+		// the weight is not the weight of the voter
+		b := census.ballot(c, pid, voters[1], 11)
+		err := cli.SubmitBallot(ctx, b)
+		c.Assert(errors.Is(err, api.ErrNotInCensus), qt.IsTrue, qt.Commentf("error: %v", err))
+
+		// the census is not the census of the process
+		other := newTestCensus(c)
+		b = other.ballot(c, pid, other.add(c, 1), 1)
+		err = cli.SubmitBallot(ctx, b)
+		c.Assert(errors.Is(err, api.ErrNotInCensus), qt.IsTrue, qt.Commentf("error: %v", err))
+	})
+
+	c.Run("per address limit", func(c *qt.C) {
+		// voters[0] already used one of its two tokens
+		c.Assert(cli.SubmitBallot(ctx, census.ballot(c, pid, voters[0], 1)), qt.IsNil)
+		b := census.ballot(c, pid, voters[0], 1)
+		err := cli.SubmitBallot(ctx, b)
+		c.Assert(errors.Is(err, api.ErrTooManyRequests), qt.IsTrue, qt.Commentf("error: %v", err))
+
+		data, err := storage.EncodeArtifact(b)
+		c.Assert(err, qt.IsNil)
+		body, err := json.Marshal(&api.BallotRequest{Ballot: data})
+		c.Assert(err, qt.IsNil)
+		resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/process/%s/ballots", port, pid.String()),
+			"application/json", bytes.NewReader(body))
+		c.Assert(err, qt.IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusTooManyRequests)
+		c.Assert(resp.Header.Get("Retry-After"), qt.Not(qt.Equals), "")
+	})
+
+	c.Run("process quota", func(c *qt.C) {
+		c.Assert(cli.SubmitBallot(ctx, census.ballot(c, pid, voters[1], 10)), qt.IsNil)
+		c.Assert(cli.SubmitBallot(ctx, census.ballot(c, pid, voters[2], 100)), qt.IsNil)
+		err := cli.SubmitBallot(ctx, census.ballot(c, pid, voters[2], 100))
+		c.Assert(errors.Is(err, api.ErrProcessQuotaExceeded), qt.IsTrue, qt.Commentf("error: %v", err))
+	})
+
+	c.Run("unknown process", func(c *qt.C) {
+		unknown := types.ProcessID{Nonce: 99}
+		err := cli.SubmitBallot(ctx, census.ballot(c, unknown.Marshal(), voters[3], 1000))
+		c.Assert(errors.Is(err, api.ErrProcessNotFound), qt.IsTrue, qt.Commentf("error: %v", err))
+	})
+
+	c.Run("per IP limit", func(c *qt.C) {
+		// the ten requests of the burst were used by the subtests above
+		err := cli.SubmitBallot(ctx, census.ballot(c, pid, voters[3], 1000))
+		c.Assert(errors.Is(err, api.ErrTooManyRequests), qt.IsTrue, qt.Commentf("error: %v", err))
+	})
+}
+
+func TestBallotAddressLimitVictim(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	_, port, err := SetupAPIWithConfig(t, &api.APIConfig{
+		BallotLimits: &api.BallotLimits{
+			PerIP:      &api.RateLimit{Rate: 0.01, Burst: 100},
+			PerAddress: &api.RateLimit{Rate: 0.01, Burst: 1},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	cli, err := NewTestClient(port)
+	c.Assert(err, qt.IsNil)
+
+	census := newTestCensus(c)
+	victim := census.add(c, 10)
+	census.add(c, 10)
+	pid := createCensusProcess(c, cli, census)
+
+	// The junk ballots with the address of the victim are rejected without
+	// charging its address
+	for range 5 {
+		junk := census.ballot(c, pid, victim, 10)
+		junk.CensusProof.Root = util.RandomBytes(32)
+		err := cli.SubmitBallot(ctx, junk)
+		c.Assert(errors.Is(err, api.ErrNotInCensus), qt.IsTrue, qt.Commentf("error: %v", err))
+		err = cli.SubmitBallot(ctx, census.ballot(c, pid, victim, 11))
+		c.Assert(errors.Is(err, api.ErrNotInCensus), qt.IsTrue, qt.Commentf("error: %v", err))
+	}
+
+	// so the victim can still vote, once
+	c.Assert(cli.SubmitBallot(ctx, census.ballot(c, pid, victim, 10)), qt.IsNil)
+	err = cli.SubmitBallot(ctx, census.ballot(c, pid, victim, 10))
+	c.Assert(errors.Is(err, api.ErrTooManyRequests), qt.IsTrue, qt.Commentf("error: %v", err))
+}
+
+func TestBallotLimitsValidation(t *testing.T) {
+	c := qt.New(t)
+	for _, limits := range []*api.BallotLimits{
+		{PerIP: &api.RateLimit{Rate: 0, Burst: 1}},
+		{PerIP: &api.RateLimit{Rate: -1, Burst: 1}},
+		{PerAddress: &api.RateLimit{Rate: 1, Burst: 0}},
+		{MaxPendingPerProcess: -1},
+	} {
+		_, err := api.New(&api.APIConfig{
+			DataDir:      t.TempDir(),
+			MasterKey:    util.RandomBytes(storage.MasterKeySize),
+			BallotLimits: limits,
+		})
+		c.Assert(err, qt.ErrorMatches, `.*invalid.*`, qt.Commentf("limits %+v", limits))
+	}
+}
+
+func TestBallotOverwritePolicy(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	_, port, err := SetupAPIWithConfig(t, &api.APIConfig{
+		OverwritePolicy: &storage.OverwritePolicy{RejectQueued: true},
+	})
+	c.Assert(err, qt.IsNil)
+	cli, err := NewTestClient(port)
+	c.Assert(err, qt.IsNil)
+
+	census := newTestCensus(c)
+	voter := census.add(c, 1)
+	pid := createCensusProcess(c, cli, census)
+
+	// the ballot that reuses the nullifier of a queued one is rejected
+	b := census.ballot(c, pid, voter, 1)
+	c.Assert(cli.SubmitBallot(ctx, b), qt.IsNil)
+	again := census.ballot(c, pid, voter, 1)
+	again.Nullifier = b.Nullifier
+	err = cli.SubmitBallot(ctx, again)
+	c.Assert(errors.Is(err, api.ErrBallotRejected), qt.IsTrue, qt.Commentf("error: %v", err))
+
+	// the ballots without nullifier are malformed
+	b = census.ballot(c, pid, voter, 1)
+	b.Nullifier = nil
+	err = cli.SubmitBallot(ctx, b)
+	c.Assert(errors.Is(err, api.ErrMalformedBody), qt.IsTrue, qt.Commentf("error: %v", err))
+
+	// a process created with its own policy does not use the one of the node
+	signer, err := NewTestSigner()
+	c.Assert(err, qt.IsNil)
+	process := NewTestProcess(c, signer)
+	process.CensusRoot = census.root(c)
+	process.OverwritePolicy = &storage.OverwritePolicy{MaxOverwrites: 1}
+	created, err := cli.CreateProcess(ctx, signer, process)
+	c.Assert(err, qt.IsNil)
+	c.Assert(created.OverwritePolicy, qt.DeepEquals, process.OverwritePolicy)
+	pr, err := cli.GetProcess(ctx, created.ProcessID)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pr.OverwritePolicy, qt.DeepEquals, process.OverwritePolicy)
+	pr, err = cli.GetProcess(ctx, pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pr.OverwritePolicy, qt.DeepEquals, &storage.OverwritePolicy{RejectQueued: true})
+
+	b = census.ballot(c, created.ProcessID, voter, 1)
+	c.Assert(cli.SubmitBallot(ctx, b), qt.IsNil)
+	again = census.ballot(c, created.ProcessID, voter, 1)
+	again.Nullifier = b.Nullifier
+	c.Assert(cli.SubmitBallot(ctx, again), qt.IsNil)
+	again = census.ballot(c, created.ProcessID, voter, 1)
+	again.Nullifier = b.Nullifier
+	err = cli.SubmitBallot(ctx, again)
+	c.Assert(errors.Is(err, api.ErrBallotRejected), qt.IsTrue, qt.Commentf("error: %v", err))
+
+	// the policy is signed with the process
+	process.Nonce++
+	c.Assert(process.Sign(signer), qt.IsNil)
+	process.OverwritePolicy = &storage.OverwritePolicy{MaxOverwrites: 2}
+	address, err := process.SignerAddress()
+	c.Assert(err, qt.IsNil)
+	c.Assert(address, qt.Not(qt.Equals), signer.Address())
+}
+
+// witnessProver checks the inputs of the ballots against the ballot circuit,
+// and returns a fixed proof, since the proving key is not available to the
+// tests and the sequencer checks the proofs after queuing the ballots.
+type witnessProver struct {
+	*ballot.CircomProver
+}
+
+func (p witnessProver) Prove(inputs []byte) (string, string, error) {
+	if _, err := p.Witness(inputs); err != nil {
+		return "", "", err
+	}
+	return `{"pi_a":["1","2","1"],"pi_b":[["1","2"],["3","4"],["1","0"]],"pi_c":["5","6","1"],"protocol":"groth16"}`, `[]`, nil
+}
+
+func TestSubmitBuiltBallot(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	node, port, err := SetupAPIWithConfig(t, &api.APIConfig{})
+	c.Assert(err, qt.IsNil)
+	cli, err := NewTestClient(port)
+	c.Assert(err, qt.IsNil)
+
+	// A process of a single field, whose ballots the sequencer accepts
+	voter, err := NewTestSigner()
+	c.Assert(err, qt.IsNil)
+	census := newTestCensus(c)
+	c.Assert(census.tree.Add(census.key(voter.Address().Bytes()), big.NewInt(10).Bytes()), qt.IsNil)
+	organizer, err := NewTestSigner()
+	c.Assert(err, qt.IsNil)
+	process := NewTestProcess(c, organizer)
+	process.CensusRoot = census.root(c)
+	process.BallotMode = types.BallotMode{
+		MaxCount:     1,
+		MaxValue:     *toBigInt(10),
+		MaxTotalCost: *toBigInt(10),
+		MinTotalCost: *toBigInt(1),
+		CostExponent: 1,
+	}
+	resp, err := cli.CreateProcess(ctx, organizer, process)
+	c.Assert(err, qt.IsNil)
+	pid := types.ProcessID{}
+	c.Assert(pid.Unmarshal(resp.ProcessID), qt.IsNil)
+	encryptionKey, err := keystore.NewLocal(node.Storage()).PublicKey(pid)
+	c.Assert(err, qt.IsNil)
+
+	// The ballot is built from the census proof of the voter
+	proof := census.ballot(c, resp.ProcessID, voter.Address().Bytes(), 10).CensusProof
+	secret, err := ballot.NewSecret()
+	c.Assert(err, qt.IsNil)
+	wasm, err := os.ReadFile("../circuits/assets/circom/circuit/ballot_proof.wasm")
+	c.Assert(err, qt.IsNil)
+	built, err := ballot.Build(&ballot.Params{
+		Process: &ballot.Process{ID: pid, BallotMode: process.BallotMode, EncryptionKey: encryptionKey},
+		Voter:   voter,
+		Census:  &ballot.CensusProof{Root: proof.Root, Weight: big.NewInt(10), Siblings: proof.Siblings},
+		Secret:  secret,
+		Choices: []*big.Int{big.NewInt(7)},
+	}, witnessProver{&ballot.CircomProver{Wasm: wasm}})
+	c.Assert(err, qt.IsNil)
+	b, err := built.StorageBallot()
+	c.Assert(err, qt.IsNil)
+
+	// and it is queued as built
+	c.Assert(cli.SubmitBallot(ctx, b), qt.IsNil)
+	status, err := cli.BallotStatus(ctx, resp.ProcessID, b.Nullifier)
+	c.Assert(err, qt.IsNil)
+	c.Assert(status, qt.Equals, storage.BallotStatusPending)
+	queued, _, err := node.Storage().NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(queued.Nullifier, qt.DeepEquals, b.Nullifier)
+	c.Assert(queued.Commitment, qt.DeepEquals, b.Commitment)
+	c.Assert(queued.BallotInputsHash, qt.DeepEquals, b.BallotInputsHash)
+	c.Assert(queued.Signature, qt.DeepEquals, b.Signature)
+	c.Assert(queued.EncryptedBallot.Serialize(), qt.DeepEquals, b.EncryptedBallot.Serialize())
+}
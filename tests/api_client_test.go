@@ -0,0 +1,197 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/api"
+	"github.com/vocdoni/vocdoni-z-sandbox/api/client"
+	"github.com/vocdoni/vocdoni-z-sandbox/crypto/elgamal"
+	"github.com/vocdoni/vocdoni-z-sandbox/keystore"
+	"github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+func TestClient(t *testing.T) {
+	c := qt.New(t)
+
+	// Setup
+	tmpPort, err := SetupAPI(t)
+	c.Assert(err, qt.IsNil)
+	cli, err := NewTestClient(tmpPort)
+	c.Assert(err, qt.IsNil)
+	ctx := context.Background()
+
+	// The processes are signed with the next nonce of the organizer
+	signer, err := NewTestSigner()
+	c.Assert(err, qt.IsNil)
+	hash, err := cli.UploadMetadata(ctx, testMetadata(3))
+	c.Assert(err, qt.IsNil)
+	for nonce := range uint64(2) {
+		process := NewTestProcess(c, signer)
+		process.MetadataHash = hash
+		resp, err := cli.CreateProcess(ctx, signer, process)
+		c.Assert(err, qt.IsNil)
+		c.Assert(process.Nonce, qt.Equals, nonce)
+
+		got, err := cli.GetProcess(ctx, resp.ProcessID)
+		c.Assert(err, qt.IsNil)
+		c.Assert(got.Address, qt.Equals, signer.AddressString())
+		c.Assert(got.Nonce, qt.Equals, nonce)
+		c.Assert(got.MetadataHash, qt.DeepEquals, hash)
+		stats, err := cli.ProcessQueue(ctx, resp.ProcessID)
+		c.Assert(err, qt.IsNil)
+		c.Assert(stats.Pending, qt.Equals, 0)
+	}
+	metadata, err := cli.Metadata(ctx, hash)
+	c.Assert(err, qt.IsNil)
+	c.Assert(metadata.Questions, qt.HasLen, 1)
+
+	// The errors of the API are decoded
+	_, err = cli.GetProcess(ctx, make([]byte, 32))
+	c.Assert(err, qt.ErrorIs, api.ErrProcessNotFound)
+	var apiErr api.Error
+	c.Assert(errors.As(err, &apiErr), qt.IsTrue)
+	c.Assert(apiErr.HTTPstatus, qt.Equals, http.StatusNotFound)
+	_, err = cli.Metadata(ctx, []byte{1})
+	c.Assert(err, qt.ErrorIs, api.ErrMalformedMetadataHash)
+	_, err = cli.Processes(ctx, &client.ProcessesQuery{Limit: 1000})
+	c.Assert(err, qt.ErrorIs, api.ErrMalformedQuery)
+	c.Assert(err, qt.Not(qt.ErrorIs), api.ErrMalformedBody)
+
+	// The calls are cancelled with the context
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = cli.GetProcess(cancelled, make([]byte, 32))
+	c.Assert(err, qt.ErrorIs, context.Canceled)
+}
+
+func TestClientRetries(t *testing.T) {
+	c := qt.New(t)
+
+	// A server that fails the first nonce requests, and all the process
+	// creations, as unavailable
+	var nonceFailures, nonceRequests, processRequests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == api.PingEndpoint:
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPost:
+			processRequests.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case nonceRequests.Add(1) <= nonceFailures.Load():
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			_, _ = w.Write([]byte(`{"address":"0x0000000000000000000000000000000000000000","nonce":3}`))
+		}
+	}))
+	defer srv.Close()
+	cli, err := client.New(srv.URL)
+	c.Assert(err, qt.IsNil)
+	ctx := context.Background()
+
+	// The idempotent calls are retried
+	nonceFailures.Store(2)
+	nonce, err := cli.OrganizerNonce(ctx, common.Address{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(nonce, qt.Equals, uint64(3))
+	c.Assert(nonceRequests.Load(), qt.Equals, int32(3))
+
+	// The process creation is not retried
+	nonceFailures.Store(0)
+	signer, err := NewTestSigner()
+	c.Assert(err, qt.IsNil)
+	_, err = cli.CreateProcess(ctx, signer, NewTestProcess(c, signer))
+	c.Assert(err, qt.ErrorMatches, ".*503.*")
+	c.Assert(processRequests.Load(), qt.Equals, int32(1))
+
+	// The retries stop when the context is done
+	nonceRequests.Store(0)
+	nonceFailures.Store(10)
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = cli.OrganizerNonce(timeout, common.Address{})
+	c.Assert(err, qt.ErrorIs, context.DeadlineExceeded)
+	c.Assert(nonceRequests.Load(), qt.Equals, int32(1))
+}
+
+func TestClientBallots(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	node, port, err := SetupAPIWithConfig(t, &api.APIConfig{})
+	c.Assert(err, qt.IsNil)
+	cli, err := NewTestClient(port)
+	c.Assert(err, qt.IsNil)
+
+	// The census of the process is its census root
+	census := newTestCensus(c)
+	voter := census.add(c, 1)
+	pid := createCensusProcess(c, cli, census)
+	got, err := cli.Census(ctx, pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(got.Root, qt.DeepEquals, types.HexBytes(census.root(c)))
+	c.Assert(got.Levels, qt.Equals, types.CensusLevels)
+	_, err = cli.Census(ctx, make([]byte, 32))
+	c.Assert(err, qt.ErrorIs, api.ErrProcessNotFound)
+
+	// The ballot is encrypted with the key of the process
+	processID := types.ProcessID{}
+	c.Assert(processID.Unmarshal(pid), qt.IsNil)
+	publicKey, err := keystore.NewLocal(node.Storage()).PublicKey(processID)
+	c.Assert(err, qt.IsNil)
+	ballot := census.ballot(c, pid, voter, 1)
+	ct, err := elgamal.NewCiphertext(publicKey).Encrypt(big.NewInt(3), publicKey, nil)
+	c.Assert(err, qt.IsNil)
+	ballot.EncryptedBallot = *ct
+	c.Assert(cli.SubmitBallot(ctx, ballot), qt.IsNil)
+	status, err := cli.BallotStatus(ctx, pid, ballot.Nullifier)
+	c.Assert(err, qt.IsNil)
+	c.Assert(status, qt.Equals, storage.BallotStatusPending)
+	_, err = cli.BallotStatus(ctx, pid, []byte{1})
+	c.Assert(err, qt.ErrorIs, api.ErrBallotNotFound)
+
+	// The ballot is verified and aggregated by the workers
+	st := node.Storage()
+	b, k, err := st.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.MarkBallotDone(k, &storage.VerifiedBallot{
+		ProcessID:       b.ProcessID,
+		Nullifier:       b.Nullifier,
+		EncryptedBallot: b.EncryptedBallot,
+	}), qt.IsNil)
+	status, err = cli.BallotStatus(ctx, pid, ballot.Nullifier)
+	c.Assert(err, qt.IsNil)
+	c.Assert(status, qt.Equals, storage.BallotStatusVerified)
+	vbs, keys, err := st.PullVerifiedBallots(pid, 1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.PushBallotBatch(&storage.AggregatedBallotBatch{
+		ProcessID: pid,
+		Ballots:   []storage.AggregatedBallot{{Nullifier: vbs[0].Nullifier, EncryptedBallot: vbs[0].EncryptedBallot}},
+	}), qt.IsNil)
+	c.Assert(st.MarkVerifiedBallotDone(keys[0]), qt.IsNil)
+	_, k, err = st.NextBallotBatch(pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.MarkBallotBatchDone(k), qt.IsNil)
+	status, err = cli.BallotStatus(ctx, pid, ballot.Nullifier)
+	c.Assert(err, qt.IsNil)
+	c.Assert(status, qt.Equals, storage.BallotStatusAggregated)
+
+	// The results are decrypted once the process has ended
+	_, err = cli.Results(ctx, pid)
+	c.Assert(err, qt.ErrorIs, api.ErrProcessNotEnded)
+	c.Assert(st.SetProcessStatus(processID, storage.ProcessStatusEnded), qt.IsNil)
+	results, err := cli.Results(ctx, pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(results.Results.MathBigInt().Int64(), qt.Equals, int64(3))
+	c.Assert(results.Ballots, qt.Equals, uint64(1))
+	c.Assert(results.Overwrites, qt.Equals, uint64(0))
+}
@@ -0,0 +1,48 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/api"
+)
+
+func TestDeadLetters(t *testing.T) {
+	c := qt.New(t)
+
+	// Setup
+	_, port, err := SetupAPIWithConfig(t, &api.APIConfig{
+		AdminTokens: map[string]api.Admin{"operator-token": {Name: "ops", Role: api.AdminRoleOperator}},
+	})
+	c.Assert(err, qt.IsNil)
+	cli, err := NewTestClient(port)
+	c.Assert(err, qt.IsNil)
+	cli.SetAuthToken("operator-token")
+
+	// No dead letters
+	body, code, err := cli.Request(http.MethodGet, nil, nil, "admin", "deadletters")
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusOK, qt.Commentf("response body %s", string(body)))
+	var resp api.DeadLettersResponse
+	c.Assert(json.NewDecoder(bytes.NewReader(body)).Decode(&resp), qt.IsNil)
+	c.Assert(resp.DeadLetters, qt.HasLen, 0)
+
+	// Unknown and malformed dead letters
+	for _, tc := range []struct {
+		method string
+		path   []string
+		status int
+	}{
+		{http.MethodGet, []string{"admin", "deadletters", "0102"}, http.StatusNotFound},
+		{http.MethodPost, []string{"admin", "deadletters", "0102", "requeue"}, http.StatusNotFound},
+		{http.MethodDelete, []string{"admin", "deadletters", "0102"}, http.StatusNotFound},
+		{http.MethodGet, []string{"admin", "deadletters", "xyz"}, http.StatusBadRequest},
+	} {
+		body, code, err := cli.Request(tc.method, nil, nil, tc.path...)
+		c.Assert(err, qt.IsNil)
+		c.Assert(code, qt.Equals, tc.status, qt.Commentf("%s %v: %s", tc.method, tc.path, string(body)))
+	}
+}
@@ -0,0 +1,213 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/api"
+	"github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/tracing"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+	"github.com/vocdoni/vocdoni-z-sandbox/util"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestAPILifecycle(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	conf := &api.APIConfig{
+		Host:      "127.0.0.1",
+		DataDir:   t.TempDir(),
+		MasterKey: util.RandomBytes(32),
+	}
+
+	// The server is not listening until it is started
+	a, err := api.New(conf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(a.Addr(), qt.IsNil)
+	select {
+	case <-a.Ready():
+		c.Fatal("the API is ready before it is started")
+	default:
+	}
+
+	c.Assert(a.Start(ctx), qt.IsNil)
+	<-a.Ready()
+	port := a.Addr().(*net.TCPAddr).Port
+	c.Assert(port, qt.Not(qt.Equals), 0)
+	cli, err := NewTestClient(port)
+	c.Assert(err, qt.IsNil)
+	signer, err := NewTestSigner()
+	c.Assert(err, qt.IsNil)
+	process := CreateTestProcess(c, cli, signer)
+	c.Assert(a.Start(ctx), qt.ErrorMatches, ".*already started")
+
+	// Another server can not listen on the same address
+	conf2 := *conf
+	conf2.DataDir = t.TempDir()
+	conf2.Port = port
+	b, err := api.New(&conf2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(b.Start(ctx), qt.ErrorMatches, "could not listen on .*")
+	// it is not ready, but the ones waiting for it are notified
+	<-b.Ready()
+	c.Assert(b.Addr(), qt.IsNil)
+	c.Assert(b.Start(ctx), qt.ErrorMatches, "could not listen on .*")
+	c.Assert(b.Shutdown(ctx), qt.IsNil)
+
+	// Once shut down, it stops listening and can not be started again
+	c.Assert(a.Shutdown(ctx), qt.IsNil)
+	c.Assert(a.Shutdown(ctx), qt.IsNil)
+	_, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, api.PingEndpoint))
+	c.Assert(err, qt.IsNotNil)
+	c.Assert(a.Start(ctx), qt.ErrorMatches, ".*shut down")
+
+	// The database is closed, so it can be opened by a new server, which
+	// is not ready if it is shut down before it is started
+	a, err = api.New(conf)
+	c.Assert(err, qt.IsNil)
+	pid := types.ProcessID{}
+	c.Assert(pid.Unmarshal(process.ProcessID), qt.IsNil)
+	_, err = a.Storage().Process(pid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(a.Shutdown(ctx), qt.IsNil)
+	<-a.Ready()
+	c.Assert(a.Addr(), qt.IsNil)
+}
+
+func TestAPIShutdownWaitsForHandlers(t *testing.T) {
+	c := qt.New(t)
+	a, err := api.New(&api.APIConfig{
+		Host:      "127.0.0.1",
+		DataDir:   t.TempDir(),
+		MasterKey: util.RandomBytes(32),
+	})
+	c.Assert(err, qt.IsNil)
+
+	// A handler that uses the storage once it is released
+	started, release := make(chan struct{}), make(chan struct{})
+	handlerErr := make(chan error, 1)
+	a.Router().Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, err := a.Storage().Process(types.ProcessID{Nonce: 1})
+		handlerErr <- err
+	})
+	c.Assert(a.Start(context.Background()), qt.IsNil)
+	addr := a.Addr()
+	go func() {
+		if resp, err := http.Get(fmt.Sprintf("http://%s/slow", addr)); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	// The server is not drained in time, so its connections are closed, but
+	// the storage is not closed until the handler returns
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- a.Shutdown(ctx) }()
+	<-ctx.Done()
+	select {
+	case err := <-shutdownErr:
+		c.Fatalf("shut down with a handler running: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// the address is available meanwhile
+	c.Assert(a.Addr().String(), qt.Equals, addr.String())
+
+	close(release)
+	c.Assert(<-handlerErr, qt.ErrorIs, storage.ErrNotFound)
+	c.Assert(<-shutdownErr, qt.ErrorMatches, "could not drain the API server: .*")
+	// the calls after the first one return its result
+	c.Assert(a.Shutdown(context.Background()), qt.ErrorMatches, "could not drain the API server: .*")
+}
+
+func TestAPIShutdownOnContextDone(t *testing.T) {
+	c := qt.New(t)
+	a, err := api.New(&api.APIConfig{
+		Host:      "127.0.0.1",
+		DataDir:   t.TempDir(),
+		MasterKey: util.RandomBytes(32),
+	})
+	c.Assert(err, qt.IsNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Assert(a.Start(ctx), qt.IsNil)
+	url := fmt.Sprintf("http://%s%s", a.Addr(), api.PingEndpoint)
+	resp, err := http.Get(url)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+
+	cancel()
+	deadline := time.Now().Add(api.DefaultShutdownTimeout)
+	for {
+		resp, err := http.Get(url)
+		if err != nil {
+			break
+		}
+		resp.Body.Close()
+		c.Assert(time.Now().Before(deadline), qt.IsTrue, qt.Commentf("the server is still listening"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(a.Shutdown(context.Background()), qt.IsNil)
+}
+
+func TestAPITracing(t *testing.T) {
+	c := qt.New(t)
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+	out := new(bytes.Buffer)
+	a, err := api.New(&api.APIConfig{
+		Host:      "127.0.0.1",
+		DataDir:   t.TempDir(),
+		MasterKey: util.RandomBytes(32),
+		Tracing:   &tracing.Config{Exporter: tracing.ExporterStdout, Writer: out},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(a.Start(context.Background()), qt.IsNil)
+	cli, err := NewTestClient(a.Addr().(*net.TCPAddr).Port)
+	c.Assert(err, qt.IsNil)
+	_, code, err := cli.Request(http.MethodGet, nil, nil, "ping")
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusOK)
+
+	// The spans of the requests are exported until the server is shut down
+	c.Assert(a.Shutdown(context.Background()), qt.IsNil)
+	c.Assert(strings.Contains(out.String(), `"Name":"GET /ping"`), qt.IsTrue, qt.Commentf("spans exported:\n%s", out))
+	exported := out.Len()
+	_, span := tracing.Start(context.Background(), "after shutdown")
+	span.End()
+	c.Assert(out.Len(), qt.Equals, exported)
+
+	// The tracing config is validated
+	_, err = api.New(&api.APIConfig{
+		DataDir:   t.TempDir(),
+		MasterKey: util.RandomBytes(32),
+		Tracing:   &tracing.Config{Exporter: "unknown"},
+	})
+	c.Assert(err, qt.ErrorMatches, `could not initialize tracing: .*`)
+}
+
+func TestParallelAPIs(t *testing.T) {
+	for i := range 16 {
+		t.Run(fmt.Sprintf("api %d", i), func(t *testing.T) {
+			t.Parallel()
+			c := qt.New(t)
+			port, err := SetupAPI(t)
+			c.Assert(err, qt.IsNil)
+			cli, err := NewTestClient(port)
+			c.Assert(err, qt.IsNil)
+			signer, err := NewTestSigner()
+			c.Assert(err, qt.IsNil)
+			CreateTestProcess(c, cli, signer)
+		})
+	}
+}
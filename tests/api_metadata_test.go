@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/api"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+// testMetadata returns the metadata of a question with the number of choices
+// provided.
+func testMetadata(choices int) *types.Metadata {
+	q := types.Question{Title: types.MultilingualString{"default": "question"}}
+	for i := 0; i < choices; i++ {
+		q.Choices = append(q.Choices, types.Choice{Title: types.MultilingualString{"default": "choice"}, Value: i})
+	}
+	return &types.Metadata{
+		Title:     types.MultilingualString{"default": "test"},
+		Questions: []types.Question{q},
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	c := qt.New(t)
+
+	// Setup
+	tmpPort, err := SetupAPI(t)
+	c.Assert(err, qt.IsNil)
+	cli, err := NewTestClient(tmpPort)
+	c.Assert(err, qt.IsNil)
+
+	uploadMetadata := func(metadata *types.Metadata) types.HexBytes {
+		body, code, err := cli.Request(http.MethodPost, metadata, nil, "metadata")
+		c.Assert(err, qt.IsNil)
+		c.Assert(code, qt.Equals, http.StatusOK, qt.Commentf("response body %s", string(body)))
+		var resp api.MetadataResponse
+		c.Assert(json.NewDecoder(bytes.NewReader(body)).Decode(&resp), qt.IsNil)
+		return resp.Hash
+	}
+
+	// Upload and retrieve the metadata
+	metadata := testMetadata(3)
+	hash := uploadMetadata(metadata)
+	c.Assert(hash, qt.HasLen, 32)
+	body, code, err := cli.Request(http.MethodGet, nil, nil, "metadata", hash.String())
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusOK, qt.Commentf("response body %s", string(body)))
+	var got types.Metadata
+	c.Assert(json.NewDecoder(bytes.NewReader(body)).Decode(&got), qt.IsNil)
+	c.Assert(got.Questions, qt.DeepEquals, metadata.Questions)
+
+	// Uploading it again returns the same hash
+	c.Assert(uploadMetadata(metadata), qt.DeepEquals, hash)
+
+	// Invalid, unknown and malformed metadata
+	invalid := testMetadata(2)
+	invalid.Questions[0].Choices[1].Value = 0
+	for _, tc := range []struct {
+		method string
+		body   any
+		path   []string
+		status int
+	}{
+		{http.MethodPost, invalid, []string{"metadata"}, http.StatusBadRequest},
+		{http.MethodPost, testMetadata(0), []string{"metadata"}, http.StatusBadRequest},
+		{http.MethodGet, nil, []string{"metadata", hex.EncodeToString(make([]byte, 32))}, http.StatusNotFound},
+		{http.MethodGet, nil, []string{"metadata", "0102"}, http.StatusBadRequest},
+	} {
+		body, code, err := cli.Request(tc.method, tc.body, nil, tc.path...)
+		c.Assert(err, qt.IsNil)
+		c.Assert(code, qt.Equals, tc.status, qt.Commentf("%s %v: %s", tc.method, tc.path, string(body)))
+	}
+
+	t.Run("process with metadata", func(t *testing.T) {
+		c := qt.New(t)
+		signer, err := NewTestSigner()
+		c.Assert(err, qt.IsNil)
+		process := NewTestProcess(c, signer)
+		process.MetadataHash = hash
+		c.Assert(process.Sign(signer), qt.IsNil)
+		body, code, err := cli.Request(http.MethodPost, process, nil, "process")
+		c.Assert(err, qt.IsNil)
+		c.Assert(code, qt.Equals, http.StatusOK, qt.Commentf("response body %s", string(body)))
+		var resp api.ProcessResponse
+		c.Assert(json.NewDecoder(bytes.NewReader(body)).Decode(&resp), qt.IsNil)
+		c.Assert(resp.MetadataHash, qt.DeepEquals, hash)
+
+		// The metadata hash is committed with the process
+		body, code, err = cli.Request(http.MethodGet, nil, []string{"id", resp.ProcessID.String()}, "process")
+		c.Assert(err, qt.IsNil)
+		c.Assert(code, qt.Equals, http.StatusOK, qt.Commentf("response body %s", string(body)))
+		var getResp api.ProcessResponse
+		c.Assert(json.NewDecoder(bytes.NewReader(body)).Decode(&getResp), qt.IsNil)
+		c.Assert(getResp.MetadataHash, qt.DeepEquals, hash)
+	})
+
+	t.Run("process with inconsistent metadata", func(t *testing.T) {
+		c := qt.New(t)
+		// more choices than fields of the ballot mode
+		tooManyChoices := uploadMetadata(testMetadata(6))
+		// a different ballot mode
+		otherMode := testMetadata(2)
+		otherMode.BallotMode = types.BallotMode{MaxCount: 2}
+		otherModeHash := uploadMetadata(otherMode)
+
+		for _, tc := range []struct {
+			hash   types.HexBytes
+			status int
+		}{
+			{tooManyChoices, http.StatusBadRequest},
+			{otherModeHash, http.StatusBadRequest},
+			{make([]byte, 32), http.StatusNotFound},
+		} {
+			signer, err := NewTestSigner()
+			c.Assert(err, qt.IsNil)
+			process := NewTestProcess(c, signer)
+			process.MetadataHash = tc.hash
+			c.Assert(process.Sign(signer), qt.IsNil)
+			body, code, err := cli.Request(http.MethodPost, process, nil, "process")
+			c.Assert(err, qt.IsNil)
+			c.Assert(code, qt.Equals, tc.status, qt.Commentf("metadata %s: %s", tc.hash, string(body)))
+		}
+	})
+}
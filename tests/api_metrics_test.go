@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/api"
+	"github.com/vocdoni/vocdoni-z-sandbox/metrics"
+	"github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+func TestMetrics(t *testing.T) {
+	c := qt.New(t)
+
+	// Setup
+	node, port, err := SetupAPIWithConfig(t, &api.APIConfig{WorkerTokens: map[string]string{"token": "worker"}})
+	c.Assert(err, qt.IsNil)
+	cli, err := NewTestClient(port)
+	c.Assert(err, qt.IsNil)
+
+	pid := types.ProcessID{Nonce: 1}
+	for i := 0; i < 3; i++ {
+		b := &storage.Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{byte(i)}, VoterWeight: big.NewInt(1)}
+		c.Assert(node.Storage().PushBallot(b), qt.IsNil)
+	}
+
+	// A successful request and a failed one
+	_, code, err := cli.Request(http.MethodGet, nil, nil, "ping")
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusOK)
+	_, code, err = cli.Request(http.MethodGet, nil, nil, "process", "xyz", "queue")
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusBadRequest)
+
+	// The sequencer exports the time the workers spent proving their jobs
+	b, k, err := node.Storage().NextBallotForWorker("worker")
+	c.Assert(err, qt.IsNil)
+	result, err := storage.EncodeArtifact(&storage.VerifiedBallot{ProcessID: b.ProcessID, Nullifier: b.Nullifier})
+	c.Assert(err, qt.IsNil)
+	cli.SetAuthToken("token")
+	_, code, err = cli.Request(http.MethodPost, &api.WorkerJobUpdate{
+		Stage:    storage.StageBallot,
+		Keys:     []types.HexBytes{k},
+		Result:   result,
+		Duration: 2 * time.Second,
+	}, nil, api.WorkerCompleteEndpoint)
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusOK)
+
+	body, code, err := cli.Request(http.MethodGet, nil, nil, "metrics")
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusOK)
+	// the request metrics are shared by all the API instances of the tests,
+	// so only the queue metrics have a known value
+	for _, metric := range []string{
+		`vocdoni_http_requests_total{code="0",method="GET",route="/ping",status="200"} `,
+		`vocdoni_http_requests_total{code="40006",method="GET",route="/process/{id}/queue",status="400"} `,
+		`vocdoni_http_request_duration_seconds_count{method="GET",route="/ping"} `,
+		`vocdoni_queue_items{stage="ballot",state="available"} 2`,
+		`vocdoni_queue_process_items{process="` + hex.EncodeToString(pid.Marshal()) + `",stage="ballot",state="available"} 2`,
+		`vocdoni_queue_dead_letters 0`,
+		`vocdoni_queue_reclaimed_reservations_total{stage="ballot"} 0`,
+		`vocdoni_prover_duration_seconds_count{result="ok",stage="ballot"} `,
+	} {
+		c.Assert(strings.Contains(string(body), metric), qt.IsTrue, qt.Commentf("missing %s in\n%s", metric, body))
+	}
+
+	// The series of a process are removed once it is canceled
+	closed := types.ProcessID{Address: common.Address{1}, Nonce: 1}
+	closedID := hex.EncodeToString(closed.Marshal())
+	c.Assert(node.Storage().SetProcess(closed, &storage.Process{}), qt.IsNil)
+	c.Assert(node.Storage().PushBallot(&storage.Ballot{ProcessID: closed.Marshal(), Nullifier: []byte{1}}), qt.IsNil)
+	metrics.StateTreeLeaves.WithLabelValues(closedID).Set(1)
+	body, _, err = cli.Request(http.MethodGet, nil, nil, "metrics")
+	c.Assert(err, qt.IsNil)
+	for _, metric := range []string{
+		`vocdoni_state_tree_leaves{process="` + closedID + `"} 1`,
+		`vocdoni_queue_process_items{process="` + closedID + `",stage="ballot",state="available"} 1`,
+	} {
+		c.Assert(strings.Contains(string(body), metric), qt.IsTrue, qt.Commentf("missing %s in\n%s", metric, body))
+	}
+	c.Assert(node.Storage().SetProcessStatus(closed, storage.ProcessStatusCanceled), qt.IsNil)
+	body, _, err = cli.Request(http.MethodGet, nil, nil, "metrics")
+	c.Assert(err, qt.IsNil)
+	c.Assert(strings.Contains(string(body), closedID), qt.IsFalse, qt.Commentf("closed process exported in\n%s", body))
+	c.Assert(strings.Contains(string(body), `vocdoni_queue_items{stage="ballot",state="available"} 3`), qt.IsTrue)
+}
@@ -2,12 +2,15 @@ package tests
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
+	"math/big"
 	"net/http"
+	"sync"
 	"testing"
 
 	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/arbo"
 	"github.com/vocdoni/vocdoni-z-sandbox/api"
 	"github.com/vocdoni/vocdoni-z-sandbox/api/client"
 	"github.com/vocdoni/vocdoni-z-sandbox/crypto/ethereum"
@@ -24,8 +27,7 @@ func TestProcess(t *testing.T) {
 	c := qt.New(t)
 
 	// Setup
-	tmpDir := t.TempDir()
-	tmpPort, err := SetupAPI(tmpDir)
+	tmpPort, err := SetupAPI(t)
 	c.Assert(err, qt.IsNil)
 
 	signer, err := NewTestSigner()
@@ -56,20 +58,206 @@ func TestProcess(t *testing.T) {
 		c.Assert(getResp.EncryptionPubKey[1].String(), qt.DeepEquals, resp.EncryptionPubKey[1].String())
 		c.Assert(getResp.Address, qt.DeepEquals, signer.AddressString())
 	})
+
+	t.Run("replay protection", func(t *testing.T) {
+		c := qt.New(t)
+		signer, err := NewTestSigner()
+		c.Assert(err, qt.IsNil)
+		nonce, err := cli.OrganizerNonce(context.Background(), signer.Address())
+		c.Assert(err, qt.IsNil)
+		c.Assert(nonce, qt.Equals, uint64(0))
+
+		process := NewTestProcessWithID(c, signer, 1, 5)
+		body, code, err := cli.Request(http.MethodPost, process, nil, "process")
+		c.Assert(err, qt.IsNil)
+		c.Assert(code, qt.Equals, http.StatusOK, qt.Commentf("response body %s", string(body)))
+		nonce, err = cli.OrganizerNonce(context.Background(), signer.Address())
+		c.Assert(err, qt.IsNil)
+		c.Assert(nonce, qt.Equals, uint64(6))
+
+		// The same request, the same nonce on another chain, and a lower
+		// nonce are rejected
+		for _, p := range []*api.Process{process, NewTestProcessWithID(c, signer, 2, 5), NewTestProcessWithID(c, signer, 1, 4)} {
+			body, code, err := cli.Request(http.MethodPost, p, nil, "process")
+			c.Assert(err, qt.IsNil)
+			c.Assert(code, qt.Equals, http.StatusConflict, qt.Commentf("chain %d nonce %d: %s", p.ChainID, p.Nonce, string(body)))
+		}
+
+		// The signature covers the chain and the parameters of the process,
+		// any change recovers another organizer
+		for _, tamper := range []func(p *api.Process){
+			func(p *api.Process) { p.ChainID, p.Nonce = 12, 3 },
+			func(p *api.Process) { p.CensusRoot = append(types.HexBytes{}, p.CensusRoot[1:]...) },
+			func(p *api.Process) { p.BallotMode.MaxValue = *toBigInt(99) },
+			func(p *api.Process) { p.MetadataHash = make([]byte, 32) },
+			func(p *api.Process) { p.EndTime = 2000000000 },
+		} {
+			p := NewTestProcessWithID(c, signer, 1, 23)
+			tamper(p)
+			address, err := p.SignerAddress()
+			c.Assert(err, qt.IsNil)
+			c.Assert(address, qt.Not(qt.Equals), signer.Address())
+		}
+
+		// The nonce of the organizer endpoint is validated
+		body, code, err = cli.Request(http.MethodGet, nil, nil, "organizers", "0x01", "nonce")
+		c.Assert(err, qt.IsNil)
+		c.Assert(code, qt.Equals, http.StatusBadRequest, qt.Commentf("response body %s", string(body)))
+	})
+
+	t.Run("concurrent requests", func(t *testing.T) {
+		c := qt.New(t)
+		signer, err := NewTestSigner()
+		c.Assert(err, qt.IsNil)
+
+		// Only one of the concurrent requests with the same signature
+		// creates the process, and its key is the one kept by the keystore
+		process := NewTestProcessWithID(c, signer, 1, 0)
+		responses := make(chan []byte, 8)
+		var wg sync.WaitGroup
+		for range cap(responses) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				body, code, err := cli.Request(http.MethodPost, process, nil, "process")
+				c.Check(err, qt.IsNil)
+				if code != http.StatusOK {
+					c.Check(code, qt.Equals, http.StatusConflict, qt.Commentf("response body %s", string(body)))
+					return
+				}
+				responses <- body
+			}()
+		}
+		wg.Wait()
+		close(responses)
+		c.Assert(responses, qt.HasLen, 1)
+		var created api.ProcessResponse
+		c.Assert(json.Unmarshal(<-responses, &created), qt.IsNil)
+
+		body, code, err := cli.Request(http.MethodGet, nil, []string{"id", created.ProcessID.String()}, "process")
+		c.Assert(err, qt.IsNil)
+		c.Assert(code, qt.Equals, http.StatusOK, qt.Commentf("response body %s", string(body)))
+		var stored api.ProcessResponse
+		c.Assert(json.Unmarshal(body, &stored), qt.IsNil)
+		c.Assert(stored.EncryptionPubKey[0].String(), qt.Equals, created.EncryptionPubKey[0].String())
+		c.Assert(stored.EncryptionPubKey[1].String(), qt.Equals, created.EncryptionPubKey[1].String())
+	})
+
+	t.Run("invalid ballot mode", func(t *testing.T) {
+		c := qt.New(t)
+		signer, err := NewTestSigner()
+		c.Assert(err, qt.IsNil)
+		for _, modify := range []func(bm *types.BallotMode){
+			func(bm *types.BallotMode) { bm.MaxCount = 9 },
+			func(bm *types.BallotMode) { bm.MinValue = *toBigInt(101) },
+			func(bm *types.BallotMode) { bm.MinTotalCost = *toBigInt(500) },
+			func(bm *types.BallotMode) { bm.CostExponent = 0 },
+		} {
+			process := NewTestProcess(c, signer)
+			modify(&process.BallotMode)
+			c.Assert(process.Sign(signer), qt.IsNil)
+			body, code, err := cli.Request(http.MethodPost, process, nil, "process")
+			c.Assert(err, qt.IsNil)
+			c.Assert(code, qt.Equals, http.StatusBadRequest, qt.Commentf("response body %s", string(body)))
+			c.Assert(string(body), qt.Contains, "40021")
+		}
+	})
+
+	t.Run("ballot mode preset", func(t *testing.T) {
+		c := qt.New(t)
+		signer, err := NewTestSigner()
+		c.Assert(err, qt.IsNil)
+
+		// The ballot mode of the process is produced by the preset
+		preset := &types.BallotModePreset{Name: types.PresetQuadratic, Options: 4, Credits: 100}
+		process := NewTestProcess(c, signer)
+		process.BallotMode = types.BallotMode{}
+		process.BallotPreset = preset
+		c.Assert(process.Sign(signer), qt.IsNil)
+		body, code, err := cli.Request(http.MethodPost, process, nil, "process")
+		c.Assert(err, qt.IsNil)
+		c.Assert(code, qt.Equals, http.StatusOK, qt.Commentf("response body %s", string(body)))
+		var resp api.ProcessResponse
+		c.Assert(json.NewDecoder(bytes.NewReader(body)).Decode(&resp), qt.IsNil)
+		c.Assert(resp.BallotPreset, qt.DeepEquals, preset)
+		got, err := cli.GetProcess(context.Background(), resp.ProcessID)
+		c.Assert(err, qt.IsNil)
+		c.Assert(got.BallotPreset, qt.DeepEquals, preset)
+		c.Assert(got.BallotMode.CostExponent, qt.Equals, uint8(2))
+		c.Assert(got.BallotMode.MaxValue.String(), qt.Equals, "10")
+
+		// and the ballot modes that match no preset are custom
+		other, err := NewTestSigner()
+		c.Assert(err, qt.IsNil)
+		got, err = cli.GetProcess(context.Background(), CreateTestProcess(c, cli, other).ProcessID)
+		c.Assert(err, qt.IsNil)
+		c.Assert(got.BallotPreset.Name, qt.Equals, types.PresetCustom)
+
+		// Unknown presets, and ballot modes that do not match the preset,
+		// are rejected
+		for _, modify := range []func(p *api.Process){
+			func(p *api.Process) { p.BallotPreset = &types.BallotModePreset{Name: "plurality", Options: 3} },
+			func(p *api.Process) { p.BallotPreset = &types.BallotModePreset{Name: types.PresetBorda, Options: 4} },
+		} {
+			process := NewTestProcess(c, signer)
+			modify(process)
+			body, code, err := cli.Request(http.MethodPost, process, nil, "process")
+			c.Assert(err, qt.IsNil)
+			c.Assert(code, qt.Equals, http.StatusBadRequest, qt.Commentf("response body %s", string(body)))
+			c.Assert(string(body), qt.Contains, "40021")
+		}
+	})
+
+	t.Run("voting period", func(t *testing.T) {
+		c := qt.New(t)
+		signer, err := NewTestSigner()
+		c.Assert(err, qt.IsNil)
+		process := NewTestProcess(c, signer)
+		process.StartTime, process.EndTime = 1900000000, 1800000000
+		c.Assert(process.Sign(signer), qt.IsNil)
+		body, code, err := cli.Request(http.MethodPost, process, nil, "process")
+		c.Assert(err, qt.IsNil)
+		c.Assert(code, qt.Equals, http.StatusBadRequest, qt.Commentf("response body %s", string(body)))
+
+		process.EndTime = 2000000000
+		c.Assert(process.Sign(signer), qt.IsNil)
+		body, code, err = cli.Request(http.MethodPost, process, nil, "process")
+		c.Assert(err, qt.IsNil)
+		c.Assert(code, qt.Equals, http.StatusOK, qt.Commentf("response body %s", string(body)))
+		var resp api.ProcessResponse
+		c.Assert(json.NewDecoder(bytes.NewReader(body)).Decode(&resp), qt.IsNil)
+		got, err := cli.GetProcess(context.Background(), resp.ProcessID)
+		c.Assert(err, qt.IsNil)
+		c.Assert(got.StartTime.Unix(), qt.Equals, int64(1900000000))
+		c.Assert(got.EndTime.Unix(), qt.Equals, int64(2000000000))
+	})
 }
 
 // CreateTestProcess creates a test process with the given parameters.
 // It returns the process response and any error encountered.
 func CreateTestProcess(c *qt.C, cli *client.HTTPclient, signer *ethereum.SignKeys) api.ProcessResponse {
-	// Create test process request
-	nonce := uint64(1)
-	chainID := uint32(1)
-	censusRoot := util.RandomBytes(32)
+	process := NewTestProcess(c, signer)
+	body, code, err := cli.Request(http.MethodPost, process, nil, "process")
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusOK, qt.Commentf("response body %s", string(body)))
 
-	// Sign the process creation request
-	msg := []byte(fmt.Sprintf("%d%d", chainID, nonce))
-	signature, err := signer.SignEthereum(msg)
+	var resp api.ProcessResponse
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&resp)
 	c.Assert(err, qt.IsNil)
+	return resp
+}
+
+// NewTestProcess returns a signed process creation request, with a ballot
+// mode of 5 fields.
+func NewTestProcess(c *qt.C, signer *ethereum.SignKeys) *api.Process {
+	return NewTestProcessWithID(c, signer, 1, 1)
+}
+
+// NewTestProcessWithID returns a signed process creation request like
+// NewTestProcess, with the chain ID and nonce provided.
+func NewTestProcessWithID(c *qt.C, signer *ethereum.SignKeys, chainID uint32, nonce uint64) *api.Process {
+	// Create test process request
+	censusRoot := arbo.BigIntToBytes(32, util.BigToFF(new(big.Int).SetBytes(util.RandomBytes(32))))
 
 	process := &api.Process{
 		CensusRoot: censusRoot,
@@ -83,17 +271,11 @@ func CreateTestProcess(c *qt.C, cli *client.HTTPclient, signer *ethereum.SignKey
 			CostExponent:    1,
 			CostFromWeight:  false,
 		},
-		Nonce:     nonce,
-		ChainID:   chainID,
-		Signature: signature,
+		Nonce:   nonce,
+		ChainID: chainID,
 	}
 
-	body, code, err := cli.Request(http.MethodPost, process, nil, "process")
-	c.Assert(err, qt.IsNil)
-	c.Assert(code, qt.Equals, http.StatusOK, qt.Commentf("response body %s", string(body)))
-
-	var resp api.ProcessResponse
-	err = json.NewDecoder(bytes.NewReader(body)).Decode(&resp)
-	c.Assert(err, qt.IsNil)
-	return resp
+	// Sign the process creation request
+	c.Assert(process.Sign(signer), qt.IsNil)
+	return process
 }
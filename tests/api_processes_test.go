@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/api"
+	"github.com/vocdoni/vocdoni-z-sandbox/api/client"
+	stg "github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+func TestProcesses(t *testing.T) {
+	c := qt.New(t)
+
+	// Setup
+	tmpPort, err := SetupAPI(t)
+	c.Assert(err, qt.IsNil)
+	cli, err := NewTestClient(tmpPort)
+	c.Assert(err, qt.IsNil)
+
+	// 2 organizers with a process on chain 1 and another on chain 2, which
+	// take consecutive nonces
+	before := time.Now().Add(-time.Second)
+	organizers := []common.Address{}
+	for range 2 {
+		signer, err := NewTestSigner()
+		c.Assert(err, qt.IsNil)
+		for chainID := uint32(1); chainID <= 2; chainID++ {
+			process := NewTestProcessWithID(c, signer, chainID, uint64(chainID))
+			body, code, err := cli.Request(http.MethodPost, process, nil, "process")
+			c.Assert(err, qt.IsNil)
+			c.Assert(code, qt.Equals, http.StatusOK, qt.Commentf("response body %s", string(body)))
+		}
+		organizers = append(organizers, signer.Address())
+	}
+
+	listIDs := func(query *client.ProcessesQuery) ([]string, types.HexBytes) {
+		resp, err := cli.Processes(context.Background(), query)
+		c.Assert(err, qt.IsNil)
+		ids := []string{}
+		for _, p := range resp.Processes {
+			ids = append(ids, p.ProcessID.String())
+		}
+		return ids, resp.NextCursor
+	}
+
+	// All the processes, in creation order
+	all, next := listIDs(&client.ProcessesQuery{})
+	c.Assert(all, qt.HasLen, 4)
+	c.Assert(next, qt.IsNil)
+
+	// The process details match the process endpoint
+	resp, err := cli.Processes(context.Background(), &client.ProcessesQuery{Limit: 1})
+	c.Assert(err, qt.IsNil)
+	first := resp.Processes[0]
+	c.Assert(first.Status, qt.Equals, stg.ProcessStatusReady)
+	c.Assert(first.CreatedAt.After(before), qt.IsTrue)
+	process, err := cli.GetProcess(context.Background(), first.ProcessID)
+	c.Assert(err, qt.IsNil)
+	for i := range first.EncryptionPubKey {
+		c.Assert(process.EncryptionPubKey[i].String(), qt.Equals, first.EncryptionPubKey[i].String())
+	}
+	c.Assert(process.CreatedAt.Equal(*first.CreatedAt), qt.IsTrue)
+
+	// Filters
+	organizer := organizers[1]
+	chainID := uint32(2)
+	ids, _ := listIDs(&client.ProcessesQuery{Organizer: &organizer})
+	c.Assert(ids, qt.DeepEquals, all[2:])
+	ids, _ = listIDs(&client.ProcessesQuery{ChainID: &chainID})
+	c.Assert(ids, qt.DeepEquals, []string{all[1], all[3]})
+	ids, _ = listIDs(&client.ProcessesQuery{Organizer: &organizer, ChainID: &chainID})
+	c.Assert(ids, qt.DeepEquals, []string{all[3]})
+	ids, _ = listIDs(&client.ProcessesQuery{Status: stg.ProcessStatusEnded})
+	c.Assert(ids, qt.HasLen, 0)
+	ids, _ = listIDs(&client.ProcessesQuery{From: before, To: time.Now()})
+	c.Assert(ids, qt.DeepEquals, all)
+	ids, _ = listIDs(&client.ProcessesQuery{To: before})
+	c.Assert(ids, qt.HasLen, 0)
+
+	// Pagination
+	page, next := listIDs(&client.ProcessesQuery{Limit: 3})
+	c.Assert(page, qt.DeepEquals, all[:3])
+	c.Assert(next, qt.Not(qt.IsNil))
+	page, next = listIDs(&client.ProcessesQuery{Limit: 3, Cursor: next})
+	c.Assert(page, qt.DeepEquals, all[3:])
+	c.Assert(next, qt.IsNil)
+
+	// Malformed queries
+	for _, params := range [][]string{
+		{"organizer", "0x01"},
+		{"chainId", "-1"},
+		{"status", "paused"},
+		{"from", "yesterday"},
+		{"cursor", "0102"},
+		{"limit", "0"},
+		{"limit", "1000"},
+	} {
+		body, code, err := cli.Request(http.MethodGet, nil, params, api.ProcessesEndpoint)
+		c.Assert(err, qt.IsNil)
+		c.Assert(code, qt.Equals, http.StatusBadRequest, qt.Commentf("%v: %s", params, string(body)))
+	}
+}
@@ -0,0 +1,61 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/api"
+	"github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+func TestQueueStats(t *testing.T) {
+	c := qt.New(t)
+
+	// Setup
+	node, port, err := SetupAPIWithConfig(t, &api.APIConfig{
+		AdminTokens: map[string]api.Admin{"auditor-token": {Name: "audit", Role: api.AdminRoleAuditor}},
+	})
+	c.Assert(err, qt.IsNil)
+	cli, err := NewTestClient(port)
+	c.Assert(err, qt.IsNil)
+
+	pid := types.ProcessID{Nonce: 1}
+	for i := 0; i < 3; i++ {
+		b := &storage.Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{byte(i)}}
+		c.Assert(node.Storage().PushBallot(b), qt.IsNil)
+	}
+
+	// Queue statistics of the process
+	pidHex := hex.EncodeToString(pid.Marshal())
+	body, code, err := cli.Request(http.MethodGet, nil, nil, "process", pidHex, "queue")
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusOK, qt.Commentf("response body %s", string(body)))
+	var stats storage.QueueStats
+	c.Assert(json.NewDecoder(bytes.NewReader(body)).Decode(&stats), qt.IsNil)
+	c.Assert(stats.Pending, qt.Equals, 3)
+	c.Assert(stats.Stages, qt.HasLen, 3)
+
+	// Queue statistics of all the processes, only for the admins
+	_, code, err = cli.Request(http.MethodGet, nil, nil, "admin", "queues")
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusUnauthorized)
+	cli.SetAuthToken("auditor-token")
+	body, code, err = cli.Request(http.MethodGet, nil, nil, "admin", "queues")
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusOK, qt.Commentf("response body %s", string(body)))
+	var resp api.QueuesResponse
+	c.Assert(json.NewDecoder(bytes.NewReader(body)).Decode(&resp), qt.IsNil)
+	c.Assert(resp.Total.Pending, qt.Equals, 3)
+	c.Assert(resp.Processes, qt.HasLen, 1)
+	c.Assert(resp.Processes[pidHex].Pending, qt.Equals, 3)
+
+	// Malformed process ID
+	_, code, err = cli.Request(http.MethodGet, nil, nil, "process", "0102", "queue")
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusBadRequest)
+}
@@ -0,0 +1,258 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/vocdoni-z-sandbox/api"
+	"github.com/vocdoni/vocdoni-z-sandbox/api/client"
+	"github.com/vocdoni/vocdoni-z-sandbox/storage"
+	"github.com/vocdoni/vocdoni-z-sandbox/types"
+)
+
+func TestWorkers(t *testing.T) {
+	c := qt.New(t)
+
+	// Setup a node with three verifier workers and one aggregator
+	tokens := map[string]string{
+		"verifier-token-1": "verifier-1",
+		"verifier-token-2": "verifier-2",
+		"verifier-token-3": "verifier-3",
+		"aggregator-token": "aggregator",
+	}
+	node, port, err := SetupAPIWithConfig(t, &api.APIConfig{
+		WorkerTokens: tokens,
+		RetryPolicy:  &storage.RetryPolicy{MaxAttempts: 1},
+	})
+	c.Assert(err, qt.IsNil)
+	stg := node.Storage()
+
+	// Push the ballots, the last one cannot be verified
+	const n = 30
+	pid := types.ProcessID{Nonce: 1}
+	invalid := []byte{n}
+	for i := 0; i <= n; i++ {
+		b := &storage.Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{byte(i)}, VoterWeight: big.NewInt(1)}
+		c.Assert(stg.PushBallot(b), qt.IsNil)
+	}
+
+	// The workers are rejected without a valid token
+	cli, err := NewTestClient(port)
+	c.Assert(err, qt.IsNil)
+	lease := &api.WorkerLeaseRequest{Stage: storage.StageBallot}
+	_, code, err := cli.Request(http.MethodPost, lease, nil, api.WorkerLeaseEndpoint)
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusUnauthorized)
+	cli.SetAuthToken("invalid")
+	_, code, err = cli.Request(http.MethodPost, lease, nil, api.WorkerLeaseEndpoint)
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusUnauthorized)
+
+	var mu sync.Mutex
+	verified := make(map[string]string)
+	verify := func(worker string) client.ProveFunc {
+		return func(_ context.Context, job *api.WorkerJob) ([]byte, error) {
+			b, err := storage.DecodeArtifact[storage.Ballot](job.Artifacts[0])
+			if err != nil {
+				return nil, err
+			}
+			if bytes.Equal(b.Nullifier, invalid) {
+				return nil, errors.New("invalid ballot proof")
+			}
+			mu.Lock()
+			if prev, ok := verified[b.Nullifier.String()]; ok {
+				t.Errorf("ballot %s verified by %s and %s", b.Nullifier, prev, worker)
+			}
+			verified[b.Nullifier.String()] = worker
+			mu.Unlock()
+			return storage.EncodeArtifact(&storage.VerifiedBallot{
+				ProcessID:   b.ProcessID,
+				Nullifier:   b.Nullifier,
+				VoterWeight: b.VoterWeight,
+			})
+		}
+	}
+	aggregate := func(_ context.Context, job *api.WorkerJob) ([]byte, error) {
+		abb := &storage.AggregatedBallotBatch{ProcessID: pid.Marshal()}
+		for _, data := range job.Artifacts {
+			vb, err := storage.DecodeArtifact[storage.VerifiedBallot](data)
+			if err != nil {
+				return nil, err
+			}
+			abb.Ballots = append(abb.Ballots, storage.AggregatedBallot{Nullifier: vb.Nullifier, TraceContext: vb.TraceContext})
+		}
+		return storage.EncodeArtifact(abb)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	for token, worker := range tokens {
+		cli, err := NewTestClient(port)
+		c.Assert(err, qt.IsNil)
+		cli.SetAuthToken(token)
+		conf := client.WorkerConfig{
+			Stage:             storage.StageBallot,
+			PollInterval:      10 * time.Millisecond,
+			HeartbeatInterval: 10 * time.Millisecond,
+		}
+		prove := verify(worker)
+		if worker == "aggregator" {
+			conf.Stage, conf.ProcessID, conf.MaxCount = storage.StageVerifiedBallot, pid.Marshal(), 4
+			prove = aggregate
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.NewWorker(cli, conf, prove).Run(ctx)
+		}()
+	}
+
+	// Every valid ballot is verified once and aggregated once
+	aggregated := make(map[string]int)
+	deadline := time.Now().Add(30 * time.Second)
+	for len(aggregated) < n {
+		c.Assert(time.Now().Before(deadline), qt.IsTrue, qt.Commentf("%d ballots aggregated", len(aggregated)))
+		abb, k, err := stg.NextBallotBatch(pid.Marshal())
+		if errors.Is(err, storage.ErrNoMoreElements) {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		c.Assert(err, qt.IsNil)
+		for _, b := range abb.Ballots {
+			aggregated[b.Nullifier.String()]++
+		}
+		c.Assert(stg.MarkBallotBatchDone(k), qt.IsNil)
+	}
+	cancel()
+	wg.Wait()
+	c.Assert(verified, qt.HasLen, n)
+	for nullifier, times := range aggregated {
+		c.Assert(times, qt.Equals, 1, qt.Commentf("ballot %s aggregated %d times", nullifier, times))
+	}
+
+	// The invalid ballot is reported and moved to the dead letters
+	dls, err := stg.DeadLetters()
+	c.Assert(err, qt.IsNil)
+	c.Assert(dls, qt.HasLen, 1)
+	c.Assert(dls[0].Error, qt.Equals, "invalid ballot proof")
+	b, err := storage.DecodeArtifact[storage.Ballot](dls[0].Artifact)
+	c.Assert(err, qt.IsNil)
+	c.Assert([]byte(b.Nullifier), qt.DeepEquals, invalid)
+
+	// The jobs cannot be completed by workers not holding their lease
+	c.Assert(stg.PushBallot(&storage.Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{n + 1}}), qt.IsNil)
+	_, k, err := stg.NextBallotForWorker("verifier-1")
+	c.Assert(err, qt.IsNil)
+	cli.SetAuthToken("verifier-token-2")
+	body, code, err := cli.Request(http.MethodPost, &api.WorkerJobUpdate{
+		Stage: storage.StageBallot,
+		Keys:  []types.HexBytes{k},
+	}, nil, api.WorkerHeartbeatEndpoint)
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusForbidden, qt.Commentf("response body %s", body))
+	cli.SetAuthToken("verifier-token-1")
+	body, code, err = cli.Request(http.MethodPost, &api.WorkerJobUpdate{
+		Stage: "unknown",
+		Keys:  []types.HexBytes{k},
+	}, nil, api.WorkerHeartbeatEndpoint)
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusBadRequest, qt.Commentf("response body %s", body))
+	_, code, err = cli.Request(http.MethodPost, &api.WorkerJobUpdate{
+		Stage: storage.StageBallot,
+		Keys:  []types.HexBytes{k},
+	}, nil, api.WorkerHeartbeatEndpoint)
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusOK)
+
+	// The results must match the items leased
+	complete := func(stage string, keys []types.HexBytes, result any) int {
+		var data []byte
+		switch r := result.(type) {
+		case *storage.VerifiedBallot:
+			data, err = storage.EncodeArtifact(r)
+		case *storage.AggregatedBallotBatch:
+			data, err = storage.EncodeArtifact(r)
+		}
+		c.Assert(err, qt.IsNil)
+		body, code, err := cli.Request(http.MethodPost, &api.WorkerJobUpdate{
+			Stage: stage, Keys: keys, Result: data,
+		}, nil, api.WorkerCompleteEndpoint)
+		c.Assert(err, qt.IsNil, qt.Commentf("response body %s", body))
+		return code
+	}
+	vb := &storage.VerifiedBallot{ProcessID: pid.Marshal(), Nullifier: []byte{n + 1}}
+	forged := &storage.VerifiedBallot{ProcessID: pid.Marshal(), Nullifier: []byte{n + 2}}
+	c.Assert(complete(storage.StageBallot, []types.HexBytes{k}, forged), qt.Equals, http.StatusBadRequest)
+	c.Assert(complete(storage.StageBallot, []types.HexBytes{k}, vb), qt.Equals, http.StatusOK)
+	_, vkeys, err := stg.PullVerifiedBallotsForWorker(pid.Marshal(), 1, "aggregator")
+	c.Assert(err, qt.IsNil)
+	cli.SetAuthToken("aggregator-token")
+	abb := &storage.AggregatedBallotBatch{
+		ProcessID: pid.Marshal(),
+		Ballots:   []storage.AggregatedBallot{{Nullifier: forged.Nullifier}},
+	}
+	c.Assert(complete(storage.StageVerifiedBallot, []types.HexBytes{vkeys[0]}, abb), qt.Equals, http.StatusBadRequest)
+	abb.Ballots[0].Nullifier = vb.Nullifier
+	c.Assert(complete(storage.StageVerifiedBallot, []types.HexBytes{vkeys[0]}, abb), qt.Equals, http.StatusOK)
+	c.Assert(complete(storage.StageVerifiedBallot, []types.HexBytes{vkeys[0]}, abb), qt.Equals, http.StatusNotFound)
+}
+
+func TestWorkersClosedProcess(t *testing.T) {
+	c := qt.New(t)
+
+	node, port, err := SetupAPIWithConfig(t, &api.APIConfig{
+		WorkerTokens: map[string]string{"worker-token": "worker"},
+	})
+	c.Assert(err, qt.IsNil)
+	stg := node.Storage()
+	cli, err := NewTestClient(port)
+	c.Assert(err, qt.IsNil)
+	cli.SetAuthToken("worker-token")
+
+	// A process with a verified ballot and a pending one
+	pid := types.ProcessID{Nonce: 1}
+	c.Assert(stg.SetProcess(pid, &storage.Process{}), qt.IsNil)
+	c.Assert(stg.PushBallot(&storage.Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{1}}), qt.IsNil)
+	_, k, err := stg.NextBallot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(stg.MarkBallotDone(k, &storage.VerifiedBallot{ProcessID: pid.Marshal(), Nullifier: []byte{1}}), qt.IsNil)
+	c.Assert(stg.PushBallot(&storage.Ballot{ProcessID: pid.Marshal(), Nullifier: []byte{2}}), qt.IsNil)
+
+	// Once canceled its items are not leased, and its pending ballots are
+	// moved to the dead letters
+	c.Assert(stg.SetProcessStatus(pid, storage.ProcessStatusCanceled), qt.IsNil)
+	body, code, err := cli.Request(http.MethodPost, &api.WorkerLeaseRequest{Stage: storage.StageBallot}, nil, api.WorkerLeaseEndpoint)
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, http.StatusNoContent, qt.Commentf("response body %s", body))
+	dls, err := stg.DeadLetters()
+	c.Assert(err, qt.IsNil)
+	c.Assert(dls, qt.HasLen, 1)
+	c.Assert(dls[0].Error, qt.Contains, storage.ErrProcessClosed.Error())
+
+	body, code, err = cli.Request(http.MethodPost, &api.WorkerLeaseRequest{
+		Stage:     storage.StageVerifiedBallot,
+		ProcessID: pid.Marshal(),
+		MaxCount:  1,
+	}, nil, api.WorkerLeaseEndpoint)
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, api.ErrProcessClosed.HTTPstatus, qt.Commentf("response body %s", body))
+	body, code, err = cli.Request(http.MethodPost, &api.WorkerLeaseRequest{
+		Stage:     storage.StageBallotBatch,
+		ProcessID: pid.Marshal(),
+	}, nil, api.WorkerLeaseEndpoint)
+	c.Assert(err, qt.IsNil)
+	c.Assert(code, qt.Equals, api.ErrProcessClosed.HTTPstatus, qt.Commentf("response body %s", body))
+
+	// the ended processes neither
+	c.Assert(stg.SetProcessStatus(pid, storage.ProcessStatusEnded), qt.IsNil)
+	_, _, err = stg.PullVerifiedBallots(pid.Marshal(), 1)
+	c.Assert(err, qt.ErrorIs, storage.ErrProcessClosed)
+}
@@ -1,8 +1,10 @@
 package tests
 
 import (
+	"context"
 	"fmt"
-	"time"
+	"net"
+	"testing"
 
 	"github.com/vocdoni/vocdoni-z-sandbox/api"
 	"github.com/vocdoni/vocdoni-z-sandbox/api/client"
@@ -18,23 +20,41 @@ func toBigInt(i int64) *types.BigInt {
 	return bi
 }
 
-// SetupAPI creates and starts a new API server for testing.
-// It returns the server port.
-func SetupAPI(tmpDir string) (int, error) {
-	tmpPort := util.RandomInt(40000, 60000)
+// SetupAPI creates and starts a new API server for testing, which is shut
+// down when the test finishes. It returns the server port.
+func SetupAPI(t testing.TB) (int, error) {
+	_, port, err := SetupAPIWithConfig(t, &api.APIConfig{})
+	return port, err
+}
 
-	_, err := api.New(&api.APIConfig{
-		Host:    "127.0.0.1",
-		Port:    tmpPort,
-		DataDir: tmpDir,
-	})
+// SetupAPIWithConfig creates and starts a new API server for testing with
+// the configuration provided, which is shut down when the test finishes.
+// The host, data directory and master key are set if they are empty, and
+// the server listens on a random free port if none is set. It returns the
+// API and the server port.
+func SetupAPIWithConfig(t testing.TB, conf *api.APIConfig) (*api.API, int, error) {
+	if conf.Host == "" {
+		conf.Host = "127.0.0.1"
+	}
+	if conf.DataDir == "" {
+		conf.DataDir = t.TempDir()
+	}
+	if conf.MasterKey == nil {
+		conf.MasterKey = util.RandomBytes(32)
+	}
+	a, err := api.New(conf)
 	if err != nil {
-		return 0, err
+		return nil, 0, err
 	}
-
-	// Wait for the HTTP server to start
-	time.Sleep(500 * time.Millisecond)
-	return tmpPort, nil
+	t.Cleanup(func() {
+		if err := a.Shutdown(context.Background()); err != nil {
+			t.Errorf("could not shut down the API: %v", err)
+		}
+	})
+	if err := a.Start(context.Background()); err != nil {
+		return nil, 0, err
+	}
+	return a, a.Addr().(*net.TCPAddr).Port, nil
 }
 
 // NewTestSigner creates and initializes a new ethereum signer for testing.
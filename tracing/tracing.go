@@ -0,0 +1,143 @@
+// Package tracing configures the OpenTelemetry tracing of the node and
+// provides the helpers to carry the trace context of a ballot through the
+// processing queues. Until Init is called the tracer is a no-op, so the
+// spans cost nothing and no trace context is stored.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans of the node.
+const tracerName = "github.com/vocdoni/vocdoni-z-sandbox"
+
+// Exporters supported by Init.
+const (
+	// ExporterOTLP sends the spans to an OTLP collector over HTTP.
+	ExporterOTLP = "otlp"
+	// ExporterStdout writes the spans as JSON, it is meant for tests and
+	// debugging.
+	ExporterStdout = "stdout"
+)
+
+// Config defines how the spans are exported.
+type Config struct {
+	// Exporter is ExporterOTLP or ExporterStdout.
+	Exporter string
+	// ServiceName identifies the node in the traces, "vocdoni-z-sandbox"
+	// if empty.
+	ServiceName string
+	// Endpoint is the host:port of the OTLP collector. If empty, the
+	// OTEL_EXPORTER_OTLP_ENDPOINT environment variable or the default
+	// localhost:4318 is used.
+	Endpoint string
+	// Insecure disables TLS for the OTLP collector.
+	Insecure bool
+	// Writer is the output of the stdout exporter, os.Stdout if nil.
+	Writer io.Writer
+}
+
+// Init sets up the global tracer provider with the exporter of the config,
+// and the W3C trace context propagation. It returns a function that flushes
+// the pending spans and stops the provider.
+func Init(ctx context.Context, conf Config) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch conf.Exporter {
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{}
+		if conf.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(conf.Endpoint))
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case ExporterStdout:
+		w := conf.Writer
+		if w == nil {
+			w = os.Stdout
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(w))
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", conf.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create %s exporter: %w", conf.Exporter, err)
+	}
+
+	serviceName := conf.ServiceName
+	if serviceName == "" {
+		serviceName = "vocdoni-z-sandbox"
+	}
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(sdkresource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	}
+	// the stdout exporter writes the spans as soon as they end, so the tests
+	// can read them without waiting for a batch
+	if conf.Exporter == ExporterStdout {
+		opts = append(opts, sdktrace.WithSyncer(exporter))
+	} else {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer of the node.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Start starts a span with the tracer of the node, see trace.Tracer.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, opts...)
+}
+
+// Inject returns the trace context of the span of the context provided, to
+// be stored with an artifact. It returns nil if there is no recording span.
+func Inject(ctx context.Context) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns a copy of the context provided that continues the trace
+// context stored with an artifact (see Inject).
+func Extract(ctx context.Context, traceContext map[string]string) context.Context {
+	if len(traceContext) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(traceContext))
+}
+
+// Link returns a link to the span of the trace context stored with an
+// artifact, and false if there is none.
+func Link(traceContext map[string]string, attrs ...attribute.KeyValue) (trace.Link, bool) {
+	sc := trace.SpanContextFromContext(Extract(context.Background(), traceContext))
+	if !sc.IsValid() {
+		return trace.Link{}, false
+	}
+	return trace.Link{SpanContext: sc, Attributes: attrs}, true
+}
@@ -5,6 +5,24 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math/big"
+)
+
+const (
+	// MaxBallotFields is the number of fields of the ballot circuit, the
+	// maximum MaxCount of a ballot mode.
+	MaxBallotFields = 8
+	// BallotValueBits is the size in bits of the values of the ballot fields
+	// supported by the circuit.
+	BallotValueBits = 32
+	// BallotCostBits is the size in bits of the costs supported by the
+	// comparators of the circuit.
+	BallotCostBits = 128
+)
+
+var (
+	maxBallotValue = new(big.Int).Lsh(big.NewInt(1), BallotValueBits)
+	maxBallotCost  = new(big.Int).Lsh(big.NewInt(1), BallotCostBits)
 )
 
 // BallotMode is the struct to define the rules of a ballot
@@ -188,3 +206,116 @@ func (b *BallotMode) UnmarshalJSON(data []byte) error {
 	}
 	return json.Unmarshal(data, aux)
 }
+
+// Validate checks that the ballot mode is consistent and supported by the
+// ballot circuit: it has between 1 and MaxBallotFields fields, the value
+// bounds are ordered and fit in BallotValueBits, the cost exponent is at
+// least 1 and the cost of MaxCount fields of MaxValue fits in
+// BallotCostBits, and the total cost bounds leave room for a vote. If
+// ForceUniqueness is set, the value range must have a value for each field.
+func (b *BallotMode) Validate() error {
+	if b.MaxCount == 0 || b.MaxCount > MaxBallotFields {
+		return fmt.Errorf("max count %d must be between 1 and %d", b.MaxCount, MaxBallotFields)
+	}
+	minValue, maxValue := b.MinValue.MathBigInt(), b.MaxValue.MathBigInt()
+	if minValue.Sign() < 0 {
+		return fmt.Errorf("min value %s is negative", minValue)
+	}
+	if minValue.Cmp(maxValue) > 0 {
+		return fmt.Errorf("min value %s is greater than max value %s", minValue, maxValue)
+	}
+	if maxValue.Cmp(maxBallotValue) >= 0 {
+		return fmt.Errorf("max value %s does not fit in %d bits", maxValue, BallotValueBits)
+	}
+	if b.ForceUniqueness {
+		values := new(big.Int).Sub(maxValue, minValue)
+		if values.Add(values, big.NewInt(1)).Cmp(big.NewInt(int64(b.MaxCount))) < 0 {
+			return fmt.Errorf("unique values between %s and %s do not fill %d fields", minValue, maxValue, b.MaxCount)
+		}
+	}
+	if b.CostExponent == 0 {
+		return fmt.Errorf("cost exponent must be at least 1")
+	}
+	fieldCost := new(big.Int).Exp(maxValue, big.NewInt(int64(b.CostExponent)), nil)
+	if fieldCost.Mul(fieldCost, big.NewInt(int64(b.MaxCount))).Cmp(maxBallotCost) >= 0 {
+		return fmt.Errorf("cost exponent %d overflows the cost of %d fields of value %s", b.CostExponent, b.MaxCount, maxValue)
+	}
+	minCost, maxCost := b.MinTotalCost.MathBigInt(), b.MaxTotalCost.MathBigInt()
+	if minCost.Sign() < 0 {
+		return fmt.Errorf("min total cost %s is negative", minCost)
+	}
+	if b.CostFromWeight {
+		// the maximum cost is the weight of each voter
+		return nil
+	}
+	if maxCost.Cmp(maxBallotCost) >= 0 {
+		return fmt.Errorf("max total cost %s does not fit in %d bits", maxCost, BallotCostBits)
+	}
+	if minCost.Cmp(maxCost) >= 0 {
+		return fmt.Errorf("min total cost %s is not lower than max total cost %s", minCost, maxCost)
+	}
+	return nil
+}
+
+// Cost returns the cost of the fields of a ballot, the sum of each field to
+// the power of CostExponent. As in the circuit, the missing fields up to
+// MaxCount are zero, and cost 1 if the exponent is 0.
+func (b *BallotMode) Cost(fields []*big.Int) *big.Int {
+	cost := new(big.Int)
+	exp := big.NewInt(int64(b.CostExponent))
+	for i := range max(len(fields), int(b.MaxCount)) {
+		field := big.NewInt(0)
+		if i < len(fields) && fields[i] != nil {
+			field = fields[i]
+		}
+		cost.Add(cost, new(big.Int).Exp(field, exp, nil))
+	}
+	return cost
+}
+
+// CheckVote checks the fields of a ballot against the ballot mode, as the
+// circuit does. There are at most MaxCount fields, the missing ones are zero,
+// and all of them must be between MinValue and MaxValue, and unique if
+// ForceUniqueness is set. Their cost (see Cost) must be at least MinTotalCost
+// and lower than the maximum cost, which is the weight of the voter if
+// CostFromWeight is set and MaxTotalCost otherwise.
+func (b *BallotMode) CheckVote(fields []*big.Int, weight *big.Int) error {
+	if len(fields) > int(b.MaxCount) {
+		return fmt.Errorf("too many fields: %d, the maximum is %d", len(fields), b.MaxCount)
+	}
+	minValue, maxValue := b.MinValue.MathBigInt(), b.MaxValue.MathBigInt()
+	seen := make(map[string]bool, b.MaxCount)
+	for i := range int(b.MaxCount) {
+		field := big.NewInt(0)
+		if i < len(fields) {
+			if fields[i] == nil {
+				return fmt.Errorf("field %d is missing", i)
+			}
+			field = fields[i]
+		}
+		if field.Cmp(minValue) < 0 || field.Cmp(maxValue) > 0 {
+			return fmt.Errorf("field %d is %s, it must be between %s and %s", i, field, minValue, maxValue)
+		}
+		if b.ForceUniqueness {
+			if seen[field.String()] {
+				return fmt.Errorf("field %d is repeated: %s", i, field)
+			}
+			seen[field.String()] = true
+		}
+	}
+	maxCost := b.MaxTotalCost.MathBigInt()
+	if b.CostFromWeight {
+		if weight == nil {
+			return fmt.Errorf("missing voter weight")
+		}
+		maxCost = weight
+	}
+	cost := b.Cost(fields)
+	if cost.Cmp(maxCost) >= 0 {
+		return fmt.Errorf("total cost %s must be lower than %s", cost, maxCost)
+	}
+	if cost.Cmp(b.MinTotalCost.MathBigInt()) < 0 {
+		return fmt.Errorf("total cost %s is lower than the minimum %s", cost, b.MinTotalCost.MathBigInt())
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+)
+
+// The names of the ballot mode presets, the common voting schemes with a
+// constructor that produces a valid BallotMode. PresetCustom labels the
+// ballot modes that do not match any preset.
+const (
+	PresetSingleChoice         = "singleChoice"
+	PresetMultipleChoice       = "multipleChoice"
+	PresetApproval             = "approval"
+	PresetBorda                = "borda"
+	PresetQuadratic            = "quadratic"
+	PresetWeightedYesNoAbstain = "weightedYesNoAbstain"
+	PresetCustom               = "custom"
+)
+
+// BallotModePreset is a voting scheme by name, with the parameters of its
+// constructor. Options is the number of options, each one a field of the
+// ballot, MaxChoices is the number of options selectable in a multiple
+// choice ballot and Credits the voice credits of a quadratic ballot.
+type BallotModePreset struct {
+	Name       string `json:"name"`
+	Options    uint8  `json:"options,omitempty"`
+	MaxChoices uint8  `json:"maxChoices,omitempty"`
+	Credits    uint64 `json:"credits,omitempty"`
+}
+
+// BallotMode returns the ballot mode of the preset.
+func (p *BallotModePreset) BallotMode() (*BallotMode, error) {
+	switch p.Name {
+	case PresetSingleChoice:
+		return SingleChoiceBallotMode(p.Options)
+	case PresetMultipleChoice:
+		return MultipleChoiceBallotMode(p.Options, p.MaxChoices)
+	case PresetApproval:
+		return ApprovalBallotMode(p.Options)
+	case PresetBorda:
+		return BordaBallotMode(p.Options)
+	case PresetQuadratic:
+		return QuadraticBallotMode(p.Options, p.Credits)
+	case PresetWeightedYesNoAbstain:
+		return WeightedYesNoAbstainBallotMode()
+	}
+	return nil, fmt.Errorf("unknown ballot mode preset %q", p.Name)
+}
+
+// SingleChoiceBallotMode returns the ballot mode to select one of the
+// options: each field is 0 or 1, and exactly one of them is 1.
+func SingleChoiceBallotMode(options uint8) (*BallotMode, error) {
+	return MultipleChoiceBallotMode(options, 1)
+}
+
+// MultipleChoiceBallotMode returns the ballot mode to select between 1 and
+// maxChoices of the options: each field is 0 or 1, and at most maxChoices of
+// them are 1.
+func MultipleChoiceBallotMode(options, maxChoices uint8) (*BallotMode, error) {
+	if maxChoices == 0 || maxChoices > options {
+		return nil, fmt.Errorf("max choices %d must be between 1 and the number of options %d", maxChoices, options)
+	}
+	return newPresetBallotMode(&BallotMode{
+		MaxCount:     options,
+		MaxValue:     *new(BigInt).SetUint64(1),
+		MinTotalCost: *new(BigInt).SetUint64(1),
+		MaxTotalCost: *new(BigInt).SetUint64(uint64(maxChoices) + 1),
+		CostExponent: 1,
+	})
+}
+
+// ApprovalBallotMode returns the ballot mode to approve any number of the
+// options, none included: each field is 0 or 1.
+func ApprovalBallotMode(options uint8) (*BallotMode, error) {
+	return newPresetBallotMode(&BallotMode{
+		MaxCount:     options,
+		MaxValue:     *new(BigInt).SetUint64(1),
+		MaxTotalCost: *new(BigInt).SetUint64(uint64(options) + 1),
+		CostExponent: 1,
+	})
+}
+
+// BordaBallotMode returns the ballot mode to rank all the options: each
+// field is the points given to an option, from 0 to options-1, and the
+// points are unique, so their sum is the same for every voter.
+func BordaBallotMode(options uint8) (*BallotMode, error) {
+	if options == 0 {
+		return nil, fmt.Errorf("no options")
+	}
+	n := uint64(options)
+	return newPresetBallotMode(&BallotMode{
+		MaxCount:        options,
+		ForceUniqueness: true,
+		MaxValue:        *new(BigInt).SetUint64(n - 1),
+		MinTotalCost:    *new(BigInt).SetUint64(n * (n - 1) / 2),
+		MaxTotalCost:    *new(BigInt).SetUint64(n*(n-1)/2 + 1),
+		CostExponent:    1,
+	})
+}
+
+// QuadraticBallotMode returns the ballot mode of quadratic voting: each
+// field is the votes given to an option, which cost its square in voice
+// credits, and the cost of the ballot cannot exceed the credits.
+func QuadraticBallotMode(options uint8, credits uint64) (*BallotMode, error) {
+	if credits == 0 {
+		return nil, fmt.Errorf("no voice credits")
+	}
+	maxVotes := new(big.Int).Sqrt(new(big.Int).SetUint64(credits))
+	return newPresetBallotMode(&BallotMode{
+		MaxCount:     options,
+		MaxValue:     *(*BigInt)(maxVotes),
+		MaxTotalCost: *new(BigInt).Add(new(BigInt).SetUint64(credits), new(BigInt).SetUint64(1)),
+		CostExponent: 2,
+	})
+}
+
+// WeightedYesNoAbstainBallotMode returns the ballot mode to split the weight
+// of the voter between yes, no and abstain, the three fields of the ballot.
+// The circuit requires the cost of the ballot to be lower than the weight,
+// so the weights of the census must be the voting power of each voter plus
+// one to vote with all of it.
+func WeightedYesNoAbstainBallotMode() (*BallotMode, error) {
+	return newPresetBallotMode(&BallotMode{
+		MaxCount:       3,
+		MaxValue:       *(*BigInt)(new(big.Int).Sub(maxBallotValue, big.NewInt(1))),
+		MinTotalCost:   *new(BigInt).SetUint64(1),
+		CostExponent:   1,
+		CostFromWeight: true,
+	})
+}
+
+// newPresetBallotMode returns the ballot mode provided if it is valid.
+func newPresetBallotMode(bm *BallotMode) (*BallotMode, error) {
+	if err := bm.Validate(); err != nil {
+		return nil, err
+	}
+	return bm, nil
+}
+
+// DetectBallotModePreset returns the preset that produces the ballot mode
+// provided, or a PresetCustom preset if there is none.
+func DetectBallotModePreset(bm *BallotMode) *BallotModePreset {
+	candidates := []*BallotModePreset{
+		{Name: PresetSingleChoice, Options: bm.MaxCount},
+		{Name: PresetApproval, Options: bm.MaxCount},
+		{Name: PresetBorda, Options: bm.MaxCount},
+		{Name: PresetWeightedYesNoAbstain},
+	}
+	// The max choices and the credits are derived from the max total cost
+	if k := new(big.Int).Sub(bm.MaxTotalCost.MathBigInt(), big.NewInt(1)); k.Sign() >= 0 && k.IsUint64() {
+		if k.Uint64() <= uint64(bm.MaxCount) {
+			candidates = append(candidates, &BallotModePreset{Name: PresetMultipleChoice, Options: bm.MaxCount, MaxChoices: uint8(k.Uint64())})
+		}
+		candidates = append(candidates, &BallotModePreset{Name: PresetQuadratic, Options: bm.MaxCount, Credits: k.Uint64()})
+	}
+	want, err := bm.Marshal()
+	if err != nil {
+		return &BallotModePreset{Name: PresetCustom}
+	}
+	for _, p := range candidates {
+		pbm, err := p.BallotMode()
+		if err != nil {
+			continue
+		}
+		if got, err := pbm.Marshal(); err == nil && bytes.Equal(got, want) {
+			return p
+		}
+	}
+	return &BallotModePreset{Name: PresetCustom}
+}
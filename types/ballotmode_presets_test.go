@@ -0,0 +1,106 @@
+package types
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func fields(values ...int64) []*big.Int {
+	f := make([]*big.Int, len(values))
+	for i, v := range values {
+		f[i] = big.NewInt(v)
+	}
+	return f
+}
+
+func TestBallotModePresets(t *testing.T) {
+	c := qt.New(t)
+	weight := big.NewInt(101)
+	for _, tc := range []struct {
+		preset  BallotModePreset
+		valid   [][]*big.Int
+		invalid [][]*big.Int
+	}{
+		{
+			preset:  BallotModePreset{Name: PresetSingleChoice, Options: 4},
+			valid:   [][]*big.Int{fields(0, 0, 1, 0), fields(1)},
+			invalid: [][]*big.Int{fields(0, 0, 0, 0), fields(1, 0, 1, 0), fields(0, 2, 0, 0)},
+		},
+		{
+			preset:  BallotModePreset{Name: PresetMultipleChoice, Options: 5, MaxChoices: 2},
+			valid:   [][]*big.Int{fields(0, 1, 0, 1, 0), fields(0, 0, 0, 0, 1)},
+			invalid: [][]*big.Int{fields(), fields(1, 1, 1, 0, 0)},
+		},
+		{
+			preset:  BallotModePreset{Name: PresetApproval, Options: 3},
+			valid:   [][]*big.Int{fields(), fields(1, 1, 1), fields(0, 1)},
+			invalid: [][]*big.Int{fields(1, 2, 1), fields(1, 1, 1, 1)},
+		},
+		{
+			preset:  BallotModePreset{Name: PresetBorda, Options: 4},
+			valid:   [][]*big.Int{fields(3, 1, 0, 2), fields(0, 1, 2, 3)},
+			invalid: [][]*big.Int{fields(3, 3, 0, 2), fields(4, 1, 0, 2), fields(3, 1)},
+		},
+		{
+			preset:  BallotModePreset{Name: PresetQuadratic, Options: 4, Credits: 100},
+			valid:   [][]*big.Int{fields(10), fields(6, 6, 5, 1), fields()},
+			invalid: [][]*big.Int{fields(10, 1), fields(11)},
+		},
+		{
+			preset:  BallotModePreset{Name: PresetWeightedYesNoAbstain},
+			valid:   [][]*big.Int{fields(100, 0, 0), fields(50, 20, 30), fields(0, 0, 1)},
+			invalid: [][]*big.Int{fields(101, 0, 0), fields(0, 0, 0)},
+		},
+	} {
+		bm, err := tc.preset.BallotMode()
+		c.Assert(err, qt.IsNil, qt.Commentf("preset %s", tc.preset.Name))
+		c.Assert(bm.Validate(), qt.IsNil)
+		for _, f := range tc.valid {
+			c.Assert(bm.CheckVote(f, weight), qt.IsNil, qt.Commentf("preset %s fields %v", tc.preset.Name, f))
+		}
+		for _, f := range tc.invalid {
+			c.Assert(bm.CheckVote(f, weight), qt.Not(qt.IsNil), qt.Commentf("preset %s fields %v", tc.preset.Name, f))
+		}
+
+		// The preset is detected from the ballot mode, also once encoded
+		c.Assert(*DetectBallotModePreset(bm), qt.Equals, tc.preset)
+		data, err := json.Marshal(bm)
+		c.Assert(err, qt.IsNil)
+		decoded := &BallotMode{}
+		c.Assert(json.Unmarshal(data, decoded), qt.IsNil)
+		c.Assert(*DetectBallotModePreset(decoded), qt.Equals, tc.preset)
+	}
+
+	// A multiple choice of one option is a single choice
+	bm, err := MultipleChoiceBallotMode(3, 1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(DetectBallotModePreset(bm).Name, qt.Equals, PresetSingleChoice)
+
+	// Other ballot modes are custom
+	bm, err = QuadraticBallotMode(4, 100)
+	c.Assert(err, qt.IsNil)
+	bm.MinTotalCost = *new(BigInt).SetUint64(1)
+	c.Assert(DetectBallotModePreset(bm).Name, qt.Equals, PresetCustom)
+	c.Assert(DetectBallotModePreset(&BallotMode{}).Name, qt.Equals, PresetCustom)
+}
+
+func TestInvalidBallotModePresets(t *testing.T) {
+	c := qt.New(t)
+	for _, p := range []BallotModePreset{
+		{Name: "plurality", Options: 3},
+		{Name: PresetCustom, Options: 3},
+		{Name: PresetSingleChoice},
+		{Name: PresetSingleChoice, Options: MaxBallotFields + 1},
+		{Name: PresetMultipleChoice, Options: 3},
+		{Name: PresetMultipleChoice, Options: 3, MaxChoices: 4},
+		{Name: PresetApproval},
+		{Name: PresetBorda},
+		{Name: PresetQuadratic, Options: 3},
+	} {
+		_, err := p.BallotMode()
+		c.Assert(err, qt.Not(qt.IsNil), qt.Commentf("preset %+v", p))
+	}
+}
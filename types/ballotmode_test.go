@@ -0,0 +1,75 @@
+package types
+
+import (
+	"encoding/json"
+	"math/big"
+	"os"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// ballotModeVectors are the test vectors of the ballot mode rules, shared
+// with the ballot package, which checks the valid votes against the circuit.
+const ballotModeVectors = "testdata/ballotmode_vectors.json"
+
+type testVectors struct {
+	BallotModes []struct {
+		Name       string     `json:"name"`
+		BallotMode BallotMode `json:"ballotMode"`
+		Valid      bool       `json:"valid"`
+	} `json:"ballotModes"`
+	Votes []struct {
+		Name       string     `json:"name"`
+		BallotMode BallotMode `json:"ballotMode"`
+		Fields     []*BigInt  `json:"fields"`
+		Weight     *BigInt    `json:"weight"`
+		Cost       *BigInt    `json:"cost"`
+		Valid      bool       `json:"valid"`
+	} `json:"votes"`
+}
+
+func loadTestVectors(c *qt.C) *testVectors {
+	data, err := os.ReadFile(ballotModeVectors)
+	c.Assert(err, qt.IsNil)
+	vectors := &testVectors{}
+	c.Assert(json.Unmarshal(data, vectors), qt.IsNil)
+	return vectors
+}
+
+func TestBallotModeValidate(t *testing.T) {
+	c := qt.New(t)
+	for _, tc := range loadTestVectors(c).BallotModes {
+		err := tc.BallotMode.Validate()
+		if tc.Valid {
+			c.Assert(err, qt.IsNil, qt.Commentf("ballot mode %s", tc.Name))
+		} else {
+			c.Assert(err, qt.Not(qt.IsNil), qt.Commentf("ballot mode %s", tc.Name))
+		}
+	}
+}
+
+func TestBallotModeCheckVote(t *testing.T) {
+	c := qt.New(t)
+	for _, tc := range loadTestVectors(c).Votes {
+		c.Assert(tc.BallotMode.Validate(), qt.IsNil, qt.Commentf("vote %s", tc.Name))
+		fields := make([]*big.Int, len(tc.Fields))
+		for i, f := range tc.Fields {
+			fields[i] = f.MathBigInt()
+		}
+		c.Assert(tc.BallotMode.Cost(fields).String(), qt.Equals, tc.Cost.String(), qt.Commentf("vote %s", tc.Name))
+		err := tc.BallotMode.CheckVote(fields, tc.Weight.MathBigInt())
+		if tc.Valid {
+			c.Assert(err, qt.IsNil, qt.Commentf("vote %s", tc.Name))
+		} else {
+			c.Assert(err, qt.Not(qt.IsNil), qt.Commentf("vote %s", tc.Name))
+		}
+	}
+
+	// The weight is only required if the cost is bounded by it
+	bm := &BallotMode{MaxCount: 2, MaxValue: *new(BigInt).SetUint64(3), MaxTotalCost: *new(BigInt).SetUint64(10), CostExponent: 2}
+	c.Assert(bm.CheckVote([]*big.Int{big.NewInt(1), big.NewInt(2)}, nil), qt.IsNil)
+	bm.CostFromWeight = true
+	c.Assert(bm.CheckVote([]*big.Int{big.NewInt(1), big.NewInt(2)}, nil), qt.ErrorMatches, "missing voter weight")
+	c.Assert(bm.CheckVote([]*big.Int{big.NewInt(1), nil}, big.NewInt(10)), qt.ErrorMatches, "field 1 is missing")
+}
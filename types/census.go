@@ -0,0 +1,16 @@
+package types
+
+import "fmt"
+
+// CensusLevels is the maximum number of siblings of the census proofs, the
+// levels of the census tree supported by the vote verifier circuit.
+const CensusLevels = 160
+
+// CheckCensusSiblings returns an error if a census proof with the number of
+// siblings provided can not be verified by the circuit.
+func CheckCensusSiblings(n int) error {
+	if n > CensusLevels {
+		return fmt.Errorf("too many census siblings: %d, the maximum is %d", n, CensusLevels)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package types
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCheckCensusSiblings(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(CheckCensusSiblings(0), qt.IsNil)
+	c.Assert(CheckCensusSiblings(CensusLevels), qt.IsNil)
+	c.Assert(CheckCensusSiblings(CensusLevels+1), qt.ErrorMatches, `too many census siblings: 161, .*`)
+}
@@ -1,5 +1,10 @@
 package types
 
+import (
+	"bytes"
+	"fmt"
+)
+
 type GenericMetadata map[string]string
 
 type MultilingualString map[string]string
@@ -35,3 +40,69 @@ type Metadata struct {
 	ProcessType ProcessType        `json:"processType"`
 	BallotMode  BallotMode         `json:"ballotMode"`
 }
+
+// Validate checks that the metadata has questions to vote, each with at
+// least one choice and with unique choice values. If the metadata defines a
+// ballot mode, the questions are checked against it (see CheckBallotMode).
+func (m *Metadata) Validate() error {
+	if len(m.Questions) == 0 {
+		return fmt.Errorf("no questions")
+	}
+	for i, q := range m.Questions {
+		if len(q.Choices) == 0 {
+			return fmt.Errorf("question %d has no choices", i)
+		}
+		values := make(map[int]bool, len(q.Choices))
+		for _, c := range q.Choices {
+			if values[c.Value] {
+				return fmt.Errorf("question %d has duplicated choice value %d", i, c.Value)
+			}
+			values[c.Value] = true
+		}
+	}
+	if m.BallotMode.MaxCount == 0 {
+		return nil
+	}
+	return m.checkFields(&m.BallotMode)
+}
+
+// CheckBallotMode checks that the metadata is valid and can be voted with
+// the ballot mode of a process: there are no more questions, nor choices in
+// any question, than fields in the ballot (MaxCount). If the metadata
+// defines a ballot mode, it must be the same.
+func (m *Metadata) CheckBallotMode(bm *BallotMode) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	if m.BallotMode.MaxCount != 0 {
+		mbm, err := m.BallotMode.Marshal()
+		if err != nil {
+			return err
+		}
+		pbm, err := bm.Marshal()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(mbm, pbm) {
+			return fmt.Errorf("the ballot mode of the metadata does not match the process")
+		}
+	}
+	return m.checkFields(bm)
+}
+
+// checkFields checks the number of questions and choices against the number
+// of fields of the ballot mode.
+func (m *Metadata) checkFields(bm *BallotMode) error {
+	if bm.MaxCount == 0 {
+		return fmt.Errorf("the ballot mode has no fields")
+	}
+	if len(m.Questions) > int(bm.MaxCount) {
+		return fmt.Errorf("%d questions, the ballot mode allows %d", len(m.Questions), bm.MaxCount)
+	}
+	for i, q := range m.Questions {
+		if len(q.Choices) > int(bm.MaxCount) {
+			return fmt.Errorf("question %d has %d choices, the ballot mode allows %d", i, len(q.Choices), bm.MaxCount)
+		}
+	}
+	return nil
+}